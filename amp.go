@@ -0,0 +1,113 @@
+package mailrail
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+)
+
+// Messages with an AMP version or List-Unsubscribe headers cannot be
+// expressed with SES's SendEmail API, so they are built as raw MIME
+// messages and sent with SendRawEmail. The parts of the
+// multipart/alternative body are in order of increasing preference:
+// text, AMP, and HTML last, as the AMP for Email specification
+// requires. Clients that do not support AMP display the HTML part, so
+// an AMP spec must also have HTML.
+
+func (mailing *mailing) composeRaw(svc sesService, i int, mangler Mangler) (func() (string, error), string, error) {
+	params, err := mailing.computeSendRawEmailInput(i, mangler)
+	if err != nil {
+		return nil, "", err
+	}
+	return func() (string, error) {
+		if !mangler.ShouldSend {
+			return "NullMangler", nil
+		}
+		response, err := svc.SendRawEmail(params)
+		if err != nil {
+			return "", err
+		}
+		return *response.MessageId, nil
+	}, rawHash(params.RawMessage.Data), nil
+}
+
+func (mailing *mailing) computeSendRawEmailInput(i int, mangler Mangler) (*ses.SendRawEmailInput, error) {
+	if variant, err := mailing.variant(i); err != nil {
+		return nil, err
+	} else if variant != mailing {
+		return variant.computeSendRawEmailInput(i, mangler)
+	}
+	params, err := mailing.computeSendEmailInput(i, mangler)
+	if err != nil {
+		return nil, err
+	}
+	ampContent := &ses.Content{}
+	if mailing.ampTemplate != nil {
+		amp, err := mailing.render("amp", mailing.ampTemplate, i)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render AMP template for recipient %d: %s\n", i, err)
+		}
+		ampContent.Data = aws.String(mailing.tagHTML(amp))
+	}
+	listUnsubscribe, err := mailing.listUnsubscribeHeaders(i)
+	if err != nil {
+		return nil, err
+	}
+	var msg bytes.Buffer
+	w := multipart.NewWriter(&msg)
+	header := [][2]string{
+		{"From", *params.Source},
+		{"To", *params.Destination.ToAddresses[0]},
+		{"Subject", mime.QEncoding.Encode("UTF-8", *params.Message.Subject.Data)}}
+	header = append(header, listUnsubscribe...)
+	header = append(header,
+		[2]string{"MIME-Version", "1.0"},
+		[2]string{"Content-Type", "multipart/alternative; boundary=" + w.Boundary()})
+	for _, h := range header {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	parts := []struct {
+		contentType string
+		content     *ses.Content
+	}{
+		{"text/plain", params.Message.Body.Text},
+		{"text/x-amp-html", ampContent},
+		{"text/html", params.Message.Body.Html}}
+	for _, part := range parts {
+		if part.content.Data == nil {
+			continue
+		}
+		if err := writeQuotedPrintablePart(w, part.contentType, *part.content.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &ses.SendRawEmailInput{
+		ConfigurationSetName: params.ConfigurationSetName,
+		Destinations:         params.Destination.ToAddresses,
+		RawMessage:           &ses.RawMessage{Data: msg.Bytes()},
+		Source:               params.Source,
+		Tags:                 params.Tags}, nil
+}
+
+func writeQuotedPrintablePart(w *multipart.Writer, contentType, data string) error {
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"}})
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(pw)
+	if _, err := qw.Write([]byte(data)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
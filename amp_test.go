@@ -0,0 +1,91 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAmp(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_amp_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hællo",
+"text": "Hello, {{.pet_name}}",
+"html": "<p>Hello, {{.pet_name}}</p>",
+"amp": "<!doctype html><html amp4email><body>Hello, {{.pet_name}}</body></html>",
+"recipients": [{"addr": "janedoe@example.com", "context": {"pet_name": "Janie"}}]
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions(nil))
+	if svc.nsent != 1 || svc.sent != nil || svc.sentRaw == nil {
+		t.Fatal("expected one raw message to be sent")
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(svc.sentRaw.RawMessage.Data)))
+	if err != nil {
+		t.Fatal("cannot parse raw message", err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Hællo" {
+		t.Fatal("unexpected subject:", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatal("unexpected content type:", mediaType, err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		if !strings.Contains(string(body), "Hello, Janie") {
+			t.Fatal("unexpected part:", string(body))
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		types = append(types, contentType)
+	}
+	if strings.Join(types, ",") != "text/plain,text/x-amp-html,text/html" {
+		t.Fatal("unexpected parts:", types)
+	}
+}
+
+func TestAmpWithoutHtml(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_amp_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"amp": "<!doctype html><html amp4email><body>Hello</body></html>",
+"recipients": [{"addr": "janedoe@example.com"}]
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions(nil))
+	if svc.nsent != 0 {
+		t.Fatal("expected no messages to be sent without an HTML fallback")
+	}
+}
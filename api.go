@@ -0,0 +1,264 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The largest spec the API accepts.
+const maxSpecBytes = 256 << 20
+
+// An APIHandler serves a REST API for a queue:
+//
+//	POST   /jobs        submit the spec in the body; returns {"job": BASENAME}
+//	GET    /jobs        list the jobs and their status
+//	GET    /jobs/JOB    get the status of a job
+//	DELETE /jobs/JOB    cancel a job
+//	POST   /jobs/JOB/pause   pause a job
+//	POST   /jobs/JOB/resume  resume a paused job
+//	GET    /jobs/JOB/events  stream the progress of a job
+//
+// Specs are checked with `CheckSpec` before they are submitted. If the
+// Submitter refuses a spec for lack of room, the response is 429 with
+// a Retry-After header.
+//
+// If Tokens is set, requests must present a token from it as
+// `Authorization: Bearer TOKEN`. Viewers can GET; submitting,
+// cancelling, pausing, and resuming require an operator. Whoever
+// changes a job is recorded in its "audit" artifact.
+//
+// The events of a job are Server-Sent Events: a "progress" event with
+// the status of the job whenever it changes, checked every
+// PollInterval (default one second), and an "end" event with the
+// final status when the job is done, failed, or cancelled.
+type APIHandler struct {
+	Submitter    *Submitter
+	Tokens       *TokenStore
+	PollInterval time.Duration
+}
+
+// Returns an API handler for the queue the submitter submits to.
+func NewAPIHandler(submitter *Submitter) *APIHandler {
+	return &APIHandler{Submitter: submitter}
+}
+
+// The JSON representation of a `JobStatus`.
+type apiJobStatus struct {
+	Job        string     `json:"job"`
+	State      string     `json:"state"`
+	Recipients int        `json:"recipients"`
+	Sent       int        `json:"sent"`
+	Rate       float64    `json:"rate,omitempty"`
+	ETA        *time.Time `json:"eta,omitempty"`
+	Deadline   *time.Time `json:"deadline,omitempty"`
+	AtRisk     bool       `json:"sla_at_risk,omitempty"`
+}
+
+func newAPIJobStatus(s JobStatus) apiJobStatus {
+	status := apiJobStatus{Job: s.Job, State: s.State, Recipients: s.Recipients, Sent: s.Sent, Rate: s.Rate, AtRisk: s.AtRisk()}
+	if !s.ETA.IsZero() {
+		status.ETA = &s.ETA
+	}
+	if !s.Deadline.IsZero() {
+		status.Deadline = &s.Deadline
+	}
+	return status
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	role := RoleOperator
+	if r.Method == "GET" {
+		role = RoleViewer
+	}
+	token, ok := h.authorize(w, r, role)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "jobs" && r.Method == "POST":
+		h.submit(w, r, token)
+	case len(parts) == 1 && parts[0] == "jobs" && r.Method == "GET":
+		h.list(w, r)
+	case len(parts) >= 2 && len(parts) <= 3 && parts[0] == "jobs":
+		basename := parts[1]
+		if _, err := findJob(h.Submitter.QueueDir, basename); err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		action := r.Method
+		if len(parts) == 3 {
+			action = r.Method + " " + parts[2]
+		}
+		switch action {
+		case "GET":
+			h.status(w, basename)
+		case "DELETE":
+			h.control(w, basename, token, "cancel", Cancel)
+		case "POST pause":
+			h.control(w, basename, token, "pause", Pause)
+		case "POST resume":
+			h.control(w, basename, token, "resume", Resume)
+		case "GET events":
+			h.events(w, r, basename)
+		default:
+			apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize checks that a request presents a token with a role. If
+// the handler has no tokens, every request is allowed.
+func (h *APIHandler) authorize(w http.ResponseWriter, r *http.Request, role string) (APIToken, bool) {
+	if h.Tokens == nil {
+		return APIToken{Name: "anonymous", Role: RoleAdmin}, true
+	}
+	token, ok := h.Tokens.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mailrail"`)
+		apiError(w, http.StatusUnauthorized, fmt.Errorf("Missing or invalid API token"))
+		return token, false
+	}
+	if !token.Can(role) {
+		log.Printf("Token %s (%s) denied %s %s", token.Name, token.Role, r.Method, r.URL.Path)
+		apiError(w, http.StatusForbidden, fmt.Errorf("Token %s is a %s; this requires %s", token.Name, token.Role, role))
+		return token, false
+	}
+	return token, true
+}
+
+func (h *APIHandler) audit(basename string, token APIToken, action string) {
+	log.Printf("%s (%s) did %s on job %s", token.Name, token.Role, action, basename)
+	if err := recordAudit(h.Submitter.QueueDir, basename, AuditRecord{time.Now(), token.Name, token.Role, action}); err != nil {
+		log.Printf("Failed to record %s of job %s by %s: %s", action, basename, token.Name, err)
+	}
+}
+
+func (h *APIHandler) submit(w http.ResponseWriter, r *http.Request, token APIToken) {
+	specBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSpecBytes))
+	if err != nil {
+		apiError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	spec, err := parseSpec(specBytes)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("Cannot parse spec: %s", err))
+		return
+	}
+	if err := CheckSpec(spec); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	basename, err := h.Submitter.Submit(specBytes)
+	if err != nil {
+		if retryErr, ok := err.(*RetryAfterError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryErr.RetryAfter.Seconds()))))
+			apiError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		log.Printf("Failed to submit spec: %s", err)
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.audit(basename, token, "submit")
+	writeJSON(w, http.StatusCreated, map[string]string{"job": basename})
+}
+
+func (h *APIHandler) list(w http.ResponseWriter, r *http.Request) {
+	statuses, err := QueueStatus(h.Submitter.QueueDir)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	jobs := make([]apiJobStatus, len(statuses))
+	for i, s := range statuses {
+		jobs[i] = newAPIJobStatus(s)
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (h *APIHandler) status(w http.ResponseWriter, basename string) {
+	s, err := GetJobStatus(h.Submitter.QueueDir, basename)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIJobStatus(s))
+}
+
+func (h *APIHandler) control(w http.ResponseWriter, basename string, token APIToken, action string, f func(queueDir, basename string) error) {
+	if err := f(h.Submitter.QueueDir, basename); err != nil {
+		apiError(w, http.StatusConflict, err)
+		return
+	}
+	h.audit(basename, token, action)
+	writeJSON(w, http.StatusAccepted, map[string]string{"job": basename})
+}
+
+func (h *APIHandler) events(w http.ResponseWriter, r *http.Request, basename string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	interval := h.PollInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	var last apiJobStatus
+	for {
+		s, err := GetJobStatus(h.Submitter.QueueDir, basename)
+		if err != nil {
+			// The worker may be moving the job.
+			log.Printf("Failed to get status of job %s for events: %s", basename, err)
+		} else {
+			status := newAPIJobStatus(s)
+			event := "progress"
+			switch s.State {
+			case "done", "failed", "cancelled":
+				event = "end"
+			}
+			if event == "end" || status.State != last.State || status.Sent != last.Sent {
+				statusBytes, err := json.Marshal(status)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, statusBytes)
+				flusher.Flush()
+				last = status
+			}
+			if event == "end" {
+				return
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": strings.TrimSpace(err.Error())})
+}
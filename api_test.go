@@ -0,0 +1,125 @@
+package mailrail
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_api_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	submitter := NewSubmitter(dir)
+	submitter.MaxBacklog = 2
+	server := httptest.NewServer(NewAPIHandler(submitter))
+	defer server.Close()
+	spec := `{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`
+
+	resp, err := http.Post(server.URL+"/jobs", "application/json", strings.NewReader(spec))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatal("POST /jobs", resp.Status, err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	job := created["job"]
+
+	resp, err = http.Post(server.URL+"/jobs", "application/json", strings.NewReader(spec))
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected 429 with Retry-After, not", resp.Status, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Post(server.URL+"/jobs", "application/json", strings.NewReader(`{"text": "{{.foo"}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400 for a bad template, not", resp.Status, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/jobs/" + job)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("GET /jobs/JOB", resp.Status, err)
+	}
+	var status apiJobStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Job != job || status.State != "queued" || status.Recipients != 2 {
+		t.Fatal("unexpected status:", status)
+	}
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/jobs/"+job, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatal("DELETE /jobs/JOB", resp.Status, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/jobs/nosuchjob")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404 for unknown job, not", resp.Status, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/jobs")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("GET /jobs", resp.Status, err)
+	}
+	var jobs []apiJobStatus
+	json.NewDecoder(resp.Body).Decode(&jobs)
+	resp.Body.Close()
+	if len(jobs) != 1 || jobs[0].Job != job {
+		t.Fatal("unexpected jobs:", jobs)
+	}
+}
+
+func TestAPIHandlerEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_api_events_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	handler := NewAPIHandler(NewSubmitter(dir))
+	handler.PollInterval = 10 * time.Millisecond
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	job, err := handler.Submitter.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+	if err != nil {
+		t.Fatal("failed to submit", err)
+	}
+	resp, err := http.Get(server.URL + "/jobs/" + job + "/events")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("GET /jobs/JOB/events", resp, err)
+	}
+	defer resp.Body.Close()
+	var events []string
+	var last apiJobStatus
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, line[len("event: "):])
+			if len(events) == 1 {
+				go Process(dir, UseMockSesService(&MockSES{}))
+			}
+		} else if strings.HasPrefix(line, "data: ") {
+			json.Unmarshal([]byte(line[len("data: "):]), &last)
+		}
+	}
+	if len(events) < 2 || events[0] != "progress" || events[len(events)-1] != "end" {
+		t.Fatal("unexpected events:", events)
+	}
+	if last.State != "done" || last.Sent != 2 {
+		t.Fatal("unexpected final status:", last)
+	}
+}
@@ -0,0 +1,157 @@
+package mailrail
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// An ArchiveStore keeps the artifacts of archived jobs, such as their
+// specs, results, reports, and feedback, so that they need not stay
+// on the sending host's disk. Keys are of the form JOB/ARTIFACT. Get
+// returns an error satisfying os.IsNotExist for a missing key.
+type ArchiveStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// OpenArchive returns the archive store at a location: an S3 URL of
+// the form s3://BUCKET/PREFIX, or else a directory.
+func OpenArchive(location string) (ArchiveStore, error) {
+	if strings.HasPrefix(location, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid S3 archive location %q", location)
+		}
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		return NewS3Archive(parts[0], prefix), nil
+	}
+	if err := os.MkdirAll(location, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create archive directory %s: %s", location, err)
+	}
+	return FileArchive(location), nil
+}
+
+// A FileArchive is an archive store in a directory, with a
+// subdirectory for each job.
+type FileArchive string
+
+func (dir FileArchive) Put(key string, data []byte) error {
+	filename := path.Join(string(dir), key)
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return writeJobFile(path.Dir(filename), path.Base(filename), data)
+}
+
+func (dir FileArchive) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(string(dir), key))
+}
+
+type s3Service interface {
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// An S3Archive is an archive store in an S3 bucket, with keys under
+// a prefix.
+type S3Archive struct {
+	Bucket string
+	Prefix string
+	svc    s3Service
+}
+
+// Returns an archive store in an S3 bucket.
+func NewS3Archive(bucket, prefix string) *S3Archive {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Archive{Bucket: bucket, Prefix: prefix, svc: s3.New(session.New(), getSesConfig())}
+}
+
+func (a *S3Archive) Put(key string, data []byte) error {
+	_, err := a.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(a.Bucket),
+		Key:    aws.String(a.Prefix + key),
+		Body:   bytes.NewReader(data)})
+	return err
+}
+
+func (a *S3Archive) Get(key string) ([]byte, error) {
+	out, err := a.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.Bucket),
+		Key:    aws.String(a.Prefix + key)})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+// ArchiveJob copies the artifacts of a done or cancelled job to an
+// archive store, and if remove is true, then removes the job from the
+// queue. Jobs should be added to the search index with `UpdateIndex`
+// before they are removed.
+func ArchiveJob(queueDir, basename string, store ArchiveStore, remove bool) error {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	if state := stateOfJobDir(dir); state != "done" && state != "cancelled" {
+		return fmt.Errorf("Job %s is %s, not done or cancelled", basename, state)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		data, err := readJobFile(dir, fi.Name())
+		if err != nil {
+			return err
+		}
+		if err := store.Put(basename+"/"+fi.Name(), data); err != nil {
+			return fmt.Errorf("Failed to archive %s of job %s: %s", fi.Name(), basename, err)
+		}
+	}
+	if remove {
+		return os.RemoveAll(dir)
+	}
+	return nil
+}
+
+// Copy the artifacts of each job that is done or cancelled to an
+// archive store. The job stays in the queue; `mailrail-archive` can
+// remove it later.
+func WithArchive(store ArchiveStore) Option {
+	return func(o *options) {
+		o.archive = store
+	}
+}
+
+// archiveJob archives a job that has ended, if the worker has an
+// archive store.
+func (o *options) archiveJob(basename string) {
+	if o.archive == nil || o.queueDir == "" {
+		return
+	}
+	if err := ArchiveJob(o.queueDir, basename, o.archive, false); err != nil {
+		log.Printf("Job %s failed to archive: %s", basename, err)
+	}
+}
@@ -0,0 +1,101 @@
+package mailrail
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+type MockS3 struct {
+	objects map[string][]byte
+}
+
+func (m *MockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[*input.Bucket+"/"+*input.Key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *MockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := m.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(data))
+	if input.IfMatch != nil && *input.IfMatch != etag {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "precondition failed", nil), http.StatusPreconditionFailed, "")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data)), ETag: aws.String(etag)}, nil
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_archive_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir := path.Join(dir, "queue")
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`)
+	j.Set("spec", spec)
+	j.Submit()
+	store, err := OpenArchive(path.Join(dir, "archive"))
+	if err != nil {
+		t.Fatal("OpenArchive", err)
+	}
+	Process(queueDir, UseMockSesService(&MockSES{}), WithArchive(store))
+	if data, err := store.Get(j.Basename + "/spec"); err != nil || !bytes.Equal(data, spec) {
+		t.Fatal("expected the spec to be archived:", string(data), err)
+	}
+	if _, err := store.Get(j.Basename + "/results.0"); err != nil {
+		t.Fatal("expected the results to be archived:", err)
+	}
+	if _, err := store.Get(j.Basename + "/nosuchartifact"); !os.IsNotExist(err) {
+		t.Fatal("expected a missing artifact not to exist:", err)
+	}
+
+	svc := &MockS3{objects: make(map[string][]byte)}
+	s3Archive := &S3Archive{Bucket: "bucket", Prefix: "mailrail/", svc: svc}
+	if err := ArchiveJob(queueDir, j.Basename, s3Archive, true); err != nil {
+		t.Fatal("ArchiveJob", err)
+	}
+	if !bytes.Equal(svc.objects["bucket/mailrail/"+j.Basename+"/spec"], spec) {
+		t.Fatal("expected the spec in S3:", svc.objects)
+	}
+	if data, err := s3Archive.Get(j.Basename + "/spec"); err != nil || !bytes.Equal(data, spec) {
+		t.Fatal("S3Archive.Get", string(data), err)
+	}
+	if _, err := s3Archive.Get(j.Basename + "/nosuchartifact"); !os.IsNotExist(err) {
+		t.Fatal("expected a missing object not to exist:", err)
+	}
+	if _, err := findJob(queueDir, j.Basename); err == nil {
+		t.Fatal("expected the job to be removed from the queue")
+	}
+
+	queued, _ := q.CreateJob("foo")
+	queued.Set("spec", spec)
+	queued.Submit()
+	if err := ArchiveJob(queueDir, queued.Basename, store, true); err == nil {
+		t.Fatal("expected a queued job not to be archived")
+	}
+}
@@ -0,0 +1,225 @@
+package mailrail
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles of API tokens, from least to most privileged. Each role can
+// do everything the roles before it can. Viewers can see jobs;
+// operators can also submit, cancel, pause, and resume them; and
+// admins can do everything. A token with any other role, such as one
+// created for a role that has since been dropped, can do nothing.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// An APIToken grants a role to whoever presents it. Only the SHA-256
+// of the token is stored.
+type APIToken struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Can tells whether the token's role includes a role.
+func (t APIToken) Can(role string) bool {
+	return roleRanks[t.Role] >= roleRanks[role]
+}
+
+// A TokenStore is a JSON file of API tokens.
+type TokenStore struct {
+	filename string
+	mu       sync.Mutex
+}
+
+// Opens a token store. The file is created when the first token is.
+func OpenTokenStore(filename string) *TokenStore {
+	return &TokenStore{filename: filename}
+}
+
+func (ts *TokenStore) read() ([]APIToken, error) {
+	tokensBytes, err := ioutil.ReadFile(ts.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(tokensBytes, &tokens); err != nil {
+		return nil, fmt.Errorf("Cannot parse token store %s: %s", ts.filename, err)
+	}
+	return tokens, nil
+}
+
+func (ts *TokenStore) write(tokens []APIToken) error {
+	tokensBytes, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ts.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, tokensBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.filename)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken creates a token with a unique name and a role, and
+// returns the token. It cannot be retrieved later.
+func (ts *TokenStore) CreateToken(name, role string) (string, error) {
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("Unknown role %q", role)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tokens, err := ts.read()
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("Token %s already exists", name)
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := "mrt_" + base64.RawURLEncoding.EncodeToString(secret)
+	tokens = append(tokens, APIToken{name, role, hashToken(token), time.Now()})
+	return token, ts.write(tokens)
+}
+
+// RevokeToken deletes the token with a name.
+func (ts *TokenStore) RevokeToken(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tokens, err := ts.read()
+	if err != nil {
+		return err
+	}
+	for i, t := range tokens {
+		if t.Name == name {
+			return ts.write(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+	return fmt.Errorf("No token %s", name)
+}
+
+// Tokens returns the tokens in the store, sorted by name.
+func (ts *TokenStore) Tokens() ([]APIToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tokens, err := ts.read()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens, err
+}
+
+// Authenticate returns the token that matches a presented token.
+func (ts *TokenStore) Authenticate(token string) (APIToken, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tokens, err := ts.read()
+	if err != nil {
+		return APIToken{}, false
+	}
+	hash := hashToken(token)
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// authenticate returns the token of a request, which presents it as
+// `Authorization: Bearer TOKEN`.
+func (ts *TokenStore) authenticate(r *http.Request) (APIToken, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return APIToken{}, false
+	}
+	return ts.Authenticate(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// An AuditRecord says who did what to a job through the API.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Role   string    `json:"role"`
+	Action string    `json:"action"`
+}
+
+const auditKey = "audit"
+
+// recordAudit appends a record to the "audit" artifact of a job.
+func recordAudit(queueDir, basename string, record AuditRecord) error {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	records, err := getAudit(dir)
+	if err != nil {
+		return err
+	}
+	auditBytes, err := json.Marshal(append(records, record))
+	if err != nil {
+		return err
+	}
+	if err := writeJobFile(dir, auditKey, auditBytes); err != nil {
+		// The worker may have moved the job while we wrote.
+		if dir, err = findJob(queueDir, basename); err != nil {
+			return err
+		}
+		return writeJobFile(dir, auditKey, auditBytes)
+	}
+	return nil
+}
+
+// GetAudit returns who submitted, cancelled, paused, or resumed a job
+// through the API, oldest first.
+func GetAudit(queueDir, basename string) ([]AuditRecord, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	return getAudit(dir)
+}
+
+func getAudit(jobDir string) ([]AuditRecord, error) {
+	var records []AuditRecord
+	auditBytes, err := readJobFile(jobDir, auditKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(auditBytes, &records); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of audit: %s", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,116 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_tokens_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	ts := OpenTokenStore(path.Join(dir, "tokens"))
+	if _, err := ts.CreateToken("alice", "superuser"); err == nil {
+		t.Fatal("expected an error for an unknown role")
+	}
+	if _, err := ts.CreateToken("alice", "approver"); err == nil {
+		t.Fatal("expected an error for the dropped approver role")
+	}
+	token, err := ts.CreateToken("alice", RoleOperator)
+	if err != nil {
+		t.Fatal("failed to create token", err)
+	}
+	if _, err := ts.CreateToken("alice", RoleViewer); err == nil {
+		t.Fatal("expected an error for a duplicate name")
+	}
+	tokenBytes, _ := ioutil.ReadFile(path.Join(dir, "tokens"))
+	if strings.Contains(string(tokenBytes), token) {
+		t.Fatal("token stored in the clear")
+	}
+	apiToken, ok := ts.Authenticate(token)
+	if !ok || apiToken.Name != "alice" {
+		t.Fatal("failed to authenticate", apiToken, ok)
+	}
+	if !apiToken.Can(RoleOperator) || apiToken.Can(RoleAdmin) {
+		t.Fatal("operator has the wrong privileges")
+	}
+	if (APIToken{Role: "approver"}).Can(RoleViewer) {
+		t.Fatal("expected a token with an unknown role to be able to do nothing")
+	}
+	if _, ok := ts.Authenticate(token + "x"); ok {
+		t.Fatal("authenticated a wrong token")
+	}
+	if err := ts.RevokeToken("alice"); err != nil {
+		t.Fatal("failed to revoke token", err)
+	}
+	if _, ok := ts.Authenticate(token); ok {
+		t.Fatal("authenticated a revoked token")
+	}
+}
+
+func TestAPIHandlerAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_api_auth_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	handler := NewAPIHandler(NewSubmitter(path.Join(dir, "queue")))
+	handler.Tokens = OpenTokenStore(path.Join(dir, "tokens"))
+	viewer, _ := handler.Tokens.CreateToken("viewer", RoleViewer)
+	operator, _ := handler.Tokens.CreateToken("operator", RoleOperator)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	do := func(method, url, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(method, url, err)
+		}
+		return resp
+	}
+	spec := `{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`
+
+	if resp := do("GET", "/jobs", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("expected 401 without a token, not", resp.Status)
+	}
+	if resp := do("POST", "/jobs", viewer, spec); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected 403 for a viewer, not", resp.Status)
+	}
+	resp := do("POST", "/jobs", operator, spec)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("POST /jobs as operator", resp.Status)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	job := created["job"]
+	if resp := do("GET", "/jobs/"+job, viewer, ""); resp.StatusCode != http.StatusOK {
+		t.Fatal("GET /jobs/JOB as viewer", resp.Status)
+	}
+	if resp := do("POST", "/jobs/"+job+"/pause", viewer, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected 403 for a viewer pausing, not", resp.Status)
+	}
+	if resp := do("POST", "/jobs/"+job+"/pause", operator, ""); resp.StatusCode != http.StatusAccepted {
+		t.Fatal("POST /jobs/JOB/pause as operator", resp.Status)
+	}
+
+	audit, err := GetAudit(handler.Submitter.QueueDir, job)
+	if err != nil {
+		t.Fatal("failed to get audit", err)
+	}
+	if len(audit) != 2 || audit[0].Action != "submit" || audit[1].Action != "pause" || audit[1].Actor != "operator" {
+		t.Fatal("unexpected audit:", audit)
+	}
+}
@@ -0,0 +1,78 @@
+package mailrail
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var backfillTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// ImportSendLog backfills the send history and the suppression list
+// from a CSV log of messages sent before mailrail was adopted. The
+// first row is a header naming the columns `address`, `campaign`,
+// and `timestamp`, and optionally `stream` and `reason`. Rows with a
+// reason (e.g., "bounce" or "unsubscribe") also suppress the
+// address. Either store may be nil. Returns the number of rows
+// imported.
+func ImportSendLog(r io.Reader, history *SendHistory, suppressions *SuppressionList) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("Cannot read header: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"address", "campaign", "timestamp"} {
+		if _, ok := columns[name]; !ok {
+			return 0, fmt.Errorf("No %s column", name)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	n := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		t, err := parseBackfillTime(field(row, "timestamp"))
+		if err != nil {
+			return n, fmt.Errorf("Row %d: %s", n+2, err)
+		}
+		addr := field(row, "address")
+		if history != nil {
+			record := SendRecord{addr, field(row, "campaign"), field(row, "stream"), t}
+			if err := history.Record(record); err != nil {
+				return n, err
+			}
+		}
+		if reason := field(row, "reason"); reason != "" && suppressions != nil {
+			if err := suppressions.Add(addr, reason, t); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+}
+
+func parseBackfillTime(s string) (time.Time, error) {
+	for _, layout := range backfillTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Cannot parse timestamp %q", s)
+}
@@ -0,0 +1,60 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportSendLog(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_backfill_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	history, err := OpenSendHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	suppressions, err := OpenSuppressionList(path.Join(dir, "suppressions"))
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	n, err := ImportSendLog(strings.NewReader(`address,campaign,timestamp,reason
+janedoe@example.com,spring,2026-03-01T09:00:00Z,
+JaneDoe@example.com,summer,2026-06-01 09:00:00,
+jimdoe@example.com,summer,2026-06-01,bounce
+`), history, suppressions)
+	if err != nil {
+		t.Fatal("ImportSendLog", err)
+	}
+	if n != 3 {
+		t.Fatal("expected 3 rows, not", n)
+	}
+	if c := history.Count("janedoe@example.com", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); c != 2 {
+		t.Fatal("expected 2 sends since January, not", c)
+	}
+	if c := history.Count("janedoe@example.com", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)); c != 1 {
+		t.Fatal("expected 1 send since April, not", c)
+	}
+	if s, ok := suppressions.Lookup("JimDoe@example.com"); !ok || s.Reason != "bounce" {
+		t.Fatal("expected jimdoe to be suppressed:", s)
+	}
+	if _, ok := suppressions.Lookup("janedoe@example.com"); ok {
+		t.Fatal("did not expect janedoe to be suppressed")
+	}
+	// The stores are persistent.
+	history, err = OpenSendHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	if c := history.Count("jimdoe@example.com", time.Time{}); c != 1 {
+		t.Fatal("expected 1 send after reopening, not", c)
+	}
+	if _, err := ImportSendLog(strings.NewReader("address,timestamp\n"), history, nil); err == nil {
+		t.Fatal("expected error for missing campaign column")
+	}
+}
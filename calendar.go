@@ -0,0 +1,140 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"os"
+	"path"
+	"time"
+)
+
+// A CalendarEntry is the projected sending period of a job that is in
+// progress, queued, or scheduled.
+type CalendarEntry struct {
+	Job        string
+	State      string
+	Recipients int
+	Start      time.Time
+	End        time.Time
+}
+
+// A job waiting to be projected.
+type calendarJob struct {
+	basename   string
+	state      string
+	priority   int
+	wakeAt     time.Time
+	recipients int
+}
+
+// Calendar projects when the jobs in a queue will send, assuming
+// that they are processed one at a time at rate messages per second.
+// Jobs that are in progress come first, with only their remaining
+// recipients. Then the queued jobs are taken as the worker takes
+// them, those with the highest priority first; jobs that do not start
+// yet, because of their `not_before` or because their deferred
+// recipients are not due, join them when they are due.
+func Calendar(queueDir string, rate float64, now time.Time) ([]CalendarEntry, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("Cannot project sending at %g messages per second", rate)
+	}
+	var current, waiting []calendarJob
+	for _, state := range []string{"cur", "queue", "failed"} {
+		basenames, err := listJobs(queueDir, state)
+		if err != nil {
+			return nil, err
+		}
+		for _, basename := range basenames {
+			dir := path.Join(queueDir, state, basename)
+			var wakeAt time.Time
+			if state == "failed" {
+				// Only scheduled jobs leave the failed state.
+				wakeAtBytes, err := readJobFile(dir, wakeAtKey)
+				if err != nil {
+					continue
+				}
+				if wakeAt, err = time.Parse(time.RFC3339Nano, string(wakeAtBytes)); err != nil {
+					return nil, fmt.Errorf("Cannot parse contents of %s of job %s: %s", wakeAtKey, basename, err)
+				}
+			}
+			spec, err := readJobSpec(dir)
+			if err != nil {
+				if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+					// The job moved on while we were looking.
+					continue
+				}
+				return nil, err
+			}
+			get := func(key string) ([]byte, error) { return readJobFile(dir, key) }
+			sent, err := getCheckpointFrom(get)
+			if err != nil {
+				return nil, err
+			}
+			deferred, err := getDeferredFrom(get)
+			if err != nil {
+				return nil, err
+			}
+			job := calendarJob{basename, state, spec.Priority, wakeAt, len(spec.Recipients) - sent + len(deferred)}
+			if state == "queue" && spec.NotBefore != nil && sent == 0 {
+				job.wakeAt = *spec.NotBefore
+			}
+			if state == "cur" {
+				current = append(current, job)
+			} else {
+				waiting = append(waiting, job)
+			}
+		}
+	}
+
+	var entries []CalendarEntry
+	t := now
+	project := func(job calendarJob) {
+		state := job.state
+		if job.wakeAt.After(now) {
+			state = "scheduled"
+		} else if state == "failed" {
+			// It is woken as soon as the worker looks.
+			state = "queue"
+		}
+		if job.wakeAt.After(t) {
+			t = job.wakeAt
+		}
+		end := t.Add(time.Duration(float64(job.recipients) / rate * float64(time.Second)))
+		entries = append(entries, CalendarEntry{job.basename, state, job.recipients, t, end})
+		t = end
+	}
+	for _, job := range current {
+		project(job)
+	}
+	for len(waiting) > 0 {
+		// If nothing is due, wait for the next job that is.
+		next := -1
+		for i, job := range waiting {
+			if next < 0 || job.wakeAt.Before(waiting[next].wakeAt) {
+				next = i
+			}
+		}
+		due := t
+		if waiting[next].wakeAt.After(due) {
+			due = waiting[next].wakeAt
+		}
+		// Of the jobs that are due, the worker takes the oldest
+		// with the highest priority, as in `takeJob`.
+		for i, job := range waiting {
+			if !job.wakeAt.After(due) && (job.priority > waiting[next].priority ||
+				job.priority == waiting[next].priority && job.basename < waiting[next].basename) {
+				next = i
+			}
+		}
+		project(waiting[next])
+		waiting = append(waiting[:next], waiting[next+1:]...)
+	}
+	return entries, nil
+}
+
+// MaxSendRate returns the maximum number of messages per second that
+// SES allows the account to send.
+func MaxSendRate() (float64, error) {
+	return getMaxSendRate(ses.New(session.New(), getSesConfig()))
+}
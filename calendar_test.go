@@ -0,0 +1,133 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_calendar_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	for _, n := range []int{2, 1} {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		spec := `{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", "recipients": [{"addr": "a@example.com"}`
+		if n == 2 {
+			spec += `, {"addr": "b@example.com"}`
+		}
+		j.Set("spec", []byte(spec+`]}`))
+		j.Submit()
+	}
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	entries, err := Calendar(dir, 0.5, now)
+	if err != nil {
+		t.Fatal("Calendar", err)
+	}
+	if len(entries) != 2 {
+		t.Fatal("expected 2 entries, not", len(entries))
+	}
+	if entries[0].Recipients != 2 || !entries[0].Start.Equal(now) || !entries[0].End.Equal(now.Add(4*time.Second)) {
+		t.Fatal("unexpected first entry:", entries[0])
+	}
+	if !entries[1].Start.Equal(entries[0].End) || !entries[1].End.Equal(now.Add(6*time.Second)) {
+		t.Fatal("unexpected second entry:", entries[1])
+	}
+	if _, err := Calendar(dir, 0, now); err == nil {
+		t.Fatal("expected an error for a rate of 0")
+	}
+}
+
+func TestCalendarPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_calendar_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue:", err)
+	}
+	for _, priority := range []string{"0", "5"} {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", "priority": `+
+			priority+`, "recipients": [{"addr": "a@example.com"}]}`))
+		j.Submit()
+		time.Sleep(time.Millisecond)
+	}
+	basenames, _ := listJobs(dir, "queue")
+	entries, err := Calendar(dir, 1, time.Now())
+	if err != nil {
+		t.Fatal("Calendar", err)
+	}
+	if len(entries) != 2 || entries[0].Job != basenames[1] || entries[1].Job != basenames[0] {
+		t.Fatal("expected the job with the higher priority to be projected first:", entries)
+	}
+}
+
+func TestCalendarSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_calendar_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue:", err)
+	}
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	submit := func(extra string) {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", `+
+			extra+`"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+		j.Submit()
+		time.Sleep(time.Millisecond)
+	}
+	submit(``)
+	submit(`"not_before": "2026-03-01T10:00:00Z", `)
+	submit(`"priority": 5, `)
+	submit(``)
+	basenames, _ := listJobs(dir, "queue")
+	// The last job has deferred recipients that are due in an hour.
+	deferred := path.Join(dir, "failed", basenames[3])
+	if err := os.Rename(path.Join(dir, "queue", basenames[3]), deferred); err != nil {
+		t.Fatal(err)
+	}
+	writeJobFile(deferred, name, []byte(`{"recipients_sent": 2}`))
+	writeJobFile(deferred, deferredKey, []byte("[1]"))
+	writeJobFile(deferred, wakeAtKey, []byte(now.Add(time.Hour).Format(time.RFC3339Nano)))
+
+	entries, err := Calendar(dir, 1, now)
+	if err != nil {
+		t.Fatal("Calendar", err)
+	}
+	var order []string
+	for _, e := range entries {
+		order = append(order, e.Job)
+	}
+	if len(entries) != 4 || entries[0].Job != basenames[2] || entries[1].Job != basenames[0] {
+		t.Fatal("expected the job with the higher priority to be projected first:", order)
+	}
+	if entries[2].Job != basenames[1] || entries[2].State != "scheduled" || !entries[2].Start.Equal(now.Add(time.Hour)) {
+		t.Fatal("expected the job with not_before to start then:", entries[2])
+	}
+	if entries[3].Job != basenames[3] || entries[3].State != "scheduled" || entries[3].Recipients != 1 ||
+		!entries[3].Start.Equal(now.Add(time.Hour+2*time.Second)) {
+		t.Fatal("expected the deferred recipient to be projected after the job ahead of it:", entries[3])
+	}
+}
@@ -0,0 +1,110 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// A Cancellation records how far a job got before it was cancelled.
+type Cancellation struct {
+	RecipientsSent int       `json:"recipients_sent"`
+	Time           time.Time `json:"time"`
+}
+
+const (
+	cancelKey    = "cancel"
+	cancelledKey = "cancelled"
+)
+
+// Cancel asks the worker to stop a queued or in-progress job. The
+// worker checks for the request between recipients, records a
+// `Cancellation` in the job, and moves it to the failed state, where
+// `mailrail-status` shows it as cancelled. A scheduled job, which
+// waits in the failed state, is cancelled right away, so that the
+// worker never wakes it. So are the shards of a sharded job.
+func Cancel(queueDir, basename string) error {
+	if err := cancel(queueDir, basename); err != nil {
+		return err
+	}
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	return controlShardsOf(queueDir, dir, hasEnded, Cancel)
+}
+
+func cancel(queueDir, basename string) error {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	if pathHasState(dir, "failed") && unschedule(dir) {
+		sent, err := getCheckpointFrom(func(key string) ([]byte, error) { return readJobFile(dir, key) })
+		if err != nil {
+			return err
+		}
+		cancellationBytes, err := json.Marshal(Cancellation{sent, time.Now()})
+		if err != nil {
+			return err
+		}
+		return writeJobFile(dir, cancelledKey, cancellationBytes)
+	}
+	// The job may have been woken while we looked.
+	if dir, err = findJob(queueDir, basename); err != nil {
+		return err
+	}
+	if pathHasState(dir, "done") || pathHasState(dir, "failed") {
+		return fmt.Errorf("Job %s has already ended", basename)
+	}
+	return requestControl(queueDir, basename, cancelKey)
+}
+
+// unschedule takes a scheduled job in the failed state away from the
+// worker that would wake it, by removing its wake time, and tells
+// whether it did; it did not if the job is not scheduled, or was woken
+// first.
+func unschedule(jobDir string) bool {
+	return os.Remove(path.Join(jobDir, wakeAtKey)) == nil
+}
+
+// requestControl leaves a marker in a job asking the worker to do
+// something with it between recipients.
+func requestControl(queueDir, basename, key string) error {
+	requestBytes, err := json.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	if err := writeJobFile(dir, key, requestBytes); err != nil {
+		// The worker may have moved the job while we wrote.
+		if dir, err = findJob(queueDir, basename); err != nil {
+			return err
+		}
+		return writeJobFile(dir, key, requestBytes)
+	}
+	return nil
+}
+
+func cancelRequested(job Job) bool {
+	_, err := job.Get(cancelKey)
+	return err == nil
+}
+
+func recordCancellation(job Job, recipientsSent int) error {
+	cancellationBytes, err := json.Marshal(Cancellation{recipientsSent, time.Now()})
+	if err != nil {
+		return err
+	}
+	return job.Set(cancelledKey, cancellationBytes)
+}
+
+func isCancelled(jobDir string) bool {
+	_, err := os.Stat(path.Join(jobDir, cancelledKey))
+	return err == nil
+}
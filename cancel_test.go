@@ -0,0 +1,122 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type cancellingObserver struct {
+	queueDir string
+	after    int
+}
+
+func (c cancellingObserver) Observe(e Event) {
+	if e.Type == MessageSent && e.Recipient == c.after-1 {
+		Cancel(c.queueDir, e.Job)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_cancel_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithObserver(cancellingObserver{dir, 2}))
+	if svc.nsent != 2 {
+		t.Fatal("expected 2 messages before cancellation, not", svc.nsent)
+	}
+	jobDir := path.Join(dir, "failed", j.Basename)
+	cancellationBytes, err := readJobFile(jobDir, cancelledKey)
+	if err != nil {
+		t.Fatal("cancellation was not recorded:", err)
+	}
+	var cancellation Cancellation
+	json.Unmarshal(cancellationBytes, &cancellation)
+	if cancellation.RecipientsSent != 2 {
+		t.Fatal("unexpected cancellation:", cancellation)
+	}
+	status, err := GetJobStatus(dir, j.Basename)
+	if err != nil || status.State != "cancelled" {
+		t.Fatal("unexpected status:", status, err)
+	}
+	if err := Cancel(dir, j.Basename); err == nil {
+		t.Fatal("expected error when cancelling a job that has ended")
+	}
+}
+
+func TestCancelAndPauseScheduled(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_cancel_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	var basenames []string
+	for i := 0; i < 2; i++ {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"not_before": "2999-01-01T00:00:00Z", "recipients": [{"addr": "a@example.com"}]}`))
+		j.Submit()
+		basenames = append(basenames, j.Basename)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	for _, basename := range basenames {
+		if !isScheduled(path.Join(dir, "failed", basename)) {
+			t.Fatal("expected the job to be scheduled:", basename)
+		}
+	}
+	if err := Retry(dir, basenames[0], false); err == nil {
+		t.Fatal("expected a scheduled job not to be retried")
+	}
+
+	if err := Cancel(dir, basenames[0]); err != nil {
+		t.Fatal("expected a scheduled job to be cancelled:", err)
+	}
+	cancelled := path.Join(dir, "failed", basenames[0])
+	if !isCancelled(cancelled) || isScheduled(cancelled) {
+		t.Fatal("expected the job to be cancelled and no longer scheduled")
+	}
+	if err := Pause(dir, basenames[1]); err != nil {
+		t.Fatal("expected a scheduled job to be paused:", err)
+	}
+	paused := path.Join(dir, "failed", basenames[1])
+	if !isPaused(paused) || isScheduled(paused) {
+		t.Fatal("expected the job to be paused and no longer scheduled")
+	}
+	if err := wakeScheduledJobs(dir, time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal("wakeScheduledJobs", err)
+	}
+	if queued, _ := listJobs(dir, "queue"); len(queued) != 0 {
+		t.Fatal("expected the cancelled and paused jobs not to be woken:", queued)
+	}
+	if err := Resume(dir, basenames[1]); err != nil {
+		t.Fatal("Resume", err)
+	}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 0 || !isScheduled(paused) {
+		t.Fatal("expected the resumed job to be scheduled again:", svc.nsent)
+	}
+}
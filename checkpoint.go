@@ -3,8 +3,9 @@ package mailrail
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/ljosa/go-pqueue/pqueue"
+	"log"
 	"os"
+	"time"
 )
 
 type checkpoint struct {
@@ -13,19 +14,23 @@ type checkpoint struct {
 
 const name string = "recipients_sent"
 
-func setCheckpoint(job *pqueue.Job, i int) error {
+func setCheckpoint(job Job, i int) error {
 	checkpointBytes, err := json.Marshal(checkpoint{i})
 	if err != nil {
-		return fmt.Errorf("Job %s failed to marshal checkpoint after %d recipients: %s", job.Basename, i, err)
+		return fmt.Errorf("Job %s failed to marshal checkpoint after %d recipients: %s", job.Name(), i, err)
 	}
 	if err := job.Set(name, checkpointBytes); err != nil {
-		return fmt.Errorf("Job %s failed to checkpoint after %d recipients: %s", job.Basename, i, err)
+		return fmt.Errorf("Job %s failed to checkpoint after %d recipients: %s", job.Name(), i, err)
 	}
 	return nil
 }
 
-func getCheckpoint(job *pqueue.Job) (int, error) {
-	checkpointBytes, err := job.Get(name)
+func getCheckpoint(job Job) (int, error) {
+	return getCheckpointFrom(job.Get)
+}
+
+func getCheckpointFrom(get func(string) ([]byte, error)) (int, error) {
+	checkpointBytes, err := get(name)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return 0, nil
@@ -38,3 +43,76 @@ func getCheckpoint(job *pqueue.Job) (int, error) {
 	}
 	return checkpoint.RecipientsSent, nil
 }
+
+// How long a job goes on sending while its checkpoint cannot be
+// written before it fails, and the longest wait between attempts.
+const (
+	checkpointBudget     = 10 * time.Minute
+	checkpointMaxBackoff = 30 * time.Second
+)
+
+// A checkpointer writes the checkpoint of a job as it sends. If a
+// write fails, for instance because the disk is full, the checkpoint
+// is kept in memory and written again when the job next checkpoints,
+// with exponential backoff, and observers are notified with
+// CheckpointFailing. The job only fails if the checkpoint cannot be
+// written for the budget. Until the checkpoint is written, a worker
+// that dies will resend to the recipients after the last one written.
+type checkpointer struct {
+	job     Job
+	o       *options
+	budget  time.Duration
+	pending int
+	failing time.Time
+	backoff time.Duration
+	next    time.Time
+	gaveUp  bool
+}
+
+func newCheckpointer(job Job, o *options) *checkpointer {
+	return &checkpointer{job: job, o: o, budget: checkpointBudget}
+}
+
+// set checkpoints the job after i recipients, returning an error
+// only once the budget is exhausted.
+func (c *checkpointer) set(i int) error {
+	c.pending = i
+	now := time.Now()
+	if !c.failing.IsZero() && now.Before(c.next) {
+		return nil
+	}
+	err := setCheckpoint(c.job, i)
+	if err == nil {
+		if !c.failing.IsZero() {
+			log.Printf("Job %s wrote its checkpoint again after %s", c.job.Name(), now.Sub(c.failing))
+			c.failing = time.Time{}
+		}
+		return nil
+	}
+	if c.failing.IsZero() {
+		c.failing = now
+		c.backoff = time.Second
+		c.o.notify(Event{Type: CheckpointFailing, Job: c.job.Name(), Recipient: i})
+	} else if c.backoff *= 2; c.backoff > checkpointMaxBackoff {
+		c.backoff = checkpointMaxBackoff
+	}
+	c.next = now.Add(c.backoff)
+	if now.Sub(c.failing) >= c.budget {
+		c.gaveUp = true
+		return fmt.Errorf("%s; giving up after %s", err, now.Sub(c.failing))
+	}
+	log.Printf("%s; retrying in %s", err, c.backoff)
+	return nil
+}
+
+// flush writes a checkpoint that could not be written, waiting for
+// the next attempt if need be, before the job stops sending.
+func (c *checkpointer) flush() error {
+	for !c.failing.IsZero() && !c.gaveUp {
+		time.Sleep(c.next.Sub(time.Now()))
+		if err := c.set(c.pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
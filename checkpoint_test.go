@@ -4,7 +4,9 @@ import (
 	"github.com/ljosa/go-pqueue/pqueue"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestCheckpoint(t *testing.T) {
@@ -18,18 +20,18 @@ func TestCheckpoint(t *testing.T) {
 	if err != nil {
 		t.Fatal("failed to create job:", err)
 	}
-	i, err := getCheckpoint(j)
+	i, err := getCheckpoint(dirJob{Job: j})
 	if err != nil {
 		t.Fatal("got unexpected error when trying to get missing checkpoint")
 	}
 	if i != 0 {
 		t.Fatal("got %d instead of 0 when getting missing checkpoint", i)
 	}
-	err = setCheckpoint(j, 42)
+	err = setCheckpoint(dirJob{Job: j}, 42)
 	if err != nil {
 		t.Fatal("failed to set checkpoint:", err)
 	}
-	i, err = getCheckpoint(j)
+	i, err = getCheckpoint(dirJob{Job: j})
 	if err != nil {
 		t.Fatal("failed to get checkpoint:", err)
 	}
@@ -37,3 +39,51 @@ func TestCheckpoint(t *testing.T) {
 		t.Fatal("getting checkpoint returned unexpected", i)
 	}
 }
+
+func TestCheckpointerRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_checkpoint_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	// The checkpoint cannot be written over a directory.
+	blocker := path.Join(dir, "tmp", j.Basename, name)
+	if err := os.MkdirAll(path.Join(blocker, "x"), 0755); err != nil {
+		t.Fatal("failed to block checkpoint", err)
+	}
+	observer := &recordingObserver{}
+	c := newCheckpointer(dirJob{Job: j}, newOptions([]Option{WithObserver(observer)}))
+	if err := c.set(1); err != nil {
+		t.Fatal("expected a failed checkpoint to be retried, not", err)
+	}
+	if err := c.set(2); err != nil {
+		t.Fatal("expected a failed checkpoint to be retried, not", err)
+	}
+	if len(observer.events) != 1 || observer.events[0].Type != CheckpointFailing || observer.events[0].Recipient != 1 {
+		t.Fatal("expected one CheckpointFailing event:", observer.events)
+	}
+	os.RemoveAll(blocker)
+	c.next = time.Now()
+	if err := c.flush(); err != nil {
+		t.Fatal("flush", err)
+	}
+	if i, err := getCheckpoint(dirJob{Job: j}); err != nil || i != 2 {
+		t.Fatal("expected the pending checkpoint to be written:", i, err)
+	}
+
+	os.Remove(blocker)
+	os.MkdirAll(path.Join(blocker, "x"), 0755)
+	c = newCheckpointer(dirJob{Job: j}, newOptions(nil))
+	c.budget = 0
+	if err := c.set(3); err == nil {
+		t.Fatal("expected an error once the budget is exhausted")
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal("expected flush to give up quietly after the budget is exhausted:", err)
+	}
+}
@@ -0,0 +1,97 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"log"
+	"sync"
+	"time"
+)
+
+type cloudWatchService interface {
+	PutMetricData(*cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+type jobCounts struct {
+	sent      int
+	throttled int
+	failures  int
+}
+
+// CloudWatchObserver publishes per-job metrics to CloudWatch when
+// each job finishes or fails: MessagesSent, ThrottleEvents,
+// Failures, and Duration.
+type CloudWatchObserver struct {
+	namespace string
+	svc       cloudWatchService
+	mu        sync.Mutex
+	jobs      map[string]*jobCounts
+}
+
+// Returns an observer that publishes metrics under the given
+// CloudWatch namespace.
+func NewCloudWatchObserver(namespace string) *CloudWatchObserver {
+	return newCloudWatchObserver(namespace, cloudwatch.New(session.New(), getSesConfig()))
+}
+
+func newCloudWatchObserver(namespace string, svc cloudWatchService) *CloudWatchObserver {
+	return &CloudWatchObserver{
+		namespace: namespace,
+		svc:       svc,
+		jobs:      make(map[string]*jobCounts)}
+}
+
+func (cw *CloudWatchObserver) Observe(e Event) {
+	cw.mu.Lock()
+	counts, ok := cw.jobs[e.Job]
+	if !ok {
+		counts = &jobCounts{}
+		cw.jobs[e.Job] = counts
+	}
+	switch e.Type {
+	case MessageSent:
+		counts.sent++
+	case Throttled:
+		counts.throttled++
+	case SendFailed:
+		counts.failures++
+	}
+	var done bool
+	switch e.Type {
+	case JobFinished, JobFailed, JobCancelled, JobPaused:
+		done = true
+	}
+	if done {
+		delete(cw.jobs, e.Job)
+	}
+	cw.mu.Unlock()
+	if done {
+		cw.publish(e, counts)
+	}
+}
+
+func (cw *CloudWatchObserver) publish(e Event, counts *jobCounts) {
+	now := aws.Time(time.Now())
+	datum := func(name string, value float64, unit string) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Timestamp:  now,
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(value)}
+	}
+	failures := counts.failures
+	if e.Type == JobFailed && failures == 0 {
+		failures = 1
+	}
+	params := &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(cw.namespace),
+		MetricData: []*cloudwatch.MetricDatum{
+			datum("MessagesSent", float64(counts.sent), cloudwatch.StandardUnitCount),
+			datum("ThrottleEvents", float64(counts.throttled), cloudwatch.StandardUnitCount),
+			datum("Failures", float64(failures), cloudwatch.StandardUnitCount),
+			datum("Duration", e.Duration.Seconds(), cloudwatch.StandardUnitSeconds)}}
+	if _, err := cw.svc.PutMetricData(params); err != nil {
+		log.Printf("Job %s failed to publish metrics to CloudWatch: %s", e.Job, err)
+	}
+}
@@ -0,0 +1,58 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"testing"
+	"time"
+)
+
+type MockCloudWatch struct {
+	input *cloudwatch.PutMetricDataInput
+}
+
+func (svc *MockCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	svc.input = input
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudWatchObserver(t *testing.T) {
+	svc := MockCloudWatch{}
+	cw := newCloudWatchObserver("Mailrail", &svc)
+	cw.Observe(Event{Type: JobStarted, Job: "foo", Recipients: 3})
+	cw.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 0})
+	cw.Observe(Event{Type: Throttled, Job: "foo", Recipient: 1})
+	cw.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 1})
+	cw.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 2})
+	if svc.input != nil {
+		t.Fatal("published metrics before the job ended")
+	}
+	cw.Observe(Event{Type: JobFinished, Job: "foo", Duration: 2 * time.Second})
+	if *svc.input.Namespace != "Mailrail" {
+		t.Fatal("unexpected namespace:", *svc.input.Namespace)
+	}
+	expected := map[string]float64{"MessagesSent": 3, "ThrottleEvents": 1, "Failures": 0, "Duration": 2}
+	for _, datum := range svc.input.MetricData {
+		if *datum.Value != expected[*datum.MetricName] {
+			t.Fatal("unexpected value for", *datum.MetricName, *datum.Value)
+		}
+	}
+	if len(cw.jobs) != 0 {
+		t.Fatal("counts for finished job were not forgotten")
+	}
+}
+
+func TestCloudWatchObserverPublishesCancelledAndPausedJobs(t *testing.T) {
+	for _, typ := range []EventType{JobCancelled, JobPaused} {
+		svc := MockCloudWatch{}
+		cw := newCloudWatchObserver("Mailrail", &svc)
+		cw.Observe(Event{Type: JobStarted, Job: "foo", Recipients: 3})
+		cw.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 0})
+		cw.Observe(Event{Type: typ, Job: "foo", Recipient: 1, Duration: time.Second})
+		if svc.input == nil {
+			t.Fatal("did not publish metrics for job that ended with event", typ)
+		}
+		if len(cw.jobs) != 0 {
+			t.Fatal("counts were not forgotten for job that ended with event", typ)
+		}
+	}
+}
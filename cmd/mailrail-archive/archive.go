@@ -0,0 +1,62 @@
+// The archive command copies the artifacts of done and cancelled jobs
+// to a directory or S3, optionally removing them from the queue.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+)
+
+func main() {
+	var remove bool
+	var indexFilename string
+
+	flag.Usage = usage
+	flag.BoolVar(&remove, "remove", false,
+		"remove jobs from the queue once they are archived")
+	flag.StringVar(&indexFilename, "index", "",
+		"add jobs to this search index before archiving them")
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	store, err := mailrail.OpenArchive(flag.Args()[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if indexFilename != "" {
+		if _, err := mailrail.UpdateIndex(queueDir, indexFilename); err != nil {
+			log.Fatalf("Failed to update index %s: %s", indexFilename, err)
+		}
+	}
+	jobs := flag.Args()[2:]
+	if len(jobs) == 0 {
+		statuses, err := mailrail.QueueStatus(queueDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			if s.State == "done" || s.State == "cancelled" {
+				jobs = append(jobs, s.Job)
+			}
+		}
+	}
+	for _, job := range jobs {
+		if err := mailrail.ArchiveJob(queueDir, job, store, remove); err != nil {
+			log.Fatalf("Failed to archive job %s: %s", job, err)
+		}
+		fmt.Println(job)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-remove] [-index FILE] QUEUE-DIR ARCHIVE [JOB...]\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nARCHIVE is a directory or s3://BUCKET/PREFIX. Without JOBs, all done and\ncancelled jobs are archived.\n")
+}
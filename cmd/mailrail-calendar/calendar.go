@@ -0,0 +1,52 @@
+// The calendar command shows when queued and scheduled jobs are
+// projected to send.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	var rate float64
+
+	flag.Usage = usage
+	flag.Float64Var(&rate, "rate", 0,
+		"messages per second (default: the SES maximum send rate)")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	if rate == 0 {
+		var err error
+		rate, err = mailrail.MaxSendRate()
+		if err != nil {
+			log.Fatalf("Failed to get max send rate from SES: %s", err)
+		}
+	}
+	entries, err := mailrail.Calendar(queueDir, rate, time.Now())
+	if err != nil {
+		log.Fatalf("Failed to project queue %s: %s", queueDir, err)
+	}
+	day := ""
+	for _, e := range entries {
+		if d := e.Start.Format("Mon 2006-01-02"); d != day {
+			day = d
+			fmt.Println(day)
+		}
+		fmt.Printf("  %s - %s  %8d recipients  %-9s  %s\n",
+			e.Start.Format("15:04"), e.End.Format("Jan 02 15:04"), e.Recipients, e.State, e.Job)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,31 @@
+// The cancel command stops a queued or in-progress job.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	job := flag.Args()[1]
+	if err := mailrail.Cancel(queueDir, job); err != nil {
+		log.Fatalf("Failed to cancel job %s: %s", job, err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR JOB\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nThe worker stops the job before its next recipient.\n")
+}
@@ -0,0 +1,34 @@
+// The exporter command serves metrics about queue directories for
+// Prometheus to scrape.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"net/http"
+	"os"
+	"path"
+)
+
+func main() {
+	var listen string
+
+	flag.Usage = usage
+	flag.StringVar(&listen, "listen", ":9464",
+		"address to listen on; metrics are served at /metrics")
+	flag.Parse()
+	if len(flag.Args()) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", mailrail.NewQueueExporter(flag.Args()))
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-listen ADDR] QUEUE-DIR...\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,59 @@
+// The fake command prints a spec with synthetic recipients whose
+// contexts fill in the variables that the spec's templates refer to.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	var n int
+	var seed int64
+
+	flag.Usage = usage
+	flag.IntVar(&n, "n", 10, "number of recipients to generate")
+	flag.Int64Var(&seed, "seed", 0, "random seed (default: based on the time)")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	specFilename := flag.Args()[0]
+	specBytes, err := ioutil.ReadFile(specFilename)
+	if err != nil {
+		log.Fatalf("Failed to open spec file %s: %s", specFilename, err)
+	}
+	var spec mailrail.Spec
+	if err := json.Unmarshal(specBytes, &spec); err != nil {
+		log.Fatalf("Failed to parse spec file %s: %s", specFilename, err)
+	}
+	vars, err := mailrail.TemplateVariables(spec)
+	if err != nil {
+		log.Fatalf("Failed to parse templates: %s", err)
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	spec.Recipients = mailrail.FakeRecipients(vars, n, rand.New(rand.NewSource(seed)))
+	spec.List = ""
+	spec.Segment = nil
+	out, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode spec: %s", err)
+	}
+	fmt.Println(string(out))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-n N] [-seed SEED] SPEC-FILE\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,45 @@
+// The feedback command consumes SES bounce and complaint notifications
+// from an SQS queue and records them against the jobs that sent the
+// messages.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	var suppressionFilename string
+	var softBounceExpiry time.Duration
+
+	flag.Usage = usage
+	flag.StringVar(&suppressionFilename, "suppression", "",
+		"also suppress addresses that bounce permanently or complain in this suppression list file")
+	flag.DurationVar(&softBounceExpiry, "soft-bounce-expiry", 0,
+		"also suppress addresses that bounce transiently for this long, doubling with each soft bounce (e.g., 720h)")
+	flag.Parse()
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	ingester := mailrail.NewFeedbackIngester(flag.Args()[0], flag.Args()[1])
+	if suppressionFilename != "" {
+		suppressions, err := mailrail.OpenSuppressionList(suppressionFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ingester.Suppressions = suppressions
+		ingester.SoftBounceExpiry = softBounceExpiry
+	}
+	ingester.Run()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-suppression FILE] QUEUE-DIR SQS-QUEUE-URL\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,61 @@
+// The import command backfills mailrail's send history and
+// suppression list from a CSV log of earlier sends.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+)
+
+func main() {
+	var historyFilename string
+	var suppressionFilename string
+
+	flag.Usage = usage
+	flag.StringVar(&historyFilename, "history", "",
+		"send history file to import into")
+	flag.StringVar(&suppressionFilename, "suppression", "",
+		"suppression list file to import into")
+	flag.Parse()
+	if len(flag.Args()) != 1 || (historyFilename == "" && suppressionFilename == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var history *mailrail.SendHistory
+	if historyFilename != "" {
+		var err error
+		history, err = mailrail.OpenSendHistory(historyFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var suppressions *mailrail.SuppressionList
+	if suppressionFilename != "" {
+		var err error
+		suppressions, err = mailrail.OpenSuppressionList(suppressionFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	csvFilename := flag.Args()[0]
+	f, err := os.Open(csvFilename)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %s", csvFilename, err)
+	}
+	defer f.Close()
+	n, err := mailrail.ImportSendLog(f, history, suppressions)
+	if err != nil {
+		log.Fatalf("Failed to import %s after %d rows: %s", csvFilename, n, err)
+	}
+	log.Printf("Imported %d rows from %s", n, csvFilename)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-history FILE] [-suppression FILE] CSV-FILE\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nThe CSV file has a header row naming the columns address, campaign,\nand timestamp, and optionally stream and reason. Rows with a reason\nare added to the suppression list.\n")
+}
@@ -0,0 +1,120 @@
+// The lint command checks spec files for problems before they are
+// submitted, without touching any queue or AWS, for instance in CI.
+// It parses the specs, compiles their templates, and checks the
+// addresses and the template variables of every recipient, including
+// recipients that will be submitted apart from the spec.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"github.com/ljosa/mailrail/mailraillint"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// mapFlag collects repeated KEY=VALUE flags into a map.
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	var pairs []string
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m mapFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected KEY=VALUE, not %q", value)
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
+
+// readRecipients reads the recipients that will be submitted with the
+// specs, if any.
+func readRecipients(recipientsNDJSON, recipientsCSV string, columns map[string]string) ([]mailrail.Recipient, error) {
+	if recipientsNDJSON != "" {
+		data, err := ioutil.ReadFile(recipientsNDJSON)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open recipients file %s: %s", recipientsNDJSON, err)
+		}
+		recipients, err := mailrail.ReadRecipientsNDJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read recipients file %s: %s", recipientsNDJSON, err)
+		}
+		return recipients, nil
+	}
+	f, err := os.Open(recipientsCSV)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open recipients file %s: %s", recipientsCSV, err)
+	}
+	defer f.Close()
+	recipients, err := mailrail.ReadRecipientsCSV(f, columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recipients file %s: %s", recipientsCSV, err)
+	}
+	return recipients, nil
+}
+
+func main() {
+	var strict bool
+	var recipientsNDJSON string
+	var recipientsCSV string
+	csvColumns := mapFlag{}
+
+	flag.Usage = usage
+	flag.BoolVar(&strict, "strict", false,
+		"treat warnings as errors")
+	flag.StringVar(&recipientsNDJSON, "recipients-ndjson", "",
+		"check the specs with the recipients in this NDJSON file, as mailrail-submit would submit them")
+	flag.StringVar(&recipientsCSV, "recipients-csv", "",
+		"check the specs with the recipients in this CSV file, as mailrail-submit would submit them")
+	flag.Var(csvColumns, "csv-column",
+		"with -recipients-csv, rename the CSV column HEADER to FIELD, or leave it out if FIELD is empty, as HEADER=FIELD (repeatable)")
+	flag.Parse()
+	if len(flag.Args()) < 1 || (recipientsNDJSON != "" && recipientsCSV != "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var recipients []mailrail.Recipient
+	if recipientsNDJSON != "" || recipientsCSV != "" {
+		var err error
+		if recipients, err = readRecipients(recipientsNDJSON, recipientsCSV, csvColumns); err != nil {
+			log.Fatal(err)
+		}
+	}
+	failed := false
+	for _, specFilename := range flag.Args() {
+		specBytes, err := ioutil.ReadFile(specFilename)
+		if err != nil {
+			log.Fatalf("Failed to open spec file %s: %s", specFilename, err)
+		}
+		if recipients != nil {
+			if specBytes, err = mailrail.SpecWithRecipients(specBytes, recipients); err != nil {
+				log.Fatalf("Failed to add recipients to spec %s: %s", specFilename, err)
+			}
+		}
+		problems := mailraillint.LintBytes(specBytes)
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", specFilename, p)
+		}
+		if mailraillint.HasErrors(problems) || (strict && len(problems) > 0) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-strict] [-recipients-ndjson FILE | -recipients-csv FILE] SPEC-FILE...\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
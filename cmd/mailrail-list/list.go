@@ -0,0 +1,149 @@
+// The list command manages the recipient lists that specs can refer
+// to by name.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	lists, err := mailrail.OpenListStore(flag.Args()[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	command := flag.Args()[1]
+	args := flag.Args()[2:]
+	switch command {
+	case "lists":
+		names, err := lists.Lists()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "create":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = lists.CreateList(args[0])
+	case "add":
+		err = add(lists, args)
+	case "remove":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = lists.RemoveMember(args[0], args[1])
+	case "export":
+		err = export(lists, args)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func add(lists *mailrail.ListStore, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	name := fs.String("name", "", "name of the recipient")
+	fs.Parse(args)
+	if len(fs.Args()) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	member := mailrail.Recipient{Name: *name, Addr: fs.Args()[1], Context: map[string]interface{}{}}
+	for _, kv := range fs.Args()[2:] {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Expected KEY=VALUE, not %q", kv)
+		}
+		member.Context[parts[0]] = parts[1]
+	}
+	return lists.AddMember(fs.Args()[0], member)
+}
+
+func export(lists *mailrail.ListStore, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json or csv")
+	fs.Parse(args)
+	if len(fs.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	members, err := lists.Members(fs.Args()[0])
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(members)
+	}
+	keySet := make(map[string]bool)
+	for _, m := range members {
+		for k := range m.Context {
+			keySet[k] = true
+		}
+	}
+	var keys []string
+	for k := range keySet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w := csv.NewWriter(os.Stdout)
+	w.Write(append([]string{"addr", "name"}, keys...))
+	for _, m := range members {
+		row := []string{m.Addr, m.Name}
+		for _, k := range keys {
+			row = append(row, csvValue(m.Context[k]))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvValue returns a context value for a CSV cell: strings as they
+// are, and lists, objects, and numbers as JSON.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func usage() {
+	name := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s LIST-DIR lists\n", name)
+	fmt.Fprintf(os.Stderr, "       %s LIST-DIR create LIST\n", name)
+	fmt.Fprintf(os.Stderr, "       %s LIST-DIR add [-name NAME] LIST ADDR [KEY=VALUE...]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s LIST-DIR remove LIST ADDR\n", name)
+	fmt.Fprintf(os.Stderr, "       %s LIST-DIR export [-format json|csv] LIST\n", name)
+	flag.PrintDefaults()
+}
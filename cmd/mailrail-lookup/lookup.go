@@ -0,0 +1,43 @@
+// The lookup command finds the job and recipient of an SES
+// Message-ID.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	// Accept the Message-ID header form, <ID@email.amazonses.com>.
+	messageId := strings.Trim(flag.Args()[1], "<>")
+	if at := strings.Index(messageId, "@"); at >= 0 {
+		messageId = messageId[:at]
+	}
+	info, err := mailrail.LookupMessage(queueDir, messageId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(info); err != nil {
+		log.Fatalf("Failed to write message info: %s", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR MESSAGE-ID\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
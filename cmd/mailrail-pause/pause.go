@@ -0,0 +1,41 @@
+// The pause command parks a queued or in-progress job, or resumes a
+// paused job.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+)
+
+func main() {
+	var resume bool
+
+	flag.Usage = usage
+	flag.BoolVar(&resume, "resume", false,
+		"resume the job instead of pausing it")
+	flag.Parse()
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	job := flag.Args()[1]
+	if resume {
+		if err := mailrail.Resume(queueDir, job); err != nil {
+			log.Fatalf("Failed to resume job %s: %s", job, err)
+		}
+	} else {
+		if err := mailrail.Pause(queueDir, job); err != nil {
+			log.Fatalf("Failed to pause job %s: %s", job, err)
+		}
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-resume] QUEUE-DIR JOB\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
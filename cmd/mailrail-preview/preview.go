@@ -0,0 +1,102 @@
+// The preview command renders the messages of a spec to .eml files,
+// so that they can be reviewed in a mail client before the spec is
+// submitted, or serves them over HTTP while the templates are being
+// written. With -send-to, it instead sends the messages of a few
+// recipients to a review address, bypassing the queue.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	var outputDir string
+	var listen string
+	var samples int
+	var sendTo string
+	var recipients string
+
+	flag.Usage = usage
+	flag.StringVar(&outputDir, "o", "",
+		"write the messages, one .eml file per recipient, to this directory")
+	flag.StringVar(&listen, "http", "",
+		"serve the messages at this address, such as :8080, reading the spec again whenever it changes")
+	flag.IntVar(&samples, "samples", 10,
+		"with -http, preview specs without recipients in them with this many sample recipients; with -send-to, send the messages of this many random recipients")
+	flag.StringVar(&sendTo, "send-to", "",
+		"send the messages of some recipients to this review address")
+	flag.StringVar(&recipients, "recipients", "",
+		"with -send-to, send the messages of these recipients, such as 0,5,7, instead of -samples random ones")
+	flag.Parse()
+	modes := 0
+	for _, mode := range []string{outputDir, listen, sendTo} {
+		if mode != "" {
+			modes++
+		}
+	}
+	if len(flag.Args()) != 1 || modes != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	specFilename := flag.Args()[0]
+	if listen != "" {
+		log.Printf("Serving previews of %s at %s", specFilename, listen)
+		log.Fatal(http.ListenAndServe(listen, mailrail.NewPreviewHandler(specFilename, samples)))
+	}
+	specBytes, err := ioutil.ReadFile(specFilename)
+	if err != nil {
+		log.Fatalf("Failed to open spec file %s: %s", specFilename, err)
+	}
+	preview, err := mailrail.NewPreview(specBytes)
+	if err != nil {
+		log.Fatalf("Failed to preview spec %s: %s", specFilename, err)
+	}
+	if sendTo != "" {
+		testSend(preview, sendTo, recipients, samples)
+		return
+	}
+	if err := preview.WriteEML(outputDir); err != nil {
+		log.Fatalf("Failed to write messages: %s", err)
+	}
+	fmt.Printf("Wrote %d messages to %s\n", preview.Len(), outputDir)
+}
+
+func testSend(preview *mailrail.Preview, to string, recipients string, samples int) {
+	var indices []int
+	if recipients != "" {
+		for _, s := range strings.Split(recipients, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("Invalid recipient index %q", s)
+			}
+			indices = append(indices, i)
+		}
+	} else {
+		indices = preview.Sample(samples, rand.New(rand.NewSource(time.Now().UnixNano())))
+	}
+	for _, i := range indices {
+		messageID, err := preview.Send(i, mailrail.SendToMe(to))
+		if err != nil {
+			log.Fatalf("Failed to send the message of recipient %d: %s", i, err)
+		}
+		fmt.Printf("Sent the message of recipient %d to %s: %s\n", i, to, messageID)
+	}
+}
+
+func usage() {
+	name := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s -o DIR SPEC-FILE\n       %s -http ADDR [-samples N] SPEC-FILE\n"+
+		"       %s -send-to ADDR [-recipients I,J,...|-samples N] SPEC-FILE\n", name, name, name)
+	flag.PrintDefaults()
+}
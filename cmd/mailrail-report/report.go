@@ -0,0 +1,86 @@
+// The report command exports the delivery status of each recipient
+// of a job as CSV or JSON.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+func main() {
+	var format string
+	var failures bool
+
+	flag.Usage = usage
+	flag.StringVar(&format, "format", "csv",
+		"output format: csv or json")
+	flag.BoolVar(&failures, "failures", false,
+		"print the job's failure report as JSON instead")
+	flag.Parse()
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	job := flag.Args()[1]
+	if failures {
+		failureReport, err := mailrail.GetFailureReport(queueDir, job)
+		if err != nil {
+			log.Fatalf("Failed to get failure report for job %s: %s", job, err)
+		}
+		if failureReport == nil {
+			log.Fatalf("Job %s has no failure report", job)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(failureReport); err != nil {
+			log.Fatalf("Failed to write failure report: %s", err)
+		}
+		return
+	}
+	report, err := mailrail.JobReport(queueDir, job)
+	if err != nil {
+		log.Fatalf("Failed to get report for job %s: %s", job, err)
+	}
+	switch format {
+	case "csv":
+		err = writeCSV(report)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write report: %s", err)
+	}
+}
+
+func writeCSV(report []mailrail.Result) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"recipient", "addr", "status", "message_id", "time", "error_code", "request_id", "error"})
+	for _, r := range report {
+		t := ""
+		if !r.Time.IsZero() {
+			t = r.Time.Format(time.RFC3339)
+		}
+		w.Write([]string{strconv.Itoa(r.Recipient), r.Addr, r.Status, r.MessageId, t, r.ErrorCode, r.RequestId, r.Error})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR JOB\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,67 @@
+// The resend command sends a job's content again to some of its
+// recipients.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	var failed bool
+	var nonOpenersDays int
+	var subject string
+	var suppressionFile string
+
+	flag.Usage = usage
+	flag.BoolVar(&failed, "failed", false,
+		"resend to the recipients that failed or were skipped")
+	flag.IntVar(&nonOpenersDays, "non-openers", 0,
+		"resend to the recipients who have not opened or clicked after this many days")
+	flag.StringVar(&subject, "subject", "",
+		"subject of the follow-up to non-openers")
+	flag.StringVar(&suppressionFile, "suppression", "",
+		"leave out non-openers in this suppression list")
+	flag.Parse()
+	nonOpeners := nonOpenersDays > 0
+	if len(flag.Args()) < 2 || (!failed && !nonOpeners && len(flag.Args()) < 3) || (nonOpeners && subject == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	job := flag.Args()[1]
+	var resendJob string
+	var err error
+	if failed {
+		resendJob, err = mailrail.ResendFailed(queueDir, job)
+	} else if nonOpeners {
+		var suppressions *mailrail.SuppressionList
+		if suppressionFile != "" {
+			suppressions, err = mailrail.OpenSuppressionList(suppressionFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		after := time.Duration(nonOpenersDays) * 24 * time.Hour
+		resendJob, err = mailrail.ResendToNonOpeners(queueDir, job, after, subject, suppressions)
+	} else {
+		resendJob, err = mailrail.ResendTo(queueDir, job, flag.Args()[2:])
+	}
+	if err != nil {
+		log.Fatalf("Failed to resend job %s: %s", job, err)
+	}
+	fmt.Println(resendJob)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR JOB RECIPIENT...\n", path.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s -failed QUEUE-DIR JOB\n", path.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s -non-openers DAYS -subject SUBJECT [-suppression FILE] QUEUE-DIR JOB\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nEach RECIPIENT is a recipient index or an email address.\n")
+}
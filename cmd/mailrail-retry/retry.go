@@ -0,0 +1,40 @@
+// The retry command moves failed jobs back to the queue.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+)
+
+func main() {
+	var reset bool
+
+	flag.Usage = usage
+	flag.BoolVar(&reset, "reset", false,
+		"start over from the first recipient instead of the checkpoint")
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	failed := false
+	for _, job := range flag.Args()[1:] {
+		if err := mailrail.Retry(queueDir, job, reset); err != nil {
+			log.Printf("Failed to retry job %s: %s", job, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-reset] QUEUE-DIR JOB...\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,73 @@
+// The search command finds what archived jobs sent to an address, in
+// a campaign, or in a date range.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func parseDate(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	log.Fatalf("Failed to parse date %q; use YYYY-MM-DD or RFC 3339", s)
+	return time.Time{}
+}
+
+func main() {
+	var indexFilename string
+	var q mailrail.SearchQuery
+	var since, until string
+
+	flag.Usage = usage
+	flag.StringVar(&indexFilename, "index", "",
+		"index file (default: QUEUE-DIR/search-index)")
+	flag.StringVar(&q.Addr, "addr", "", "recipient address")
+	flag.StringVar(&q.Campaign, "campaign", "", "campaign")
+	flag.StringVar(&q.MessageId, "message-id", "", "SES message ID")
+	flag.StringVar(&since, "since", "", "earliest date, as YYYY-MM-DD or RFC 3339")
+	flag.StringVar(&until, "until", "", "latest date, as YYYY-MM-DD or RFC 3339")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	queueDir := flag.Args()[0]
+	if indexFilename == "" {
+		indexFilename = path.Join(queueDir, "search-index")
+	}
+	q.Since = parseDate(since)
+	q.Until = parseDate(until)
+	if len(until) == len("2006-01-02") {
+		// A date means the whole day.
+		q.Until = q.Until.Add(24*time.Hour - time.Nanosecond)
+	}
+	if _, err := mailrail.UpdateIndex(queueDir, indexFilename); err != nil {
+		log.Fatalf("Failed to update index %s: %s", indexFilename, err)
+	}
+	entries, err := mailrail.SearchIndex(indexFilename, q)
+	if err != nil {
+		log.Fatalf("Failed to search index %s: %s", indexFilename, err)
+	}
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Format(time.RFC3339), e.Job, e.Campaign, e.Addr, e.Status, e.MessageId, e.Subject)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] QUEUE-DIR\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nThe index is updated with newly archived jobs before searching.\n")
+}
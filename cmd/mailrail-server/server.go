@@ -0,0 +1,141 @@
+// The server command serves a REST API for submitting, inspecting,
+// cancelling, and pausing jobs, optionally the same as a gRPC service,
+// and optionally the double opt-in signup, unsubscribe, and tracking
+// endpoints.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"google.golang.org/grpc"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+func main() {
+	var listen string
+	var maxBacklog int
+	var listDir string
+	var baseURL string
+	var fromAddr string
+	var secretRef string
+	var allowedLists string
+	var tokenFile string
+	var insecure bool
+	var grpcListen string
+	var suppressionFile string
+	var unsubscribeSecret string
+	var trackingSecret string
+
+	flag.Usage = usage
+	flag.StringVar(&listen, "listen", ":8080",
+		"address to listen on")
+	flag.IntVar(&maxBacklog, "max-backlog", 0,
+		"refuse specs if more than this many recipients would be waiting")
+	flag.StringVar(&listDir, "list-dir", "",
+		"directory of recipient lists; serves /signup and /confirm if given")
+	flag.StringVar(&baseURL, "base-url", "",
+		"public URL of this server, used in confirmation links")
+	flag.StringVar(&fromAddr, "from", "",
+		"sender of confirmation emails")
+	flag.StringVar(&secretRef, "secret", "",
+		"secret for signing confirmation links, as PROVIDER:NAME (e.g., env:MAILRAIL_SIGNUP_SECRET)")
+	flag.StringVar(&allowedLists, "lists", "",
+		"comma-separated lists that accept signups")
+	flag.StringVar(&tokenFile, "tokens", "",
+		"require API tokens from this file, managed with mailrail-token")
+	flag.BoolVar(&insecure, "insecure", false,
+		"serve the API without -tokens, letting anyone who can connect submit and control jobs")
+	flag.StringVar(&grpcListen, "grpc-listen", "",
+		"also serve the gRPC control plane on this address")
+	flag.StringVar(&suppressionFile, "suppression", "",
+		"suppression list to add unsubscribed addresses to; serves /unsubscribe if given, and is not sent signup confirmations")
+	flag.StringVar(&unsubscribeSecret, "unsubscribe-secret", "",
+		"secret the worker signs unsubscribe links with, given as a secret reference such as env:NAME")
+	flag.StringVar(&trackingSecret, "tracking-secret", "",
+		"secret the worker signs tracking tokens with, given as a secret reference such as env:NAME; serves /open and /click if given")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if tokenFile == "" && !insecure {
+		log.Fatal("You must give -tokens, or -insecure to serve the API without authentication")
+	}
+	submitter := mailrail.NewSubmitter(flag.Args()[0])
+	submitter.MaxBacklog = maxBacklog
+	api := mailrail.NewAPIHandler(submitter)
+	if tokenFile != "" {
+		api.Tokens = mailrail.OpenTokenStore(tokenFile)
+	}
+	if grpcListen != "" {
+		control := mailrail.NewControlServer(submitter)
+		control.Tokens = api.Tokens
+		lis, err := net.Listen("tcp", grpcListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server := grpc.NewServer()
+		control.Register(server)
+		go func() {
+			log.Fatal(server.Serve(lis))
+		}()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", api)
+	mux.Handle("/jobs/", api)
+	var suppressions *mailrail.SuppressionList
+	if suppressionFile != "" {
+		var err error
+		if suppressions, err = mailrail.OpenSuppressionList(suppressionFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if listDir != "" {
+		if baseURL == "" || fromAddr == "" || secretRef == "" || allowedLists == "" {
+			log.Fatal("You must give -base-url, -from, -secret, and -lists with -list-dir")
+		}
+		lists, err := mailrail.OpenListStore(listDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret, err := mailrail.LookupSecret(secretRef)
+		if err != nil {
+			log.Fatal(err)
+		}
+		signup := mailrail.NewSignupHandler(lists, secret, baseURL, fromAddr, strings.Split(allowedLists, ","))
+		signup.Suppressions = suppressions
+		mux.Handle("/signup", signup)
+		mux.Handle("/confirm", signup)
+	}
+	if suppressionFile != "" {
+		if unsubscribeSecret == "" {
+			log.Fatal("You must give -unsubscribe-secret with -suppression")
+		}
+		secret, err := mailrail.LookupSecret(unsubscribeSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux.Handle("/unsubscribe", mailrail.NewUnsubscribeHandler(suppressions, secret))
+	}
+	if trackingSecret != "" {
+		secret, err := mailrail.LookupSecret(trackingSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tracking := mailrail.NewTrackingHandler(flag.Args()[0], secret)
+		mux.Handle("/open", tracking)
+		mux.Handle("/click", tracking)
+	}
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] QUEUE-DIR\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
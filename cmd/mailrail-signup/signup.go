@@ -0,0 +1,63 @@
+// The signup command serves a double opt-in signup endpoint that adds
+// confirmed addresses to recipient lists.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+func main() {
+	var listen string
+	var baseURL string
+	var fromAddr string
+	var secretRef string
+	var allowedLists string
+	var suppressionFile string
+
+	flag.Usage = usage
+	flag.StringVar(&listen, "listen", ":8080",
+		"address to listen on")
+	flag.StringVar(&baseURL, "base-url", "",
+		"public URL of this server, used in confirmation links")
+	flag.StringVar(&fromAddr, "from", "",
+		"sender of confirmation emails")
+	flag.StringVar(&secretRef, "secret", "",
+		"secret for signing confirmation links, as PROVIDER:NAME (e.g., env:MAILRAIL_SIGNUP_SECRET)")
+	flag.StringVar(&allowedLists, "lists", "",
+		"comma-separated lists that accept signups")
+	flag.StringVar(&suppressionFile, "suppression", "",
+		"suppression list whose addresses are not sent confirmation emails")
+	flag.Parse()
+	if len(flag.Args()) != 1 || baseURL == "" || fromAddr == "" || secretRef == "" || allowedLists == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	lists, err := mailrail.OpenListStore(flag.Args()[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	secret, err := mailrail.LookupSecret(secretRef)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := mailrail.NewSignupHandler(lists, secret, baseURL, fromAddr, strings.Split(allowedLists, ","))
+	if suppressionFile != "" {
+		if handler.Suppressions, err = mailrail.OpenSuppressionList(suppressionFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Fatal(http.ListenAndServe(listen, handler))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -base-url URL -from ADDR -secret REF -lists LIST,... LIST-DIR\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nYou must set the AWS_DEFAULT_REGION environment variable\n(e.g., to `us-east-1`).\n")
+}
@@ -0,0 +1,58 @@
+// The status command shows the jobs in a queue and the progress of
+// a job.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	switch len(flag.Args()) {
+	case 1:
+		statuses, err := mailrail.QueueStatus(flag.Args()[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			risk := ""
+			if s.AtRisk() {
+				risk = "  (SLA at risk)"
+			}
+			fmt.Printf("%-11s  %8d/%-8d  %s%s\n", s.State, s.Sent, s.Recipients, s.Job, risk)
+		}
+	case 2:
+		s, err := mailrail.GetJobStatus(flag.Args()[0], flag.Args()[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Job:        %s\n", s.Job)
+		fmt.Printf("State:      %s\n", s.State)
+		fmt.Printf("Sent:       %d of %d\n", s.Sent, s.Recipients)
+		if s.Rate > 0 {
+			fmt.Printf("Rate:       %.1f messages/second\n", s.Rate)
+			fmt.Printf("ETA:        %s (in %s)\n", s.ETA.Format(time.RFC1123), s.ETA.Sub(time.Now()).Round(time.Second))
+		}
+		if !s.Deadline.IsZero() {
+			fmt.Printf("Deadline:   %s\n", s.Deadline.Format(time.RFC1123))
+			if s.AtRisk() {
+				fmt.Printf("SLA:        at risk; predicted %s late\n", s.ETA.Sub(s.Deadline).Round(time.Second))
+			}
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR [JOB]\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
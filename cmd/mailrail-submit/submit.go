@@ -1,39 +1,215 @@
-// The submit command adds a spec to a pqueue.
+// The submit command adds a spec to a pqueue or to an SQS or Redis job
+// queue.
 package main
 
 import (
 	"flag"
 	"fmt"
-	"github.com/ljosa/go-pqueue/pqueue"
+	"github.com/ljosa/mailrail"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
+// mapFlag collects repeated KEY=VALUE flags into a map.
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	var pairs []string
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m mapFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected KEY=VALUE, not %q", value)
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
+
+// readSpec reads a spec file, taking its recipients from a CSV file if
+// one is given.
+func readSpec(specFilename, recipientsCSV string, columns map[string]string) ([]byte, error) {
+	spec, err := ioutil.ReadFile(specFilename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open spec file %s: %s", specFilename, err)
+	}
+	if recipientsCSV != "" {
+		return specWithCSVRecipients(spec, recipientsCSV, columns)
+	}
+	return spec, nil
+}
+
+// encode gzips data if compress is true, and then encrypts it if a KMS
+// key is given.
+func encode(data []byte, compress bool, kmsKey string) ([]byte, error) {
+	var err error
+	if compress {
+		if data, err = mailrail.Gzip(data); err != nil {
+			return nil, err
+		}
+	}
+	if kmsKey != "" {
+		return mailrail.Encrypt(kmsKey, data)
+	}
+	return data, nil
+}
+
+func specWithCSVRecipients(spec []byte, recipientsCSV string, columns map[string]string) ([]byte, error) {
+	f, err := os.Open(recipientsCSV)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open recipients file %s: %s", recipientsCSV, err)
+	}
+	defer f.Close()
+	recipients, err := mailrail.ReadRecipientsCSV(f, columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recipients file %s: %s", recipientsCSV, err)
+	}
+	return mailrail.SpecWithRecipients(spec, recipients)
+}
+
 func main() {
+	var maxBacklog int
+	var checkQuota bool
+	var minQuotaHeadroom int
+	var wait time.Duration
+	var sqsQueueURL string
+	var sqsStore string
+	var redisAddr string
+	var redisPrefix string
+	var recipientsNDJSON string
+	var recipientsCSV string
+	csvColumns := mapFlag{}
+	var compress bool
+	var kmsKey string
+
 	flag.Usage = usage
+	flag.IntVar(&maxBacklog, "max-backlog", 0,
+		"refuse the spec if more than this many recipients would be waiting")
+	flag.BoolVar(&checkQuota, "check-quota", false,
+		"refuse the spec if the SES 24-hour quota cannot cover the backlog")
+	flag.IntVar(&minQuotaHeadroom, "min-quota-headroom", 0,
+		"with -check-quota, leave room for this many more messages in the quota")
+	flag.DurationVar(&wait, "wait", 0,
+		"wait this long for room before refusing the spec")
+	flag.StringVar(&sqsQueueURL, "sqs", "",
+		"submit to this SQS queue instead of a queue directory")
+	flag.StringVar(&sqsStore, "sqs-store", "",
+		"with -sqs, keep the job in this directory or s3://BUCKET/PREFIX")
+	flag.StringVar(&redisAddr, "redis", "",
+		"submit to the Redis server at this HOST:PORT instead of a queue directory")
+	flag.StringVar(&redisPrefix, "redis-prefix", "mailrail",
+		"with -redis, the prefix of the queue's keys")
+	flag.StringVar(&recipientsNDJSON, "recipients-ndjson", "",
+		"store the recipients in this NDJSON file, one JSON recipient per line, apart from the spec (queue directories only)")
+	flag.StringVar(&recipientsCSV, "recipients-csv", "",
+		"take the recipients from this CSV file, whose header names the columns: addr, name, from_name, from_addr, subject, stream, send_at, or else context keys")
+	flag.Var(csvColumns, "csv-column",
+		"with -recipients-csv, rename the CSV column HEADER to FIELD, or leave it out if FIELD is empty, as HEADER=FIELD (repeatable)")
+	flag.BoolVar(&compress, "gzip", false,
+		"gzip the spec, and the recipients of -recipients-ndjson, to save disk and transfer")
+	flag.StringVar(&kmsKey, "kms-key", "",
+		"encrypt the spec, and the recipients of -recipients-ndjson, at rest with a data key from this KMS key ID, ARN, or alias")
 	flag.Parse()
+	if recipientsCSV != "" && recipientsNDJSON != "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if redisAddr != "" {
+		if len(flag.Args()) != 1 || sqsQueueURL != "" || recipientsNDJSON != "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		specFilename := flag.Args()[0]
+		spec, err := readSpec(specFilename, recipientsCSV, csvColumns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if spec, err = encode(spec, compress, kmsKey); err != nil {
+			log.Fatal(err)
+		}
+		job, err := mailrail.NewRedisQueue(redisAddr, redisPrefix).Submit(spec)
+		if err != nil {
+			log.Fatalf("Failed to submit spec %s: %s", specFilename, err)
+		}
+		fmt.Println(job)
+		return
+	}
+	if sqsQueueURL != "" {
+		if len(flag.Args()) != 1 || sqsStore == "" || recipientsNDJSON != "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		specFilename := flag.Args()[0]
+		spec, err := readSpec(specFilename, recipientsCSV, csvColumns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if spec, err = encode(spec, compress, kmsKey); err != nil {
+			log.Fatal(err)
+		}
+		store, err := mailrail.OpenArchive(sqsStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		job, err := mailrail.NewSQSQueue(sqsQueueURL, store).Submit(spec)
+		if err != nil {
+			log.Fatalf("Failed to submit spec %s: %s", specFilename, err)
+		}
+		fmt.Println(job)
+		return
+	}
 	if len(flag.Args()) != 2 {
 		flag.Usage()
 		os.Exit(1)
 	}
 	queueDir := flag.Args()[0]
 	specFilename := flag.Args()[1]
-	spec, err := ioutil.ReadFile(specFilename)
+	spec, err := readSpec(specFilename, recipientsCSV, csvColumns)
 	if err != nil {
-		log.Fatalf("Failed to open spec file %s: %s", specFilename, err)
+		log.Fatal(err)
+	}
+	if spec, err = encode(spec, compress, kmsKey); err != nil {
+		log.Fatal(err)
+	}
+	s := mailrail.NewSubmitter(queueDir)
+	s.MaxBacklog = maxBacklog
+	s.CheckQuota = checkQuota
+	s.MinQuotaHeadroom = minQuotaHeadroom
+	s.Wait = wait
+	var job string
+	if recipientsNDJSON != "" {
+		recipients, rerr := ioutil.ReadFile(recipientsNDJSON)
+		if rerr != nil {
+			log.Fatalf("Failed to open recipients file %s: %s", recipientsNDJSON, rerr)
+		}
+		if recipients, rerr = encode(recipients, compress, kmsKey); rerr != nil {
+			log.Fatal(rerr)
+		}
+		job, err = s.SubmitNDJSON(spec, recipients)
+	} else {
+		job, err = s.Submit(spec)
 	}
-	q, err := pqueue.OpenQueue(queueDir)
 	if err != nil {
-		log.Fatalf("Failed to open queue %s: %s", queueDir, err)
+		if retryErr, ok := err.(*mailrail.RetryAfterError); ok {
+			log.Printf("Refused spec %s: %s", specFilename, retryErr)
+			os.Exit(75) // EX_TEMPFAIL
+		}
+		log.Fatalf("Failed to submit spec %s: %s", specFilename, err)
 	}
-	j, err := q.CreateJob("standalone")
-	j.Set("spec", spec)
-	j.Submit()
+	fmt.Println(job)
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR SPEC-FILE\n", path.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "Usage: %s [-recipients-ndjson FILE | -recipients-csv FILE] QUEUE-DIR SPEC-FILE\n       %s [-recipients-csv FILE] -sqs QUEUE-URL -sqs-store LOCATION SPEC-FILE\n       %s [-recipients-csv FILE] -redis HOST:PORT SPEC-FILE\n",
+		path.Base(os.Args[0]), path.Base(os.Args[0]), path.Base(os.Args[0]))
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nExits with status 75 if the spec is refused for lack of room.\n")
 }
@@ -0,0 +1,72 @@
+// The suppression command manages a suppression list of addresses
+// that must not be emailed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	suppressions, err := mailrail.OpenSuppressionList(flag.Args()[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	command := flag.Args()[1]
+	args := flag.Args()[2:]
+	switch command {
+	case "add":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = suppressions.Add(args[0], args[1], time.Now())
+	case "check":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		entry, ok := suppressions.Lookup(args[0])
+		if !ok {
+			fmt.Printf("%s is not suppressed\n", args[0])
+			os.Exit(1)
+		}
+		if entry.Expires.IsZero() {
+			fmt.Printf("%s is suppressed: %s\n", entry.Addr, entry.Reason)
+		} else {
+			fmt.Printf("%s is suppressed until %s: %s\n", entry.Addr, entry.Expires.Format(time.RFC3339), entry.Reason)
+		}
+	case "compact":
+		var dropped int
+		dropped, err = suppressions.Compact(time.Now())
+		if err == nil {
+			log.Printf("Dropped %d expired suppressions", dropped)
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	name := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s SUPPRESSION-FILE add ADDR REASON\n", name)
+	fmt.Fprintf(os.Stderr, "       %s SUPPRESSION-FILE check ADDR\n", name)
+	fmt.Fprintf(os.Stderr, "       %s SUPPRESSION-FILE compact\n", name)
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nRun compact periodically, e.g. daily from cron, to drop expired soft-bounce\nsuppressions from the file.\n")
+}
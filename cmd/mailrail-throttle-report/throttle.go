@@ -0,0 +1,36 @@
+// The throttle-report command exports the attempted and achieved send
+// rate and throttle events that workers recorded with -telemetry, for
+// requesting an increase of the SES sending rate.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	var days int
+
+	flag.Usage = usage
+	flag.IntVar(&days, "days", 14,
+		"export the last this many days")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	since := time.Now().AddDate(0, 0, -days)
+	if err := mailrail.ExportThrottleTelemetry(flag.Args()[0], since, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-days N] TELEMETRY-FILE\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
@@ -0,0 +1,64 @@
+// The token command manages the API tokens that mailrail-server
+// accepts with -tokens.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	tokens := mailrail.OpenTokenStore(flag.Args()[0])
+	command := flag.Args()[1]
+	args := flag.Args()[2:]
+	var err error
+	switch command {
+	case "list":
+		var all []mailrail.APIToken
+		all, err = tokens.Tokens()
+		for _, t := range all {
+			fmt.Printf("%s\t%s\t%s\n", t.Name, t.Role, t.Created.Format(time.RFC3339))
+		}
+	case "create":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		var token string
+		token, err = tokens.CreateToken(args[0], args[1])
+		if err == nil {
+			fmt.Println(token)
+		}
+	case "revoke":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = tokens.RevokeToken(args[0])
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	name := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s TOKEN-FILE list\n", name)
+	fmt.Fprintf(os.Stderr, "       %s TOKEN-FILE create NAME viewer|operator|admin\n", name)
+	fmt.Fprintf(os.Stderr, "       %s TOKEN-FILE revoke NAME\n", name)
+	flag.PrintDefaults()
+}
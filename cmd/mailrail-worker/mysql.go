@@ -0,0 +1,7 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// Data sources with the mysql driver.
+import _ "github.com/go-sql-driver/mysql"
@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// Data sources with the postgres driver.
+import _ "github.com/lib/pq"
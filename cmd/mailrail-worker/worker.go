@@ -2,36 +2,240 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/ljosa/mailrail"
+	"log"
+	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// mapFlag collects repeated KEY=VALUE flags into a map.
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	var pairs []string
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m mapFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected KEY=VALUE, not %q", value)
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
+
 func main() {
 	var doNotSend bool
 	var simulator bool
 	var sendTo string
+	var simulatorMix string
+	var honorSpecModes bool
+	var cloudWatchNamespace string
+	var snsTopicArn string
+	var slackWebhook string
+	var summaryTo string
+	var summaryFrom string
+	configurationSets := mapFlag{}
+	weights := mapFlag{}
+	var statsDAddr string
+	var dogStatsD bool
+	var historyFilename string
+	var archiveLocation string
+	var presetsFilename string
+	var templateDir string
+	var recipientsDir string
+	var idlePollMin time.Duration
+	var idlePollMax time.Duration
+	var concurrency int
+	var shardSize int
+	var sharedRateLimit string
+	var lease time.Duration
+	var workerID string
+	var sqsQueueURL string
+	var sqsStore string
+	var redisAddr string
+	var redisPrefix string
+	var enrichURL string
+	var enrichTimeout time.Duration
+	var enrichOnError string
+	var suppressionFilename string
+	var unsubscribeURL string
+	var unsubscribeSecret string
+	var trackingSecret string
+	var sesSuppressions string
+	var telemetryFilename string
+	var frequencyCap int
+	var frequencyCapPeriod time.Duration
+	var listDir string
+	var errorPolicy string
+	var webhookURL string
+	var webhookSecret string
+	var webhookEvery int
+	var webhookDeadLetterFile string
+	var specWebhookHosts string
+	var specWebhookSecrets string
+	var residencyField string
+	residencyZones := mapFlag{}
+	dataSources := mapFlag{}
+	var checkContext bool
+	var previewDir string
+	var checkUnusedContext bool
 
 	flag.Usage = usage
 	flag.BoolVar(&doNotSend, "donotsend", false,
 		"do not send any emails")
 	flag.BoolVar(&simulator, "simulator", false,
 		"send emails to AWS simulator")
+	flag.StringVar(&simulatorMix, "simulator-mix", "",
+		"send emails to AWS simulator addresses in this mix, e.g. success=90,bounce=5,complaint=5")
+	flag.BoolVar(&honorSpecModes, "honor-spec-modes", false,
+		"honor the donotsend, simulator, and sendto modes of specs instead of failing jobs that set them")
 	flag.StringVar(&sendTo, "sendto", "",
 		"send all emails to this address")
+	flag.StringVar(&cloudWatchNamespace, "cloudwatch", "",
+		"publish job metrics to this CloudWatch namespace")
+	flag.StringVar(&snsTopicArn, "sns", "",
+		"publish a summary to this SNS topic ARN when jobs finish, fail, or are cancelled")
+	flag.StringVar(&slackWebhook, "slack", "",
+		"post job summaries to this Slack incoming webhook, given as a secret reference such as env:NAME")
+	flag.StringVar(&summaryTo, "summary-to", "",
+		"email a summary of each job to this operator address")
+	flag.StringVar(&summaryFrom, "summary-from", "",
+		"sender address of job summaries")
+	flag.Var(configurationSets, "configset",
+		"send a stream with an SES configuration set, as STREAM=NAME (repeatable)")
+	flag.Var(weights, "weight",
+		"take jobs from a queue in proportion to this weight, as QUEUE-DIR=WEIGHT (repeatable; default 1)")
+	flag.StringVar(&statsDAddr, "statsd", "",
+		"send metrics to the StatsD server at this HOST:PORT")
+	flag.BoolVar(&dogStatsD, "dogstatsd", false,
+		"tag StatsD metrics with DogStatsD tags")
+	flag.StringVar(&telemetryFilename, "telemetry", "",
+		"record attempted and achieved send rates in this file, for mailrail-throttle-report")
+	flag.StringVar(&suppressionFilename, "suppression", "",
+		"skip recipients in this suppression list file")
+	flag.StringVar(&enrichURL, "enrich", "",
+		"POST each recipient to this URL before sending and merge the JSON object it returns into the recipient's context")
+	flag.DurationVar(&enrichTimeout, "enrich-timeout", 2*time.Second,
+		"give up on enriching a recipient after this long")
+	flag.StringVar(&enrichOnError, "enrich-on-error", mailrail.EnrichSkip,
+		"what to do when enrichment fails: skip the recipient, or send with stale data")
+	flag.StringVar(&sesSuppressions, "ses-suppressions", "",
+		"skip recipients on the SES account suppression list, looking them up one at a time (lookup) or all at startup (preload)")
+	flag.StringVar(&unsubscribeURL, "unsubscribe-url", "",
+		"base URL of unsubscribe links made by {{unsubscribe_url .}} in templates")
+	flag.StringVar(&unsubscribeSecret, "unsubscribe-secret", "",
+		"secret for signing unsubscribe links, given as a secret reference such as env:NAME")
+	flag.StringVar(&trackingSecret, "tracking-secret", "",
+		"secret for signing the tokens of tracking URLs, given as a secret reference such as env:NAME")
+	flag.StringVar(&historyFilename, "history", "",
+		"record sends in this send history file")
+	flag.StringVar(&archiveLocation, "archive", "",
+		"copy the artifacts of done and cancelled jobs to this directory or s3://BUCKET/PREFIX")
+	flag.StringVar(&sqsQueueURL, "sqs", "",
+		"take jobs from this SQS queue instead of queue directories")
+	flag.StringVar(&sqsStore, "sqs-store", "",
+		"with -sqs, keep jobs in this directory or s3://BUCKET/PREFIX")
+	flag.StringVar(&redisAddr, "redis", "",
+		"take jobs from the Redis server at this HOST:PORT instead of queue directories")
+	flag.StringVar(&redisPrefix, "redis-prefix", "mailrail",
+		"with -redis, the prefix of the queue's keys")
+	flag.DurationVar(&idlePollMin, "idle-poll-min", time.Second,
+		"poll idle queues this often at first")
+	flag.DurationVar(&idlePollMax, "idle-poll-max", 0,
+		"back off to polling idle queues this often (default: -idle-poll-min, or 10s for watched queue directories)")
+	flag.DurationVar(&lease, "lease", 0,
+		"lease jobs for this long, renewing the leases while processing them, so that workers sharing a queue directory take up the jobs of dead workers")
+	flag.StringVar(&workerID, "worker-id", "",
+		"identify the worker by this in leases (default: HOSTNAME:PID)")
+	flag.StringVar(&sharedRateLimit, "shared-rate-limit", "",
+		"keep to the SES send rate together with the other workers that use this ledger file or redis://HOST:PORT/KEY")
+	flag.IntVar(&shardSize, "shard-size", 0,
+		"split jobs with more recipients than this into shards of this many recipients that several workers can send in parallel")
+	flag.IntVar(&concurrency, "concurrency", 1,
+		"send to this many recipients of a job at a time")
+	flag.StringVar(&presetsFilename, "presets", "",
+		"let specs use the named presets defined in this JSON file")
+	flag.StringVar(&templateDir, "template-dir", "",
+		"let specs name templates in this directory with text_template, html_template, and amp_template")
+	flag.StringVar(&recipientsDir, "recipients-dir", "",
+		"let specs refer to recipient files in this directory with recipients_ref file:NAME")
+	flag.IntVar(&frequencyCap, "frequency-cap", 0,
+		"skip marketing mail to recipients who got this many messages within -frequency-cap-period")
+	flag.DurationVar(&frequencyCapPeriod, "frequency-cap-period", 7*24*time.Hour,
+		"period of the frequency cap")
+	flag.StringVar(&listDir, "lists", "",
+		"directory of recipient lists that specs can refer to")
+	flag.StringVar(&errorPolicy, "error-policy", "fail-job",
+		"what to do when sending fails: fail-job, skip-recipient, or retry-N-then-skip")
+	flag.StringVar(&webhookURL, "webhook", "",
+		"call this URL when jobs start, finish, fail, are cancelled, or are paused")
+	flag.StringVar(&webhookSecret, "webhook-secret", "",
+		"sign webhook calls with this secret, given as a secret reference such as env:NAME")
+	flag.IntVar(&webhookEvery, "webhook-every", 0,
+		"also call the webhook after every this many recipients")
+	flag.StringVar(&webhookDeadLetterFile, "webhook-dead-letter", "",
+		"append webhook calls that cannot be delivered to this file")
+	flag.StringVar(&specWebhookHosts, "spec-webhook-hosts", "",
+		"let specs have webhooks on these comma-separated hosts; other spec webhooks are ignored")
+	flag.StringVar(&specWebhookSecrets, "spec-webhook-secrets", "",
+		"let spec webhooks be signed with these comma-separated secret references")
+	flag.StringVar(&residencyField, "residency-field", "region",
+		"recipient context field that names the data-residency zone of the recipient")
+	flag.Var(residencyZones, "residency",
+		"send to a zone's recipients through SES in a region, and store their results in a directory, as ZONE=REGION[:DIR] (repeatable)")
+	flag.StringVar(&previewDir, "preview", "",
+		"instead of sending, write each job's messages as .eml files to a directory named after the job in this directory, and pause the job until it is resumed")
+	flag.BoolVar(&checkContext, "check-context", false,
+		"fail jobs whose recipients lack context keys that the templates refer to")
+	flag.BoolVar(&checkUnusedContext, "check-unused-context", false,
+		"with -check-context, also log the context keys that no template refers to")
+	flag.Var(dataSources, "data-source",
+		"let specs select segments with SQL queries against a database, as NAME=DRIVER:DSN, where the DSN is a secret reference such as env:NAME and DRIVER is postgres or mysql (repeatable; the worker must be built with -tags postgres or -tags mysql)")
 	flag.Parse()
-	if len(flag.Args()) != 1 {
+	if (sqsQueueURL == "" && redisAddr == "") == (len(flag.Args()) == 0) ||
+		(sqsQueueURL != "" && redisAddr != "") || (sqsQueueURL == "") != (sqsStore == "") {
 		flag.Usage()
 		os.Exit(1)
 	}
-	queueDir := flag.Args()[0]
+	var queues []mailrail.WeightedQueue
+	for _, queueDir := range flag.Args() {
+		weight := 1
+		if w, ok := weights[queueDir]; ok {
+			n, err := strconv.Atoi(w)
+			if err != nil || n < 1 {
+				log.Fatalf("Invalid weight %q for queue %s", w, queueDir)
+			}
+			weight = n
+			delete(weights, queueDir)
+		}
+		queues = append(queues, mailrail.WeightedQueue{Dir: queueDir, Weight: weight})
+	}
+	for queueDir := range weights {
+		log.Fatalf("Weight given for %s, which is not a queue directory argument", queueDir)
+	}
 
 	var mangler mailrail.Mangler
 	switch {
 	case doNotSend:
 		mangler = mailrail.DoNotSend
+	case simulatorMix != "":
+		mix, err := mailrail.ParseSimulatorMix(simulatorMix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mangler = mailrail.SendToSimulatorMix(mix)
 	case simulator:
 		mangler = mailrail.SendToSimulator
 	case sendTo != "":
@@ -39,11 +243,212 @@ func main() {
 	default:
 		mangler = mailrail.DoNotMangle
 	}
-	mailrail.ProcessForever(queueDir, mangler)
+	policy, err := mailrail.ParseErrorPolicy(errorPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []mailrail.Option{
+		mailrail.WithConfigurationSets(configurationSets),
+		mailrail.WithErrorPolicy(policy)}
+	if len(residencyZones) > 0 {
+		zones := make(map[string]*mailrail.Zone)
+		for name, value := range residencyZones {
+			parts := strings.SplitN(value, ":", 2)
+			artifactDir := ""
+			if len(parts) == 2 {
+				artifactDir = parts[1]
+			}
+			zones[name] = mailrail.NewZone(parts[0], artifactDir)
+		}
+		opts = append(opts, mailrail.WithResidency(residencyField, zones))
+	}
+	if honorSpecModes {
+		opts = append(opts, mailrail.WithSpecModes())
+	}
+	if cloudWatchNamespace != "" {
+		opts = append(opts, mailrail.WithObserver(mailrail.NewCloudWatchObserver(cloudWatchNamespace)))
+	}
+	if snsTopicArn != "" {
+		opts = append(opts, mailrail.WithObserver(mailrail.NewSNSObserver(snsTopicArn)))
+	}
+	if slackWebhook != "" {
+		url, err := mailrail.LookupSecret(slackWebhook)
+		if err != nil {
+			log.Fatalf("Failed to look up Slack webhook: %s", err)
+		}
+		opts = append(opts, mailrail.WithObserver(mailrail.NewSlackObserver(string(url))))
+	}
+	if summaryTo != "" {
+		if summaryFrom == "" {
+			log.Fatal("You must give -summary-from with -summary-to")
+		}
+		opts = append(opts, mailrail.WithOperatorSummary(summaryTo, summaryFrom))
+	}
+	if statsDAddr != "" {
+		statsD, err := mailrail.NewStatsDObserver(statsDAddr, "mailrail", dogStatsD)
+		if err != nil {
+			log.Fatalf("Failed to connect to StatsD at %s: %s", statsDAddr, err)
+		}
+		opts = append(opts, mailrail.WithObserver(statsD))
+	}
+	if telemetryFilename != "" {
+		opts = append(opts, mailrail.WithObserver(mailrail.NewTelemetryObserver(telemetryFilename)))
+	}
+	if suppressionFilename != "" {
+		suppressions, err := mailrail.OpenSuppressionList(suppressionFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithSuppressionList(suppressions))
+	}
+	if unsubscribeURL != "" {
+		if unsubscribeSecret == "" {
+			log.Fatal("You must give -unsubscribe-secret with -unsubscribe-url")
+		}
+		secret, err := mailrail.LookupSecret(unsubscribeSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithUnsubscribeLinks(unsubscribeURL, secret))
+	}
+	if trackingSecret != "" {
+		secret, err := mailrail.LookupSecret(trackingSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithTracking(secret))
+	}
+	if sesSuppressions != "" {
+		if sesSuppressions != "lookup" && sesSuppressions != "preload" {
+			log.Fatalf("Unknown -ses-suppressions %q", sesSuppressions)
+		}
+		as, err := mailrail.NewAccountSuppressions(sesSuppressions == "preload")
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithAccountSuppressions(as))
+	}
+	if enrichURL != "" {
+		if enrichOnError != mailrail.EnrichSkip && enrichOnError != mailrail.EnrichStale {
+			log.Fatalf("Unknown -enrich-on-error %q", enrichOnError)
+		}
+		opts = append(opts, mailrail.WithEnricher(mailrail.NewHTTPEnricher(enrichURL), enrichTimeout, enrichOnError))
+	}
+	if idlePollMax != 0 || idlePollMin != time.Second {
+		opts = append(opts, mailrail.WithIdlePolling(idlePollMin, idlePollMax))
+	}
+	if lease > 0 {
+		opts = append(opts, mailrail.WithLeases(lease))
+	}
+	if workerID != "" {
+		opts = append(opts, mailrail.WithWorkerID(workerID))
+	}
+	if sharedRateLimit != "" {
+		limiter, err := mailrail.OpenSharedRateLimiter(sharedRateLimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithSharedRateLimiter(limiter))
+	}
+	if shardSize > 0 {
+		opts = append(opts, mailrail.WithSharding(shardSize))
+	}
+	if concurrency > 1 {
+		opts = append(opts, mailrail.WithConcurrency(concurrency))
+	}
+	if presetsFilename != "" {
+		presets, err := mailrail.LoadPresets(presetsFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithPresets(presets))
+	}
+	if templateDir != "" {
+		opts = append(opts, mailrail.WithTemplateDir(templateDir))
+	}
+	if recipientsDir != "" {
+		opts = append(opts, mailrail.WithRecipientsDir(recipientsDir))
+	}
+	if specWebhookHosts != "" {
+		var secrets []string
+		if specWebhookSecrets != "" {
+			secrets = strings.Split(specWebhookSecrets, ",")
+		}
+		opts = append(opts, mailrail.WithSpecWebhooks(strings.Split(specWebhookHosts, ","), secrets))
+	}
+	if archiveLocation != "" {
+		store, err := mailrail.OpenArchive(archiveLocation)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithArchive(store))
+	}
+	if historyFilename != "" {
+		history, err := mailrail.OpenSendHistoryFor(historyFilename, frequencyCapPeriod)
+		if err != nil {
+			log.Fatal(err)
+		}
+		max := frequencyCap
+		if max == 0 {
+			max = math.MaxInt32
+		}
+		opts = append(opts, mailrail.WithFrequencyCap(history, max, frequencyCapPeriod))
+	}
+	if listDir != "" {
+		lists, err := mailrail.OpenListStore(listDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, mailrail.WithListStore(lists))
+	}
+	if previewDir != "" {
+		opts = append(opts, mailrail.WithPreview(previewDir))
+	}
+	if checkContext {
+		opts = append(opts, mailrail.WithContextCheck(checkUnusedContext))
+	}
+	for name, value := range dataSources {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Data source %s is not of the form DRIVER:DSN", name)
+		}
+		dsn, err := mailrail.LookupSecret(parts[1])
+		if err != nil {
+			log.Fatalf("Failed to look up DSN of data source %s: %s", name, err)
+		}
+		db, err := sql.Open(parts[0], string(dsn))
+		if err != nil {
+			log.Fatalf("Failed to open data source %s: %s", name, err)
+		}
+		opts = append(opts, mailrail.WithDataSource(name, db))
+	}
+	if webhookURL != "" {
+		var secret []byte
+		if webhookSecret != "" {
+			secret, err = mailrail.LookupSecret(webhookSecret)
+			if err != nil {
+				log.Fatalf("Failed to look up webhook secret: %s", err)
+			}
+		}
+		webhook := mailrail.NewWebhook(webhookURL, secret, webhookDeadLetterFile)
+		opts = append(opts, mailrail.WithObserver(mailrail.NewLifecycleObserver(webhook, webhookEvery)))
+	}
+	if sqsQueueURL != "" {
+		store, err := mailrail.OpenArchive(sqsStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mailrail.ProcessJobStoreForever(mailrail.NewSQSQueue(sqsQueueURL, store), mangler, opts...)
+	} else if redisAddr != "" {
+		mailrail.ProcessJobStoreForever(mailrail.NewRedisQueue(redisAddr, redisPrefix), mangler, opts...)
+	} else {
+		mailrail.ProcessQueuesForever(queues, mangler, opts...)
+	}
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR\n", path.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "Usage: %s QUEUE-DIR...\n       %s -sqs QUEUE-URL -sqs-store LOCATION\n       %s -redis HOST:PORT\n",
+		path.Base(os.Args[0]), path.Base(os.Args[0]), path.Base(os.Args[0]))
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\nYou must set the AWS_DEFAULT_REGION environment variable\n(e.g., to `us-east-1`).\n")
 }
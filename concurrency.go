@@ -0,0 +1,93 @@
+package mailrail
+
+// Send to up to n recipients of a job at a time. The sends share the
+// job's token bucket, so they are still paced to the SES send rate.
+// Messages are rendered one at a time, and each recipient's result is
+// recorded and the checkpoint advanced past it in recipient order,
+// once the sends to the recipients before it are done, so that the
+// checkpoint never moves past a recipient that has not been sent to.
+// If the job fails at a recipient, the sends already under way to the
+// recipients after it are waited for and their results recorded, but
+// the checkpoint stays at the failed recipient, so resuming the job
+// sends to them again. By default, workers send to one recipient at a
+// time.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// A pipeline holds the recipients of a job that are being sent to,
+// in recipient order. done is closed when the send to a recipient is
+// done, or nil if there is nothing to wait for, and complete records
+// its result and advances past it, telling whether the job goes on.
+// If the job is stopping, complete only records what was sent.
+type pipeline struct {
+	size    int
+	pending []pendingRecipient
+}
+
+type pendingRecipient struct {
+	done     chan struct{}
+	complete func(stopping bool) bool
+}
+
+func newPipeline(size int) *pipeline {
+	if size < 1 {
+		size = 1
+	}
+	return &pipeline{size: size}
+}
+
+// add adds a recipient to the pipeline, completing the oldest one if
+// the pipeline is full.
+func (p *pipeline) add(done chan struct{}, complete func(stopping bool) bool) bool {
+	p.pending = append(p.pending, pendingRecipient{done, complete})
+	if len(p.pending) < p.size {
+		return true
+	}
+	return p.completeOldest()
+}
+
+func (p *pipeline) completeOldest() bool {
+	r := p.pending[0]
+	p.pending = p.pending[1:]
+	if r.done != nil {
+		<-r.done
+	}
+	return r.complete(false)
+}
+
+// drain completes all recipients in the pipeline.
+func (p *pipeline) drain() bool {
+	for len(p.pending) > 0 {
+		if !p.completeOldest() {
+			return false
+		}
+	}
+	return true
+}
+
+// abandon waits for the sends under way when the job stops and
+// records them without advancing past them.
+func (p *pipeline) abandon() {
+	pending := p.pending
+	p.pending = nil
+	for _, r := range pending {
+		if r.done != nil {
+			<-r.done
+		}
+		r.complete(true)
+	}
+}
+
+// wait waits for the sends under way and forgets them, for when the
+// job is no longer the worker's to record them in.
+func (p *pipeline) wait() {
+	for _, r := range p.pending {
+		if r.done != nil {
+			<-r.done
+		}
+	}
+	p.pending = nil
+}
@@ -0,0 +1,104 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An SES service that takes a while to send, and keeps track of how
+// many sends were under way at once.
+type SlowSES struct {
+	MockSES
+	failAddr    string
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (svc *SlowSES) SendEmail(input *ses.SendEmailInput) (*ses.SendEmailOutput, error) {
+	svc.mu.Lock()
+	svc.inFlight++
+	if svc.inFlight > svc.maxInFlight {
+		svc.maxInFlight = svc.inFlight
+	}
+	svc.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.inFlight--
+	if *input.Destination.ToAddresses[0] == svc.failAddr {
+		return nil, awserr.New("MessageRejected", "rejected", nil)
+	}
+	return svc.MockSES.SendEmail(input)
+}
+
+func submitRecipients(t *testing.T, s *MemoryStore, n int) string {
+	var recipients []string
+	for i := 0; i < n; i++ {
+		recipients = append(recipients, fmt.Sprintf(`{"addr": "r%d@example.com"}`, i))
+	}
+	name, err := s.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [` + strings.Join(recipients, ", ") + `]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	return name
+}
+
+func TestConcurrency(t *testing.T) {
+	s := NewMemoryStore()
+	name := submitRecipients(t, s, 8)
+	svc := SlowSES{}
+	ProcessJobStore(s, UseMockSesService(&svc), WithConcurrency(4))
+	if svc.nsent != 8 || s.State(name) != "done" {
+		t.Fatal("expected all recipients to be sent to:", svc.nsent, s.State(name))
+	}
+	if svc.maxInFlight < 2 || svc.maxInFlight > 4 {
+		t.Fatal("expected up to 4 sends at a time:", svc.maxInFlight)
+	}
+	job := &memoryJob{s, name}
+	if i, err := getCheckpoint(job); err != nil || i != 8 {
+		t.Fatal("expected the checkpoint to be recorded:", i, err)
+	}
+	results, err := getResults(job.Get, 8)
+	if err != nil || len(results) != 8 {
+		t.Fatal("expected a result per recipient:", results, err)
+	}
+	for i, r := range results {
+		if r.Recipient != i || r.Status != StatusSent {
+			t.Fatal("expected results in recipient order:", i, r)
+		}
+	}
+}
+
+func TestConcurrencyFailure(t *testing.T) {
+	s := NewMemoryStore()
+	name := submitRecipients(t, s, 8)
+	svc := SlowSES{failAddr: "r2@example.com"}
+	ProcessJobStore(s, UseMockSesService(&svc), WithConcurrency(4))
+	if s.State(name) != "failed" {
+		t.Fatal("expected the job to fail:", s.State(name))
+	}
+	job := &memoryJob{s, name}
+	if i, err := getCheckpoint(job); err != nil || i != 2 {
+		t.Fatal("expected the checkpoint to stay at the failed recipient:", i, err)
+	}
+	results, err := getResults(job.Get, 8)
+	if err != nil {
+		t.Fatal("getResults", err)
+	}
+	sent := 0
+	for _, r := range results {
+		if r.Status == StatusSent {
+			sent++
+		}
+	}
+	if sent != svc.nsent || results[2].Status != StatusFailed {
+		t.Fatal("expected the sends under way to be recorded:", svc.nsent, results)
+	}
+}
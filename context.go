@@ -0,0 +1,144 @@
+package mailrail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// context returns the context that the templates of recipient i are
+// rendered with: the spec's context, for values that are the same for
+// every recipient, such as the company name or a support URL, with
+// the recipient's own context on top of it.
+func (mailing *mailing) context(i int) map[string]interface{} {
+	return mergeContext(mailing.spec.Context, mailing.recipient(i).Context)
+}
+
+func mergeContext(defaults, context map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return context
+	}
+	merged := make(map[string]interface{}, len(defaults)+len(context))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range context {
+		merged[k] = v
+	}
+	return merged
+}
+
+// contextString returns a value of a context as a string, or "" if
+// the context lacks it. Values that are not strings are formatted as
+// templates would print them.
+func contextString(context map[string]interface{}, key string) string {
+	v, ok := context[key]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// unmarshalJSON is json.Unmarshal for specs and recipients. Numbers in
+// contexts that are integers become int64 rather than float64, so
+// that templates print integers such as order IDs as they were written
+// rather than as floats. Other numbers become float64, as they would
+// with json.Unmarshal.
+func unmarshalJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	convertNumbers(reflect.ValueOf(v))
+	return nil
+}
+
+// convertNumbers replaces the json.Numbers that a decoder that uses
+// numbers left in the interface{} values of v by int64s or float64s,
+// which templates compare and test as numbers: a json.Number is a
+// string, so {{if .count}} would be true for 0.
+func convertNumbers(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			convertNumbers(v.Elem())
+		}
+	case reflect.Interface:
+		if !v.IsNil() && v.CanSet() {
+			v.Set(reflect.ValueOf(convertNumber(v.Interface())))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				convertNumbers(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if !hasInterfaces(v.Type().Elem()) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			convertNumbers(v.Index(i))
+		}
+	case reflect.Map:
+		if !hasInterfaces(v.Type().Elem()) {
+			return
+		}
+		for _, key := range v.MapKeys() {
+			// Map elements cannot be set in place.
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			convertNumbers(elem)
+			v.SetMapIndex(key, elem)
+		}
+	}
+}
+
+// hasInterfaces tells whether values of a type can hold interface{}
+// values.
+func hasInterfaces(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return hasInterfaces(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && hasInterfaces(f.Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// convertNumber returns a value decoded into an interface{} with its
+// json.Numbers converted.
+func convertNumber(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = convertNumber(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertNumber(e)
+		}
+	}
+	return v
+}
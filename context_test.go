@@ -0,0 +1,108 @@
+package mailrail
+
+import (
+	"testing"
+)
+
+func TestSpecContext(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "{{.greeting}}, {{.name}} from {{.company}}",
+"context": {"company": "ACME", "greeting": "Hello"},
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}},
+{"addr": "b@example.com", "context": {"name": "B", "greeting": "Hi"}}]}`)
+	preview, err := NewPreview(spec, WithContextCheck(false))
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	var texts []string
+	for i := 0; i < preview.Len(); i++ {
+		msg, err := preview.Render(i)
+		if err != nil {
+			t.Fatal("Render", err)
+		}
+		texts = append(texts, msg.Text)
+	}
+	if len(texts) != 2 || texts[0] != "Hello, A from ACME" || texts[1] != "Hi, B from ACME" {
+		t.Fatal("expected the spec's context under the recipients':", texts)
+	}
+	if err := preview.mailing.checkContexts(preview.Len()); err != nil {
+		t.Fatal("expected the spec's context to count for the context check:", err)
+	}
+	if _, ok := preview.mailing.spec.Recipients[0].Context["company"]; ok {
+		t.Fatal("expected the recipient's own context to be left alone:", preview.mailing.spec.Recipients[0].Context)
+	}
+}
+
+func TestJSONContext(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Your order",
+"text": "{{range .items}}{{.qty}} x {{.sku}} {{currency \"USD\" .price}}\n{{end}}{{.customer.name}}{{if .vip}} (VIP){{end}}",
+"recipients": [{"addr": "a@example.com", "context": {
+  "items": [{"sku": "ab12", "qty": 2, "price": 9.5}, {"sku": "cd34", "qty": 1, "price": 1200}],
+  "customer": {"name": "Jane"}, "vip": true}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	msg, err := preview.Render(0)
+	if err != nil {
+		t.Fatal("Render", err)
+	}
+	if msg.Text != "2 x ab12 $9.50\n1 x cd34 $1,200.00\nJane (VIP)" {
+		t.Fatal("unexpected text:", msg.Text)
+	}
+	if s := contextString(map[string]interface{}{"n": 3.0}, "n"); s != "3" {
+		t.Fatal("unexpected string of a number:", s)
+	}
+}
+
+func TestLargeIntegerContext(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Order {{.order_id}}",
+"text": "Order {{.order_id}}: {{.count}} items",
+"recipients": [{"addr": "a@example.com", "context": {"order_id": 12345678, "count": 3}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	msg, err := preview.Render(0)
+	if err != nil {
+		t.Fatal("Render", err)
+	}
+	if msg.Subject != "Order 12345678" || msg.Text != "Order 12345678: 3 items" {
+		t.Fatal("expected integers to render as written:", msg.Subject, msg.Text)
+	}
+	recipients, err := ReadRecipientsNDJSON([]byte(`{"addr": "a@example.com", "context": {"order_id": 12345678}}`))
+	if err != nil {
+		t.Fatal("ReadRecipientsNDJSON", err)
+	}
+	if s := contextString(recipients[0].Context, "order_id"); s != "12345678" {
+		t.Fatal("expected NDJSON integers to be kept as written:", s)
+	}
+}
+
+func TestNumericContext(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "{{if .count}}{{.count}} new{{else}}nothing new{{end}}{{if gt .score 1.5}} at {{.score}}{{end}}",
+"recipients": [{"addr": "a@example.com", "context": {"count": 0, "score": 2.5}},
+  {"addr": "b@example.com", "context": {"count": 3, "score": 0.5}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	for i, expected := range []string{"nothing new at 2.5", "3 new"} {
+		msg, err := preview.Render(i)
+		if err != nil {
+			t.Fatal("Render", err)
+		}
+		if msg.Text != expected {
+			t.Fatal("expected numbers to be tested and compared as numbers:", msg.Text)
+		}
+	}
+	var recipient Recipient
+	if err := unmarshalJSON([]byte(`{"addr": "a@example.com", "context": {"n": 7, "x": 0.5, "l": [1, {"m": 2e3}]}}`), &recipient); err != nil {
+		t.Fatal("unmarshalJSON", err)
+	}
+	c := recipient.Context
+	if c["n"] != int64(7) || c["x"] != 0.5 || c["l"].([]interface{})[0] != int64(1) || c["l"].([]interface{})[1].(map[string]interface{})["m"] != float64(2000) {
+		t.Fatal("expected integers as int64 and other numbers as float64:", c)
+	}
+}
@@ -0,0 +1,88 @@
+package mailrail
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// A worker can check in the dry run that the contexts of the
+// recipients have the keys that the templates refer to, so that
+// messages are not sent with "<no value>" where a missing key was
+// rendered. A job with recipients that lack keys fails, naming them
+// by index. Keys that templates refer to only in `if` blocks are
+// checked too, so specs that leave keys out on purpose should give
+// them empty values instead. Keys that enrichment adds at send time
+// are not known to the dry run.
+type contextCheck struct {
+	unused bool
+}
+
+// The most recipient indices listed for each missing key.
+const maxListedRecipients = 10
+
+// Fail jobs whose recipients lack context keys that the templates
+// refer to. If unused is true, also log the context keys that no
+// template refers to.
+func WithContextCheck(unused bool) Option {
+	return func(o *options) {
+		o.contextCheck = &contextCheck{unused: unused}
+	}
+}
+
+// checkContexts checks the contexts of the first n recipients.
+func (mailing *mailing) checkContexts(n int) error {
+	vars, err := TemplateVariables(mailing.spec)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, v := range vars {
+		used[v] = true
+	}
+	missing := make(map[string][]int)
+	unused := make(map[string]int)
+	for i := 0; i < n; i++ {
+		context := mailing.context(i)
+		for _, v := range vars {
+			if _, ok := context[v]; !ok {
+				missing[v] = append(missing[v], i)
+			}
+		}
+		for k := range context {
+			if !used[k] {
+				unused[k]++
+			}
+		}
+	}
+	if mailing.opts.contextCheck.unused && len(unused) > 0 {
+		keys := make([]string, 0, len(unused))
+		for k, count := range unused {
+			keys = append(keys, fmt.Sprintf("%s (%d recipients)", k, count))
+		}
+		sort.Strings(keys)
+		log.Printf("Job %s has context keys that no template refers to: %s", mailing.basename, strings.Join(keys, ", "))
+	}
+	var problems []string
+	for _, v := range vars {
+		if indices := missing[v]; len(indices) > 0 {
+			problems = append(problems, fmt.Sprintf("%d recipients lack %q (%s)", len(indices), v, listIndices(indices)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Templates refer to missing context keys: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func listIndices(indices []int) string {
+	listed := make([]string, 0, maxListedRecipients)
+	for _, i := range indices {
+		if len(listed) == maxListedRecipients {
+			return strings.Join(listed, ", ") + fmt.Sprintf(", and %d more", len(indices)-maxListedRecipients)
+		}
+		listed = append(listed, fmt.Sprint(i))
+	}
+	return strings.Join(listed, ", ")
+}
@@ -0,0 +1,38 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContextCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_contextcheck_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A", "pet": "Rex"}}, {"addr": "b@example.com"},
+{"addr": "c@example.com", "context": {"nmae": "C"}}]}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithContextCheck(true))
+	if svc.nsent != 0 {
+		t.Fatal("expected the job to fail before sending:", svc.nsent)
+	}
+	report, err := GetFailureReport(dir, j.Basename)
+	if err != nil || report == nil || !strings.Contains(report.Reason, `2 recipients lack "name" (1, 2)`) {
+		t.Fatal("expected the recipients that lack the key to be named:", report, err)
+	}
+	if s := listIndices([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}); s != "0, 1, 2, 3, 4, 5, 6, 7, 8, 9, and 2 more" {
+		t.Fatal("unexpected list of indices:", s)
+	}
+}
@@ -0,0 +1,92 @@
+package mailrail
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ReadRecipientsCSV reads recipients from CSV, such as a list exported
+// from a CRM. The first row is a header naming the columns. Columns
+// named addr, name, from_name, from_addr, subject, stream, variant, and
+// send_at (an RFC 3339 time) fill in those fields of the recipients,
+// and the other columns go into their contexts under their names.
+// columns renames columns before that, for instance from "Email" to
+// "addr"; columns renamed to "" are left out. Rows with no addr are an
+// error.
+func ReadRecipientsCSV(r io.Reader, columns map[string]string) ([]Recipient, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read header: %s", err)
+	}
+	names := make([]string, len(header))
+	hasAddr := false
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if renamed, ok := columns[name]; ok {
+			name = renamed
+		}
+		names[i] = name
+		if name == "addr" {
+			hasAddr = true
+		}
+	}
+	if !hasAddr {
+		return nil, fmt.Errorf("No addr column")
+	}
+	var recipients []Recipient
+	for row := 2; ; row++ {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return recipients, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var recipient Recipient
+		for i, value := range values {
+			if i >= len(names) || names[i] == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			switch names[i] {
+			case "addr":
+				recipient.Addr = value
+			case "name":
+				recipient.Name = value
+			case "from_name":
+				recipient.FromName = value
+			case "from_addr":
+				recipient.FromAddr = value
+			case "subject":
+				recipient.Subject = value
+			case "stream":
+				recipient.Stream = value
+			case "variant":
+				recipient.Variant = value
+			case "send_at":
+				if value == "" {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return nil, fmt.Errorf("Row %d: Cannot parse send_at %q", row, value)
+				}
+				recipient.SendAt = &t
+			default:
+				if recipient.Context == nil {
+					recipient.Context = make(map[string]interface{})
+				}
+				recipient.Context[names[i]] = value
+			}
+		}
+		if recipient.Addr == "" {
+			return nil, fmt.Errorf("Row %d: No addr", row)
+		}
+		recipients = append(recipients, recipient)
+	}
+}
@@ -0,0 +1,41 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReadRecipientsCSV(t *testing.T) {
+	csv := `Email,Name,first, Notes
+a@example.com,Alice A,Alice,vip
+b@example.com ,Bob B,Bob,
+`
+	recipients, err := ReadRecipientsCSV(strings.NewReader(csv), map[string]string{"Email": "addr", "Name": "name", "Notes": ""})
+	if err != nil {
+		t.Fatal("ReadRecipientsCSV", err)
+	}
+	if len(recipients) != 2 {
+		t.Fatal("expected 2 recipients:", recipients)
+	}
+	if r := recipients[1]; r.Addr != "b@example.com" || r.Name != "Bob B" || r.Context["first"] != "Bob" || len(r.Context) != 1 {
+		t.Fatal("unexpected recipient:", r)
+	}
+	if _, err := ReadRecipientsCSV(strings.NewReader(csv), nil); err == nil {
+		t.Fatal("expected an error without an addr column")
+	}
+	if _, err := ReadRecipientsCSV(strings.NewReader("addr,first\n,Carol\n"), nil); err == nil {
+		t.Fatal("expected an error for a row without an addr")
+	}
+	spec, err := SpecWithRecipients([]byte(`{"subject": "Hello, {{.first}}", "list": "customers"}`), recipients)
+	if err != nil {
+		t.Fatal("SpecWithRecipients", err)
+	}
+	var s Spec
+	if err := json.Unmarshal(spec, &s); err != nil {
+		t.Fatal("cannot parse spec", err)
+	}
+	if s.Subject != "Hello, {{.first}}" || s.List != "" || len(s.Recipients) != 2 || s.Recipients[0].Context["first"] != "Alice" {
+		t.Fatal("unexpected spec:", string(spec))
+	}
+}
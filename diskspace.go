@@ -0,0 +1,40 @@
+package mailrail
+
+import "fmt"
+
+// Rough upper bounds on what a job writes to the queue volume: per
+// recipient, its result and its share of the ledgers, reports, and
+// archives; and the free space and inodes to leave for everything
+// else.
+const (
+	diskBytesPerRecipient = 2048
+	diskReserveBytes      = 64 << 20
+	diskReserveInodes     = 1024
+)
+
+// diskFree returns the bytes and inodes free in the file system of a
+// directory, with ok false if it cannot tell. Inodes is zero if the
+// file system does not limit them. Tests replace it.
+var diskFree = statfsFree
+
+// checkDiskSpace returns an error if the queue volume is unlikely to
+// have room for what a job writes while sending to its remaining
+// recipients.
+func checkDiskSpace(queueDir string, remaining int) error {
+	if queueDir == "" {
+		return nil
+	}
+	bytes, inodes, ok := diskFree(queueDir)
+	if !ok {
+		return nil
+	}
+	needBytes := uint64(remaining)*diskBytesPerRecipient + diskReserveBytes
+	if bytes < needBytes {
+		return fmt.Errorf("Not enough disk space for %d recipients: %d MB free in %s, need %d MB", remaining, bytes>>20, queueDir, needBytes>>20)
+	}
+	needInodes := uint64(remaining/resultsPerChunk) + diskReserveInodes
+	if inodes != 0 && inodes < needInodes {
+		return fmt.Errorf("Not enough inodes for %d recipients: %d free in %s, need %d", remaining, inodes, queueDir, needInodes)
+	}
+	return nil
+}
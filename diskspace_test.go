@@ -0,0 +1,56 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiskSpacePreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_diskspace_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { diskFree = statfsFree }()
+	var free uint64 = diskReserveBytes + 2*diskBytesPerRecipient
+	diskFree = func(string) (uint64, uint64, bool) { return free, 0, true }
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if s, _ := GetJobStatus(dir, j.Basename); svc.nsent != 0 || s.State != "paused" {
+		t.Fatal("expected the job to be paused before sending:", svc.nsent, s.State)
+	}
+	report, err := GetFailureReport(dir, j.Basename)
+	if err != nil || report == nil || !strings.HasPrefix(report.Reason, "Not enough disk space for 3 recipients") {
+		t.Fatal("unexpected failure report:", report, err)
+	}
+
+	free = diskReserveBytes + 3*diskBytesPerRecipient
+	if err := Resume(dir, j.Basename); err != nil {
+		t.Fatal("Resume", err)
+	}
+	Process(dir, UseMockSesService(&svc))
+	if s, _ := GetJobStatus(dir, j.Basename); svc.nsent != 3 || s.State != "done" {
+		t.Fatal("expected the resumed job to be sent:", svc.nsent, s.State)
+	}
+	if report, err := GetFailureReport(dir, j.Basename); err != nil || report != nil {
+		t.Fatal("expected no failure report after resuming:", report, err)
+	}
+
+	if bytes, _, ok := statfsFree(dir); !ok || bytes == 0 {
+		t.Fatal("statfsFree", bytes, ok)
+	}
+}
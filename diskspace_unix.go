@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package mailrail
+
+import "syscall"
+
+func statfsFree(dir string) (bytes, inodes uint64, ok bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, false
+	}
+	if st.Files != 0 {
+		inodes = uint64(st.Ffree)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), inodes, true
+}
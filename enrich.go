@@ -0,0 +1,133 @@
+package mailrail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// An Enricher fetches last-minute data for a recipient right before
+// its message is rendered, such as a live account balance. The data is
+// merged into the recipient's context, replacing fields with the same
+// names. Enrich should give up when ctx is done.
+type Enricher interface {
+	Enrich(ctx context.Context, job string, recipient Recipient) (map[string]interface{}, error)
+}
+
+// EnricherFunc lets an ordinary function be an Enricher.
+type EnricherFunc func(ctx context.Context, job string, recipient Recipient) (map[string]interface{}, error)
+
+func (f EnricherFunc) Enrich(ctx context.Context, job string, recipient Recipient) (map[string]interface{}, error) {
+	return f(ctx, job, recipient)
+}
+
+// What to do with a recipient whose enrichment fails or times out:
+// skip the recipient, or send with the data the spec has.
+const (
+	EnrichSkip  = "skip"
+	EnrichStale = "stale"
+)
+
+type enrichment struct {
+	enricher Enricher
+	timeout  time.Duration
+	onError  string
+}
+
+// Enrich each recipient with an enricher just before sending, giving
+// up after timeout, if it is not zero. If enrichment fails, onError
+// (`EnrichSkip` or `EnrichStale`) says whether to skip the recipient
+// or send anyway.
+func WithEnricher(enricher Enricher, timeout time.Duration, onError string) Option {
+	return func(o *options) {
+		o.enrichment = &enrichment{enricher, timeout, onError}
+	}
+}
+
+// enrich merges the data of the enricher, if any, into the context of
+// recipient i. It returns an error only if the recipient must be
+// skipped.
+func (mailing *mailing) enrich(ctx context.Context, job string, i int) error {
+	e := mailing.opts.enrichment
+	if e == nil {
+		return nil
+	}
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	recipient := *mailing.recipient(i)
+	type enriched struct {
+		data map[string]interface{}
+		err  error
+	}
+	// Buffered, so that an enricher that ignores ctx does not leak.
+	done := make(chan enriched, 1)
+	go func() {
+		data, err := e.enricher.Enrich(ctx, job, recipient)
+		done <- enriched{data, err}
+	}()
+	var result enriched
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result.err = ctx.Err()
+	}
+	if result.err != nil {
+		if e.onError == EnrichStale {
+			log.Printf("Job %s sending recipient %d without enrichment: %s", job, i, result.err)
+			return nil
+		}
+		return fmt.Errorf("Enrichment failed: %s", result.err)
+	}
+	mailing.recipient(i).Context = mergeContext(recipient.Context, result.data)
+	return nil
+}
+
+// HTTPEnricher enriches recipients by POSTing the job and recipient to
+// a URL as JSON, {"job": JOB, "recipient": RECIPIENT}, and merging the
+// JSON object it responds with.
+type HTTPEnricher struct {
+	URL    string
+	Client *http.Client
+}
+
+// Returns an enricher that calls the given URL.
+func NewHTTPEnricher(url string) *HTTPEnricher {
+	return &HTTPEnricher{URL: url, Client: http.DefaultClient}
+}
+
+func (h *HTTPEnricher) Enrich(ctx context.Context, job string, recipient Recipient) (map[string]interface{}, error) {
+	body, err := json.Marshal(map[string]interface{}{"job": job, "recipient": recipient})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Enrichment service returned %s", resp.Status)
+	}
+	var data map[string]interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("Cannot parse enrichment: %s", err)
+	}
+	convertNumbers(reflect.ValueOf(data))
+	return data, nil
+}
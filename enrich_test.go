@@ -0,0 +1,86 @@
+package mailrail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnricher(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_enrich_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	enricher := EnricherFunc(func(ctx context.Context, job string, recipient Recipient) (map[string]interface{}, error) {
+		switch recipient.Addr {
+		case "broken@example.com":
+			return nil, errors.New("no such account")
+		case "slow@example.com":
+			time.Sleep(200 * time.Millisecond)
+		}
+		return map[string]interface{}{"balance": "$42"}, nil
+	})
+	submit := func() string {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "{{.name}}: {{.balance}}",
+"recipients": [
+  {"addr": "a@example.com", "context": {"name": "A", "balance": "stale"}},
+  {"addr": "broken@example.com", "context": {"name": "B", "balance": "stale"}},
+  {"addr": "slow@example.com", "context": {"name": "C", "balance": "stale"}}]}`))
+		j.Submit()
+		return j.Basename
+	}
+
+	skipped := submit()
+	var svc MockSES
+	Process(dir, UseMockSesService(&svc), WithEnricher(enricher, 50*time.Millisecond, EnrichSkip))
+	results, err := GetResults(dir, skipped)
+	if err != nil || len(results) != 3 {
+		t.Fatal("GetResults", results, err)
+	}
+	if results[0].Status != StatusSent || results[1].Status != StatusSkipped || results[2].Status != StatusSkipped {
+		t.Fatal("unexpected results:", results)
+	}
+	if svc.nsent != 1 || *svc.sent.Message.Body.Text.Data != "A: $42" {
+		t.Fatal("unexpected message:", *svc.sent.Message.Body.Text.Data)
+	}
+
+	submit()
+	svc = MockSES{}
+	Process(dir, UseMockSesService(&svc), WithEnricher(enricher, 50*time.Millisecond, EnrichStale))
+	if svc.nsent != 3 || *svc.sent.Message.Body.Text.Data != "C: stale" {
+		t.Fatal("expected stale data to be sent:", svc.nsent, *svc.sent.Message.Body.Text.Data)
+	}
+}
+
+func TestHTTPEnricher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Job       string    `json:"job"`
+			Recipient Recipient `json:"recipient"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]string{"greeting": "Hi " + req.Recipient.Name + " from " + req.Job})
+	}))
+	defer server.Close()
+	data, err := NewHTTPEnricher(server.URL).Enrich(context.Background(), "foo", Recipient{Name: "John"})
+	if err != nil || data["greeting"] != "Hi John from foo" {
+		t.Fatal("unexpected enrichment:", data, err)
+	}
+}
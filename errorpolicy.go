@@ -0,0 +1,65 @@
+package mailrail
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// An ErrorPolicy says what a job does when sending to a recipient
+// fails for a reason other than throttling. The message is first
+// retried up to Retries times. If it still fails, the recipient's
+// result is recorded as failed, and the job either fails or, if Skip
+// is set, continues with the next recipient.
+type ErrorPolicy struct {
+	Retries int
+	Skip    bool
+}
+
+// The default policy: the job fails at the first error.
+var FailJob = ErrorPolicy{}
+
+// Record the error and continue with the next recipient.
+var SkipRecipient = ErrorPolicy{Skip: true}
+
+var retryThenSkipRegexp = regexp.MustCompile(`^retry-(\d+)-then-skip$`)
+
+// ParseErrorPolicy parses "fail-job", "skip-recipient", or
+// "retry-N-then-skip".
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch s {
+	case "fail-job":
+		return FailJob, nil
+	case "skip-recipient":
+		return SkipRecipient, nil
+	}
+	if m := retryThenSkipRegexp.FindStringSubmatch(s); m != nil {
+		retries, err := strconv.Atoi(m[1])
+		if err != nil {
+			return ErrorPolicy{}, fmt.Errorf("Invalid error policy %q: %s", s, err)
+		}
+		return ErrorPolicy{Retries: retries, Skip: true}, nil
+	}
+	return ErrorPolicy{}, fmt.Errorf("Invalid error policy %q", s)
+}
+
+func (p ErrorPolicy) String() string {
+	switch {
+	case !p.Skip && p.Retries == 0:
+		return "fail-job"
+	case p.Skip && p.Retries == 0:
+		return "skip-recipient"
+	case p.Skip:
+		return fmt.Sprintf("retry-%d-then-skip", p.Retries)
+	default:
+		return fmt.Sprintf("retry-%d-then-fail", p.Retries)
+	}
+}
+
+// Handle errors sending to a recipient according to a policy. Specs
+// can override it with their `error_policy` field.
+func WithErrorPolicy(policy ErrorPolicy) Option {
+	return func(o *options) {
+		o.errorPolicy = policy
+	}
+}
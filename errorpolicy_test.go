@@ -0,0 +1,72 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseErrorPolicy(t *testing.T) {
+	for _, s := range []string{"fail-job", "skip-recipient", "retry-3-then-skip"} {
+		p, err := ParseErrorPolicy(s)
+		if err != nil {
+			t.Fatal("ParseErrorPolicy", s, err)
+		}
+		if p.String() != s {
+			t.Fatal("unexpected round trip:", s, p.String())
+		}
+	}
+	if _, err := ParseErrorPolicy("retry-forever"); err == nil {
+		t.Fatal("expected error for invalid policy")
+	}
+}
+
+func runWithErrorPolicy(t *testing.T, policy string, svc sesService) (string, []Result) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_errorpolicy_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"error_policy": "`+policy+`",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(svc))
+	state := "done"
+	if _, err := os.Stat(path.Join(dir, "failed", j.Basename)); err == nil {
+		state = "failed"
+	}
+	results, err := GetResults(dir, j.Basename)
+	if err != nil {
+		t.Fatal("GetResults", err)
+	}
+	return state, results
+}
+
+func TestErrorPolicy(t *testing.T) {
+	state, results := runWithErrorPolicy(t, "fail-job", &FlakySES{failAddr: "b@example.com"})
+	if state != "failed" || len(results) != 2 {
+		t.Fatal("expected the job to fail at the second recipient:", state, results)
+	}
+	svc := &FlakySES{failAddr: "b@example.com"}
+	state, results = runWithErrorPolicy(t, "skip-recipient", svc)
+	if state != "done" || len(results) != 3 || results[1].Status != StatusFailed || results[2].Status != StatusSent {
+		t.Fatal("expected the job to skip the second recipient:", state, results)
+	}
+	svc = &FlakySES{failAddr: "b@example.com"}
+	state, results = runWithErrorPolicy(t, "retry-2-then-skip", svc)
+	if state != "done" || results[1].Status != StatusFailed || svc.attempts != 3 {
+		t.Fatal("expected 3 attempts before skipping:", state, results, svc.attempts)
+	}
+}
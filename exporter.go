@@ -0,0 +1,197 @@
+package mailrail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A QueueExporter serves metrics about queue directories in the
+// Prometheus text format: the number of jobs in each state, the
+// backlog of unsent recipients and the rate it is being sent at, the
+// number of jobs at risk of missing their SLA, and the number of
+// recipients of all jobs by the status of their latest result. It
+// only reads the queues, so it can run next to workers it cannot
+// change. The results of done jobs are read once and remembered.
+type QueueExporter struct {
+	QueueDirs []string
+	mu        sync.Mutex
+	done      map[string]map[string]int
+}
+
+// Returns an exporter for some queue directories.
+func NewQueueExporter(queueDirs []string) *QueueExporter {
+	return &QueueExporter{QueueDirs: queueDirs, done: make(map[string]map[string]int)}
+}
+
+func (e *QueueExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := e.WriteMetrics(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+type queueMetrics struct {
+	up         bool
+	jobs       map[string]int
+	backlog    int
+	rate       float64
+	atRisk     int
+	recipients map[string]int
+}
+
+// WriteMetrics writes the metrics of all the queues. A queue that
+// cannot be read has mailrail_queue_up 0 and no other metrics.
+func (e *QueueExporter) WriteMetrics(w io.Writer) error {
+	metrics := make([]queueMetrics, len(e.QueueDirs))
+	for k, queueDir := range e.QueueDirs {
+		m, err := e.queueMetrics(queueDir)
+		if err != nil {
+			log.Printf("Cannot read queue %s: %s", queueDir, err)
+		}
+		metrics[k] = m
+	}
+	p := &promWriter{w: w}
+	p.family("mailrail_queue_up", "gauge", "Whether the queue could be read.")
+	for k, m := range metrics {
+		up := 0
+		if m.up {
+			up = 1
+		}
+		p.sample("mailrail_queue_up", float64(up), "queue", e.QueueDirs[k])
+	}
+	p.family("mailrail_jobs", "gauge", "Jobs by state.")
+	for k, m := range metrics {
+		for _, state := range sortedKeys(m.jobs) {
+			p.sample("mailrail_jobs", float64(m.jobs[state]), "queue", e.QueueDirs[k], "state", state)
+		}
+	}
+	p.family("mailrail_backlog_recipients", "gauge", "Recipients of queued and in-progress jobs not sent yet.")
+	for k, m := range metrics {
+		if m.up {
+			p.sample("mailrail_backlog_recipients", float64(m.backlog), "queue", e.QueueDirs[k])
+		}
+	}
+	p.family("mailrail_send_rate", "gauge", "Messages per second being sent by in-progress jobs.")
+	for k, m := range metrics {
+		if m.up {
+			p.sample("mailrail_send_rate", m.rate, "queue", e.QueueDirs[k])
+		}
+	}
+	p.family("mailrail_jobs_at_risk", "gauge", "In-progress jobs predicted to miss their SLA.")
+	for k, m := range metrics {
+		if m.up {
+			p.sample("mailrail_jobs_at_risk", float64(m.atRisk), "queue", e.QueueDirs[k])
+		}
+	}
+	p.family("mailrail_recipients", "gauge", "Recipients of all jobs by the status of their latest result.")
+	for k, m := range metrics {
+		for _, status := range sortedKeys(m.recipients) {
+			p.sample("mailrail_recipients", float64(m.recipients[status]), "queue", e.QueueDirs[k], "status", status)
+		}
+	}
+	return p.err
+}
+
+func (e *QueueExporter) queueMetrics(queueDir string) (queueMetrics, error) {
+	statuses, err := QueueStatus(queueDir)
+	if err != nil {
+		return queueMetrics{}, err
+	}
+	m := queueMetrics{up: true, jobs: make(map[string]int), recipients: make(map[string]int)}
+	for _, state := range jobStates {
+		m.jobs[stateNames[state]] = 0
+	}
+	for _, status := range statuses {
+		m.jobs[status.State]++
+		if status.State == stateNames["queue"] || status.State == stateNames["cur"] {
+			m.backlog += status.Recipients - status.Sent
+			m.rate += status.Rate
+		}
+		if status.AtRisk() {
+			m.atRisk++
+		}
+		counts, err := e.recipientCounts(queueDir, status)
+		if err != nil {
+			// The worker may have moved the job.
+			continue
+		}
+		for s, n := range counts {
+			m.recipients[s] += n
+		}
+	}
+	return m, nil
+}
+
+// recipientCounts returns the number of recipients of a job by the
+// status of their latest result.
+func (e *QueueExporter) recipientCounts(queueDir string, status JobStatus) (map[string]int, error) {
+	key := queueDir + "\x00" + status.Job
+	if status.State == stateNames["done"] {
+		e.mu.Lock()
+		counts, ok := e.done[key]
+		e.mu.Unlock()
+		if ok {
+			return counts, nil
+		}
+	}
+	report, err := JobReport(queueDir, status.Job)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, r := range report {
+		counts[r.Status]++
+	}
+	if status.State == stateNames["done"] {
+		e.mu.Lock()
+		e.done[key] = counts
+		e.mu.Unlock()
+	}
+	return counts, nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// promWriter writes the Prometheus text format, remembering the first
+// error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) family(name, kind, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample with labels given as name, value, ...
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	var pairs []string
+	for k := 0; k+1 < len(labels); k += 2 {
+		pairs = append(pairs, labels[k]+`="`+promEscaper.Replace(labels[k+1])+`"`)
+	}
+	p.printf("%s{%s} %g\n", name, strings.Join(pairs, ","), value)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,56 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestQueueExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_exporter_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	submit := func() {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]}`))
+		j.Submit()
+	}
+	submit()
+	Process(dir, UseMockSesService(&FlakySES{failAddr: "b@example.com"}), WithErrorPolicy(SkipRecipient))
+	submit()
+	exporter := NewQueueExporter([]string{dir, dir + "/nosuchqueue"})
+	for scrape := 0; scrape < 2; scrape++ {
+		rec := httptest.NewRecorder()
+		exporter.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		metrics := rec.Body.String()
+		for _, line := range []string{
+			`mailrail_queue_up{queue="` + dir + `"} 1`,
+			`mailrail_queue_up{queue="` + dir + `/nosuchqueue"} 0`,
+			`mailrail_jobs{queue="` + dir + `",state="done"} 1`,
+			`mailrail_jobs{queue="` + dir + `",state="queued"} 1`,
+			`mailrail_jobs{queue="` + dir + `",state="failed"} 0`,
+			`mailrail_backlog_recipients{queue="` + dir + `"} 3`,
+			`mailrail_recipients{queue="` + dir + `",status="sent"} 2`,
+			`mailrail_recipients{queue="` + dir + `",status="failed"} 1`,
+			`mailrail_recipients{queue="` + dir + `",status="pending"} 3`,
+			"# TYPE mailrail_jobs gauge",
+		} {
+			if !strings.Contains(metrics, line+"\n") {
+				t.Fatal("missing", line, "in", metrics)
+			}
+		}
+	}
+}
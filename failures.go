@@ -0,0 +1,121 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"os"
+	"time"
+)
+
+const failureReportKey = "failure_report"
+
+// A FailureReport is written into a job when it fails or finishes
+// with recipients that were not sent, so that operators do not have
+// to piece failures together from the worker's logs. Recipient is the
+// index of the recipient the job failed at, or -1 if it failed
+// before or between recipients or did not fail. Unsent holds the
+// results of the recipients that failed or were skipped by a policy
+// without failing the job. The report of a job with an encrypted spec
+// is encrypted under the same KMS key.
+type FailureReport struct {
+	Failed    bool      `json:"failed"`
+	Reason    string    `json:"reason"`
+	Recipient int       `json:"recipient"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+	Unsent    []Result  `json:"unsent,omitempty"`
+}
+
+// writeFailureReport writes the failure report of a job that failed
+// with err at a recipient, or, if err is nil, of a job that finished.
+// Finished jobs only get a report if they have unsent recipients.
+func writeFailureReport(job Job, err error, recipient int) error {
+	unsent, rerr := getUnsent(job.Get)
+	if rerr != nil {
+		return rerr
+	}
+	report := FailureReport{Failed: err != nil, Recipient: recipient, Time: time.Now(), Unsent: unsent}
+	if err == nil {
+		if len(unsent) == 0 {
+			return nil
+		}
+		report.Reason = fmt.Sprintf("Finished with %d recipients not sent", len(unsent))
+	} else {
+		report.Reason = err.Error()
+		if awsErr, ok := err.(awserr.Error); ok {
+			report.ErrorCode = awsErr.Code()
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			report.RequestId = reqErr.RequestID()
+		}
+	}
+	reportBytes, merr := json.Marshal(report)
+	if merr != nil {
+		return merr
+	}
+	specBytes, serr := job.Get("spec")
+	if serr != nil {
+		return serr
+	}
+	if reportBytes, merr = encryptLike(specBytes, reportBytes); merr != nil {
+		return merr
+	}
+	return job.Set(failureReportKey, reportBytes)
+}
+
+// getUnsent returns the latest results that are failures or
+// skips with a reason. Messages skipped because the worker was told
+// not to send have no reason.
+func getUnsent(get func(string) ([]byte, error)) ([]Result, error) {
+	latest := make(map[int]Result)
+	var order []int
+	for chunk := 0; ; chunk++ {
+		rs, err := getResultsChunk(get, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if rs == nil {
+			break
+		}
+		for _, r := range rs {
+			if _, ok := latest[r.Recipient]; !ok {
+				order = append(order, r.Recipient)
+			}
+			latest[r.Recipient] = r
+		}
+	}
+	var unsent []Result
+	for _, i := range order {
+		r := latest[i]
+		if r.Status == StatusFailed || (r.Status == StatusSkipped && r.Error != "") {
+			unsent = append(unsent, r)
+		}
+	}
+	return unsent, nil
+}
+
+// GetFailureReport returns the failure report of a job, or nil if it
+// has none.
+func GetFailureReport(queueDir, basename string) (*FailureReport, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	reportBytes, err := readJobFile(dir, failureReportKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if reportBytes, err = decrypt(reportBytes); err != nil {
+		return nil, err
+	}
+	var report FailureReport
+	if err := json.Unmarshal(reportBytes, &report); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of %s: %s", failureReportKey, err)
+	}
+	return &report, nil
+}
@@ -0,0 +1,58 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFailureReport(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_failures_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	submit := func(policy string) string {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"error_policy": "`+policy+`",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+		j.Submit()
+		return j.Basename
+	}
+	failed := submit("fail-job")
+	Process(dir, UseMockSesService(&FlakySES{failAddr: "b@example.com"}))
+	report, err := GetFailureReport(dir, failed)
+	if err != nil || report == nil {
+		t.Fatal("GetFailureReport", report, err)
+	}
+	if !report.Failed || report.Recipient != 1 || report.ErrorCode != "MessageRejected" || len(report.Unsent) != 1 {
+		t.Fatal("unexpected failure report:", report)
+	}
+	if err := Retry(dir, failed, false); err != nil {
+		t.Fatal("Retry", err)
+	}
+	Process(dir, UseMockSesService(&MockSES{}))
+	if report, err := GetFailureReport(dir, failed); err != nil || report != nil {
+		t.Fatal("expected no failure report after a successful retry:", report, err)
+	}
+
+	skipped := submit("skip-recipient")
+	Process(dir, UseMockSesService(&FlakySES{failAddr: "b@example.com"}))
+	report, err = GetFailureReport(dir, skipped)
+	if err != nil || report == nil {
+		t.Fatal("GetFailureReport", report, err)
+	}
+	if report.Failed || report.Recipient != -1 || len(report.Unsent) != 1 || report.Unsent[0].Addr != "b@example.com" {
+		t.Fatal("unexpected failure report:", report)
+	}
+}
@@ -0,0 +1,92 @@
+package mailrail
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+var (
+	fakeFirstNames = []string{"Alice", "Bjørn", "Carmen", "Dmitri", "Emeka", "Fatima", "Giulia", "Hiroshi", "Ingrid", "Juan", "Kwame", "Lena", "Mei", "Nils", "Olga", "Priya"}
+	fakeLastNames  = []string{"Andersen", "Barros", "Chen", "Dubois", "Eriksen", "Fischer", "García", "Haddad", "Ito", "Johansson", "Kowalski", "Lopez", "Müller", "Nakamura", "Okafor", "Petrov"}
+	fakeCities     = []string{"Oslo", "Lagos", "Lyon", "Osaka", "Porto", "Denver", "Kraków", "Bergen", "Austin", "Pune"}
+	fakeCountries  = []string{"Norway", "Nigeria", "France", "Japan", "Portugal", "United States", "Poland", "India"}
+	fakeWords      = []string{"alpha", "bravo", "coral", "delta", "ember", "fjord", "garnet", "harbor", "indigo", "juniper"}
+)
+
+// FakeRecipients returns n recipients with synthetic data for the
+// given context variables, for previewing templates and load testing
+// without production data. The value of each variable is chosen from
+// its name, so that `first_name` gets a first name, `city` a city, and
+// so on. Addresses are at example.com.
+func FakeRecipients(vars []string, n int, rnd *rand.Rand) []Recipient {
+	recipients := make([]Recipient, n)
+	for i := range recipients {
+		first := fakeFirstNames[rnd.Intn(len(fakeFirstNames))]
+		last := fakeLastNames[rnd.Intn(len(fakeLastNames))]
+		context := make(map[string]interface{})
+		for _, v := range vars {
+			context[v] = fakeValue(v, first, last, i, rnd)
+		}
+		recipients[i] = Recipient{
+			Name:    first + " " + last,
+			Addr:    fakeAddr(first, last, i),
+			Context: context}
+	}
+	return recipients
+}
+
+func fakeAddr(first, last string, i int) string {
+	local := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(first+"."+last))
+	return fmt.Sprintf("%s.%d@example.com", local, i)
+}
+
+func fakeValue(v, first, last string, i int, rnd *rand.Rand) string {
+	name := strings.ToLower(v)
+	has := func(substrings ...string) bool {
+		for _, s := range substrings {
+			if strings.Contains(name, s) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("email", "addr"):
+		return fakeAddr(first, last, i)
+	case has("first", "given"):
+		return first
+	case has("last", "surname", "family"):
+		return last
+	case has("name"):
+		return first + " " + last
+	case has("city", "town"):
+		return fakeCities[rnd.Intn(len(fakeCities))]
+	case has("country"):
+		return fakeCountries[rnd.Intn(len(fakeCountries))]
+	case has("phone", "mobile"):
+		return fmt.Sprintf("+1 555 %03d %04d", rnd.Intn(1000), rnd.Intn(10000))
+	case has("url", "link"):
+		return fmt.Sprintf("https://example.com/%s/%d", fakeWords[rnd.Intn(len(fakeWords))], rnd.Intn(100000))
+	case has("date"):
+		return fmt.Sprintf("2024-%02d-%02d", 1+rnd.Intn(12), 1+rnd.Intn(28))
+	case has("amount", "price", "total", "balance"):
+		return fmt.Sprintf("%d.%02d", rnd.Intn(1000), rnd.Intn(100))
+	case has("count", "number", "qty", "quantity"):
+		return fmt.Sprintf("%d", 1+rnd.Intn(99))
+	case has("code", "token", "id"):
+		const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+		code := make([]byte, 8)
+		for j := range code {
+			code[j] = alphabet[rnd.Intn(len(alphabet))]
+		}
+		return string(code)
+	default:
+		return fakeWords[rnd.Intn(len(fakeWords))]
+	}
+}
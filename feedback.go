@@ -0,0 +1,335 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of feedback from recipients and their mail servers.
+const (
+	FeedbackBounce    = "bounce"
+	FeedbackComplaint = "complaint"
+	FeedbackOpen      = "open"
+	FeedbackClick     = "click"
+)
+
+// A Feedback records that a message a job sent bounced, drew a
+// complaint, or was opened or clicked. Kind is the bounce type (e.g.,
+// "Permanent"), the complaint feedback type (e.g., "abuse"), or the
+// link that was clicked, and SubKind the bounce subtype.
+type Feedback struct {
+	Type      string    `json:"type"`
+	Recipient int       `json:"recipient"`
+	Addr      string    `json:"addr"`
+	MessageId string    `json:"message_id"`
+	Kind      string    `json:"kind,omitempty"`
+	SubKind   string    `json:"sub_kind,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+const feedbackKey = "feedback"
+
+type sqsService interface {
+	ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(*sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+}
+
+// A FeedbackIngester consumes SES bounce and complaint notifications,
+// and open and click events if the configuration set publishes them,
+// from an SQS queue subscribed to the SNS topic SES publishes them to,
+// and records them in the "feedback" artifact of the job that sent
+// the message. If Suppressions is set, addresses that bounce
+// permanently or complain are also suppressed, and if SoftBounceExpiry
+// is also set, addresses that bounce transiently are suppressed for
+// that long, doubling with each soft bounce that follows.
+type FeedbackIngester struct {
+	QueueDir         string
+	QueueURL         string
+	Suppressions     *SuppressionList
+	SoftBounceExpiry time.Duration
+	svc              sqsService
+	mu               sync.Mutex
+	index            map[string]messageRef
+	indexed          time.Time
+}
+
+type messageRef struct {
+	job       string
+	recipient int
+}
+
+// How often the ingester may rescan the queue for a Message-ID it does
+// not know, which may belong to another sender.
+const feedbackReindexInterval = time.Minute
+
+// Returns an ingester for the jobs of a queue directory that reads
+// the SQS queue with the given URL.
+func NewFeedbackIngester(queueDir, queueURL string) *FeedbackIngester {
+	return &FeedbackIngester{
+		QueueDir: queueDir,
+		QueueURL: queueURL,
+		svc:      sqs.New(session.New(), getSesConfig())}
+}
+
+// Run receives and records notifications forever. Notifications are
+// deleted from the SQS queue once they are recorded, or if they are
+// not about a message sent by a job in the queue directory.
+func (fi *FeedbackIngester) Run() {
+	for {
+		if err := fi.receive(); err != nil {
+			log.Printf("Failed to receive feedback from %s: %s", fi.QueueURL, err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+func (fi *FeedbackIngester) receive() error {
+	resp, err := fi.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(fi.QueueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20)})
+	if err != nil {
+		return err
+	}
+	for _, message := range resp.Messages {
+		if err := fi.HandleNotification([]byte(aws.StringValue(message.Body))); err != nil {
+			// Leave it to be received again, or dead-lettered.
+			log.Printf("Failed to record feedback %s: %s", aws.StringValue(message.MessageId), err)
+			continue
+		}
+		if _, err := fi.svc.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(fi.QueueURL),
+			ReceiptHandle: message.ReceiptHandle}); err != nil {
+			log.Printf("Failed to delete feedback %s: %s", aws.StringValue(message.MessageId), err)
+		}
+	}
+	return nil
+}
+
+// An SES notification, either as published to SNS or wrapped in an
+// SNS envelope, whose Message then holds the notification. Event
+// publishing has EventType where notifications have NotificationType.
+type sesNotification struct {
+	Message          string `json:"Message"`
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageId   string   `json:"messageId"`
+		Destination []string `json:"destination"`
+	} `json:"mail"`
+	Bounce *struct {
+		BounceType        string    `json:"bounceType"`
+		BounceSubType     string    `json:"bounceSubType"`
+		Timestamp         time.Time `json:"timestamp"`
+		BouncedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint *struct {
+		ComplaintFeedbackType string    `json:"complaintFeedbackType"`
+		Timestamp             time.Time `json:"timestamp"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+	Open *struct {
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"open"`
+	Click *struct {
+		Timestamp time.Time `json:"timestamp"`
+		Link      string    `json:"link"`
+	} `json:"click"`
+}
+
+// parseFeedback returns the feedback in an SES notification, without
+// the recipient index, which only the job knows.
+func parseFeedback(body []byte) ([]Feedback, error) {
+	var n sesNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, fmt.Errorf("Cannot parse notification: %s", err)
+	}
+	if n.Message != "" {
+		if err := json.Unmarshal([]byte(n.Message), &n); err != nil {
+			return nil, fmt.Errorf("Cannot parse notification in SNS message: %s", err)
+		}
+	}
+	if n.NotificationType == "" {
+		n.NotificationType = n.EventType
+	}
+	var feedback []Feedback
+	switch n.NotificationType {
+	case "Bounce":
+		if n.Bounce == nil {
+			return nil, fmt.Errorf("Bounce notification without bounce")
+		}
+		for _, r := range n.Bounce.BouncedRecipients {
+			feedback = append(feedback, Feedback{
+				Type:      FeedbackBounce,
+				Addr:      r.EmailAddress,
+				MessageId: n.Mail.MessageId,
+				Kind:      n.Bounce.BounceType,
+				SubKind:   n.Bounce.BounceSubType,
+				Time:      n.Bounce.Timestamp})
+		}
+	case "Complaint":
+		if n.Complaint == nil {
+			return nil, fmt.Errorf("Complaint notification without complaint")
+		}
+		for _, r := range n.Complaint.ComplainedRecipients {
+			feedback = append(feedback, Feedback{
+				Type:      FeedbackComplaint,
+				Addr:      r.EmailAddress,
+				MessageId: n.Mail.MessageId,
+				Kind:      n.Complaint.ComplaintFeedbackType,
+				Time:      n.Complaint.Timestamp})
+		}
+	case "Open", "Click":
+		// Opens and clicks are tracked per message, and mailrail
+		// sends each message to one recipient.
+		if len(n.Mail.Destination) == 0 {
+			return nil, fmt.Errorf("%s event without destination", n.NotificationType)
+		}
+		f := Feedback{Addr: n.Mail.Destination[0], MessageId: n.Mail.MessageId}
+		if n.Open != nil {
+			f.Type, f.Time = FeedbackOpen, n.Open.Timestamp
+		} else if n.Click != nil {
+			f.Type, f.Kind, f.Time = FeedbackClick, n.Click.Link, n.Click.Timestamp
+		} else {
+			return nil, fmt.Errorf("%s event without details", n.NotificationType)
+		}
+		feedback = append(feedback, f)
+	}
+	return feedback, nil
+}
+
+// HandleNotification records the feedback in an SES notification.
+// Notifications of other types, and about messages the queue has no
+// record of, are ignored.
+func (fi *FeedbackIngester) HandleNotification(body []byte) error {
+	feedback, err := parseFeedback(body)
+	if err != nil {
+		return err
+	}
+	for _, f := range feedback {
+		ref, ok, err := fi.lookup(f.MessageId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Printf("Ignoring %s of %s: no job sent Message-ID %s", f.Type, f.Addr, f.MessageId)
+			continue
+		}
+		f.Recipient = ref.recipient
+		if err := recordFeedback(fi.QueueDir, ref.job, f); err != nil {
+			return err
+		}
+		log.Printf("Job %s recipient %d: %s %s", ref.job, f.Recipient, f.Type, f.Kind)
+		if fi.Suppressions == nil {
+			continue
+		}
+		if f.Type == FeedbackComplaint || f.Kind == "Permanent" {
+			if err := fi.Suppressions.Add(f.Addr, f.Type, f.Time); err != nil {
+				return err
+			}
+		} else if f.Kind == "Transient" && fi.SoftBounceExpiry > 0 {
+			reason := "soft bounce"
+			if f.SubKind != "" {
+				reason += " (" + f.SubKind + ")"
+			}
+			if err := fi.Suppressions.AddSoft(f.Addr, reason, f.Time, fi.SoftBounceExpiry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookup finds the job and recipient of a Message-ID.
+func (fi *FeedbackIngester) lookup(messageId string) (messageRef, bool, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if ref, ok := fi.index[messageId]; ok {
+		return ref, true, nil
+	}
+	if time.Since(fi.indexed) < feedbackReindexInterval {
+		return messageRef{}, false, nil
+	}
+	index := make(map[string]messageRef)
+	for _, state := range jobStates {
+		basenames, err := listJobs(fi.QueueDir, state)
+		if err != nil {
+			return messageRef{}, false, err
+		}
+		for _, basename := range basenames {
+			results, err := GetResults(fi.QueueDir, basename)
+			if err != nil {
+				// The worker may have moved the job.
+				continue
+			}
+			for _, r := range results {
+				if r.MessageId != "" {
+					index[r.MessageId] = messageRef{basename, r.Recipient}
+				}
+			}
+		}
+	}
+	fi.index = index
+	fi.indexed = time.Now()
+	ref, ok := fi.index[messageId]
+	return ref, ok, nil
+}
+
+func recordFeedback(queueDir, basename string, f Feedback) error {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	feedback, err := getFeedback(dir)
+	if err != nil {
+		return err
+	}
+	feedbackBytes, err := json.Marshal(append(feedback, f))
+	if err != nil {
+		return err
+	}
+	if err := writeJobFile(dir, feedbackKey, feedbackBytes); err != nil {
+		// The worker may have moved the job while we wrote.
+		if dir, err = findJob(queueDir, basename); err != nil {
+			return err
+		}
+		return writeJobFile(dir, feedbackKey, feedbackBytes)
+	}
+	return nil
+}
+
+// GetFeedback returns the bounces, complaints, opens, and clicks
+// recorded for a job.
+func GetFeedback(queueDir, basename string) ([]Feedback, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	return getFeedback(dir)
+}
+
+func getFeedback(jobDir string) ([]Feedback, error) {
+	var feedback []Feedback
+	feedbackBytes, err := readJobFile(jobDir, feedbackKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(feedbackBytes, &feedback); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of feedback: %s", err)
+	}
+	return feedback, nil
+}
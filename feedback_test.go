@@ -0,0 +1,107 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type MockSQS struct {
+	messages []*sqs.Message
+	deleted  []string
+}
+
+func (svc *MockSQS) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	messages := svc.messages
+	svc.messages = nil
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (svc *MockSQS) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	svc.deleted = append(svc.deleted, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestFeedbackIngester(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_feedback_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir := path.Join(dir, "queue")
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+	j.Submit()
+	Process(queueDir, UseMockSesService(&CountingSES{}))
+
+	suppressions, err := OpenSuppressionList(path.Join(dir, "suppressions"))
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	svc := &MockSQS{}
+	fi := &FeedbackIngester{QueueDir: queueDir, QueueURL: "queue-url", Suppressions: suppressions, svc: svc}
+	bounce := `{"notificationType": "Bounce", "mail": {"messageId": "msg-2"},
+"bounce": {"bounceType": "Permanent", "bounceSubType": "General", "timestamp": "2026-01-02T03:04:05Z",
+"bouncedRecipients": [{"emailAddress": "b@example.com"}]}}`
+	envelope, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": bounce})
+	complaint := `{"notificationType": "Complaint", "mail": {"messageId": "msg-1"},
+"complaint": {"complaintFeedbackType": "abuse", "timestamp": "2026-01-02T03:04:05Z",
+"complainedRecipients": [{"emailAddress": "a@example.com"}]}}`
+	unknown := `{"notificationType": "Bounce", "mail": {"messageId": "msg-from-elsewhere"},
+"bounce": {"bounceType": "Transient", "bouncedRecipients": [{"emailAddress": "c@example.com"}]}}`
+	svc.messages = []*sqs.Message{
+		{Body: aws.String(string(envelope)), ReceiptHandle: aws.String("1")},
+		{Body: aws.String(complaint), ReceiptHandle: aws.String("2")},
+		{Body: aws.String(unknown), ReceiptHandle: aws.String("3")},
+		{Body: aws.String("not json"), ReceiptHandle: aws.String("4")}}
+	if err := fi.receive(); err != nil {
+		t.Fatal("receive", err)
+	}
+	if len(svc.deleted) != 3 {
+		t.Fatal("expected the unparseable notification to be left in the queue:", svc.deleted)
+	}
+	feedback, err := GetFeedback(queueDir, j.Basename)
+	if err != nil || len(feedback) != 2 {
+		t.Fatal("GetFeedback", feedback, err)
+	}
+	if feedback[0].Type != FeedbackBounce || feedback[0].Recipient != 1 || feedback[0].Kind != "Permanent" {
+		t.Fatal("unexpected bounce:", feedback[0])
+	}
+	if feedback[1].Type != FeedbackComplaint || feedback[1].Recipient != 0 || feedback[1].Addr != "a@example.com" {
+		t.Fatal("unexpected complaint:", feedback[1])
+	}
+	if _, ok := suppressions.Lookup("b@example.com"); !ok {
+		t.Fatal("permanent bounce not suppressed")
+	}
+	if _, ok := suppressions.Lookup("a@example.com"); !ok {
+		t.Fatal("complaint not suppressed")
+	}
+}
+
+func TestParseOpenAndClickEvents(t *testing.T) {
+	open := `{"eventType": "Open", "mail": {"messageId": "msg-1", "destination": ["a@example.com"]},
+"open": {"timestamp": "2026-01-02T03:04:05Z", "userAgent": "Mozilla/5.0"}}`
+	feedback, err := parseFeedback([]byte(open))
+	if err != nil || len(feedback) != 1 || feedback[0].Type != FeedbackOpen || feedback[0].Addr != "a@example.com" || feedback[0].MessageId != "msg-1" {
+		t.Fatal("unexpected open:", feedback, err)
+	}
+	click := `{"eventType": "Click", "mail": {"messageId": "msg-1", "destination": ["a@example.com"]},
+"click": {"timestamp": "2026-01-02T03:04:05Z", "link": "https://example.com/"}}`
+	feedback, err = parseFeedback([]byte(click))
+	if err != nil || len(feedback) != 1 || feedback[0].Type != FeedbackClick || feedback[0].Kind != "https://example.com/" {
+		t.Fatal("unexpected click:", feedback, err)
+	}
+}
@@ -0,0 +1,170 @@
+package mailrail
+
+import (
+	"context"
+	"fmt"
+	"github.com/ljosa/mailrail/mailrailpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ControlServer implements the gRPC control plane in mailrailpb. It
+// does what the REST API of `APIHandler` does, with the same checks,
+// roles, and audit records.
+type ControlServer struct {
+	mailrailpb.UnimplementedControlServer
+	Submitter *Submitter
+	Tokens    *TokenStore
+}
+
+// Returns a control server for the queue the submitter submits to.
+func NewControlServer(submitter *Submitter) *ControlServer {
+	return &ControlServer{Submitter: submitter}
+}
+
+// Register registers the control server with a gRPC server.
+func (s *ControlServer) Register(server *grpc.Server) {
+	mailrailpb.RegisterControlServer(server, s)
+}
+
+// authorize checks that a call presents a token with a role in its
+// "authorization" metadata, as `Bearer TOKEN`. If the server has no
+// tokens, every call is allowed.
+func (s *ControlServer) authorize(ctx context.Context, role string) (APIToken, error) {
+	if s.Tokens == nil {
+		return APIToken{Name: "anonymous", Role: RoleAdmin}, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			continue
+		}
+		token, ok := s.Tokens.Authenticate(strings.TrimPrefix(auth, "Bearer "))
+		if !ok {
+			break
+		}
+		if !token.Can(role) {
+			return token, status.Errorf(codes.PermissionDenied, "Token %s is a %s; this requires %s", token.Name, token.Role, role)
+		}
+		return token, nil
+	}
+	return APIToken{}, status.Error(codes.Unauthenticated, "Missing or invalid API token")
+}
+
+func (s *ControlServer) audit(basename string, token APIToken, action string) {
+	log.Printf("%s (%s) did %s on job %s", token.Name, token.Role, action, basename)
+	if err := recordAudit(s.Submitter.QueueDir, basename, AuditRecord{time.Now(), token.Name, token.Role, action}); err != nil {
+		log.Printf("Failed to record %s of job %s by %s: %s", action, basename, token.Name, err)
+	}
+}
+
+func (s *ControlServer) Submit(ctx context.Context, req *mailrailpb.SubmitRequest) (*mailrailpb.SubmitResponse, error) {
+	token, err := s.authorize(ctx, RoleOperator)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseSpec(req.Spec)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Cannot parse spec: %s", err)
+	}
+	if err := CheckSpec(spec); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	basename, err := s.Submitter.Submit(req.Spec)
+	if err != nil {
+		if retryErr, ok := err.(*RetryAfterError); ok {
+			grpc.SetTrailer(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(retryErr.RetryAfter.Seconds())))))
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		log.Printf("Failed to submit spec: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.audit(basename, token, "submit")
+	return &mailrailpb.SubmitResponse{Job: basename}, nil
+}
+
+func (s *ControlServer) ListJobs(ctx context.Context, req *mailrailpb.ListJobsRequest) (*mailrailpb.ListJobsResponse, error) {
+	if _, err := s.authorize(ctx, RoleViewer); err != nil {
+		return nil, err
+	}
+	statuses, err := QueueStatus(s.Submitter.QueueDir)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &mailrailpb.ListJobsResponse{}
+	for _, js := range statuses {
+		resp.Jobs = append(resp.Jobs, newJobStatusProto(js))
+	}
+	return resp, nil
+}
+
+func (s *ControlServer) GetJob(ctx context.Context, req *mailrailpb.JobRequest) (*mailrailpb.JobStatus, error) {
+	if _, err := s.authorize(ctx, RoleViewer); err != nil {
+		return nil, err
+	}
+	return s.jobStatus(req.Job)
+}
+
+func (s *ControlServer) CancelJob(ctx context.Context, req *mailrailpb.JobRequest) (*mailrailpb.JobStatus, error) {
+	return s.control(ctx, req.Job, "cancel", Cancel)
+}
+
+func (s *ControlServer) PauseJob(ctx context.Context, req *mailrailpb.JobRequest) (*mailrailpb.JobStatus, error) {
+	return s.control(ctx, req.Job, "pause", Pause)
+}
+
+func (s *ControlServer) ResumeJob(ctx context.Context, req *mailrailpb.JobRequest) (*mailrailpb.JobStatus, error) {
+	return s.control(ctx, req.Job, "resume", Resume)
+}
+
+func (s *ControlServer) control(ctx context.Context, basename, action string, f func(queueDir, basename string) error) (*mailrailpb.JobStatus, error) {
+	token, err := s.authorize(ctx, RoleOperator)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := findJob(s.Submitter.QueueDir, basename); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err := f(s.Submitter.QueueDir, basename); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	s.audit(basename, token, action)
+	return s.jobStatus(basename)
+}
+
+func (s *ControlServer) jobStatus(basename string) (*mailrailpb.JobStatus, error) {
+	if _, err := findJob(s.Submitter.QueueDir, basename); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	js, err := GetJobStatus(s.Submitter.QueueDir, basename)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Cannot get status of job %s: %s", basename, err))
+	}
+	return newJobStatusProto(js), nil
+}
+
+func newJobStatusProto(s JobStatus) *mailrailpb.JobStatus {
+	js := &mailrailpb.JobStatus{
+		Job:        s.Job,
+		State:      s.State,
+		Recipients: int64(s.Recipients),
+		Sent:       int64(s.Sent),
+		Rate:       s.Rate,
+		SlaAtRisk:  s.AtRisk(),
+	}
+	if !s.ETA.IsZero() {
+		js.Eta = timestamppb.New(s.ETA)
+	}
+	if !s.Deadline.IsZero() {
+		js.Deadline = timestamppb.New(s.Deadline)
+	}
+	return js
+}
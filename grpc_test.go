@@ -0,0 +1,93 @@
+package mailrail
+
+import (
+	"context"
+	"github.com/ljosa/mailrail/mailrailpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestControlServer(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_grpc_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	control := NewControlServer(NewSubmitter(path.Join(dir, "queue")))
+	control.Tokens = OpenTokenStore(path.Join(dir, "tokens"))
+	viewer, _ := control.Tokens.CreateToken("viewer", RoleViewer)
+	operator, _ := control.Tokens.CreateToken("operator", RoleOperator)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	server := grpc.NewServer()
+	control.Register(server)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	client := mailrailpb.NewControlClient(conn)
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`)
+
+	if _, err := client.ListJobs(context.Background(), &mailrailpb.ListJobsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("expected Unauthenticated without a token, not", err)
+	}
+	if _, err := client.Submit(as(viewer), &mailrailpb.SubmitRequest{Spec: spec}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("expected PermissionDenied for a viewer, not", err)
+	}
+	if _, err := client.Submit(as(operator), &mailrailpb.SubmitRequest{Spec: []byte(`{"text": "{{.foo"}`)}); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("expected InvalidArgument for a bad template, not", err)
+	}
+	submitted, err := client.Submit(as(operator), &mailrailpb.SubmitRequest{Spec: spec})
+	if err != nil {
+		t.Fatal("failed to submit", err)
+	}
+	js, err := client.GetJob(as(viewer), &mailrailpb.JobRequest{Job: submitted.Job})
+	if err != nil || js.State != "queued" || js.Recipients != 2 {
+		t.Fatal("unexpected status:", js, err)
+	}
+	if _, err := client.GetJob(as(viewer), &mailrailpb.JobRequest{Job: "nosuchjob"}); status.Code(err) != codes.NotFound {
+		t.Fatal("expected NotFound for unknown job, not", err)
+	}
+	if _, err := client.CancelJob(as(operator), &mailrailpb.JobRequest{Job: submitted.Job}); err != nil {
+		t.Fatal("failed to cancel", err)
+	}
+	jobs, err := client.ListJobs(as(viewer), &mailrailpb.ListJobsRequest{})
+	if err != nil || len(jobs.Jobs) != 1 || jobs.Jobs[0].Job != submitted.Job {
+		t.Fatal("unexpected jobs:", jobs, err)
+	}
+	audit, _ := GetAudit(control.Submitter.QueueDir, submitted.Job)
+	if len(audit) != 2 || audit[1].Action != "cancel" || audit[1].Actor != "operator" {
+		t.Fatal("unexpected audit:", audit)
+	}
+	for _, name := range []string{"..", ".", "../..", "../queue", ""} {
+		for _, call := range []func(context.Context, *mailrailpb.JobRequest, ...grpc.CallOption) (*mailrailpb.JobStatus, error){
+			client.GetJob, client.CancelJob, client.PauseJob, client.ResumeJob} {
+			if _, err := call(as(operator), &mailrailpb.JobRequest{Job: name}); status.Code(err) != codes.NotFound {
+				t.Fatalf("expected NotFound for job %q, not %v", name, err)
+			}
+		}
+	}
+	entries, _ := ioutil.ReadDir(control.Submitter.QueueDir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			t.Fatal("expected nothing written to the queue directory itself:", e.Name())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package mailrail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Specs and recipients, which are mostly repetitive JSON, can be
+// stored gzipped to save disk and transfer. They are recognized by the
+// gzip magic number, which JSON cannot start with, and decompressed
+// when they are read, so that every queue and command takes them as
+// they are.
+
+// maxGunzippedBytes caps how large gzipped data may grow when it is
+// decompressed, so that a small gzip bomb cannot exhaust memory.
+var maxGunzippedBytes int64 = 1 << 30
+
+func isGzipped(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// gunzip decompresses gzipped data and returns other data as it is.
+func gunzip(data []byte) ([]byte, error) {
+	if !isGzipped(data) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decompress: %s", err)
+	}
+	defer r.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(r, maxGunzippedBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decompress: %s", err)
+	}
+	if int64(len(data)) > maxGunzippedBytes {
+		return nil, fmt.Errorf("Cannot decompress: larger than %d bytes", maxGunzippedBytes)
+	}
+	return data, nil
+}
+
+// Gzip compresses a spec or recipients for submission.
+func Gzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
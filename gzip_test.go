@@ -0,0 +1,56 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGzippedSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_gzip_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewSubmitter(dir)
+	spec, _ := Gzip([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}}]}`))
+	a, err := s.Submit(spec)
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	spec, _ = Gzip([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}"}`))
+	recipients, _ := Gzip([]byte(`{"addr": "b@example.com", "context": {"name": "B"}}
+{"addr": "c@example.com", "context": {"name": "C"}}`))
+	b, err := s.SubmitNDJSON(spec, recipients)
+	if err != nil {
+		t.Fatal("SubmitNDJSON", err)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 3 || *svc.sent.Message.Body.Text.Data != "Hello, C" {
+		t.Fatal("expected the gzipped recipients to be sent to:", svc.nsent)
+	}
+	if report, err := JobReport(dir, a); err != nil || len(report) != 1 || report[0].Status != StatusSent {
+		t.Fatal("unexpected report:", report, err)
+	}
+	if report, err := JobReport(dir, b); err != nil || len(report) != 2 || report[1].Addr != "c@example.com" {
+		t.Fatal("unexpected report:", report, err)
+	}
+	if data, err := gunzip([]byte(`{"addr": "a@example.com"}`)); err != nil || string(data) != `{"addr": "a@example.com"}` {
+		t.Fatal("expected data that is not gzipped to be left as it is:", string(data), err)
+	}
+}
+
+func TestGunzipLimit(t *testing.T) {
+	defer func(max int64) { maxGunzippedBytes = max }(maxGunzippedBytes)
+	maxGunzippedBytes = 1000
+	data, _ := Gzip(make([]byte, 1000))
+	if data, err := gunzip(data); err != nil || len(data) != 1000 {
+		t.Fatal("expected data at the limit to be decompressed:", len(data), err)
+	}
+	data, _ = Gzip(make([]byte, 1001))
+	if _, err := gunzip(data); err == nil {
+		t.Fatal("expected data over the limit to be refused")
+	}
+}
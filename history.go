@@ -0,0 +1,250 @@
+package mailrail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A SendRecord says that an address was sent a message in a campaign.
+type SendRecord struct {
+	Addr     string    `json:"addr"`
+	Campaign string    `json:"campaign"`
+	Stream   string    `json:"stream"`
+	Time     time.Time `json:"time"`
+}
+
+// A SendHistory is a file of the messages that have been sent, one
+// JSON-encoded `SendRecord` per line, used to enforce frequency caps.
+// New records are appended to the file; the times of marketing
+// messages are kept in memory by address. Several workers and
+// `mailrail-import` can share the file: each takes a lock on a file
+// next to it, named after it with ".lock" added, to append or compact,
+// and reads what the others have appended before it counts messages.
+// The lock file must be one that can be locked, which rules out
+// Windows.
+type SendHistory struct {
+	filename string
+	mu       sync.Mutex
+	times    map[string][]time.Time
+	// Records older than keep are dropped, unless it is zero.
+	keep time.Duration
+	// The file as it was last read, and how much of it was read.
+	file   os.FileInfo
+	offset int64
+	// The lines in the file, and how many it had when it was last
+	// compacted.
+	lines, compacted int
+}
+
+// The fewest lines the file of a send history has before Record
+// compacts it.
+const minSendHistoryCompaction = 10000
+
+// Opens a send history, creating it if it does not exist.
+func OpenSendHistory(filename string) (*SendHistory, error) {
+	return OpenSendHistoryFor(filename, 0)
+}
+
+// OpenSendHistoryFor opens a send history that keeps only the records
+// of the last period, such as the period of a frequency cap. Older
+// records are dropped, and the file is compacted when it is opened and
+// whenever it has doubled in size since.
+func OpenSendHistoryFor(filename string, period time.Duration) (*SendHistory, error) {
+	h := &SendHistory{filename: filename, keep: period, times: make(map[string][]time.Time)}
+	if err := h.locked(h.compact); err != nil {
+		return nil, fmt.Errorf("Cannot read send history %s: %s", filename, err)
+	}
+	return h, nil
+}
+
+// locked calls f with the history locked against other processes,
+// after reading the records that they have appended.
+func (h *SendHistory) locked(f func() error) error {
+	lock, err := os.OpenFile(h.filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("Cannot lock %s: %s", lock.Name(), err)
+	}
+	defer unlockFile(lock)
+	if err := h.catchUp(); err != nil {
+		return err
+	}
+	return f()
+}
+
+// catchUp reads the records appended to the file since it was last
+// read, or all of them if another process has compacted it since.
+func (h *SendHistory) catchUp() error {
+	file, err := os.Open(h.filename)
+	if os.IsNotExist(err) {
+		h.times, h.file, h.offset, h.lines = make(map[string][]time.Time), nil, 0, 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if h.file == nil || !os.SameFile(info, h.file) || info.Size() < h.offset {
+		h.times, h.offset, h.lines = make(map[string][]time.Time), 0, 0
+	}
+	h.file = info
+	if _, err := file.Seek(h.offset, 0); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without its newline is still being written.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		h.offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r SendRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("Cannot parse %s at offset %d: %s", h.filename, h.offset-int64(len(line)), err)
+		}
+		h.lines++
+		h.remember(r)
+	}
+}
+
+// compact rewrites the file without the records that have expired,
+// if there are any. The history must be locked.
+func (h *SendHistory) compact() error {
+	h.compacted = h.lines
+	if h.keep == 0 {
+		return nil
+	}
+	cutoff := h.cutoff()
+	var kept []byte
+	lines, dropped := 0, 0
+	err := readLines(h.filename, func(line []byte) error {
+		var r SendRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if r.Time.Before(cutoff) {
+			dropped++
+			return nil
+		}
+		kept = append(append(kept, line...), '\n')
+		lines++
+		return nil
+	})
+	if err != nil || dropped == 0 {
+		return err
+	}
+	tmp := h.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, kept, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.filename); err != nil {
+		return err
+	}
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		return err
+	}
+	h.file, h.offset, h.lines, h.compacted = info, int64(len(kept)), lines, lines
+	return nil
+}
+
+// cutoff returns the time before which records have expired.
+func (h *SendHistory) cutoff() time.Time {
+	if h.keep == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-h.keep)
+}
+
+func (h *SendHistory) remember(r SendRecord) {
+	if r.Stream != "" && r.Stream != MarketingStream {
+		return
+	}
+	cutoff := h.cutoff()
+	if r.Time.Before(cutoff) {
+		return
+	}
+	addr := normalizeAddr(r.Addr)
+	times := h.times[addr][:0]
+	for _, t := range h.times[addr] {
+		if !t.Before(cutoff) {
+			times = append(times, t)
+		}
+	}
+	h.times[addr] = append(times, r.Time)
+}
+
+// Record adds a message to the history. Records without a stream are
+// taken to be marketing mail.
+func (h *SendHistory) Record(r SendRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.locked(func() error {
+		if err := appendLine(h.filename, r); err != nil {
+			return err
+		}
+		// Reads the record back along with any others appended.
+		if err := h.catchUp(); err != nil {
+			return err
+		}
+		if h.keep > 0 && h.lines >= 2*h.compacted && h.lines >= minSendHistoryCompaction {
+			if err := h.compact(); err != nil {
+				log.Printf("Failed to compact send history %s: %s", h.filename, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Count returns the number of marketing messages sent to an address
+// since a point in time.
+func (h *SendHistory) Count(addr string, since time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.locked(func() error { return nil }); err != nil {
+		log.Printf("Failed to read send history %s: %s", h.filename, err)
+	}
+	n := 0
+	for _, t := range h.times[normalizeAddr(addr)] {
+		if !t.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+type frequencyCap struct {
+	history *SendHistory
+	max     int
+	period  time.Duration
+}
+
+// Skip marketing messages to recipients who have already been sent
+// max marketing messages within period, and record the messages that
+// are sent in the history. Transactional messages are recorded but
+// never capped.
+func WithFrequencyCap(history *SendHistory, max int, period time.Duration) Option {
+	return func(o *options) {
+		o.frequencyCap = &frequencyCap{history, max, period}
+	}
+}
@@ -0,0 +1,129 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrequencyCap(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_frequency_cap_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	history, err := OpenSendHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	history.Record(SendRecord{"janedoe@example.com", "spring", MarketingStream, time.Now().Add(-time.Hour)})
+	q, err := pqueue.OpenQueue(path.Join(dir, "queue"))
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"campaign": "summer",
+"text": "Hello",
+"recipients": [
+  {"addr": "janedoe@example.com"},
+  {"addr": "janedoe@example.com", "stream": "transactional"},
+  {"addr": "jimdoe@example.com"}
+]
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions([]Option{WithFrequencyCap(history, 1, 24*time.Hour)}))
+	if svc.nsent != 2 {
+		t.Fatal("expected 2 messages to be sent, not", svc.nsent)
+	}
+	results, err := getResults(j.Get, 3)
+	if err != nil {
+		t.Fatal("getResults", err)
+	}
+	if results[0].Status != StatusSkipped || results[1].Status != StatusSent || results[2].Status != StatusSent {
+		t.Fatal("unexpected results:", results)
+	}
+	if c := history.Count("jimdoe@example.com", time.Now().Add(-time.Minute)); c != 1 {
+		t.Fatal("send was not recorded in history")
+	}
+	historyBytes, _ := ioutil.ReadFile(path.Join(dir, "history"))
+	if !strings.Contains(string(historyBytes), `"campaign":"summer"`) {
+		t.Fatal("expected the spec's campaign to be recorded:", string(historyBytes))
+	}
+}
+
+func TestSendHistoryExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_history_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "history")
+	history, err := OpenSendHistory(filename)
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	history.Record(SendRecord{"janedoe@example.com", "winter", MarketingStream, time.Now().Add(-10 * 24 * time.Hour)})
+	history.Record(SendRecord{"jimdoe@example.com", "winter", MarketingStream, time.Now().Add(-10 * 24 * time.Hour)})
+	history.Record(SendRecord{"janedoe@example.com", "spring", MarketingStream, time.Now().Add(-time.Hour)})
+	history, err = OpenSendHistoryFor(filename, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal("OpenSendHistoryFor", err)
+	}
+	if len(history.times) != 1 || len(history.times["janedoe@example.com"]) != 1 {
+		t.Fatal("expected expired records to be dropped:", history.times)
+	}
+	historyBytes, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(historyBytes), "winter") || !strings.Contains(string(historyBytes), "spring") {
+		t.Fatal("expected the file to be compacted:", string(historyBytes))
+	}
+	history.times["janedoe@example.com"][0] = time.Now().Add(-8 * 24 * time.Hour)
+	history.Record(SendRecord{"janedoe@example.com", "summer", MarketingStream, time.Now()})
+	if c := history.Count("janedoe@example.com", time.Time{}); c != 1 {
+		t.Fatal("expected Record to drop the address's expired records:", c)
+	}
+}
+
+func TestSharedSendHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_history_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "history")
+	// An importer and a worker share the file.
+	importer, err := OpenSendHistory(filename)
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	worker, err := OpenSendHistoryFor(filename, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal("OpenSendHistoryFor", err)
+	}
+	importer.Record(SendRecord{"jimdoe@example.com", "winter", MarketingStream, time.Now().Add(-10 * 24 * time.Hour)})
+	importer.Record(SendRecord{"janedoe@example.com", "spring", MarketingStream, time.Now().Add(-time.Hour)})
+	if c := worker.Count("janedoe@example.com", time.Time{}); c != 1 {
+		t.Fatal("expected the worker to count what the importer appended:", c)
+	}
+	if err := worker.locked(worker.compact); err != nil {
+		t.Fatal("compact", err)
+	}
+	importer.Record(SendRecord{"jimdoe@example.com", "summer", MarketingStream, time.Now()})
+	worker.Record(SendRecord{"janedoe@example.com", "summer", MarketingStream, time.Now()})
+	if c := importer.Count("janedoe@example.com", time.Time{}); c != 2 {
+		t.Fatal("expected the importer to reread the compacted file:", c)
+	}
+	if c := worker.Count("jimdoe@example.com", time.Time{}); c != 1 {
+		t.Fatal("expected the worker to count what was appended after compaction:", c)
+	}
+	historyBytes, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(historyBytes), "winter") || strings.Count(string(historyBytes), "summer") != 2 {
+		t.Fatal("expected no appended record to be lost:", string(historyBytes))
+	}
+}
@@ -0,0 +1,104 @@
+package mailrail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The subdirectories of a pqueue directory that hold jobs, in the
+// order a job normally passes through them.
+var jobStates = []string{"queue", "cur", "done", "failed"}
+
+// findJob returns the directory of the job with the given basename,
+// regardless of what state it is in.
+func findJob(queueDir, basename string) (string, error) {
+	// Basenames come from API clients, so they must not reach
+	// outside the queue's state directories.
+	if basename == "" || basename == "." || basename == ".." || strings.ContainsAny(basename, `/\`) {
+		return "", fmt.Errorf("Invalid job name %q", basename)
+	}
+	for _, state := range jobStates {
+		dir := path.Join(queueDir, state, basename)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("No job %s in queue %s", basename, queueDir)
+}
+
+// pathHasState tells whether a job directory is in a state.
+func pathHasState(jobDir, state string) bool {
+	return path.Base(path.Dir(jobDir)) == state
+}
+
+func readJobFile(jobDir, key string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(jobDir, key))
+}
+
+func writeJobFile(jobDir, key string, value []byte) error {
+	tmp := path.Join(jobDir, "."+key+".tmp")
+	if err := ioutil.WriteFile(tmp, value, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(jobDir, key))
+}
+
+// listJobs returns the basenames of the jobs in a state, in the order
+// they are taken from the queue.
+func listJobs(queueDir, state string) ([]string, error) {
+	fis, err := ioutil.ReadDir(path.Join(queueDir, state))
+	if err != nil {
+		return nil, err
+	}
+	var basenames []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			basenames = append(basenames, fi.Name())
+		}
+	}
+	sort.Strings(basenames)
+	return basenames, nil
+}
+
+func readJobSpec(jobDir string) (Spec, error) {
+	specBytes, err := readJobFile(jobDir, "spec")
+	if err != nil {
+		return Spec{}, fmt.Errorf("Cannot get spec: %s", err)
+	}
+	spec, err := parseSpec(specBytes)
+	if err != nil {
+		return Spec{}, fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	_, snapshotErr := os.Stat(path.Join(jobDir, recipientsRefSnapshotKey))
+	if isFileRef(spec.recipientsRef()) && os.IsNotExist(snapshotErr) {
+		// Until the job is taken, the file is read only by the
+		// worker, in its recipients directory.
+	} else if spec.recipientsRef() != "" {
+		data, err := readRecipientsRef(spec, "", func(key string) ([]byte, error) { return readJobFile(jobDir, key) }, nil, nil)
+		if err != nil {
+			return Spec{}, err
+		}
+		recipients, err := parseRecipientsRef(&spec, data)
+		if err != nil {
+			return Spec{}, err
+		}
+		if recipients != nil {
+			spec.Recipients = recipients.all()
+		}
+	} else if spec.recipientSource() != "" {
+		// Until the job is taken, its recipients have no snapshot.
+		if snapshotBytes, err := readJobFile(jobDir, recipientsSnapshotKey); err == nil {
+			if snapshotBytes, err = decodeArtifact(snapshotBytes); err != nil {
+				return Spec{}, err
+			}
+			if err := unmarshalJSON(snapshotBytes, &spec.Recipients); err != nil {
+				return Spec{}, fmt.Errorf("Cannot parse snapshot of %s: %s", spec.recipientSource(), err)
+			}
+		}
+	}
+	return spec, nil
+}
@@ -0,0 +1,243 @@
+package mailrail
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"sync"
+	"time"
+)
+
+// Specs and recipients, which contain personal data and may wait in
+// the queue for days, can be encrypted at rest with KMS envelope
+// encryption: each is encrypted with AES-256-GCM under a new data key
+// from KMS, and carries that data key encrypted under the KMS key.
+// Encrypted artifacts start with kmsMagic and are decrypted wherever
+// they are read, like gzipped ones, by workers and commands that may
+// use the KMS key. Copies that the worker makes of the recipients of
+// an encrypted spec, such as snapshots, shards, and resends, are
+// encrypted under the same KMS key, as are the results and failure
+// report, which hold recipients' addresses. Decrypted data keys are cached for
+// a few minutes, so that KMS is asked about once per artifact while a
+// job is processed, but a worker that runs for long does not keep
+// every key it has decrypted, or keep using keys after access to the
+// KMS key is revoked.
+var kmsMagic = []byte("mailrail-kms-v1\n")
+
+type kmsEnvelope struct {
+	KeyID        string `json:"key_id"`
+	EncryptedKey []byte `json:"encrypted_key"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+type kmsService interface {
+	GenerateDataKey(*kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(*kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+var dataKeys = struct {
+	sync.Mutex
+	svc  kmsService
+	keys map[string]*list.Element
+	// Of *cachedDataKey, most recently used first.
+	lru *list.List
+}{keys: make(map[string]*list.Element), lru: list.New()}
+
+type cachedDataKey struct {
+	encryptedKey string
+	key          []byte
+	expires      time.Time
+}
+
+// The most decrypted data keys that are kept, and for how long.
+const (
+	dataKeyCacheSize = 100
+	dataKeyTTL       = 5 * time.Minute
+)
+
+func kmsClient() kmsService {
+	dataKeys.Lock()
+	defer dataKeys.Unlock()
+	if dataKeys.svc == nil {
+		dataKeys.svc = kms.New(session.New(), getSesConfig())
+	}
+	return dataKeys.svc
+}
+
+// Encrypt encrypts a spec or recipients for submission under a KMS
+// key, given by ID, ARN, or alias.
+func Encrypt(keyID string, data []byte) ([]byte, error) {
+	s, err := newSealer(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(data)
+}
+
+// A sealer encrypts artifacts under a data key from KMS. The worker
+// seals the results of a job, which it rewrites as it goes, under one
+// data key, so that it does not ask KMS for a data key per recipient.
+type sealer struct {
+	keyID        string
+	encryptedKey []byte
+	gcm          cipher.AEAD
+}
+
+func newSealer(keyID string) (*sealer, error) {
+	out, err := kmsClient().GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256)})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot generate data key with KMS key %s: %s", keyID, err)
+	}
+	gcm, err := newGCM(out.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{keyID: aws.StringValue(out.KeyId), encryptedKey: out.CiphertextBlob, gcm: gcm}, nil
+}
+
+func (s *sealer) seal(data []byte) ([]byte, error) {
+	envelope := kmsEnvelope{KeyID: s.keyID, EncryptedKey: s.encryptedKey, Nonce: make([]byte, s.gcm.NonceSize())}
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext = s.gcm.Seal(nil, envelope.Nonce, data, nil)
+	envelopeBytes, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), kmsMagic...), envelopeBytes...), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, kmsMagic)
+}
+
+func parseEnvelope(data []byte) (*kmsEnvelope, error) {
+	var envelope kmsEnvelope
+	if err := json.Unmarshal(data[len(kmsMagic):], &envelope); err != nil {
+		return nil, fmt.Errorf("Cannot parse encryption envelope: %s", err)
+	}
+	return &envelope, nil
+}
+
+// encryptionKeyID returns the KMS key that data is encrypted under, or
+// "" if it is not encrypted.
+func encryptionKeyID(data []byte) string {
+	if !isEncrypted(data) {
+		return ""
+	}
+	envelope, err := parseEnvelope(data)
+	if err != nil {
+		return ""
+	}
+	return envelope.KeyID
+}
+
+// decrypt decrypts encrypted data and returns other data as it is.
+func decrypt(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	envelope, err := parseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := dataKey(envelope)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt: %s", err)
+	}
+	return plaintext, nil
+}
+
+func dataKey(envelope *kmsEnvelope) ([]byte, error) {
+	svc := kmsClient()
+	if key, ok := cachedKey(string(envelope.EncryptedKey)); ok {
+		return key, nil
+	}
+	out, err := svc.Decrypt(&kms.DecryptInput{CiphertextBlob: envelope.EncryptedKey})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt data key with KMS key %s: %s", envelope.KeyID, err)
+	}
+	cacheKey(string(envelope.EncryptedKey), out.Plaintext)
+	return out.Plaintext, nil
+}
+
+// cachedKey returns a decrypted data key from the cache if it has not
+// expired.
+func cachedKey(encryptedKey string) ([]byte, bool) {
+	dataKeys.Lock()
+	defer dataKeys.Unlock()
+	e, ok := dataKeys.keys[encryptedKey]
+	if !ok {
+		return nil, false
+	}
+	cached := e.Value.(*cachedDataKey)
+	if time.Now().After(cached.expires) {
+		dataKeys.lru.Remove(e)
+		delete(dataKeys.keys, encryptedKey)
+		return nil, false
+	}
+	dataKeys.lru.MoveToFront(e)
+	return cached.key, true
+}
+
+// cacheKey caches a decrypted data key, evicting the least recently
+// used one if the cache is full.
+func cacheKey(encryptedKey string, key []byte) {
+	dataKeys.Lock()
+	defer dataKeys.Unlock()
+	if e, ok := dataKeys.keys[encryptedKey]; ok {
+		dataKeys.lru.Remove(e)
+	}
+	for dataKeys.lru.Len() >= dataKeyCacheSize {
+		oldest := dataKeys.lru.Back()
+		dataKeys.lru.Remove(oldest)
+		delete(dataKeys.keys, oldest.Value.(*cachedDataKey).encryptedKey)
+	}
+	cached := &cachedDataKey{encryptedKey: encryptedKey, key: key, expires: time.Now().Add(dataKeyTTL)}
+	dataKeys.keys[encryptedKey] = dataKeys.lru.PushFront(cached)
+}
+
+// decodeArtifact decrypts and decompresses a spec or recipients.
+func decodeArtifact(data []byte) ([]byte, error) {
+	data, err := decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return gunzip(data)
+}
+
+// encryptLike encrypts data under the KMS key that original is
+// encrypted under, if any.
+func encryptLike(original, data []byte) ([]byte, error) {
+	if keyID := encryptionKeyID(original); keyID != "" {
+		return Encrypt(keyID, data)
+	}
+	return data, nil
+}
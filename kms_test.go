@@ -0,0 +1,153 @@
+package mailrail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// MockKMS "encrypts" data keys by prefixing them with the key ID.
+type MockKMS struct {
+	ndecrypted int
+}
+
+func (m *MockKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          input.KeyId,
+		Plaintext:      key,
+		CiphertextBlob: append([]byte(*input.KeyId+":"), key...)}, nil
+}
+
+func (m *MockKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	m.ndecrypted++
+	i := bytes.IndexByte(input.CiphertextBlob, ':')
+	return &kms.DecryptOutput{KeyId: aws.String(string(input.CiphertextBlob[:i])), Plaintext: input.CiphertextBlob[i+1:]}, nil
+}
+
+func TestEncryptedSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_kms_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	kmsSvc := &MockKMS{}
+	dataKeys.svc = kmsSvc
+	defer func() { dataKeys.svc = nil }()
+	spec, _ := Gzip([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}"}`))
+	if spec, err = Encrypt("alias/mailrail", spec); err != nil {
+		t.Fatal("Encrypt", err)
+	}
+	if bytes.Contains(spec, []byte("johndoe")) {
+		t.Fatal("expected the spec to be encrypted")
+	}
+	recipients, _ := Encrypt("alias/mailrail", []byte(`{"addr": "a@example.com", "context": {"name": "A"}}
+{"addr": "b@example.com", "context": {"name": "B"}}`))
+	basename, err := NewSubmitter(dir).SubmitNDJSON(spec, recipients)
+	if err != nil {
+		t.Fatal("SubmitNDJSON", err)
+	}
+	stored, _ := readJobFile(path.Join(dir, "queue", basename), "spec")
+	if encryptionKeyID(stored) != "alias/mailrail" {
+		t.Fatal("expected the spec to stay encrypted")
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 2 || *svc.sent.Message.Body.Text.Data != "Hello, B" {
+		t.Fatal("expected the encrypted recipients to be sent to:", svc.nsent)
+	}
+	if report, err := JobReport(dir, basename); err != nil || len(report) != 2 || report[1].Addr != "b@example.com" {
+		t.Fatal("unexpected report:", report, err)
+	}
+	// The submitter encrypts the spec it adds recipients_ndjson to
+	// under a new data key, and the worker the results under another.
+	if n := kmsSvc.ndecrypted; n != 4 {
+		t.Fatal("expected each data key to be decrypted once:", n)
+	}
+	if results, _ := readJobFile(path.Join(dir, "done", basename), resultsKey(0)); len(results) == 0 || bytes.Contains(results, []byte("b@example.com")) {
+		t.Fatal("expected the results to be encrypted")
+	}
+	// Copies of the recipients are encrypted too.
+	resent, err := ResendTo(dir, basename, []string{"b@example.com"})
+	if err != nil {
+		t.Fatal("ResendTo", err)
+	}
+	stored, _ = readJobFile(path.Join(dir, "queue", resent), "spec")
+	if encryptionKeyID(stored) != "alias/mailrail" {
+		t.Fatal("expected the resent spec to be encrypted")
+	}
+}
+
+func TestDataKeyCache(t *testing.T) {
+	kmsSvc := &MockKMS{}
+	dataKeys.svc = kmsSvc
+	defer func() { dataKeys.svc = nil }()
+	var artifacts [][]byte
+	for i := 0; i < dataKeyCacheSize+1; i++ {
+		data, err := Encrypt("alias/mailrail", []byte("secret"))
+		if err != nil {
+			t.Fatal("Encrypt", err)
+		}
+		if _, err := decrypt(data); err != nil {
+			t.Fatal("decrypt", err)
+		}
+		artifacts = append(artifacts, data)
+	}
+	if len(dataKeys.keys) != dataKeyCacheSize || dataKeys.lru.Len() != dataKeyCacheSize {
+		t.Fatal("expected the cache to be bounded:", len(dataKeys.keys))
+	}
+	n := kmsSvc.ndecrypted
+	decrypt(artifacts[len(artifacts)-1])
+	if kmsSvc.ndecrypted != n {
+		t.Fatal("expected a recent data key to be cached")
+	}
+	decrypt(artifacts[0])
+	if kmsSvc.ndecrypted != n+1 {
+		t.Fatal("expected the least recently used data key to be evicted")
+	}
+	envelope, _ := parseEnvelope(artifacts[0])
+	dataKeys.keys[string(envelope.EncryptedKey)].Value.(*cachedDataKey).expires = time.Now().Add(-time.Second)
+	decrypt(artifacts[0])
+	if kmsSvc.ndecrypted != n+2 {
+		t.Fatal("expected an expired data key to be decrypted again")
+	}
+}
+
+func TestEncryptedFailureReportAndSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_kms_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	dataKeys.svc = &MockKMS{}
+	defer func() { dataKeys.svc = nil }()
+	ioutil.WriteFile(path.Join(dir, "recipients.ndjson"), []byte(`{"addr": "a@example.com"}
+{"addr": "b@example.com"}`), 0644)
+	spec, err := Encrypt("alias/mailrail", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"error_policy": "skip-recipient", "recipients_ref": "file:recipients.ndjson"}`))
+	if err != nil {
+		t.Fatal("Encrypt", err)
+	}
+	basename, err := NewSubmitter(path.Join(dir, "queue")).Submit(spec)
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	Process(path.Join(dir, "queue"), UseMockSesService(&FlakySES{failAddr: "b@example.com"}), WithRecipientsDir(dir))
+	jobDir := path.Join(dir, "queue", "done", basename)
+	for _, key := range []string{recipientsRefSnapshotKey, failureReportKey} {
+		if data, _ := readJobFile(jobDir, key); encryptionKeyID(data) != "alias/mailrail" {
+			t.Fatal("expected to be encrypted:", key)
+		}
+	}
+	report, err := GetFailureReport(path.Join(dir, "queue"), basename)
+	if err != nil || report == nil || len(report.Unsent) != 1 || report.Unsent[0].Addr != "b@example.com" {
+		t.Fatal("expected the failure report to be decrypted:", report, err)
+	}
+}
@@ -0,0 +1,272 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// Workers that share a queue directory, on one host or several, can
+// take leases on the jobs they take. A worker records in the job's
+// "lease" artifact who it is and when the lease expires, and renews
+// the lease while it processes the job. Other workers put jobs whose
+// leases have expired back in the queue when they look for jobs, so
+// the jobs of a worker that died are taken up again from their
+// checkpoints without waiting for a worker to start. A worker that
+// finds that it lost the lease on its job stops processing it.
+// Jobs that were taken without a lease are left alone. All workers on
+// a queue should use leases of the same length.
+//
+// SQS queues lease jobs by themselves, and Redis and Postgres queues
+// lease every job they give out; see `SQSQueue`, `RedisQueue`, and
+// `PostgresQueue`.
+const leaseKey = "lease"
+
+// A Lease says which worker holds a job, and until when.
+type Lease struct {
+	Worker  string    `json:"worker"`
+	Expires time.Time `json:"expires"`
+}
+
+// Take leases on the jobs taken from queue directories that last for
+// d unless they are renewed. Workers renew them every third of d.
+func WithLeases(d time.Duration) Option {
+	return func(o *options) {
+		o.lease = d
+	}
+}
+
+// Identify the worker in the leases it takes. By default, workers are
+// identified by hostname and process ID.
+func WithWorkerID(id string) Option {
+	return func(o *options) {
+		o.workerID = id
+	}
+}
+
+func (o *options) worker() string {
+	if o.workerID != "" {
+		return o.workerID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// leaseToken returns a new token that tells the lease a worker takes
+// on a job in a shared store from those taken before and after.
+func leaseToken() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// A job that the worker holds a lease on. leaseDuration tells how
+// long the lease lasts when it is taken. renewLease renews the lease
+// and returns how long it lasts, or fails if the lease was lost, after
+// which leaseLost tells the worker to stop processing the job.
+type leasedJob interface {
+	leaseDuration() time.Duration
+	renewLease() (time.Duration, error)
+	leaseLost() bool
+}
+
+// A leasedDirJob is a job in a queue directory that the worker holds
+// a lease on. The lease is renewed where the job is while it is being
+// processed, so that it cannot be renewed once the job has moved on,
+// and not after it has expired, as the job may have been taken by
+// another worker since.
+type leasedDirJob struct {
+	dirJob
+	worker string
+	d      time.Duration
+	lost   int32
+}
+
+func (job *leasedDirJob) leaseDuration() time.Duration {
+	return job.d
+}
+
+func (job *leasedDirJob) renewLease() (time.Duration, error) {
+	jobDir := path.Join(job.dir, "cur", job.Basename)
+	now := time.Now()
+	lease, err := readLease(jobDir)
+	switch {
+	case err != nil:
+	case lease == nil:
+		err = fmt.Errorf("Job %s is no longer being processed", job.Basename)
+	case lease.Worker != job.worker:
+		err = fmt.Errorf("Job %s was leased by worker %s", job.Basename, lease.Worker)
+	case now.After(lease.Expires):
+		// Another worker may have put it back in the queue.
+		err = fmt.Errorf("Lease on job %s expired at %s", job.Basename, lease.Expires.Format(time.RFC3339))
+	default:
+		err = writeLease(jobDir, Lease{Worker: job.worker, Expires: now.Add(job.d)})
+	}
+	if err != nil {
+		atomic.StoreInt32(&job.lost, 1)
+		return 0, err
+	}
+	return job.d, nil
+}
+
+func (job *leasedDirJob) leaseLost() bool {
+	return atomic.LoadInt32(&job.lost) != 0
+}
+
+// Fail and Finish remove the worker's lease before the job leaves
+// cur/, so that it is not found expired there after the job is taken
+// again, such as when a scheduled or paused job is woken up or
+// resumed, and reclaimed from whichever worker took it.
+func (job *leasedDirJob) Fail() error {
+	job.dropLease()
+	return job.dirJob.Fail()
+}
+
+func (job *leasedDirJob) Finish() error {
+	job.dropLease()
+	return job.dirJob.Finish()
+}
+
+// dropLease removes the lease on the job if the worker still holds it.
+func (job *leasedDirJob) dropLease() {
+	if job.leaseLost() {
+		return
+	}
+	jobDir := path.Join(job.dir, "cur", job.Basename)
+	lease, err := readLease(jobDir)
+	if err == nil && (lease == nil || lease.Worker != job.worker) {
+		return
+	}
+	if err == nil {
+		err = os.Remove(path.Join(jobDir, leaseKey))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove lease of job %s: %s", job.Basename, err)
+	}
+}
+
+func readLease(jobDir string) (*Lease, error) {
+	return readLeaseFile(path.Join(jobDir, leaseKey))
+}
+
+func readLeaseFile(filename string) (*Lease, error) {
+	leaseBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lease Lease
+	if err := json.Unmarshal(leaseBytes, &lease); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of %s: %s", leaseKey, err)
+	}
+	return &lease, nil
+}
+
+func writeLease(jobDir string, lease Lease) error {
+	leaseBytes, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return writeJobFile(jobDir, leaseKey, leaseBytes)
+}
+
+// GetLease returns the lease on a job that is being processed, or nil
+// if it has none.
+func GetLease(queueDir, basename string) (*Lease, error) {
+	return readLease(path.Join(queueDir, "cur", basename))
+}
+
+// reclaimExpiredLeases puts the jobs being processed whose leases
+// expired before now back in the queue. A worker claims an expired
+// lease by moving it aside, so that only one worker reclaims the job,
+// and removes it before the job goes back in the queue, so that no
+// worker can find the expired lease again once the job has been taken
+// and not yet leased.
+func reclaimExpiredLeases(queueDir string, now time.Time) error {
+	basenames, err := listJobs(queueDir, "cur")
+	if err != nil {
+		return err
+	}
+	for _, basename := range basenames {
+		dir := path.Join(queueDir, "cur", basename)
+		lease, err := readLease(dir)
+		if err != nil {
+			log.Printf("Failed to read lease of job %s: %s", basename, err)
+			continue
+		}
+		if lease == nil || now.Before(lease.Expires) {
+			continue
+		}
+		lease, err = claimExpiredLease(dir, now)
+		if err != nil {
+			log.Printf("Failed to reclaim job %s: %s", basename, err)
+			continue
+		}
+		if lease == nil {
+			// Another worker reclaimed it, or it was done or leased
+			// again.
+			continue
+		}
+		if err := os.Rename(dir, path.Join(queueDir, "queue", basename)); err != nil {
+			log.Printf("Failed to put job %s back in the queue: %s", basename, err)
+			continue
+		}
+		log.Printf("Job %s put back in the queue: lease of worker %s expired at %s", basename, lease.Worker, lease.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// claimExpiredLease moves the lease of a job aside, where no other
+// worker can claim it, and removes it if it has expired. If it has not,
+// because the job was leased again since the lease was read, it is put
+// back. It returns the expired lease, or nil if there was none to
+// claim.
+func claimExpiredLease(jobDir string, now time.Time) (*Lease, error) {
+	claimed := path.Join(jobDir, fmt.Sprintf(".%s.%d.%d.claimed", leaseKey, os.Getpid(), time.Now().UnixNano()))
+	if err := os.Rename(path.Join(jobDir, leaseKey), claimed); err != nil {
+		return nil, nil
+	}
+	lease, err := readLeaseFile(claimed)
+	if err != nil || lease == nil || now.Before(lease.Expires) {
+		if restoreErr := os.Rename(claimed, path.Join(jobDir, leaseKey)); err == nil {
+			err = restoreErr
+		}
+		return nil, err
+	}
+	return lease, os.Remove(claimed)
+}
+
+// takeLease takes the lease on a job that was just taken, replacing
+// that of any worker that held it before.
+func (job *leasedDirJob) takeLease() error {
+	return writeLease(path.Join(job.dir, "cur", job.Basename), Lease{Worker: job.worker, Expires: time.Now().Add(job.d)})
+}
+
+// heartbeat renews the lease on a job until stop is closed.
+func heartbeat(name string, job leasedJob, stop <-chan struct{}) {
+	d := job.leaseDuration()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(d / 3):
+		}
+		var err error
+		if d, err = job.renewLease(); err != nil {
+			log.Printf("Job %s lost its lease: %s", name, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lease_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	j.Submit()
+	a, err := openDirQueue(dir)
+	if err != nil {
+		t.Fatal("openDirQueue", err)
+	}
+	a.worker, a.lease = "a", time.Hour
+	b, err := openDirQueue(dir)
+	if err != nil {
+		t.Fatal("openDirQueue", err)
+	}
+	b.worker, b.lease = "b", time.Hour
+	job, err := a.Take()
+	if err != nil || job == nil {
+		t.Fatal("expected to take the job:", err)
+	}
+	if lease, err := GetLease(dir, job.Name()); err != nil || lease == nil || lease.Worker != "a" {
+		t.Fatal("expected worker a to hold the lease:", lease, err)
+	}
+	if job, _ := b.Take(); job != nil {
+		t.Fatal("expected a leased job not to be taken:", job.Name())
+	}
+	// Worker a stops renewing its lease.
+	writeLease(path.Join(dir, "cur", job.Name()), Lease{Worker: "a", Expires: time.Now().Add(-time.Minute)})
+	reclaimed, err := b.Take()
+	if err != nil || reclaimed == nil || reclaimed.Name() != job.Name() {
+		t.Fatal("expected worker b to take the job with the expired lease:", reclaimed, err)
+	}
+	if lease, err := GetLease(dir, job.Name()); err != nil || lease == nil || lease.Worker != "b" {
+		t.Fatal("expected worker b to hold the lease:", lease, err)
+	}
+	leased := job.(leasedJob)
+	if _, err := leased.renewLease(); err == nil || !leased.leaseLost() {
+		t.Fatal("expected worker a to find that it lost the lease")
+	}
+	svc := MockSES{}
+	processJob(&svc, job, DoNotMangle, newOptions(nil))
+	if svc.nsent != 0 {
+		t.Fatal("expected worker a to stop processing the job:", svc.nsent)
+	}
+	if _, err := os.Stat(path.Join(dir, "cur", job.Name())); err != nil {
+		t.Fatal("expected the job to be left to worker b:", err)
+	}
+	processJob(&svc, reclaimed, DoNotMangle, newOptions(nil))
+	if svc.nsent != 1 {
+		t.Fatal("expected worker b to send:", svc.nsent)
+	}
+}
+
+func TestReclaimRemovesExpiredLease(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lease_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	for _, name := range []string{"foo", "bar"} {
+		j, err := q.CreateJob(name)
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello"}`))
+		j.Submit()
+	}
+	a, _ := openDirQueue(dir)
+	a.worker, a.lease = "a", time.Hour
+	expired, _ := a.Take()
+	live, _ := a.Take()
+	writeLease(path.Join(dir, "cur", expired.Name()), Lease{Worker: "a", Expires: time.Now().Add(-time.Minute)})
+	// A worker that starts up leaves the job with a live lease alone.
+	b, _ := openDirQueue(dir)
+	b.worker, b.lease = "b", time.Hour
+	if err := b.Rescue(); err != nil {
+		t.Fatal("Rescue", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "cur", live.Name())); err != nil {
+		t.Fatal("expected the job with a live lease to be left alone:", err)
+	}
+	if lease, err := readLease(path.Join(dir, "queue", expired.Name())); err != nil || lease != nil {
+		t.Fatal("expected the expired lease to be removed before the job went back in the queue:", lease, err)
+	}
+	// A job with a lease that was renewed since it was read is not
+	// claimed.
+	if lease, err := claimExpiredLease(path.Join(dir, "cur", live.Name()), time.Now()); err != nil || lease != nil {
+		t.Fatal("expected a live lease not to be claimed:", lease, err)
+	}
+	if lease, err := GetLease(dir, live.Name()); err != nil || lease == nil || lease.Worker != "a" {
+		t.Fatal("expected the live lease to be put back:", lease, err)
+	}
+}
+
+func TestLeaseRemovedWhenJobLeavesCur(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lease_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"not_before": "`+time.Now().Add(time.Hour).Format(time.RFC3339)+`", "recipients": [{"addr": "a@example.com"}]}`))
+	j.Submit()
+	a, _ := openDirQueue(dir)
+	a.worker, a.lease = "a", time.Hour
+	job, _ := a.Take()
+	svc := MockSES{}
+	processJob(&svc, job, DoNotMangle, newOptions(nil))
+	if !isScheduled(path.Join(dir, "failed", job.Name())) {
+		t.Fatal("expected the job to be scheduled")
+	}
+	if lease, err := readLease(path.Join(dir, "failed", job.Name())); err != nil || lease != nil {
+		t.Fatal("expected the lease to be removed when the job left cur/:", lease, err)
+	}
+	// A job that still has a lease from before is taken without it.
+	writeLease(path.Join(dir, "failed", job.Name()), Lease{Worker: "a", Expires: time.Now().Add(-time.Minute)})
+	if err := wakeJob(dir, job.Name()); err != nil {
+		t.Fatal("wakeJob", err)
+	}
+	b, _ := openDirQueue(dir)
+	if job, _ := b.Take(); job == nil {
+		t.Fatal("expected the job to be taken")
+	}
+	if lease, err := GetLease(dir, job.Name()); err != nil || lease != nil {
+		t.Fatal("expected the stale lease to be removed when the job was taken:", lease, err)
+	}
+}
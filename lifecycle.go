@@ -0,0 +1,210 @@
+package mailrail
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A JobWebhook is a webhook in a spec that is notified of the
+// lifecycle of that job. Secret is a secret reference as accepted by
+// `LookupSecret`, so that specs need not contain the secret itself.
+// If Every is positive, the webhook is also notified after every
+// Every recipients. The webhook is ignored unless the worker allows
+// its host and secret with `WithSpecWebhooks`.
+type JobWebhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	Every  int    `json:"every"`
+}
+
+// The payload of lifecycle webhook calls. Event is one of
+// "job.started", "job.progress", "job.finished", "job.failed",
+// "job.cancelled", and "job.paused". Processed is the number of
+// recipients the job has gotten through.
+type LifecycleEvent struct {
+	Event           string    `json:"event"`
+	Job             string    `json:"job"`
+	Recipients      int       `json:"recipients,omitempty"`
+	Processed       int       `json:"processed"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+// The number of lifecycle events that can wait for delivery before
+// progress events are dropped.
+const lifecycleBacklog = 1000
+
+// A LifecycleObserver calls a webhook when jobs start, finish, fail,
+// are cancelled or paused, and, optionally, after every so many
+// recipients. Calls are made in order from a separate goroutine, so
+// that slow webhooks do not hold up sending.
+type LifecycleObserver struct {
+	queue  *webhookQueue
+	every  int
+	mu     sync.Mutex
+	totals map[string]int
+}
+
+// A webhookQueue delivers payloads to a webhook in order from its own
+// goroutine.
+type webhookQueue struct {
+	webhook  *Webhook
+	payloads chan interface{}
+	done     chan struct{}
+}
+
+func newWebhookQueue(webhook *Webhook) *webhookQueue {
+	q := &webhookQueue{
+		webhook:  webhook,
+		payloads: make(chan interface{}, lifecycleBacklog),
+		done:     make(chan struct{})}
+	go q.deliver()
+	return q
+}
+
+func (q *webhookQueue) deliver() {
+	for payload := range q.payloads {
+		if err := q.webhook.Deliver(payload); err != nil {
+			log.Println(err)
+		}
+	}
+	close(q.done)
+}
+
+// add queues a payload. If the queue is full, optional payloads are
+// dropped and others wait for room.
+func (q *webhookQueue) add(payload interface{}, optional bool) {
+	if !optional {
+		q.payloads <- payload
+		return
+	}
+	select {
+	case q.payloads <- payload:
+	default:
+		log.Printf("Dropped webhook call; %s is behind", q.webhook.URL)
+	}
+}
+
+func (q *webhookQueue) close() {
+	close(q.payloads)
+	<-q.done
+}
+
+// Returns an observer that calls webhook. If every is positive, it
+// also reports progress after every `every` recipients.
+func NewLifecycleObserver(webhook *Webhook, every int) *LifecycleObserver {
+	return &LifecycleObserver{
+		queue:  newWebhookQueue(webhook),
+		every:  every,
+		totals: make(map[string]int)}
+}
+
+func (lo *LifecycleObserver) Observe(e Event) {
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	le := LifecycleEvent{Job: e.Job, Processed: e.Recipient, Time: time.Now()}
+	switch e.Type {
+	case JobStarted:
+		lo.totals[e.Job] = e.Recipients
+		le.Event = "job.started"
+		le.Recipients = e.Recipients
+	case MessageSent, Skipped:
+		if lo.every <= 0 || (e.Recipient+1)%lo.every != 0 {
+			return
+		}
+		le.Event = "job.progress"
+		le.Recipients = lo.totals[e.Job]
+		le.Processed = e.Recipient + 1
+		lo.queue.add(le, true)
+		return
+	case JobFinished:
+		le.Event = "job.finished"
+		le.Recipients = e.Recipients
+		le.Processed = e.Recipients
+	case JobFailed:
+		le.Event = "job.failed"
+		le.Recipients = lo.totals[e.Job]
+	case JobCancelled:
+		le.Event = "job.cancelled"
+		le.Recipients = e.Recipients
+	case JobPaused:
+		le.Event = "job.paused"
+		le.Recipients = e.Recipients
+	default:
+		return
+	}
+	if e.Duration > 0 {
+		le.DurationSeconds = e.Duration.Seconds()
+	}
+	if le.Event != "job.started" {
+		delete(lo.totals, e.Job)
+	}
+	lo.queue.add(le, false)
+}
+
+// Close waits for pending calls to be delivered or dead-lettered.
+// The observer must not be notified after it is closed.
+func (lo *LifecycleObserver) Close() {
+	lo.queue.close()
+}
+
+// Let specs have webhooks on the given hosts, signed with the given
+// secret references. Without allowed hosts, spec webhooks are ignored,
+// so that whoever can submit a spec cannot make the worker call any
+// URL it can reach or sign calls with any secret it can look up.
+func WithSpecWebhooks(hosts, secrets []string) Option {
+	return func(o *options) {
+		o.specWebhookHosts = hosts
+		o.specWebhookSecrets = secrets
+	}
+}
+
+// specWebhookAllowed tells whether the options allow a spec's webhook.
+func (o *options) specWebhookAllowed(jw *JobWebhook) error {
+	u, err := url.Parse(jw.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Webhook URL %q is not an HTTP URL", jw.URL)
+	}
+	if !containsFold(o.specWebhookHosts, u.Hostname()) && !containsFold(o.specWebhookHosts, u.Host) {
+		return fmt.Errorf("Webhook host %s is not allowed", u.Host)
+	}
+	if jw.Secret != "" && !contains(o.specWebhookSecrets, jw.Secret) {
+		return fmt.Errorf("Webhook secret %s is not allowed", jw.Secret)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// newJobLifecycleObserver returns an observer for a spec's webhook.
+func newJobLifecycleObserver(jw *JobWebhook) (*LifecycleObserver, error) {
+	var secret []byte
+	if jw.Secret != "" {
+		var err error
+		secret, err = LookupSecret(jw.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewLifecycleObserver(NewWebhook(jw.URL, secret, ""), jw.Every), nil
+}
@@ -0,0 +1,114 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSpecWebhook(t *testing.T) {
+	os.Setenv("MAILRAIL_TEST_WEBHOOK_SECRET", "s3cret")
+	defer os.Unsetenv("MAILRAIL_TEST_WEBHOOK_SECRET")
+	var mu sync.Mutex
+	var events []LifecycleEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !VerifyWebhookSignature([]byte("s3cret"), r.Header.Get("X-Mailrail-Timestamp"), r.Header.Get("X-Mailrail-Signature"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e LifecycleEvent
+		json.Unmarshal(body, &e)
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lifecycle_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"webhook": {"url": "`+server.URL+`", "secret": "env:MAILRAIL_TEST_WEBHOOK_SECRET", "every": 2},
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	serverURL, _ := url.Parse(server.URL)
+	Process(dir, UseMockSesService(&MockSES{}), WithSpecWebhooks([]string{serverURL.Hostname()}, []string{"env:MAILRAIL_TEST_WEBHOOK_SECRET"}))
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatal("expected 3 events, not", events)
+	}
+	if events[0].Event != "job.started" || events[0].Recipients != 3 {
+		t.Fatal("unexpected first event:", events[0])
+	}
+	if events[1].Event != "job.progress" || events[1].Processed != 2 || events[1].Recipients != 3 {
+		t.Fatal("unexpected progress event:", events[1])
+	}
+	if events[2].Event != "job.finished" || events[2].Job != j.Basename || events[2].Processed != 3 {
+		t.Fatal("unexpected last event:", events[2])
+	}
+}
+
+func TestSpecWebhookNotAllowed(t *testing.T) {
+	os.Setenv("MAILRAIL_TEST_WEBHOOK_SECRET", "s3cret")
+	defer os.Unsetenv("MAILRAIL_TEST_WEBHOOK_SECRET")
+	var mu sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lifecycle_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	for _, opt := range []Option{
+		func(o *options) {},
+		WithSpecWebhooks([]string{"example.com"}, []string{"env:MAILRAIL_TEST_WEBHOOK_SECRET"}),
+		WithSpecWebhooks([]string{serverURL.Hostname()}, nil)} {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"webhook": {"url": "`+server.URL+`", "secret": "env:MAILRAIL_TEST_WEBHOOK_SECRET"},
+"recipients": [{"addr": "a@example.com"}]
+}`))
+		j.Submit()
+		svc := MockSES{}
+		Process(dir, UseMockSesService(&svc), opt)
+		if svc.nsent != 1 {
+			t.Fatal("expected the job to be sent without its webhook, not", svc.nsent)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 0 {
+		t.Fatal("expected webhooks that are not allowed to be ignored, not", calls)
+	}
+}
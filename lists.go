@@ -0,0 +1,153 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A ListStore is a directory of named recipient lists, one JSON file
+// per list. Specs can name a list in their `list` field instead of
+// embedding recipients; the worker then snapshots the list into the
+// job when it first takes it, so that the job sends to the same
+// recipients even if the list changes while it runs.
+type ListStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+var listNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Opens a list store, creating the directory if it does not exist.
+func OpenListStore(dir string) (*ListStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ListStore{dir: dir}, nil
+}
+
+func (ls *ListStore) filename(name string) (string, error) {
+	if !listNameRegexp.MatchString(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Invalid list name %q", name)
+	}
+	return path.Join(ls.dir, name+".json"), nil
+}
+
+// Lists returns the names of the lists in the store.
+func (ls *ListStore) Lists() ([]string, error) {
+	fis, err := ioutil.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(fi.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateList creates an empty list.
+func (ls *ListStore) CreateList(name string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	filename, err := ls.filename(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("List %s already exists", name)
+	}
+	return ls.write(name, []Recipient{})
+}
+
+// Members returns the members of a list.
+func (ls *ListStore) Members(name string) ([]Recipient, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.read(name)
+}
+
+// AddMember adds a recipient to a list, replacing any member with the
+// same address.
+func (ls *ListStore) AddMember(name string, member Recipient) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	members, err := ls.read(name)
+	if err != nil {
+		return err
+	}
+	for i, m := range members {
+		if normalizeAddr(m.Addr) == normalizeAddr(member.Addr) {
+			members[i] = member
+			return ls.write(name, members)
+		}
+	}
+	return ls.write(name, append(members, member))
+}
+
+// RemoveMember removes the member with an address from a list.
+func (ls *ListStore) RemoveMember(name, addr string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	members, err := ls.read(name)
+	if err != nil {
+		return err
+	}
+	for i, m := range members {
+		if normalizeAddr(m.Addr) == normalizeAddr(addr) {
+			return ls.write(name, append(members[:i], members[i+1:]...))
+		}
+	}
+	return fmt.Errorf("%s is not a member of list %s", addr, name)
+}
+
+func (ls *ListStore) read(name string) ([]Recipient, error) {
+	filename, err := ls.filename(name)
+	if err != nil {
+		return nil, err
+	}
+	listBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No list %s", name)
+		}
+		return nil, err
+	}
+	var members []Recipient
+	if err := unmarshalJSON(listBytes, &members); err != nil {
+		return nil, fmt.Errorf("Cannot parse list %s: %s", name, err)
+	}
+	return members, nil
+}
+
+func (ls *ListStore) write(name string, members []Recipient) error {
+	filename, err := ls.filename(name)
+	if err != nil {
+		return err
+	}
+	listBytes, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, listBytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Resolve recipient lists named in specs with this list store.
+func WithListStore(lists *ListStore) Option {
+	return func(o *options) {
+		o.lists = lists
+	}
+}
@@ -0,0 +1,69 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListStore(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lists_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	lists, err := OpenListStore(path.Join(dir, "lists"))
+	if err != nil {
+		t.Fatal("OpenListStore", err)
+	}
+	if err := lists.CreateList("pets"); err != nil {
+		t.Fatal("CreateList", err)
+	}
+	if err := lists.CreateList("pets"); err == nil {
+		t.Fatal("expected error when creating existing list")
+	}
+	if err := lists.CreateList("../pets"); err == nil {
+		t.Fatal("expected error for invalid list name")
+	}
+	lists.AddMember("pets", Recipient{Addr: "janedoe@example.com", Context: map[string]interface{}{"pet_name": "Janie"}})
+	lists.AddMember("pets", Recipient{Addr: "jimdoe@example.com", Context: map[string]interface{}{"pet_name": "Jim"}})
+	lists.AddMember("pets", Recipient{Addr: "JimDoe@example.com", Context: map[string]interface{}{"pet_name": "Jimmy"}})
+	members, err := lists.Members("pets")
+	if err != nil {
+		t.Fatal("Members", err)
+	}
+	if len(members) != 2 || members[1].Context["pet_name"] != "Jimmy" {
+		t.Fatal("unexpected members:", members)
+	}
+
+	q, err := pqueue.OpenQueue(path.Join(dir, "queue"))
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.pet_name}}",
+"list": "pets"
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions([]Option{WithListStore(lists)}))
+	if svc.nsent != 2 || *svc.sent.Message.Body.Text.Data != "Hello, Jimmy" {
+		t.Fatal("unexpected messages:", svc.nsent, *svc.sent.Message.Body.Text.Data)
+	}
+
+	// Later changes to the list do not affect the job.
+	if err := lists.RemoveMember("pets", "janedoe@example.com"); err != nil {
+		t.Fatal("RemoveMember", err)
+	}
+	spec, err := readJobSpec(path.Join(dir, "queue", "done", j.Basename))
+	if err != nil {
+		t.Fatal("readJobSpec", err)
+	}
+	if len(spec.Recipients) != 2 || spec.Recipients[0].Addr != "janedoe@example.com" {
+		t.Fatal("unexpected snapshot:", spec.Recipients)
+	}
+}
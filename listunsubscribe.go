@@ -0,0 +1,65 @@
+package mailrail
+
+import "strings"
+
+// ListUnsubscribe says how a spec's messages offer to unsubscribe in
+// their List-Unsubscribe header (RFC 2369): by mail to the Mailto
+// address, with the subject "unsubscribe", and, if OneClick is set,
+// by an RFC 8058 one-click POST to the worker's unsubscribe URL (see
+// `WithUnsubscribeLinks`). Specs without it get a one-click header on
+// marketing messages if the worker has unsubscribe links.
+type ListUnsubscribe struct {
+	Mailto   string `json:"mailto"`
+	OneClick bool   `json:"one_click"`
+}
+
+// listUnsubscribeHeaders returns the List-Unsubscribe headers of the
+// message to recipient i, if it has any.
+func (mailing *mailing) listUnsubscribeHeaders(i int) ([][2]string, error) {
+	lu := mailing.spec.ListUnsubscribe
+	if lu == nil {
+		stream, err := computeStream(*mailing, i)
+		if err != nil {
+			return nil, err
+		}
+		if mailing.opts.unsubscribe == nil || stream != MarketingStream {
+			return nil, nil
+		}
+		lu = &ListUnsubscribe{OneClick: true}
+	}
+	var uris []string
+	if lu.OneClick {
+		u, err := mailing.unsubscribeURL(i)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, "<"+u+">")
+	}
+	if lu.Mailto != "" {
+		uris = append(uris, "<mailto:"+lu.Mailto+"?subject=unsubscribe>")
+	}
+	if len(uris) == 0 {
+		return nil, nil
+	}
+	headers := [][2]string{{"List-Unsubscribe", strings.Join(uris, ", ")}}
+	if lu.OneClick {
+		headers = append(headers, [2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	return headers, nil
+}
+
+// isRaw tells whether the message to recipient i must be sent with
+// SendRawEmail, because it has AMP or headers that SendEmail cannot
+// set.
+func (mailing *mailing) isRaw(i int) (bool, error) {
+	if variant, err := mailing.variant(i); err != nil {
+		return false, err
+	} else if variant != mailing {
+		return variant.isRaw(i)
+	}
+	if mailing.ampTemplate != nil {
+		return true, nil
+	}
+	headers, err := mailing.listUnsubscribeHeaders(i)
+	return len(headers) > 0, err
+}
@@ -0,0 +1,66 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestListUnsubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_listunsubscribe_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	send := func(spec string) (*MockSES, *mail.Message) {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(spec))
+		j.Submit()
+		svc := &MockSES{}
+		Process(dir, UseMockSesService(svc), WithUnsubscribeLinks("https://example.com/unsubscribe", []byte("secret")))
+		if svc.sentRaw == nil {
+			return svc, nil
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(string(svc.sentRaw.RawMessage.Data)))
+		if err != nil {
+			t.Fatal("cannot parse raw message", err)
+		}
+		return svc, msg
+	}
+
+	_, msg := send(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", "html": "<p>Hello</p>",
+"recipients": [{"addr": "a@example.com"}]}`)
+	if msg == nil {
+		t.Fatal("expected a marketing message to be sent raw")
+	}
+	if !strings.HasPrefix(msg.Header.Get("List-Unsubscribe"), "<https://example.com/unsubscribe?token=") ||
+		msg.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Fatal("unexpected headers:", msg.Header)
+	}
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/alternative") {
+		t.Fatal("unexpected content type:", msg.Header.Get("Content-Type"))
+	}
+
+	_, msg = send(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"list_unsubscribe": {"mailto": "unsubscribe@example.com"},
+"recipients": [{"addr": "a@example.com"}]}`)
+	if msg == nil || msg.Header.Get("List-Unsubscribe") != "<mailto:unsubscribe@example.com?subject=unsubscribe>" || msg.Header.Get("List-Unsubscribe-Post") != "" {
+		t.Fatal("unexpected mailto header:", msg)
+	}
+
+	svc, msg := send(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", "stream": "transactional",
+"recipients": [{"addr": "a@example.com"}]}`)
+	if msg != nil || svc.sent == nil {
+		t.Fatal("expected a transactional message to be sent without List-Unsubscribe")
+	}
+}
@@ -0,0 +1,83 @@
+package mailrail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// sendEmailHash returns the hex SHA-256 of a message that SES builds
+// from its parts: sender, recipient, subject, and each body, separated
+// by NUL bytes.
+func sendEmailHash(params *ses.SendEmailInput) string {
+	var content bytes.Buffer
+	content.WriteString(*params.Source)
+	content.WriteByte(0)
+	content.WriteString(*params.Destination.ToAddresses[0])
+	content.WriteByte(0)
+	content.WriteString(*params.Message.Subject.Data)
+	for _, body := range []*string{params.Message.Body.Text.Data, params.Message.Body.Html.Data} {
+		content.WriteByte(0)
+		if body != nil {
+			content.WriteString(*body)
+		}
+	}
+	return rawHash(content.Bytes())
+}
+
+// rawHash returns the hex SHA-256 of a message sent as it is, such as
+// a raw MIME message.
+func rawHash(msg []byte) string {
+	sum := sha256.Sum256(msg)
+	return hex.EncodeToString(sum[:])
+}
+
+// What a job sent with a given SES Message-ID.
+type MessageInfo struct {
+	Job      string `json:"job"`
+	State    string `json:"state"`
+	Campaign string `json:"campaign,omitempty"`
+	Subject  string `json:"subject"`
+	Result
+}
+
+// LookupMessage finds the job and recipient that an SES Message-ID
+// was sent to, for answering questions from AWS support or mailbox
+// providers about a specific message. It searches the results of
+// every job in the queue.
+func LookupMessage(queueDir, messageId string) (MessageInfo, error) {
+	for _, state := range jobStates {
+		basenames, err := listJobs(queueDir, state)
+		if err != nil {
+			return MessageInfo{}, err
+		}
+		for _, basename := range basenames {
+			dir, err := findJob(queueDir, basename)
+			if err != nil {
+				continue
+			}
+			spec, err := readJobSpec(dir)
+			if err != nil {
+				return MessageInfo{}, fmt.Errorf("Job %s: %s", basename, err)
+			}
+			get := func(key string) ([]byte, error) { return readJobFile(dir, key) }
+			results, err := getResults(get, len(spec.Recipients))
+			if err != nil {
+				return MessageInfo{}, fmt.Errorf("Job %s: %s", basename, err)
+			}
+			for _, r := range results {
+				if r.MessageId != messageId {
+					continue
+				}
+				subject := spec.Subject
+				if r.Recipient < len(spec.Recipients) && spec.Recipients[r.Recipient].Subject != "" {
+					subject = spec.Recipients[r.Recipient].Subject
+				}
+				return MessageInfo{basename, stateOfJobDir(dir), spec.Campaign, subject, r}, nil
+			}
+		}
+	}
+	return MessageInfo{}, fmt.Errorf("No message with Message-ID %s in queue %s", messageId, queueDir)
+}
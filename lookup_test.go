@@ -0,0 +1,87 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// A mock SES service that gives each message a distinct Message-ID.
+type CountingSES struct {
+	MockSES
+}
+
+func (svc *CountingSES) SendEmail(input *ses.SendEmailInput) (*ses.SendEmailOutput, error) {
+	svc.MockSES.SendEmail(input)
+	messageId := "msg-" + strconv.Itoa(svc.nsent)
+	return &ses.SendEmailOutput{MessageId: &messageId}, nil
+}
+
+func TestLookupMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lookup_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.pet_name}}",
+"recipients": [
+  {"addr": "janedoe@example.com", "context": {"pet_name": "Janie"}},
+  {"addr": "jimdoe@example.com", "context": {"pet_name": "Jimmy"}}
+]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(&CountingSES{}))
+	info, err := LookupMessage(dir, "msg-2")
+	if err != nil {
+		t.Fatal("LookupMessage", err)
+	}
+	if info.Job != j.Basename || info.State != "done" || info.Recipient != 1 || info.Addr != "jimdoe@example.com" || info.Subject != "Hello" {
+		t.Fatal("unexpected message info:", info)
+	}
+	first, err := LookupMessage(dir, "msg-1")
+	if err != nil {
+		t.Fatal("LookupMessage", err)
+	}
+	if len(info.ContentHash) != 64 || info.ContentHash == first.ContentHash {
+		t.Fatal("expected distinct content hashes:", info.ContentHash, first.ContentHash)
+	}
+	if _, err := LookupMessage(dir, "msg-3"); err == nil {
+		t.Fatal("expected error for unknown Message-ID")
+	}
+}
+
+func TestRawContentHash(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_lookup_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"html": "<p>Hello</p>", "amp": "<p>Hello</p>", "recipients": [{"addr": "janedoe@example.com"}]}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	results, err := GetResults(dir, j.Basename)
+	if err != nil || len(results) != 1 {
+		t.Fatal("GetResults", results, err)
+	}
+	if svc.sentRaw == nil || results[0].ContentHash != rawHash(svc.sentRaw.RawMessage.Data) {
+		t.Fatal("expected the hash of the raw message that was sent:", results[0].ContentHash)
+	}
+}
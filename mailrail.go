@@ -11,20 +11,25 @@
 package mailrail
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/ljosa/go-aimdtokenbucket/aimdtokenbucket"
-	"github.com/ljosa/go-pqueue/pqueue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	htemplate "html/template"
 	"log"
 	"net/mail"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	ttemplate "text/template"
+	"text/template/parse"
 	"time"
 )
 
@@ -32,7 +37,8 @@ import (
 // without sending emails to the actual recipeints. There are some
 // predefined manglers (`DoNotMangle`, `DoNotSend`, `SendToSimulator`)
 // and some predefined functions that return manglers (`SendToMe`,
-// `UseMockSesService`). You can also make your own.
+// `SendToSimulatorMix`, `UseMockSesService`). You can also make your
+// own.
 type Mangler struct {
 	ShouldSend bool
 	Mangle     func(addr string) string
@@ -40,18 +46,53 @@ type Mangler struct {
 }
 
 // Wait forever for new jobs and process them.
-func ProcessForever(queueDir string, mangler Mangler) {
-	process(queueDir, foreverMode, mangler)
+func ProcessForever(queueDir string, mangler Mangler, opts ...Option) {
+	process(queueDir, foreverMode, mangler, newOptions(opts))
 }
 
 // Process a single job.
-func ProcessOne(queueDir string, mangler Mangler) {
-	process(queueDir, oneMode, mangler)
+func ProcessOne(queueDir string, mangler Mangler, opts ...Option) {
+	process(queueDir, oneMode, mangler, newOptions(opts))
 }
 
 // Process jobs until there are no more jobs, then stop.
-func Process(queueDir string, mangler Mangler) {
-	process(queueDir, allMode, mangler)
+func Process(queueDir string, mangler Mangler, opts ...Option) {
+	process(queueDir, allMode, mangler, newOptions(opts))
+}
+
+// A queue directory and its share of the jobs that a worker takes
+// from several queues.
+type WeightedQueue struct {
+	Dir    string
+	Weight int
+}
+
+// Wait forever for new jobs in several queues and process them one at
+// a time, so that they share the SES sending rate. While more than one
+// queue has jobs, each queue gets a share of the jobs taken in
+// proportion to its weight.
+func ProcessQueuesForever(queues []WeightedQueue, mangler Mangler, opts ...Option) {
+	processQueues(queues, foreverMode, mangler, newOptions(opts))
+}
+
+// Process jobs from several queues until there are no more jobs, then
+// stop.
+func ProcessQueues(queues []WeightedQueue, mangler Mangler, opts ...Option) {
+	processQueues(queues, allMode, mangler, newOptions(opts))
+}
+
+// Wait forever for new jobs in a job store other than a queue
+// directory, such as an `SQSQueue`, and process them.
+func ProcessJobStoreForever(queue JobStore, mangler Mangler, opts ...Option) {
+	o := newOptions(opts)
+	run([]*queueState{{queue: queue, weight: 1, opts: o}}, foreverMode, mangler, o)
+}
+
+// Process jobs from a job store other than a queue directory until
+// there are no more jobs, then stop.
+func ProcessJobStore(queue JobStore, mangler Mangler, opts ...Option) {
+	o := newOptions(opts)
+	run([]*queueState{{queue: queue, weight: 1, opts: o}}, allMode, mangler, o)
 }
 
 type processMode int
@@ -62,29 +103,93 @@ const (
 	allMode                 = iota
 )
 
-func process(queueDir string, mode processMode, mangler Mangler) {
-	q, err := pqueue.OpenQueue(queueDir)
-	if err != nil {
-		log.Fatalf("Failed to open queue %s: %s", queueDir, err)
+func process(queueDir string, mode processMode, mangler Mangler, o *options) {
+	processQueues([]WeightedQueue{{queueDir, 1}}, mode, mangler, o)
+}
+
+// How often a worker that is told when jobs are submitted looks for
+// scheduled jobs that have come due.
+const notifiedPollInterval = 10 * time.Second
+
+type queueState struct {
+	queue   JobStore
+	weight  int
+	opts    *options
+	current int
+}
+
+func processQueues(queues []WeightedQueue, mode processMode, mangler Mangler, o *options) {
+	var states []*queueState
+	for _, queue := range queues {
+		d, err := openDirQueue(queue.Dir)
+		if err != nil {
+			log.Fatalf("Failed to open queue %s: %s", queue.Dir, err)
+		}
+		d.worker, d.lease = o.worker(), o.lease
+		states = append(states, &queueState{
+			queue:  d,
+			weight: queue.Weight,
+			opts:   o.with(func(o *options) { o.queueDir = d.dir })})
+	}
+	run(states, mode, mangler, o)
+}
+
+func run(states []*queueState, mode processMode, mangler Mangler, o *options) {
+	for _, state := range states {
+		if err := state.queue.Rescue(); err != nil {
+			log.Printf("Failed to rescue jobs of dead workers: %s", err)
+		}
 	}
 	svc := mangler.SesService
 	if svc == nil {
 		svc = ses.New(session.New(), getSesConfig())
 	}
-	q.RescueDeadJobs()
-	for {
-		job, err := q.Take()
-		if err != nil {
-			log.Fatal("Failed to take job:", err)
+	// An idle worker polls every second unless told otherwise. If it
+	// is told when jobs are submitted, it polls only to find scheduled
+	// jobs that have come due, and backs off to doing so every
+	// notifiedPollInterval.
+	minPoll, maxPoll := o.idlePollMin, o.idlePollMax
+	if minPoll == 0 {
+		minPoll, maxPoll = time.Second, time.Second
+	}
+	wake := make(chan struct{}, 1)
+	if mode == foreverMode {
+		notified := true
+		for _, state := range states {
+			if n, ok := state.queue.(notifyingStore); !ok || !n.notify(wake) {
+				notified = false
+			}
 		}
+		if notified && o.idlePollMin == 0 {
+			maxPoll = notifiedPollInterval
+		}
+	}
+	poll := minPoll
+	for {
+		job, state := takeWeighted(states)
 		if job == nil {
 			if mode == foreverMode {
-				time.Sleep(time.Second)
+				select {
+				case <-wake:
+					poll = minPoll
+				case <-time.After(poll):
+					if poll *= 2; poll > maxPoll {
+						poll = maxPoll
+					}
+				}
 			} else {
 				break
 			}
 		} else {
-			processJob(svc, job, mangler)
+			poll = minPoll
+			if leased, ok := job.(leasedJob); ok {
+				stop := make(chan struct{})
+				go heartbeat(job.Name(), leased, stop)
+				processJob(svc, job, mangler, state.opts)
+				close(stop)
+			} else {
+				processJob(svc, job, mangler, state.opts)
+			}
 		}
 		if mode == oneMode {
 			break
@@ -92,6 +197,37 @@ func process(queueDir string, mode processMode, mangler Mangler) {
 	}
 }
 
+// takeWeighted takes a job from one of the queues by smooth weighted
+// round-robin: every queue is credited its weight, the queue with the
+// most credit that has a job gives it, and is charged the total weight.
+// Queues that turn out to be empty lose their credit, so that they do
+// not build up a claim on the worker while idle. Queues that fail to
+// give a job, for instance because their service cannot be reached,
+// are taken to be empty, so that the worker backs off as if idle.
+func takeWeighted(states []*queueState) (Job, *queueState) {
+	total := 0
+	for _, state := range states {
+		state.current += state.weight
+		total += state.weight
+	}
+	byCredit := append([]*queueState(nil), states...)
+	sort.SliceStable(byCredit, func(i, j int) bool { return byCredit[i].current > byCredit[j].current })
+	for _, state := range byCredit {
+		job, err := state.queue.Take()
+		if err != nil {
+			log.Printf("Failed to take job: %s", err)
+		}
+		if job != nil {
+			state.current -= total
+			return job, state
+		}
+		if state.current > 0 {
+			state.current = 0
+		}
+	}
+	return nil, nil
+}
+
 func getSesConfig() *aws.Config {
 	region := os.Getenv("AWS_DEFAULT_REGION")
 	if region == "" {
@@ -101,49 +237,175 @@ func getSesConfig() *aws.Config {
 }
 
 type Recipient struct {
-	Name     string            `json:"name"`
-	Addr     string            `json:"addr"`
-	FromName string            `json:"from_name"`
-	FromAddr string            `json:"from_addr"`
-	Subject  string            `json:"subject"`
-	Context  map[string]string `json:"context"`
+	Name     string                 `json:"name"`
+	Addr     string                 `json:"addr"`
+	FromName string                 `json:"from_name"`
+	FromAddr string                 `json:"from_addr"`
+	Subject  string                 `json:"subject"`
+	Stream   string                 `json:"stream"`
+	Variant  string                 `json:"variant,omitempty"`
+	Context  map[string]interface{} `json:"context"`
+	// The recipient is skipped if the job sends to it before this
+	// time, for instance because of a recent purchase.
+	SuppressUntil *time.Time `json:"suppress_until,omitempty"`
+	// The recipient is not sent to before this time. The job goes
+	// on with the recipients after it and comes back for it.
+	SendAt *time.Time `json:"send_at,omitempty"`
 }
 
 type Spec struct {
-	FromName   string `json:"from_name"`
-	FromAddr   string `json:"from_addr"`
-	Subject    string `json:"subject"`
-	Html       string `json:"html"`
-	Text       string `json:"text"`
-	Recipients []Recipient
+	Version  int    `json:"version,omitempty"`
+	FromName string `json:"from_name"`
+	FromAddr string `json:"from_addr"`
+	Subject  string `json:"subject"`
+	Campaign string `json:"campaign"`
+	Html     string `json:"html"`
+	Amp      string `json:"amp"`
+	Text     string `json:"text"`
+	// Context for every recipient, under the recipient's own.
+	Context          map[string]interface{} `json:"context,omitempty"`
+	Partials         map[string]string      `json:"partials,omitempty"`
+	TextTemplate     string                 `json:"text_template,omitempty"`
+	HtmlTemplate     string                 `json:"html_template,omitempty"`
+	AmpTemplate      string                 `json:"amp_template,omitempty"`
+	Variants         map[string]Variant     `json:"variants,omitempty"`
+	Stream           string                 `json:"stream"`
+	List             string                 `json:"list"`
+	Segment          *Segment               `json:"segment"`
+	ErrorPolicy      string                 `json:"error_policy"`
+	Webhook          *JobWebhook            `json:"webhook"`
+	SLA              string                 `json:"sla"`
+	Mode             string                 `json:"mode"`
+	SendTo           string                 `json:"send_to"`
+	ListUnsubscribe  *ListUnsubscribe       `json:"list_unsubscribe"`
+	OpenTrackingURL  string                 `json:"open_tracking_url"`
+	ClickTrackingURL string                 `json:"click_tracking_url"`
+	UTM              *UTM                   `json:"utm"`
+	SendWindow       *SendWindow            `json:"send_window"`
+	Preset           string                 `json:"preset"`
+	NotBefore        *time.Time             `json:"not_before,omitempty"`
+	Priority         int                    `json:"priority"`
+	ShardOf          string                 `json:"shard_of,omitempty"`
+	RecipientsNDJSON bool                   `json:"recipients_ndjson,omitempty"`
+	RecipientsRef    string                 `json:"recipients_ref,omitempty"`
+	Recipients       []Recipient
+	// The KMS key the spec was encrypted under, if any.
+	kmsKeyID string
 }
 
 type mailing struct {
-	spec         Spec
-	textTemplate *ttemplate.Template
-	htmlTemplate *htemplate.Template
+	spec          Spec
+	opts          *options
+	basename      string
+	textTemplate  *ttemplate.Template
+	subject       *ttemplate.Template
+	htmlTemplate  *htemplate.Template
+	ampTemplate   *htemplate.Template
+	openTracking  *ttemplate.Template
+	clickTracking *ttemplate.Template
+	errorPolicy   ErrorPolicy
+	sla           time.Duration
+	renderCache   *renderCache
+	sendWindow    *sendWindow
+	preset        *Preset
+	ndjson        *ndjsonRecipients
+	variants      map[string]*mailing
+	variantName   string
 }
 
 type sesService interface {
 	GetSendQuota(*ses.GetSendQuotaInput) (*ses.GetSendQuotaOutput, error)
 	SendEmail(*ses.SendEmailInput) (*ses.SendEmailOutput, error)
+	SendRawEmail(*ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error)
 }
 
-func processJob(svc sesService, job *pqueue.Job, mangler Mangler) {
-	mailing, err := getMailing(job)
-	if err != nil {
-		log.Printf("Job %s failed: %s", job.Basename, err)
+func processJob(svc sesService, job Job, mangler Mangler, o *options) {
+	if _, ok := job.(*previewCopy); o.previewDir != "" && !ok {
+		previewJob(svc, job, mangler, o)
+		return
+	}
+	start := time.Now()
+	ctx, jobSpan := o.tracer.Start(context.Background(), "mailrail.job",
+		trace.WithAttributes(attribute.String("mailrail.job", job.Name())))
+	defer jobSpan.End()
+	if o.operatorSummary != nil && mangler.ShouldSend {
+		o = o.with(WithObserver(&summaryObserver{svc: svc, summary: o.operatorSummary}))
+	}
+	current := -1
+	var checkpoints *checkpointer
+	var results *resultsWriter
+	var abandon func()
+	fail := func(err error) {
+		if abandon != nil {
+			abandon()
+		}
+		if checkpoints != nil {
+			if err := checkpoints.flush(); err != nil {
+				log.Println(err)
+			}
+		}
+		if results != nil {
+			if err := results.close(); err != nil {
+				log.Println(err)
+			}
+		}
+		jobSpan.RecordError(err)
+		jobSpan.SetStatus(codes.Error, "job failed")
+		o.notify(Event{Type: JobFailed, Job: job.Name(), Duration: time.Since(start)})
+		if err := writeFailureReport(job, err, current); err != nil {
+			log.Printf("Job %s failed to write failure report: %s", job.Name(), err)
+		}
 		job.Fail()
+	}
+	if notBefore, err := getNotBefore(job); err == nil && time.Now().Before(notBefore) {
+		log.Printf("Job %s does not start before %s", job.Name(), notBefore.Format(time.RFC3339))
+		if err := schedule(job, notBefore); err != nil {
+			fail(err)
+		}
+		return
+	}
+	mailing, err := getMailing(job, o)
+	if err != nil {
+		log.Printf("Job %s failed: %s", job.Name(), err)
+		fail(err)
 		return
 	}
+	mangler, err = mailing.specMangler(mangler)
+	if err != nil {
+		log.Printf("Job %s failed: %s", job.Name(), err)
+		fail(err)
+		return
+	}
+	if sharded, err := mailing.shard(job, o); err != nil {
+		log.Printf("Job %s failed: %s", job.Name(), err)
+		fail(err)
+		return
+	} else if sharded {
+		return
+	}
+	if mailing.spec.Webhook != nil && o.previewDir == "" {
+		if err := o.specWebhookAllowed(mailing.spec.Webhook); err != nil {
+			log.Printf("Ignoring webhook of job %s: %s", job.Name(), err)
+		} else {
+			lifecycle, err := newJobLifecycleObserver(mailing.spec.Webhook)
+			if err != nil {
+				log.Printf("Job %s failed to set up webhook: %s", job.Name(), err)
+				fail(err)
+				return
+			}
+			defer lifecycle.Close()
+			o = o.with(WithObserver(lifecycle))
+		}
+	}
 	if err := mailing.dryRun(mangler); err != nil {
-		log.Printf("Job %s failed: %s", job.Basename, err)
-		job.Fail()
+		log.Printf("Job %s failed: %s", job.Name(), err)
+		fail(err)
 		return
 	}
 	maxRatePerSecond, err := getMaxSendRate(svc)
 	if err != nil {
-		log.Printf("Job %s failed to get max send rate from SES: %s", job.Basename, err)
+		log.Printf("Job %s failed to get max send rate from SES: %s", job.Name(), err)
+		jobSpan.RecordError(err)
 		job.Submit()
 		return
 	}
@@ -151,52 +413,374 @@ func processJob(svc sesService, job *pqueue.Job, mangler Mangler) {
 	defer tb.Stop()
 	i, err := getCheckpoint(job)
 	if err != nil {
-		log.Printf("Job %s failed to get checkpoint: %s", job.Basename, err)
+		log.Printf("Job %s failed to get checkpoint: %s", job.Name(), err)
+		fail(err)
+		return
+	}
+	n := mailing.recipientCount()
+	checkpoints = newCheckpointer(job, o)
+	results = newResultsWriter(job, mailing.spec.kmsKeyID)
+	result := func(i int, status, messageId, contentHash string, err error) error {
+		r := Result{
+			Recipient:   i,
+			Addr:        mailing.recipient(i).Addr,
+			Status:      status,
+			MessageId:   messageId,
+			ContentHash: contentHash,
+			Time:        time.Now()}
+		if err != nil {
+			r.Error = err.Error()
+			if awsErr, ok := err.(awserr.Error); ok {
+				r.ErrorCode = awsErr.Code()
+			}
+			if reqErr, ok := err.(awserr.RequestFailure); ok {
+				r.RequestId = reqErr.RequestID()
+			}
+		}
+		r, err = mailing.zoneResult(job.Name(), r)
+		if err != nil {
+			return err
+		}
+		return results.record(r)
+	}
+	jobSpan.SetAttributes(attribute.Int("mailrail.recipients", n), attribute.Int("mailrail.checkpoint", i))
+	if err := checkDiskSpace(o.queueDir, n-i); err != nil {
+		// Paused rather than failed, so that it can be resumed once
+		// there is room, and before it has sent anything.
+		log.Printf("Job %s paused before recipient %d: %s", job.Name(), i, err)
+		if err := writeFailureReport(job, err, i); err != nil {
+			log.Printf("Job %s failed to write failure report: %s", job.Name(), err)
+		}
+		if err := job.Set(pausedKey, []byte(time.Now().Format(time.RFC3339))); err != nil {
+			log.Printf("Job %s failed to record that it is paused: %s", job.Name(), err)
+		}
+		o.notify(Event{Type: JobPaused, Job: job.Name(), Recipient: i, Recipients: n, Duration: time.Since(start)})
 		job.Fail()
 		return
 	}
-	n := len(mailing.spec.Recipients)
-	for ; i < n; i++ {
+	o.notify(Event{Type: JobStarted, Job: job.Name(), Recipient: i, Recipients: n})
+	sla, err := mailing.trackSLA(job, i)
+	if err != nil {
+		log.Printf("Job %s failed to track its SLA: %s", job.Name(), err)
+	}
+	sends := newPipeline(o.concurrency)
+	if sends.size > 1 {
+		o = o.with(func(o *options) { o.notifyMu = new(sync.Mutex) })
+	}
+	abandon = sends.abandon
+	// deliver sends a message to recipient i, retrying and backing
+	// off as needed. It can be called from other goroutines.
+	deliver := func(i int, send func() (string, error)) (string, error) {
+		_, span := o.tracer.Start(ctx, "mailrail.send",
+			trace.WithAttributes(attribute.Int("mailrail.recipient", i)))
+		defer span.End()
+		attempts := 0
 		for {
 			rate := <-tb.Bucket
-			log.Println("Job", job.Basename, "rate for recipient", i, "is", rate)
-			messageId, err := mailing.send(svc, i, mangler)
-			if err != nil {
-				if awsErr, ok := err.(awserr.Error); ok {
-					if reqErr, ok := err.(awserr.RequestFailure); ok {
-						log.Println("Job", job.Basename, "recipient", i, "AWS request failure. Code:", reqErr.StatusCode(), "-- Request ID:", reqErr.RequestID())
-					}
-					if awsErr.Code() == "Throttling" {
-						log.Println("Job", job.Basename, "recipient", i, "backing off because of throttling")
-						tb.Backoff()
-					} else if awsErr.Code() == "ServiceUnavailable" {
-						log.Println("Job", job.Basename, "recipient", i, "backing off because service is unavailable")
-						tb.Backoff()
-					} else {
-						log.Println("Job", job.Basename, "failed because of AWS error. Code:", awsErr.Code(), "-- Message:", awsErr.Message(), "-- OrigErr:", awsErr.OrigErr())
-						job.Fail()
-						return
-					}
-				} else {
-					log.Printf("Job %s failed to send message to recipient %i: %s", job.Basename, i, err)
-					job.Fail()
-					return
+			if o.rateLimiter != nil {
+				if err := waitForTurn(o.rateLimiter, maxRatePerSecond); err != nil {
+					log.Printf("Job %s recipient %d: %s", job.Name(), i, err)
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "rate limiter failed")
+					return "", err
+				}
+			}
+			log.Println("Job", job.Name(), "rate for recipient", i, "is", rate)
+			span.SetAttributes(attribute.Float64("mailrail.rate", rate))
+			messageId, sendErr := send()
+			if sendErr == nil {
+				log.Printf("Job %s sent message to recipient %d. Message-ID: %s", job.Name(), i, messageId)
+				o.notify(Event{Type: MessageSent, Job: job.Name(), Recipient: i, MessageId: messageId})
+				span.SetAttributes(attribute.String("ses.message_id", messageId))
+				return messageId, nil
+			}
+			var code string
+			if awsErr, ok := sendErr.(awserr.Error); ok {
+				code = awsErr.Code()
+				attrs := []attribute.KeyValue{attribute.String("aws.error_code", code)}
+				if reqErr, ok := sendErr.(awserr.RequestFailure); ok {
+					log.Println("Job", job.Name(), "recipient", i, "AWS request failure. Code:", reqErr.StatusCode(), "-- Request ID:", reqErr.RequestID())
+					attrs = append(attrs,
+						attribute.Int("http.status_code", reqErr.StatusCode()),
+						attribute.String("aws.request_id", reqErr.RequestID()))
 				}
+				span.AddEvent("ses.error", trace.WithAttributes(attrs...))
+				if code == "Throttling" {
+					log.Println("Job", job.Name(), "recipient", i, "backing off because of throttling")
+					o.notify(Event{Type: Throttled, Job: job.Name(), Recipient: i, Code: code})
+					tb.Backoff()
+					continue
+				} else if code == "ServiceUnavailable" {
+					log.Println("Job", job.Name(), "recipient", i, "backing off because service is unavailable")
+					o.notify(Event{Type: Throttled, Job: job.Name(), Recipient: i, Code: code})
+					tb.Backoff()
+					continue
+				}
+				log.Println("Job", job.Name(), "recipient", i, "AWS error. Code:", code, "-- Message:", awsErr.Message(), "-- OrigErr:", awsErr.OrigErr())
+				span.SetStatus(codes.Error, code)
 			} else {
-				log.Printf("Job %s sent message to recipient %d. Message-ID: %s", job.Basename, i, messageId)
-				break
+				log.Printf("Job %s failed to send message to recipient %d: %s", job.Name(), i, sendErr)
+				span.RecordError(sendErr)
+				span.SetStatus(codes.Error, "send failed")
 			}
+			attempts++
+			if attempts <= mailing.errorPolicy.Retries {
+				log.Printf("Job %s retrying recipient %d (retry %d of %d)", job.Name(), i, attempts, mailing.errorPolicy.Retries)
+				continue
+			}
+			o.notify(Event{Type: SendFailed, Job: job.Name(), Recipient: i, Code: code})
+			return "", sendErr
+		}
+	}
+	// complete records the result of sending to recipient i and then
+	// advances past it. It tells whether the job goes on.
+	var advance func(i int) error
+	complete := func(i int, messageId, contentHash string, sendErr error, stopping bool) bool {
+		if !stopping {
+			current = i
 		}
-		if err := setCheckpoint(job, i+1); err != nil {
+		if sendErr != nil {
+			if err := result(i, StatusFailed, "", "", sendErr); err != nil {
+				log.Println(err)
+			}
+			if stopping {
+				return false
+			}
+			// Skipping a recipient that was not sent to for want of
+			// a turn would skip all the rest as well.
+			if _, ok := sendErr.(*rateLimiterError); !mailing.errorPolicy.Skip || ok {
+				log.Printf("Job %s failed at recipient %d", job.Name(), i)
+				fail(sendErr)
+				return false
+			}
+			log.Printf("Job %s skipping recipient %d after failure", job.Name(), i)
+			if err := advance(i); err != nil {
+				fail(err)
+				return false
+			}
+			return true
+		}
+		status := StatusSent
+		switch {
+		case !mangler.ShouldSend || o.previewDir != "":
+			status, messageId = StatusSkipped, ""
+		case !mangler.deliversTo(mailing.recipient(i).Addr):
+			// Sent elsewhere, such as to the mailbox simulator,
+			// so the recipient got nothing.
+			status = StatusSkipped
+		}
+		if err := result(i, status, messageId, contentHash, nil); err != nil {
+			log.Println(err)
+			if !stopping {
+				fail(err)
+			}
+			return false
+		}
+		if o.frequencyCap != nil && status == StatusSent {
+			stream, _ := computeStream(*mailing, i)
+			record := SendRecord{mailing.recipient(i).Addr, mailing.spec.Campaign, stream, time.Now()}
+			if err := o.frequencyCap.history.Record(record); err != nil {
+				log.Printf("Job %s failed to record send to recipient %d in history: %s", job.Name(), i, err)
+			}
+		}
+		if stopping {
+			return false
+		}
+		if err := advance(i); err != nil {
+			fail(err)
+			return false
+		}
+		return true
+	}
+	// sendTo sends to recipient i, or skips it, and then advances past
+	// it once the recipients before it are done. It tells whether the
+	// job goes on.
+	sendTo := func(i int) bool {
+		if sla != nil {
+			sla.check(job.Name(), i, n, o)
+		}
+		if cancelRequested(job) {
+			if !sends.drain() {
+				return false
+			}
+			current = i
+			if err := checkpoints.flush(); err != nil {
+				log.Println(err)
+			}
+			if err := results.close(); err != nil {
+				log.Println(err)
+			}
+			log.Printf("Job %s cancelled after %d recipients", job.Name(), i)
+			jobSpan.SetStatus(codes.Error, "job cancelled")
+			if err := recordCancellation(job, i); err != nil {
+				log.Printf("Job %s failed to record cancellation: %s", job.Name(), err)
+			}
+			o.notify(Event{Type: JobCancelled, Job: job.Name(), Recipient: i, Recipients: n, Duration: time.Since(start)})
+			job.Fail()
+			o.archiveJob(job.Name())
+			return false
+		}
+		if leased, ok := job.(leasedJob); ok && leased.leaseLost() {
+			// Another worker may have taken the job, so it is left
+			// as it is.
+			sends.wait()
+			log.Printf("Job %s stopped at recipient %d: lease lost", job.Name(), i)
+			jobSpan.SetStatus(codes.Error, "lease lost")
+			return false
+		}
+		if pauseRequested(job) {
+			if !sends.drain() {
+				return false
+			}
+			current = i
+			if err := checkpoints.flush(); err != nil {
+				log.Println(err)
+			}
+			if err := results.close(); err != nil {
+				log.Println(err)
+			}
+			log.Printf("Job %s paused after %d recipients", job.Name(), i)
+			if err := job.Set(pausedKey, []byte(time.Now().Format(time.RFC3339))); err != nil {
+				log.Printf("Job %s failed to record that it is paused: %s", job.Name(), err)
+			}
+			o.notify(Event{Type: JobPaused, Job: job.Name(), Recipient: i, Recipients: n, Duration: time.Since(start)})
 			job.Fail()
+			return false
+		}
+		err := mailing.skip(i)
+		if err == nil {
+			err = mailing.enrich(ctx, job.Name(), i)
+		}
+		if err != nil {
+			log.Printf("Job %s skipped recipient %d: %s", job.Name(), i, err)
+			o.notify(Event{Type: Skipped, Job: job.Name(), Recipient: i})
+			return sends.add(nil, func(stopping bool) bool {
+				if stopping {
+					return false
+				}
+				current = i
+				if err := result(i, StatusSkipped, "", "", err); err != nil {
+					log.Println(err)
+					fail(err)
+					return false
+				}
+				if err := advance(i); err != nil {
+					fail(err)
+					return false
+				}
+				return true
+			})
+		}
+		send, contentHash, err := mailing.compose(mailing.service(svc, i), i, mangler)
+		if err != nil {
+			// Failed like a send, according to the error policy.
+			renderErr := err
+			send = func() (string, error) { return "", renderErr }
+		}
+		var messageId string
+		var sendErr error
+		var done chan struct{}
+		if sends.size > 1 {
+			done = make(chan struct{})
+			go func() {
+				defer close(done)
+				messageId, sendErr = deliver(i, send)
+			}()
+		} else {
+			messageId, sendErr = deliver(i, send)
+		}
+		return sends.add(done, func(stopping bool) bool {
+			return complete(i, messageId, contentHash, sendErr, stopping)
+		})
+	}
+	deferred, err := getDeferred(job)
+	if err != nil {
+		log.Printf("Job %s failed to get deferred recipients: %s", job.Name(), err)
+		fail(err)
+		return
+	}
+	advance = func(i int) error { return checkpoints.set(i + 1) }
+	for ; i < n; i++ {
+		if due := mailing.dueAt(i, time.Now()); due.After(time.Now()) {
+			log.Printf("Job %s deferred recipient %d until %s", job.Name(), i, due.Format(time.RFC3339))
+			i := i
+			ok := sends.add(nil, func(stopping bool) bool {
+				if stopping {
+					return false
+				}
+				if deferred, err = addDeferred(job, deferred, i); err != nil {
+					fail(err)
+					return false
+				}
+				if err := checkpoints.set(i + 1); err != nil {
+					fail(err)
+					return false
+				}
+				return true
+			})
+			if !ok {
+				return
+			}
+			continue
+		}
+		if !sendTo(i) {
+			return
+		}
+	}
+	if !sends.drain() {
+		return
+	}
+	advance = func(i int) error {
+		deferred, err = removeDeferred(job, deferred, i)
+		return err
+	}
+	for _, d := range append([]int(nil), deferred...) {
+		if mailing.dueAt(d, time.Now()).After(time.Now()) {
+			continue
+		}
+		if !sendTo(d) {
+			return
+		}
+	}
+	if !sends.drain() {
+		return
+	}
+	if len(deferred) > 0 {
+		if err := checkpoints.flush(); err != nil {
+			fail(err)
 			return
 		}
+		if err := results.close(); err != nil {
+			log.Println(err)
+		}
+		wakeAt := mailing.nextSendAt(deferred)
+		log.Printf("Job %s has %d deferred recipients; scheduled for %s", job.Name(), len(deferred), wakeAt.Format(time.RFC3339))
+		if err := schedule(job, wakeAt); err != nil {
+			fail(err)
+		}
+		return
+	}
+	if err := checkpoints.flush(); err != nil {
+		fail(err)
+		return
+	}
+	if err := results.close(); err != nil {
+		log.Println(err)
+	}
+	o.notify(Event{Type: JobFinished, Job: job.Name(), Recipients: n, Duration: time.Since(start)})
+	if sla != nil {
+		sla.finish(job.Name(), n, o)
+	}
+	if err := writeFailureReport(job, nil, -1); err != nil {
+		log.Printf("Job %s failed to write failure report: %s", job.Name(), err)
 	}
 	job.Finish()
+	o.archiveJob(job.Name())
+	mailing.wakeParent(o)
 }
 
-func getMailing(job *pqueue.Job) (*mailing, error) {
-	var mailing mailing
+func getMailing(job Job, o *options) (*mailing, error) {
+	mailing := mailing{opts: o, basename: job.Name()}
 	specbytes, err := job.Get("spec")
 	if err != nil {
 		return nil, fmt.Errorf("Cannot get spec: %s", err)
@@ -205,77 +789,281 @@ func getMailing(job *pqueue.Job) (*mailing, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Cannot parse spec: %s", err)
 	}
+	if err := snapshotRecipients(&mailing.spec, job, o); err != nil {
+		return nil, fmt.Errorf("Cannot get recipients: %s", err)
+	}
+	if mailing.spec.recipientsRef() != "" {
+		data, err := readRecipientsRef(mailing.spec, o.recipientsDir, job.Get, job.Set, o.s3)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get recipients: %s", err)
+		}
+		if mailing.ndjson, err = parseRecipientsRef(&mailing.spec, data); err != nil {
+			return nil, fmt.Errorf("Cannot get recipients: %s", err)
+		}
+	}
+	if err := mailing.loadTemplates(); err != nil {
+		return nil, err
+	}
+	if err := mailing.applyPreset(); err != nil {
+		return nil, err
+	}
+	if err := mailing.prepare(); err != nil {
+		return nil, err
+	}
+	return &mailing, nil
+}
+
+// prepare parses the templates and error policy of the spec.
+func (mailing *mailing) prepare() error {
+	var err error
+	if mailing.variants, err = prepareVariants(mailing); err != nil {
+		return err
+	}
+	mailing.errorPolicy = mailing.opts.errorPolicy
+	if mailing.spec.ErrorPolicy != "" {
+		mailing.errorPolicy, err = ParseErrorPolicy(mailing.spec.ErrorPolicy)
+		if err != nil {
+			return err
+		}
+	}
+	if err := mailing.spec.checkMode(); err != nil {
+		return err
+	}
+	if mailing.spec.SLA != "" {
+		mailing.sla, err = time.ParseDuration(mailing.spec.SLA)
+		if err != nil || mailing.sla <= 0 {
+			return fmt.Errorf("Invalid SLA %q", mailing.spec.SLA)
+		}
+	}
+	if mailing.spec.SendWindow != nil {
+		mailing.sendWindow, err = parseSendWindow(mailing.spec.SendWindow)
+		if err != nil {
+			return err
+		}
+	}
+	// Subjects without actions, and recipients' own subjects, are
+	// used as they are.
+	if strings.Contains(mailing.spec.Subject, "{{") {
+		mailing.subject, err = ttemplate.New("subject").Funcs(textFuncs(mailing.opts.templateFuncs)).Parse(mailing.spec.Subject)
+		if err != nil {
+			return fmt.Errorf("Cannot parse subject template: %s", err)
+		}
+	}
 	if mailing.spec.Text != "" {
-		mailing.textTemplate, err = ttemplate.New("text").Parse(mailing.spec.Text)
+		mailing.textTemplate, err = ttemplate.New("text").Funcs(textFuncs(mailing.opts.templateFuncs)).Parse(mailing.spec.Text)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot parse text template: %s", err)
+			return fmt.Errorf("Cannot parse text template: %s", err)
+		}
+		if err := mailing.parsePartials(func(name, text string) error {
+			_, err := mailing.textTemplate.New(name).Parse(text)
+			return err
+		}); err != nil {
+			return err
 		}
 	}
 	if mailing.spec.Html != "" {
-		mailing.htmlTemplate, err = htemplate.New("html").Parse(mailing.spec.Html)
+		mailing.htmlTemplate, err = htemplate.New("html").Funcs(htmlFuncs(mailing.opts.templateFuncs)).Parse(mailing.spec.Html)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot parse html template: %s", err)
+			return fmt.Errorf("Cannot parse html template: %s", err)
+		}
+		if err := mailing.parsePartials(func(name, text string) error {
+			_, err := mailing.htmlTemplate.New(name).Parse(text)
+			return err
+		}); err != nil {
+			return err
 		}
 	}
-	return &mailing, nil
+	if mailing.spec.Amp != "" {
+		if mailing.spec.Html == "" {
+			return fmt.Errorf("Spec has AMP but no HTML to fall back on")
+		}
+		mailing.ampTemplate, err = htemplate.New("amp").Funcs(htmlFuncs(mailing.opts.templateFuncs)).Parse(mailing.spec.Amp)
+		if err != nil {
+			return fmt.Errorf("Cannot parse AMP template: %s", err)
+		}
+		if err := mailing.parsePartials(func(name, text string) error {
+			_, err := mailing.ampTemplate.New(name).Parse(text)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if mailing.spec.OpenTrackingURL != "" {
+		if mailing.spec.Html == "" {
+			return fmt.Errorf("Spec has open tracking but no HTML to put the pixel in")
+		}
+		mailing.openTracking, err = parseTrackingURL("open_tracking_url", mailing.spec.OpenTrackingURL)
+		if err != nil {
+			return err
+		}
+	}
+	if mailing.spec.ClickTrackingURL != "" {
+		mailing.clickTracking, err = parseTrackingURL("click_tracking_url", mailing.spec.ClickTrackingURL)
+		if err != nil {
+			return err
+		}
+	}
+	var trees []*parse.Tree
+	if mailing.subject != nil {
+		trees = append(trees, mailing.subject.Tree)
+	}
+	if mailing.textTemplate != nil {
+		for _, t := range mailing.textTemplate.Templates() {
+			trees = append(trees, t.Tree)
+		}
+	}
+	for _, h := range []*htemplate.Template{mailing.htmlTemplate, mailing.ampTemplate} {
+		if h != nil {
+			for _, t := range h.Templates() {
+				trees = append(trees, t.Tree)
+			}
+		}
+	}
+	mailing.renderCache = newRenderCache()
+	for _, tree := range trees {
+		if tree != nil && callsRecipientFuncs(tree.Root) {
+			mailing.renderCache = nil
+			return nil
+		}
+	}
+	if mailing.subject != nil {
+		mailing.renderCache.fields["subject"] = templateFields(mailing.subject.Tree)
+	}
+	if mailing.textTemplate != nil {
+		mailing.renderCache.fields["text"] = templateFields(mailing.textTemplate.Tree)
+	}
+	if mailing.htmlTemplate != nil {
+		mailing.renderCache.fields["html"] = templateFields(mailing.htmlTemplate.Tree)
+	}
+	if mailing.ampTemplate != nil {
+		mailing.renderCache.fields["amp"] = templateFields(mailing.ampTemplate.Tree)
+	}
+	return nil
 }
 
 func parseSpec(bytes []byte) (Spec, error) {
-	var spec Spec
-	if err := json.Unmarshal(bytes, &spec); err != nil {
+	keyID := encryptionKeyID(bytes)
+	bytes, err := decodeArtifact(bytes)
+	if err != nil {
+		return Spec{}, err
+	}
+	version, err := specVersion(bytes)
+	if err != nil {
+		return Spec{}, err
+	}
+	spec, err := decodeSpec(bytes, version)
+	if err != nil {
 		return Spec{}, err
 	}
+	spec.kmsKeyID = keyID
 	return spec, nil
 }
 
 func (mailing *mailing) dryRun(mangler Mangler) error {
-	for i, _ := range mailing.spec.Recipients {
-		_, err := mailing.computeSendEmailInput(i, mangler)
+	n := mailing.recipientCount()
+	if mailing.ndjson != nil && n > dryRunSample {
+		n = dryRunSample
+	}
+	for i := 0; i < n; i++ {
+		raw, err := mailing.isRaw(i)
+		if err != nil {
+			return fmt.Errorf("Dry run failed for recipient %d: %s", i, err)
+		}
+		if raw {
+			_, err = mailing.computeSendRawEmailInput(i, mangler)
+		} else {
+			_, err = mailing.computeSendEmailInput(i, mangler)
+		}
 		if err != nil {
-			return fmt.Errorf("Dry run failed for recipient %s: %s\n", i, err)
+			return fmt.Errorf("Dry run failed for recipient %d: %s", i, err)
 		}
 	}
+	if mailing.opts.contextCheck != nil {
+		return mailing.checkContexts(n)
+	}
 	return nil
 }
 
-func (mailing *mailing) send(svc sesService, i int, mangler Mangler) (string, error) {
-	params, err := mailing.computeSendEmailInput(i, mangler)
+// compose renders the message to recipient i and returns a function
+// that sends it. Messages must be rendered one at a time, but they can
+// be sent from other goroutines.
+func (mailing *mailing) compose(svc sesService, i int, mangler Mangler) (func() (string, error), string, error) {
+	if mailing.opts.previewDir != "" {
+		return mailing.composePreview(i, mangler)
+	}
+	raw, err := mailing.isRaw(i)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
-	if !mangler.ShouldSend {
-		return "NullMangler", nil
+	if raw {
+		return mailing.composeRaw(svc, i, mangler)
 	}
-	response, err := svc.SendEmail(params)
+	params, err := mailing.computeSendEmailInput(i, mangler)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
-	return *response.MessageId, nil
+	return func() (string, error) {
+		if !mangler.ShouldSend {
+			return "NullMangler", nil
+		}
+		response, err := svc.SendEmail(params)
+		if err != nil {
+			return "", err
+		}
+		return *response.MessageId, nil
+	}, sendEmailHash(params), nil
 }
 
 func (mailing *mailing) computeSendEmailInput(i int, mangler Mangler) (*ses.SendEmailInput, error) {
-	recipient := mailing.spec.Recipients[i]
+	if variant, err := mailing.variant(i); err != nil {
+		return nil, err
+	} else if variant != mailing {
+		return variant.computeSendEmailInput(i, mangler)
+	}
+	recipient := *mailing.recipient(i)
+	mailing.bindRecipient(i)
 	var textContent *ses.Content = &ses.Content{}
 	if mailing.textTemplate != nil {
-		textBytes := new(bytes.Buffer)
-		if err := mailing.textTemplate.Execute(textBytes, recipient.Context); err != nil {
+		text, err := mailing.render("text", mailing.textTemplate, i)
+		if err != nil {
 			return nil, fmt.Errorf("Failed to render text template for recipient %s: %s\n", i, err)
 		}
 		textContent = &ses.Content{
-			Data:    aws.String(textBytes.String()),
+			Data:    aws.String(mailing.tagText(text)),
 			Charset: aws.String("UTF-8")}
 	}
 	var htmlContent *ses.Content = &ses.Content{}
 	if mailing.htmlTemplate != nil {
-		htmlBytes := new(bytes.Buffer)
-		if err := mailing.htmlTemplate.Execute(htmlBytes, recipient.Context); err != nil {
+		html, err := mailing.render("html", mailing.htmlTemplate, i)
+		if err != nil {
 			return nil, fmt.Errorf("Failed to render HTML template for recipient %s: %s\n", i, err)
 		}
+		html, err = mailing.trackClicks(mailing.tagHTML(html), i)
+		if err != nil {
+			return nil, err
+		}
+		html, err = mailing.trackOpens(html, i)
+		if err != nil {
+			return nil, err
+		}
 		htmlContent = &ses.Content{
-			Data:    aws.String(htmlBytes.String()),
+			Data:    aws.String(html),
 			Charset: aws.String("UTF-8")}
 	}
+	subject, err := computeSubject(*mailing, i)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := computeStream(*mailing, i)
+	if err != nil {
+		return nil, err
+	}
 	var params ses.SendEmailInput
+	if configurationSet := mailing.opts.configurationSets[stream]; configurationSet != "" {
+		params.ConfigurationSetName = aws.String(configurationSet)
+	}
+	params.Tags = []*ses.MessageTag{{Name: aws.String("stream"), Value: aws.String(stream)}}
+	mailing.applyPresetToMessage(&params)
 	params.Source = aws.String(computeSource(*mailing, i))
 	params.Destination = &ses.Destination{
 		ToAddresses:  []*string{aws.String(mangler.Mangle(recipient.Addr))},
@@ -283,7 +1071,7 @@ func (mailing *mailing) computeSendEmailInput(i int, mangler Mangler) (*ses.Send
 		BccAddresses: []*string{}}
 	params.Message = &ses.Message{
 		Subject: &ses.Content{
-			Data:    aws.String(computeSubject(*mailing, i)),
+			Data:    aws.String(subject),
 			Charset: aws.String("UTF-8")},
 		Body: &ses.Body{
 			Html: htmlContent,
@@ -292,7 +1080,7 @@ func (mailing *mailing) computeSendEmailInput(i int, mangler Mangler) (*ses.Send
 }
 
 func computeSource(mailing mailing, i int) string {
-	recipient := mailing.spec.Recipients[i]
+	recipient := *mailing.recipient(i)
 	var fromName string
 	if recipient.FromName != "" {
 		fromName = recipient.FromName
@@ -317,13 +1105,18 @@ func computeSource(mailing mailing, i int) string {
 	}
 }
 
-func computeSubject(mailing mailing, i int) string {
-	recipient := mailing.spec.Recipients[i]
+func computeSubject(mailing mailing, i int) (string, error) {
+	recipient := *mailing.recipient(i)
 	if recipient.Subject != "" {
-		return recipient.Subject
-	} else {
-		return mailing.spec.Subject
+		return recipient.Subject, nil
+	} else if mailing.subject == nil {
+		return mailing.spec.Subject, nil
 	}
+	subject, err := mailing.render("subject", mailing.subject, i)
+	if err != nil {
+		return "", fmt.Errorf("Failed to render subject template for recipient %d: %s", i, err)
+	}
+	return subject, nil
 }
 
 func getMaxSendRate(svc sesService) (float64, error) {
@@ -335,6 +1128,13 @@ func getMaxSendRate(svc sesService) (float64, error) {
 	return *resp.MaxSendRate, nil
 }
 
+// deliversTo tells whether the mangler sends a message to addr to that
+// address, rather than not sending it or sending it elsewhere, such as
+// to the SES mailbox simulator.
+func (m Mangler) deliversTo(addr string) bool {
+	return m.ShouldSend && normalizeAddr(m.Mangle(addr)) == normalizeAddr(addr)
+}
+
 func identityAddr(addr string) string { return addr }
 
 func alwaysAddr(addr string) func(string) string {
@@ -25,8 +25,9 @@ func TestParseSpec(t *testing.T) {
 }
 
 type MockSES struct {
-	nsent int
-	sent  *ses.SendEmailInput
+	nsent   int
+	sent    *ses.SendEmailInput
+	sentRaw *ses.SendRawEmailInput
 }
 
 func (svc *MockSES) GetSendQuota(input *ses.GetSendQuotaInput) (*ses.GetSendQuotaOutput, error) {
@@ -41,6 +42,13 @@ func (svc *MockSES) SendEmail(input *ses.SendEmailInput) (*ses.SendEmailOutput,
 	return &ses.SendEmailOutput{MessageId: &messageId}, nil
 }
 
+func (svc *MockSES) SendRawEmail(input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	messageId := "foo"
+	svc.nsent += 1
+	svc.sentRaw = input
+	return &ses.SendRawEmailOutput{MessageId: &messageId}, nil
+}
+
 func makeSendEmailInput(t *testing.T, spec string, mangler Mangler) *ses.SendEmailInput {
 	dir, err := ioutil.TempDir("/tmp", "mailrail_test_makesendemailinput_")
 	if err != nil {
@@ -54,7 +62,7 @@ func makeSendEmailInput(t *testing.T, spec string, mangler Mangler) *ses.SendEma
 	}
 	j.Set("spec", []byte(spec))
 	svc := MockSES{}
-	processJob(&svc, j, mangler)
+	processJob(&svc, dirJob{Job: j}, mangler, newOptions(nil))
 	return svc.sent
 }
 
@@ -185,7 +193,7 @@ func TestProcessJob(t *testing.T) {
 }]
 }`))
 	svc := MockSES{}
-	processJob(&svc, j, DoNotMangle)
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions(nil))
 	if svc.nsent != 1 {
 		t.Fatal("expected 1 message to be sent, not", svc.nsent)
 	}
@@ -290,3 +298,70 @@ func TestManglers(t *testing.T) {
 		t.Fatal("unexpected To: addresses with SendToSimulator:", *sent4.Destination.ToAddresses[0])
 	}
 }
+
+func TestStream(t *testing.T) {
+	spec := `{
+            "from_addr": "johndoe@example.com",
+            "subject": "Hello",
+            "text": "Hello",
+            "stream": "transactional",
+            "recipients": [{"addr": "janedoe@example.com"}]
+          }`
+	svc := MockSES{}
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_stream_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(spec))
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions([]Option{WithConfigurationSets(map[string]string{"transactional": "tx"})}))
+	if *svc.sent.ConfigurationSetName != "tx" {
+		t.Fatal("unexpected configuration set:", *svc.sent.ConfigurationSetName)
+	}
+	if *svc.sent.Tags[0].Value != "transactional" {
+		t.Fatal("unexpected stream tag:", *svc.sent.Tags[0].Value)
+	}
+	sent := makeSendEmailInput(t, `{
+            "from_addr": "johndoe@example.com",
+            "subject": "Hello",
+            "text": "Hello",
+            "recipients": [{"addr": "janedoe@example.com"}]
+          }`, DoNotMangle)
+	if sent.ConfigurationSetName != nil || *sent.Tags[0].Value != "marketing" {
+		t.Fatal("unexpected default stream:", sent)
+	}
+	sent = makeSendEmailInput(t, `{
+            "from_addr": "johndoe@example.com",
+            "subject": "Hello",
+            "text": "Hello",
+            "stream": "bulk",
+            "recipients": [{"addr": "janedoe@example.com"}]
+          }`, DoNotMangle)
+	if sent != nil {
+		t.Fatal("sent message with unknown stream")
+	}
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	preview, err := NewPreview([]byte(`{"from_addr": "johndoe@example.com", "subject": "Your {{.plan | title}} renewal", "text": "Hi",
+"recipients": [{"addr": "a@example.com", "context": {"plan": "pro"}},
+{"addr": "b@example.com", "subject": "Literal {{.plan}}", "context": {"plan": "basic"}}]}`))
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	for i, expected := range []string{"Your Pro renewal", "Literal {{.plan}}"} {
+		msg, err := preview.Render(i)
+		if err != nil || msg.Subject != expected {
+			t.Fatal("unexpected subject:", msg, err)
+		}
+	}
+	vars, err := TemplateVariables(preview.mailing.spec)
+	if err != nil || len(vars) != 1 || vars[0] != "plan" {
+		t.Fatal("expected the subject's variables:", vars, err)
+	}
+}
@@ -0,0 +1,140 @@
+// Package mailraillint checks mailrail specs for problems, so that
+// services that produce specs can validate them when they create
+// them, for instance in their own CI, instead of finding out when a
+// worker fails the job.
+package mailraillint
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ljosa/mailrail"
+	"net/mail"
+	"strings"
+)
+
+// Severities of problems. A spec with errors will fail or send
+// broken messages; warnings are likely mistakes.
+const (
+	Error   = "error"
+	Warning = "warning"
+)
+
+// A Problem is something wrong with a spec. Recipient is the index of
+// the recipient the problem concerns, or -1 if it concerns the spec
+// as a whole.
+type Problem struct {
+	Severity  string
+	Recipient int
+	Message   string
+}
+
+func (p Problem) String() string {
+	if p.Recipient >= 0 {
+		return fmt.Sprintf("%s: recipient %d: %s", p.Severity, p.Recipient, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+}
+
+// LintBytes parses a spec and lints it. Specs that cannot be parsed
+// have a single error. Fields of unversioned specs that are ignored
+// are warnings, as they are likely misspelled.
+func LintBytes(specBytes []byte) []Problem {
+	upgraded, ignored, err := mailrail.UpgradeSpec(specBytes)
+	if err != nil {
+		return []Problem{{Error, -1, fmt.Sprintf("Cannot parse spec: %s", err)}}
+	}
+	var spec mailrail.Spec
+	if err := json.Unmarshal(upgraded, &spec); err != nil {
+		return []Problem{{Error, -1, fmt.Sprintf("Cannot parse spec: %s", err)}}
+	}
+	var problems []Problem
+	for _, field := range ignored {
+		problems = append(problems, Problem{Warning, -1, fmt.Sprintf("Spec has unknown field %s, which is ignored; specs with a version cannot have it", field)})
+	}
+	return append(problems, Lint(spec)...)
+}
+
+// Lint returns the problems with a spec, spec-level problems first.
+func Lint(spec mailrail.Spec) []Problem {
+	var problems []Problem
+	add := func(severity string, i int, format string, args ...interface{}) {
+		problems = append(problems, Problem{severity, i, fmt.Sprintf(format, args...)})
+	}
+	text := spec.Text != "" || spec.TextTemplate != ""
+	html := spec.Html != "" || spec.HtmlTemplate != ""
+	if !text && !html {
+		add(Error, -1, "Spec has neither text nor html")
+	} else if !text {
+		add(Warning, -1, "Spec has no plain-text alternative to the HTML")
+	}
+	if err := mailrail.CheckSpec(spec); err != nil {
+		add(Error, -1, "%s", strings.TrimSpace(err.Error()))
+	}
+	fromSource := spec.List != "" || spec.Segment != nil || spec.RecipientsNDJSON || spec.RecipientsRef != ""
+	if fromSource && len(spec.Recipients) > 0 {
+		add(Warning, -1, "Spec has recipients but also a list, segment, or recipients_ref, which replaces them")
+	}
+	if !fromSource && len(spec.Recipients) == 0 {
+		add(Warning, -1, "Spec has no recipients")
+	}
+	if fromSource {
+		if spec.FromAddr == "" {
+			add(Error, -1, "Spec has no from_addr")
+		} else if _, err := mail.ParseAddress(spec.FromAddr); err != nil {
+			add(Error, -1, "Invalid from_addr %q: %s", spec.FromAddr, err)
+		}
+		if spec.Subject == "" {
+			add(Warning, -1, "Spec has no subject")
+		}
+		return problems
+	}
+
+	vars, _ := mailrail.TemplateVariables(spec)
+	missing := make(map[string][]int)
+	seen := make(map[string]int)
+	for i, recipient := range spec.Recipients {
+		if recipient.Addr == "" {
+			add(Error, i, "Recipient has no addr")
+		} else if _, err := mail.ParseAddress(recipient.Addr); err != nil {
+			add(Error, i, "Invalid addr %q: %s", recipient.Addr, err)
+		} else if first, ok := seen[strings.ToLower(recipient.Addr)]; ok {
+			add(Warning, i, "Duplicate of recipient %d (%s)", first, recipient.Addr)
+		} else {
+			seen[strings.ToLower(recipient.Addr)] = i
+		}
+		fromAddr := recipient.FromAddr
+		if fromAddr == "" {
+			fromAddr = spec.FromAddr
+		}
+		if fromAddr == "" {
+			add(Error, i, "Neither the recipient nor the spec has a from_addr")
+		} else if _, err := mail.ParseAddress(fromAddr); err != nil {
+			add(Error, i, "Invalid from_addr %q: %s", fromAddr, err)
+		}
+		if recipient.Subject == "" && spec.Subject == "" {
+			add(Warning, i, "Neither the recipient nor the spec has a subject")
+		}
+		for _, v := range vars {
+			_, inSpec := spec.Context[v]
+			if _, ok := recipient.Context[v]; !ok && !inSpec {
+				missing[v] = append(missing[v], i)
+			}
+		}
+	}
+	for _, v := range vars {
+		if indices := missing[v]; len(indices) > 0 {
+			add(Warning, indices[0], "Context lacks %q, which the templates use; %d recipients lack it", v, len(indices))
+		}
+	}
+	return problems
+}
+
+// HasErrors tells whether any of the problems are errors.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package mailraillint
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	problems := LintBytes([]byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.pet_name}}",
+"recipients": [
+  {"addr": "janedoe@example.com", "context": {"pet_name": "Janie"}},
+  {"addr": "JaneDoe@example.com", "context": {"pet_name": "Janie"}},
+  {"addr": "not an address", "context": {}}
+]
+}`))
+	if !HasErrors(problems) || len(problems) != 3 {
+		t.Fatal("unexpected problems:", problems)
+	}
+	if problems[0].Recipient != 1 || problems[0].Severity != Warning || !strings.Contains(problems[0].Message, "Duplicate") {
+		t.Fatal("expected duplicate warning, not", problems[0])
+	}
+	if problems[1].Recipient != 2 || problems[1].Severity != Error {
+		t.Fatal("expected invalid address error, not", problems[1])
+	}
+	if problems[2].Recipient != 2 || !strings.Contains(problems[2].Message, "pet_name") {
+		t.Fatal("expected missing variable warning, not", problems[2])
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	problems := LintBytes([]byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"html": "<p>Hello</p>",
+"list": "newsletter"
+}`))
+	if len(problems) != 0 {
+		t.Fatal("expected no problems, not", problems)
+	}
+}
+
+func TestLintTemplates(t *testing.T) {
+	problems := LintBytes([]byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"html": "<p>Hello, {{.name</p>",
+"recipients": [{"addr": "janedoe@example.com"}]
+}`))
+	if !HasErrors(problems) || !strings.Contains(problems[1].Message, "html template") {
+		t.Fatal("expected template error, not", problems)
+	}
+	if problems := LintBytes([]byte(`{"from_addr":`)); !HasErrors(problems) {
+		t.Fatal("expected error for malformed spec")
+	}
+}
+
+func TestLintUnknownFields(t *testing.T) {
+	problems := LintBytes([]byte(`{
+"form_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"list": "newsletter"
+}`))
+	if len(problems) != 2 || problems[0].Severity != Warning || !strings.Contains(problems[0].Message, "form_addr") {
+		t.Fatal("expected the misspelled field to be a warning, not", problems)
+	}
+	problems = LintBytes([]byte(`{
+"version": 1,
+"form_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"list": "newsletter"
+}`))
+	if len(problems) != 1 || !HasErrors(problems) || !strings.Contains(problems[0].Message, "form_addr") {
+		t.Fatal("expected the misspelled field to be an error, not", problems)
+	}
+}
+
+func TestLintSpecContext(t *testing.T) {
+	problems := LintBytes([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "{{.company}} {{.name}}",
+"context": {"company": "ACME"},
+"recipients": [{"addr": "janedoe@example.com", "context": {"name": "Jane"}}]}`))
+	if len(problems) != 0 {
+		t.Fatal("expected the spec's context to count:", problems)
+	}
+}
+
+func TestLintLibraryTemplates(t *testing.T) {
+	problems := LintBytes([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text_template": "newsletter/basic", "html_template": "newsletter/basic",
+"recipients": [{"addr": "janedoe@example.com"}]}`))
+	if len(problems) != 0 {
+		t.Fatal("expected templates from the library to count:", problems)
+	}
+}
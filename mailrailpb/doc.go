@@ -0,0 +1,5 @@
+// Package mailrailpb holds the protocol buffers and gRPC stubs of
+// mailrail's control plane, which `mailrail.ControlServer` implements.
+package mailrailpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative mailrail.proto
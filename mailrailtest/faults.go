@@ -0,0 +1,136 @@
+package mailrailtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/ljosa/mailrail"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Error codes of faults. Workers back off and retry on throttling
+// and unavailability; any other code is an error that the job's
+// error policy handles.
+const (
+	Throttling         = "Throttling"
+	ServiceUnavailable = "ServiceUnavailable"
+	MessageRejected    = "MessageRejected"
+)
+
+// A Fault makes sending to a recipient fail with an AWS error code.
+// The first Times attempts fail; zero means that every attempt does.
+// Workers retry throttling and unavailability until they succeed, so
+// faults with those codes must have Times, or the test would hang.
+type Fault struct {
+	Recipient int
+	Code      string
+	Times     int
+}
+
+// An Attempt is a recorded attempt to send to a recipient. Code is
+// the error code returned, or empty if the message was sent.
+type Attempt struct {
+	Recipient int
+	Addr      string
+	Code      string
+}
+
+// A FaultySES is a MockSES that fails at chosen recipients, so that
+// tests can check how error policies, retries, and checkpoints
+// handle failures. It tells recipients by their addresses, so the
+// addresses in the spec should be distinct, and the worker must not
+// mangle them. Every attempt is recorded in Attempts.
+type FaultySES struct {
+	MockSES
+	Attempts []Attempt
+	faults   map[int]Fault
+	indices  map[string]int
+	failed   map[int]int
+	mu       sync.Mutex
+}
+
+// NewFaultySES returns a FaultySES for the recipients in a spec.
+func NewFaultySES(spec []byte, faults ...Fault) (*FaultySES, error) {
+	var s mailrail.Spec
+	if err := json.Unmarshal(spec, &s); err != nil {
+		return nil, fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	svc := &FaultySES{faults: map[int]Fault{}, indices: map[string]int{}, failed: map[int]int{}}
+	for i, r := range s.Recipients {
+		addr := strings.ToLower(r.Addr)
+		if _, ok := svc.indices[addr]; ok {
+			return nil, fmt.Errorf("Recipient %d has the same address as an earlier one: %s", i, r.Addr)
+		}
+		svc.indices[addr] = i
+	}
+	for _, f := range faults {
+		if f.Recipient < 0 || f.Recipient >= len(s.Recipients) {
+			return nil, fmt.Errorf("No recipient %d; the spec has %d", f.Recipient, len(s.Recipients))
+		}
+		if f.Times <= 0 && (f.Code == Throttling || f.Code == ServiceUnavailable) {
+			return nil, fmt.Errorf("Fault %s at recipient %d must have Times, or the worker would retry forever", f.Code, f.Recipient)
+		}
+		svc.faults[f.Recipient] = f
+	}
+	return svc, nil
+}
+
+func (svc *FaultySES) SendEmail(input *ses.SendEmailInput) (*ses.SendEmailOutput, error) {
+	if err := svc.attempt(*input.Destination.ToAddresses[0]); err != nil {
+		return nil, err
+	}
+	return svc.MockSES.SendEmail(input)
+}
+
+func (svc *FaultySES) SendRawEmail(input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	if err := svc.attempt(*input.Destinations[0]); err != nil {
+		return nil, err
+	}
+	return svc.MockSES.SendRawEmail(input)
+}
+
+// Mangler returns a mangler that sends through the stub.
+func (svc *FaultySES) Mangler() mailrail.Mangler {
+	return mailrail.UseMockSesService(svc)
+}
+
+// AttemptsAt returns the number of attempts to send to a recipient.
+func (svc *FaultySES) AttemptsAt(i int) int {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	n := 0
+	for _, a := range svc.Attempts {
+		if a.Recipient == i {
+			n++
+		}
+	}
+	return n
+}
+
+// attempt records an attempt to send to an address and returns the
+// error it fails with, if any.
+func (svc *FaultySES) attempt(addr string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	i, ok := svc.indices[strings.ToLower(addr)]
+	if !ok {
+		i = -1
+	}
+	attempt := Attempt{Recipient: i, Addr: addr}
+	defer func() { svc.Attempts = append(svc.Attempts, attempt) }()
+	f, ok := svc.faults[i]
+	if !ok || (f.Times > 0 && svc.failed[i] >= f.Times) {
+		return nil
+	}
+	svc.failed[i]++
+	attempt.Code = f.Code
+	status := http.StatusBadRequest
+	if f.Code == ServiceUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	return awserr.NewRequestFailure(awserr.New(f.Code, fmt.Sprintf("Injected fault for recipient %d", i), nil),
+		status, fmt.Sprintf("fault-%d-%d", i, svc.failed[i]))
+}
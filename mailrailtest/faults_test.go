@@ -0,0 +1,63 @@
+package mailrailtest
+
+import (
+	"github.com/ljosa/mailrail"
+	"testing"
+)
+
+var threeRecipients = []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]}`)
+
+func TestFaultySES(t *testing.T) {
+	svc, err := NewFaultySES(threeRecipients,
+		Fault{Recipient: 0, Code: Throttling, Times: 2},
+		Fault{Recipient: 1, Code: MessageRejected})
+	if err != nil {
+		t.Fatal("NewFaultySES", err)
+	}
+	queueDir, basename := ProcessSpec(t, svc.Mangler(), threeRecipients, mailrail.WithErrorPolicy(mailrail.SkipRecipient))
+	if svc.AttemptsAt(0) != 3 || svc.AttemptsAt(1) != 1 || svc.AttemptsAt(2) != 1 {
+		t.Fatal("unexpected attempts:", svc.Attempts)
+	}
+	if svc.Attempts[0].Code != Throttling || svc.Attempts[2].Code != "" {
+		t.Fatal("expected two throttled attempts before the message was sent:", svc.Attempts)
+	}
+	results, err := mailrail.GetResults(queueDir, basename)
+	if err != nil {
+		t.Fatal("GetResults", err)
+	}
+	if len(results) != 3 || results[0].Status != mailrail.StatusSent || results[1].Status != mailrail.StatusFailed ||
+		results[1].ErrorCode != MessageRejected || results[2].Status != mailrail.StatusSent {
+		t.Fatal("expected the rejected recipient to be skipped:", results)
+	}
+	if svc.Len() != 2 {
+		t.Fatal("expected two messages to be sent:", svc.Len())
+	}
+}
+
+func TestFaultySESFailsJob(t *testing.T) {
+	svc, err := NewFaultySES(threeRecipients, Fault{Recipient: 1, Code: MessageRejected})
+	if err != nil {
+		t.Fatal("NewFaultySES", err)
+	}
+	queueDir, basename := ProcessSpec(t, svc.Mangler(), threeRecipients)
+	report, err := mailrail.GetFailureReport(queueDir, basename)
+	if err != nil || report == nil || report.ErrorCode != MessageRejected {
+		t.Fatal("expected the job to fail at the rejected recipient:", report, err)
+	}
+	if svc.AttemptsAt(2) != 0 {
+		t.Fatal("expected no attempt after the failure:", svc.Attempts)
+	}
+}
+
+func TestNewFaultySESErrors(t *testing.T) {
+	if _, err := NewFaultySES(threeRecipients, Fault{Recipient: 3, Code: Throttling, Times: 1}); err == nil {
+		t.Fatal("expected an error for a fault at a recipient out of range")
+	}
+	if _, err := NewFaultySES(threeRecipients, Fault{Recipient: 0, Code: Throttling}); err == nil {
+		t.Fatal("expected an error for a throttling fault at every attempt")
+	}
+	if _, err := NewFaultySES([]byte(`{"recipients": [{"addr": "a@example.com"}, {"addr": "A@example.com"}]}`)); err == nil {
+		t.Fatal("expected an error for recipients with the same address")
+	}
+}
@@ -0,0 +1,172 @@
+// Package mailrailtest helps services that produce mailrail specs
+// test them: a mock SES service that records what would have been
+// sent, a stub that fails at chosen recipients, a way to run a spec
+// through a worker against them, and golden .eml files of the
+// messages a spec renders.
+package mailrailtest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/ljosa/mailrail"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var update = flag.Bool("mailrailtest.update", false, "write golden .eml files instead of comparing with them")
+
+// A MockSES records the messages sent through it instead of sending
+// them. If Err is set, sending fails with it. MaxSendRate is the send
+// rate it reports; zero means 1000 messages per second.
+type MockSES struct {
+	MaxSendRate float64
+	Err         error
+	Sent        []*ses.SendEmailInput
+	SentRaw     []*ses.SendRawEmailInput
+	mu          sync.Mutex
+}
+
+func (svc *MockSES) GetSendQuota(input *ses.GetSendQuotaInput) (*ses.GetSendQuotaOutput, error) {
+	maxSendRate := svc.MaxSendRate
+	if maxSendRate == 0 {
+		maxSendRate = 1000
+	}
+	return &ses.GetSendQuotaOutput{MaxSendRate: aws.Float64(maxSendRate)}, nil
+}
+
+func (svc *MockSES) SendEmail(input *ses.SendEmailInput) (*ses.SendEmailOutput, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.Err != nil {
+		return nil, svc.Err
+	}
+	svc.Sent = append(svc.Sent, input)
+	return &ses.SendEmailOutput{MessageId: aws.String(fmt.Sprintf("mock-%d", svc.len()))}, nil
+}
+
+func (svc *MockSES) SendRawEmail(input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.Err != nil {
+		return nil, svc.Err
+	}
+	svc.SentRaw = append(svc.SentRaw, input)
+	return &ses.SendRawEmailOutput{MessageId: aws.String(fmt.Sprintf("mock-%d", svc.len()))}, nil
+}
+
+// Len returns the number of messages sent, raw or not.
+func (svc *MockSES) Len() int {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.len()
+}
+
+func (svc *MockSES) len() int {
+	return len(svc.Sent) + len(svc.SentRaw)
+}
+
+// Mangler returns a mangler that sends through the mock.
+func (svc *MockSES) Mangler() mailrail.Mangler {
+	return mailrail.UseMockSesService(svc)
+}
+
+// Run submits a spec to a temporary queue and has a worker process it
+// with the options, sending through a new mock, which it returns. The
+// test fails if the spec cannot be submitted or the job fails.
+func Run(t testing.TB, spec []byte, opts ...mailrail.Option) *MockSES {
+	t.Helper()
+	svc := &MockSES{}
+	queueDir, basename := ProcessSpec(t, svc.Mangler(), spec, opts...)
+	report, err := mailrail.GetFailureReport(queueDir, basename)
+	if err != nil {
+		t.Fatal("Failed to read failure report:", err)
+	}
+	if report != nil {
+		t.Fatal("Job failed:", report.Reason)
+	}
+	return svc
+}
+
+// ProcessSpec submits a spec to a temporary queue and has a worker
+// process it with a mangler and options. It returns the queue
+// directory and the job's basename, so that the test can check the
+// job's status, results, and failure report. The queue is removed
+// when the test ends.
+func ProcessSpec(t testing.TB, mangler mailrail.Mangler, spec []byte, opts ...mailrail.Option) (string, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mailrailtest_")
+	if err != nil {
+		t.Fatal("Failed to create queue directory:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	basename, err := mailrail.NewSubmitter(dir).Submit(spec)
+	if err != nil {
+		t.Fatal("Failed to submit spec:", err)
+	}
+	mailrail.Process(dir, mangler, opts...)
+	return dir, basename
+}
+
+// AssertGolden renders the message to each recipient of a spec, as
+// `mailrail.Preview` does, and compares it with NNNNNN.eml in dir,
+// where NNNNNN is the index of the recipient. MIME boundaries, which
+// are random, are replaced by "BOUNDARY". Run the tests with
+// -mailrailtest.update to write the golden files instead.
+func AssertGolden(t testing.TB, dir string, spec []byte, opts ...mailrail.Option) {
+	t.Helper()
+	preview, err := mailrail.NewPreview(spec, opts...)
+	if err != nil {
+		t.Fatal("Failed to render spec:", err)
+	}
+	if *update {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goldens, err := filepath.Glob(path.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*update && len(goldens) != preview.Len() {
+		t.Errorf("Spec has %d recipients, but there are %d golden files in %s", preview.Len(), len(goldens), dir)
+	}
+	for i := 0; i < preview.Len(); i++ {
+		msg, err := preview.Message(i)
+		if err != nil {
+			t.Fatalf("Failed to render message to recipient %d: %s", i, err)
+		}
+		msg = normalizeBoundaries(msg)
+		filename := path.Join(dir, fmt.Sprintf("%06d.eml", i))
+		if *update {
+			if err := ioutil.WriteFile(filename, msg, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Errorf("Failed to read golden file: %s", err)
+			continue
+		}
+		if !bytes.Equal(msg, golden) {
+			t.Errorf("Message to recipient %d differs from %s:\n%s", i, filename, msg)
+		}
+	}
+}
+
+var boundaryRegexp = regexp.MustCompile(`boundary=([0-9a-zA-Z'()+_,./:=?-]+)`)
+
+func normalizeBoundaries(msg []byte) []byte {
+	for _, m := range boundaryRegexp.FindAllSubmatch(msg, -1) {
+		msg = bytes.ReplaceAll(msg, m[1], []byte("BOUNDARY"))
+	}
+	return msg
+}
@@ -0,0 +1,46 @@
+package mailrailtest
+
+import (
+	"strings"
+	"testing"
+)
+
+var spec = []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"html": "<p>Hello, {{.name}}</p>",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}}, {"addr": "b@example.com", "context": {"name": "B"}}]}`)
+
+func TestRun(t *testing.T) {
+	svc := Run(t, spec)
+	if svc.Len() != 2 {
+		t.Fatal("expected two messages to be sent:", svc.Len())
+	}
+	var bodies []string
+	for _, input := range svc.Sent {
+		bodies = append(bodies, *input.Message.Body.Text.Data)
+	}
+	if strings.Join(bodies, "|") != "Hello, A|Hello, B" {
+		t.Fatal("unexpected messages:", bodies)
+	}
+}
+
+func TestAssertGolden(t *testing.T) {
+	AssertGolden(t, "testdata/hello", spec)
+	if *update {
+		return
+	}
+	rt := &recordingT{T: t}
+	AssertGolden(rt, "testdata/hello", []byte(strings.Replace(string(spec), "Hello,", "Goodbye,", -1)))
+	if !rt.failed {
+		t.Fatal("expected changed messages to differ from the golden files")
+	}
+}
+
+// recordingT records failures instead of failing the test.
+type recordingT struct {
+	*testing.T
+	failed bool
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.failed = true
+}
@@ -0,0 +1,167 @@
+package mailrail
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A MemoryStore is a job store in memory, for testing programs that
+// embed the worker without a queue directory or a server.
+type MemoryStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*memoryJobState
+	queue []string
+	next  int
+}
+
+type memoryJobState struct {
+	state     string
+	wakeAt    time.Time
+	artifacts map[string][]byte
+}
+
+// Returns an empty job store in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: make(map[string]*memoryJobState)}
+}
+
+// Submit stores a spec and queues it, and returns the name of the new
+// job.
+func (s *MemoryStore) Submit(specBytes []byte) (string, error) {
+	if _, err := parseSpec(specBytes); err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	name := fmt.Sprintf("%06d-standalone", s.next)
+	s.jobs[name] = &memoryJobState{state: "queued", artifacts: map[string][]byte{
+		"spec":       append([]byte(nil), specBytes...),
+		submittedKey: []byte(time.Now().Format(time.RFC3339Nano))}}
+	s.queue = append(s.queue, name)
+	return name, nil
+}
+
+// State returns the state of a job: queued, cur, scheduled, done, or
+// failed, or the empty string if there is no such job.
+func (s *MemoryStore) State(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[name]; ok {
+		return job.state
+	}
+	return ""
+}
+
+// Artifact returns an artifact of a job, such as its "spec" or
+// "results.0".
+func (s *MemoryStore) Artifact(name, key string) ([]byte, error) {
+	return (&memoryJob{s, name}).Get(key)
+}
+
+// Take queues the scheduled jobs that are due, then takes the oldest
+// queued job.
+func (s *MemoryStore) Take() (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, job := range s.jobs {
+		if job.state == "scheduled" && !time.Now().Before(job.wakeAt) {
+			s.enqueue(name)
+		}
+	}
+	if len(s.queue) == 0 {
+		return nil, nil
+	}
+	name := s.queue[0]
+	s.queue = s.queue[1:]
+	s.jobs[name].state = "cur"
+	return &memoryJob{s, name}, nil
+}
+
+// Rescue queues the jobs that have been taken and not put back.
+func (s *MemoryStore) Rescue() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, job := range s.jobs {
+		if job.state == "cur" {
+			s.enqueue(name)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) enqueue(name string) {
+	s.jobs[name].state = "queued"
+	s.queue = append(s.queue, name)
+}
+
+type memoryJob struct {
+	store *MemoryStore
+	name  string
+}
+
+func (job *memoryJob) Name() string {
+	return job.name
+}
+
+func (job *memoryJob) Get(key string) ([]byte, error) {
+	job.store.mu.Lock()
+	defer job.store.mu.Unlock()
+	state, ok := job.store.jobs[job.name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	value, ok := state.artifacts[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (job *memoryJob) Set(key string, value []byte) error {
+	job.store.mu.Lock()
+	defer job.store.mu.Unlock()
+	job.store.jobs[job.name].artifacts[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (job *memoryJob) Append(key string, value []byte) error {
+	job.store.mu.Lock()
+	defer job.store.mu.Unlock()
+	artifacts := job.store.jobs[job.name].artifacts
+	artifacts[key] = append(artifacts[key], value...)
+	return nil
+}
+
+func (job *memoryJob) setState(state string) error {
+	job.store.mu.Lock()
+	defer job.store.mu.Unlock()
+	job.store.jobs[job.name].state = state
+	return nil
+}
+
+func (job *memoryJob) Submit() error {
+	job.store.mu.Lock()
+	defer job.store.mu.Unlock()
+	job.store.enqueue(job.name)
+	return nil
+}
+
+func (job *memoryJob) Fail() error {
+	return job.setState("failed")
+}
+
+func (job *memoryJob) Finish() error {
+	return job.setState("done")
+}
+
+// Schedule marks the job as scheduled until wakeAt.
+func (job *memoryJob) Schedule(wakeAt time.Time) error {
+	job.store.mu.Lock()
+	defer job.store.mu.Unlock()
+	job.store.jobs[job.name].state = "scheduled"
+	job.store.jobs[job.name].wakeAt = wakeAt
+	return nil
+}
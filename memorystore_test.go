@@ -0,0 +1,73 @@
+package mailrail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.Submit([]byte("not json")); err == nil {
+		t.Fatal("expected an unparseable spec to be refused")
+	}
+	name, err := s.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	later, err := s.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"not_before": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `", "recipients": [{"addr": "c@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	svc := MockSES{}
+	ProcessJobStore(s, UseMockSesService(&svc))
+	if svc.nsent != 2 || s.State(name) != "done" || s.State(later) != "scheduled" {
+		t.Fatal("expected the job that is due to be done:", svc.nsent, s.State(name), s.State(later))
+	}
+	if i, err := getCheckpoint(&memoryJob{s, name}); err != nil || i != 2 {
+		t.Fatal("expected the checkpoint to be recorded:", i, err)
+	}
+	if _, err := s.Artifact(name, "results.0"); err != nil {
+		t.Fatal("expected the results to be recorded:", err)
+	}
+}
+
+func TestMemoryStoreRescue(t *testing.T) {
+	s := NewMemoryStore()
+	name, err := s.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	if job, err := s.Take(); err != nil || job.Name() != name {
+		t.Fatal("expected to take the job:", job, err)
+	}
+	if job, _ := s.Take(); job != nil {
+		t.Fatal("expected a taken job not to be taken again:", job.Name())
+	}
+	svc := MockSES{}
+	ProcessJobStore(s, UseMockSesService(&svc))
+	if svc.nsent != 1 || s.State(name) != "done" {
+		t.Fatal("expected the worker to rescue and finish the job:", svc.nsent, s.State(name))
+	}
+}
+
+func TestIdlePolling(t *testing.T) {
+	s := NewMemoryStore()
+	svc := MockSES{}
+	go ProcessJobStoreForever(s, UseMockSesService(&svc), WithIdlePolling(10*time.Millisecond, 40*time.Millisecond))
+	time.Sleep(200 * time.Millisecond)
+	name, err := s.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for s.State(name) != "done" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected an idle worker to pick up the job within its longest poll interval:", s.State(name))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
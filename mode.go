@@ -0,0 +1,68 @@
+package mailrail
+
+import "fmt"
+
+// Specs can set a `mode` so that test campaigns can share a queue
+// with production campaigns: "donotsend", "simulator", or "sendto"
+// with the address in `send_to`. The mode "send" and an empty mode
+// leave the worker's mangler alone. A mode never makes a worker that
+// does not send start sending. Recipients whose messages go elsewhere
+// are recorded as skipped, and not in the send history, so that test
+// campaigns do not count against their frequency caps.
+//
+// Workers fail jobs that set a mode unless they are told to honor
+// modes with `WithSpecModes`, so that a test campaign is not sent for
+// real by a worker that does not know about modes.
+const (
+	ModeSend      = "send"
+	ModeDoNotSend = "donotsend"
+	ModeSimulator = "simulator"
+	ModeSendTo    = "sendto"
+)
+
+// Honor the `mode` field of specs.
+func WithSpecModes() Option {
+	return func(o *options) {
+		o.honorSpecModes = true
+	}
+}
+
+func (spec Spec) checkMode() error {
+	switch spec.Mode {
+	case "", ModeSend, ModeDoNotSend, ModeSimulator:
+		return nil
+	case ModeSendTo:
+		if spec.SendTo == "" {
+			return fmt.Errorf("Mode %s requires send_to", ModeSendTo)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown mode %q", spec.Mode)
+	}
+}
+
+// specMangler returns the mangler to use for the job, given the
+// worker's.
+func (mailing *mailing) specMangler(mangler Mangler) (Mangler, error) {
+	mode := mailing.spec.Mode
+	if mode == "" || mode == ModeSend {
+		return mangler, nil
+	}
+	if !mailing.opts.honorSpecModes {
+		return mangler, fmt.Errorf("Spec has mode %s, but this worker does not honor spec modes", mode)
+	}
+	if !mangler.ShouldSend {
+		return mangler, nil
+	}
+	var m Mangler
+	switch mode {
+	case ModeDoNotSend:
+		m = DoNotSend
+	case ModeSimulator:
+		m = SendToSimulator
+	case ModeSendTo:
+		m = SendToMe(mailing.spec.SendTo)
+	}
+	m.SesService = mangler.SesService
+	return m, nil
+}
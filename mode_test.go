@@ -0,0 +1,83 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func runWithMode(t *testing.T, mode string, mangler Mangler, opts ...Option) *MockSES {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_mode_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+`+mode+`
+"recipients": [{"addr": "janedoe@example.com"}]
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, mangler, newOptions(opts))
+	return &svc
+}
+
+func TestSpecModes(t *testing.T) {
+	svc := runWithMode(t, `"mode": "sendto", "send_to": "tester@example.com",`, DoNotMangle, WithSpecModes())
+	if svc.nsent != 1 || *svc.sent.Destination.ToAddresses[0] != "tester@example.com" {
+		t.Fatal("expected the message to go to the tester")
+	}
+	svc = runWithMode(t, `"mode": "simulator",`, DoNotMangle, WithSpecModes())
+	if svc.nsent != 1 || *svc.sent.Destination.ToAddresses[0] != "success@simulator.amazonses.com" {
+		t.Fatal("expected the message to go to the simulator")
+	}
+	svc = runWithMode(t, `"mode": "donotsend",`, DoNotMangle, WithSpecModes())
+	if svc.nsent != 0 {
+		t.Fatal("expected no message to be sent")
+	}
+	svc = runWithMode(t, `"mode": "simulator",`, DoNotMangle)
+	if svc.nsent != 0 {
+		t.Fatal("expected a worker that does not honor modes to fail the job")
+	}
+	svc = runWithMode(t, `"mode": "send",`, DoNotSend, WithSpecModes())
+	if svc.nsent != 0 {
+		t.Fatal("expected a mode not to make a worker send")
+	}
+	svc = runWithMode(t, `"mode": "sendto",`, DoNotMangle, WithSpecModes())
+	if svc.nsent != 0 {
+		t.Fatal("expected sendto without send_to to fail the job")
+	}
+}
+
+func TestSpecModesSkipHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_mode_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	history, err := OpenSendHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	svc := runWithMode(t, `"mode": "simulator",`, DoNotMangle, WithSpecModes(), WithFrequencyCap(history, 1, time.Hour))
+	if svc.nsent != 1 {
+		t.Fatal("expected the message to go to the simulator")
+	}
+	if n := history.Count("janedoe@example.com", time.Now().Add(-time.Hour)); n != 0 {
+		t.Fatal("expected a message to the simulator not to count against the recipient:", n)
+	}
+	runWithMode(t, ``, DoNotMangle, WithFrequencyCap(history, 1, time.Hour))
+	if n := history.Count("janedoe@example.com", time.Now().Add(-time.Hour)); n != 1 {
+		t.Fatal("expected a message to the recipient to count against it:", n)
+	}
+}
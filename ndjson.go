@@ -0,0 +1,126 @@
+package mailrail
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// The recipients of a very large job can be stored apart from its
+// spec, in the job's "recipients.ndjson" artifact, one JSON recipient
+// per line, if the spec says `"recipients_ndjson": true`, or in NDJSON
+// wherever its `recipients_ref` says. The worker
+// keeps the artifact as it is and decodes each recipient only when it
+// gets to it, instead of holding millions of decoded recipients in
+// memory, and the dry run before sending checks only the first
+// dryRunSample recipients; a recipient whose message cannot be
+// rendered fails according to the error policy like one that cannot
+// be sent. Commands that read jobs, such as `mailrail-report`, still
+// decode all the recipients.
+const (
+	recipientsNDJSONKey = "recipients.ndjson"
+	dryRunSample        = 100
+)
+
+// ndjsonRecipients are the recipients of a job in NDJSON. The
+// recipients the job is working on are kept decoded, so that changes
+// to them, such as enrichment, last until the job is done with them.
+type ndjsonRecipients struct {
+	data    []byte
+	offsets []int
+	decoded map[int]*Recipient
+	order   []int
+}
+
+// How many decoded recipients are kept, which must be more than the
+// recipients a job works on at a time.
+const ndjsonDecodedRecipients = 1024
+
+// newNDJSONRecipients indexes the lines of the artifact, checking that
+// each is a recipient. Blank lines are skipped.
+func newNDJSONRecipients(data []byte) (*ndjsonRecipients, error) {
+	r := &ndjsonRecipients{data: data, decoded: make(map[int]*Recipient)}
+	for start := 0; start < len(data); {
+		end := bytes.IndexByte(data[start:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += start
+		}
+		if line := bytes.TrimSpace(data[start:end]); len(line) > 0 {
+			var recipient Recipient
+			if err := unmarshalJSON(line, &recipient); err != nil {
+				return nil, fmt.Errorf("Cannot parse recipient %d of %s: %s", len(r.offsets), recipientsNDJSONKey, err)
+			}
+			r.offsets = append(r.offsets, start)
+		}
+		start = end + 1
+	}
+	return r, nil
+}
+
+func (r *ndjsonRecipients) len() int {
+	return len(r.offsets)
+}
+
+func (r *ndjsonRecipients) get(i int) *Recipient {
+	if recipient, ok := r.decoded[i]; ok {
+		return recipient
+	}
+	recipient := r.decode(i)
+	if len(r.order) == ndjsonDecodedRecipients {
+		delete(r.decoded, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.decoded[i] = recipient
+	r.order = append(r.order, i)
+	return recipient
+}
+
+func (r *ndjsonRecipients) decode(i int) *Recipient {
+	line := r.data[r.offsets[i]:]
+	if end := bytes.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	recipient := new(Recipient)
+	// Checked when the artifact was indexed.
+	unmarshalJSON(line, recipient)
+	return recipient
+}
+
+// ReadRecipientsNDJSON reads recipients in NDJSON, one JSON recipient
+// per line, which may be gzipped or encrypted.
+func ReadRecipientsNDJSON(data []byte) ([]Recipient, error) {
+	data, err := decodeArtifact(data)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newNDJSONRecipients(data)
+	if err != nil {
+		return nil, err
+	}
+	return r.all(), nil
+}
+
+// all decodes all the recipients.
+func (r *ndjsonRecipients) all() []Recipient {
+	recipients := make([]Recipient, r.len())
+	for i := range recipients {
+		recipients[i] = *r.decode(i)
+	}
+	return recipients
+}
+
+// recipient returns recipient i of the mailing.
+func (mailing *mailing) recipient(i int) *Recipient {
+	if mailing.ndjson != nil {
+		return mailing.ndjson.get(i)
+	}
+	return &mailing.spec.Recipients[i]
+}
+
+func (mailing *mailing) recipientCount() int {
+	if mailing.ndjson != nil {
+		return mailing.ndjson.len()
+	}
+	return len(mailing.spec.Recipients)
+}
@@ -0,0 +1,69 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNDJSONRecipients(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_ndjson_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewSubmitter(dir)
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}"}`)
+	if _, err := s.SubmitNDJSON(spec, []byte("{\"addr\": \"a@example.com\"}\nnot json\n")); err == nil {
+		t.Fatal("expected a line that is not a recipient to be refused")
+	}
+	basename, err := s.SubmitNDJSON(spec, []byte(`{"addr": "a@example.com", "context": {"name": "A"}}
+
+{"addr": "b@example.com", "context": {"name": "B"}}
+{"addr": "c@example.com", "context": {"name": "C"}}`))
+	if err != nil {
+		t.Fatal("SubmitNDJSON", err)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 3 || *svc.sent.Message.Body.Text.Data != "Hello, C" {
+		t.Fatal("expected the recipients to be sent to:", svc.nsent)
+	}
+	report, err := JobReport(dir, basename)
+	if err != nil || len(report) != 3 || report[1].Addr != "b@example.com" || report[1].Status != StatusSent {
+		t.Fatal("unexpected report:", report, err)
+	}
+}
+
+func TestNDJSONRecipientsDecoded(t *testing.T) {
+	var data []byte
+	for i := 0; i < ndjsonDecodedRecipients+10; i++ {
+		data = append(data, `{"addr": "a@example.com"}`+"\n"...)
+	}
+	r, err := newNDJSONRecipients(data)
+	if err != nil || r.len() != ndjsonDecodedRecipients+10 {
+		t.Fatal("newNDJSONRecipients", err)
+	}
+	first := r.get(0)
+	first.Context = map[string]interface{}{"enriched": "yes"}
+	if r.get(0).Context["enriched"] != "yes" {
+		t.Fatal("expected changes to a decoded recipient to last")
+	}
+	for i := 0; i < r.len(); i++ {
+		r.get(i)
+	}
+	if len(r.decoded) != ndjsonDecodedRecipients || r.get(0).Context != nil {
+		t.Fatal("expected recipients the job is done with to be forgotten:", len(r.decoded))
+	}
+}
+
+func TestReadRecipientsNDJSON(t *testing.T) {
+	data, _ := Gzip([]byte("{\"addr\": \"a@example.com\"}\n\n{\"addr\": \"b@example.com\"}\n"))
+	recipients, err := ReadRecipientsNDJSON(data)
+	if err != nil || len(recipients) != 2 || recipients[1].Addr != "b@example.com" {
+		t.Fatal("unexpected recipients:", recipients, err)
+	}
+	if _, err := ReadRecipientsNDJSON([]byte("not json\n")); err == nil {
+		t.Fatal("expected a line that is not a recipient to be an error")
+	}
+}
@@ -0,0 +1,59 @@
+package mailrail
+
+import "time"
+
+type EventType int
+
+const (
+	// A job with `Recipients` recipients is about to start sending,
+	// possibly resuming from a checkpoint at `Recipient`.
+	JobStarted EventType = iota
+	// A message was sent to `Recipient`.
+	MessageSent
+	// SES asked us to slow down while sending to `Recipient`.
+	Throttled
+	// Sending to `Recipient` failed with the AWS error `Code`, if
+	// any.
+	SendFailed
+	// The job finished after `Duration`.
+	JobFinished
+	// The job failed after `Duration`.
+	JobFailed
+	// `Recipient` was skipped because of a policy such as a
+	// frequency cap.
+	Skipped
+	// The job was cancelled after `Duration`, before sending to
+	// `Recipient`.
+	JobCancelled
+	// The job was paused after `Duration`, before sending to
+	// `Recipient`.
+	JobPaused
+	// At `Recipient` of `Recipients`, the job is predicted to finish
+	// `Duration` after the deadline of its SLA.
+	SLAAtRisk
+	// The job with `Recipients` recipients finished `Duration` after
+	// the deadline of its SLA.
+	SLAMissed
+	// The job failed to write its checkpoint after `Recipient`
+	// recipients and goes on sending while it tries again.
+	CheckpointFailing
+)
+
+// Events describe the progress of jobs. Only the fields mentioned
+// in the documentation of the event's type are set.
+type Event struct {
+	Type       EventType
+	Job        string
+	Recipient  int
+	Recipients int
+	MessageId  string
+	Code       string
+	Duration   time.Duration
+}
+
+// Observers are notified of events as jobs are processed. Observe is
+// called synchronously from the sending loop, so it should not
+// block.
+type Observer interface {
+	Observe(e Event)
+}
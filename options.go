@@ -0,0 +1,88 @@
+package mailrail
+
+import (
+	"database/sql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// An Option changes how jobs are processed. Options are passed to
+// `Process`, `ProcessOne`, and `ProcessForever`.
+type Option func(*options)
+
+type options struct {
+	queueDir            string
+	observers           []Observer
+	configurationSets   map[string]string
+	tracer              trace.Tracer
+	frequencyCap        *frequencyCap
+	lists               *ListStore
+	dataSources         map[string]*sql.DB
+	s3                  s3Service
+	errorPolicy         ErrorPolicy
+	operatorSummary     *operatorSummary
+	honorSpecModes      bool
+	residency           *residency
+	suppressions        *SuppressionList
+	enrichment          *enrichment
+	contextCheck        *contextCheck
+	previewDir          string
+	templateFuncs       map[string]interface{}
+	templateDir         string
+	recipientsDir       string
+	specWebhookHosts    []string
+	specWebhookSecrets  []string
+	accountSuppressions *AccountSuppressions
+	unsubscribe         *unsubscribe
+	tracking            *tracking
+	archive             ArchiveStore
+	presets             map[string]Preset
+	idlePollMin         time.Duration
+	idlePollMax         time.Duration
+	concurrency         int
+	lease               time.Duration
+	workerID            string
+	rateLimiter         SharedRateLimiter
+	shardSize           int
+	// Held while observers are called, if they can be called from
+	// more than one goroutine.
+	notifyMu *sync.Mutex
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{tracer: otel.Tracer(tracerName)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// with returns a copy of the options with more options applied.
+func (o *options) with(opts ...Option) *options {
+	c := *o
+	c.observers = append([]Observer(nil), o.observers...)
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// Report events to an observer. This option can be given more than
+// once.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observers = append(o.observers, observer)
+	}
+}
+
+func (o *options) notify(e Event) {
+	if o.notifyMu != nil {
+		o.notifyMu.Lock()
+		defer o.notifyMu.Unlock()
+	}
+	for _, observer := range o.observers {
+		observer.Observe(e)
+	}
+}
@@ -0,0 +1,30 @@
+package mailrail
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Partials are named templates in a spec, such as a header, footer,
+// or signature, that the text, HTML, and AMP templates can include
+// with `{{template "footer" .}}`. Each of those templates gets its own
+// copy of every partial, so a partial included in HTML is escaped as
+// HTML. Partials are assumed to be executed with the recipient's
+// context when finding the context fields that templates refer to.
+func (mailing *mailing) parsePartials(parse func(name, text string) error) error {
+	names := make([]string, 0, len(mailing.spec.Partials))
+	for name := range mailing.spec.Partials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "text", "html", "amp":
+			return fmt.Errorf("Partial cannot be named %q", name)
+		}
+		if err := parse(name, mailing.spec.Partials[name]); err != nil {
+			return fmt.Errorf("Cannot parse partial %q: %s", name, err)
+		}
+	}
+	return nil
+}
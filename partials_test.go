@@ -0,0 +1,36 @@
+package mailrail
+
+import (
+	"testing"
+)
+
+func TestPartials(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "Hello, {{.name}}\n{{template \"footer\" .}}",
+"html": "<p>Hello, {{.name}}</p>{{template \"footer\" .}}",
+"partials": {"footer": "-- {{.company}}"},
+"recipients": [{"addr": "a@example.com", "context": {"name": "A", "company": "ACME & Sons"}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	msg, err := preview.Render(0)
+	if err != nil {
+		t.Fatal("Render", err)
+	}
+	if msg.Text != "Hello, A\n-- ACME & Sons" || msg.HTML != "<p>Hello, A</p>-- ACME &amp; Sons" {
+		t.Fatal("unexpected message:", msg.Text, msg.HTML)
+	}
+	vars, err := TemplateVariables(preview.mailing.spec)
+	if err != nil || len(vars) != 2 || vars[0] != "company" || vars[1] != "name" {
+		t.Fatal("expected the partial's variables:", vars, err)
+	}
+	if _, err := NewPreview([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hi",
+"partials": {"footer": "{{.company"}, "recipients": [{"addr": "a@example.com"}]}`)); err == nil {
+		t.Fatal("expected an error for a partial that does not parse")
+	}
+	if _, err := NewPreview([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hi",
+"partials": {"html": "Hello"}, "recipients": [{"addr": "a@example.com"}]}`)); err == nil {
+		t.Fatal("expected an error for a partial with a reserved name")
+	}
+}
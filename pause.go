@@ -0,0 +1,103 @@
+package mailrail
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	pauseKey  = "pause"
+	pausedKey = "paused"
+)
+
+// Pause asks the worker to park a queued or in-progress job. Between
+// recipients, the worker checkpoints the job, records that it is
+// paused, and moves it to the failed state, where `mailrail-status`
+// shows it as paused. `Resume` puts it back in the queue, and it
+// continues from the same recipient. A scheduled job, which waits in
+// the failed state, is paused right away; once resumed, it is
+// scheduled again if it is not yet due. The shards of a sharded job
+// are paused and resumed along with it.
+func Pause(queueDir, basename string) error {
+	if err := pause(queueDir, basename); err != nil {
+		return err
+	}
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	return controlShardsOf(queueDir, dir, hasEnded, Pause)
+}
+
+func pause(queueDir, basename string) error {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	if pathHasState(dir, "failed") && unschedule(dir) {
+		return writeJobFile(dir, pausedKey, []byte(time.Now().Format(time.RFC3339)))
+	}
+	// The job may have been woken while we looked.
+	if dir, err = findJob(queueDir, basename); err != nil {
+		return err
+	}
+	if pathHasState(dir, "done") || pathHasState(dir, "failed") {
+		return fmt.Errorf("Job %s is not queued or in progress", basename)
+	}
+	return requestControl(queueDir, basename, pauseKey)
+}
+
+// Resume requeues a paused job, or withdraws the request to pause a
+// job that has not been parked yet. A worker pauses a job by itself
+// if the queue volume does not have room for it; its failure report
+// says why.
+func Resume(queueDir, basename string) error {
+	if err := resume(queueDir, basename); err != nil {
+		return err
+	}
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	return controlShardsOf(queueDir, dir, func(dir string) bool {
+		_, err := os.Stat(path.Join(dir, pauseKey))
+		return err != nil && !isPaused(dir)
+	}, Resume)
+}
+
+func resume(queueDir, basename string) error {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return err
+	}
+	if !pathHasState(dir, "failed") {
+		if err := os.Remove(path.Join(dir, pauseKey)); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("Job %s is not paused", basename)
+			}
+			return err
+		}
+		return nil
+	}
+	if !isPaused(dir) {
+		return fmt.Errorf("Job %s is not paused", basename)
+	}
+	for _, key := range []string{pauseKey, pausedKey, failureReportKey} {
+		if err := os.Remove(path.Join(dir, key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(dir, path.Join(queueDir, "queue", basename))
+}
+
+func pauseRequested(job Job) bool {
+	_, err := job.Get(pauseKey)
+	return err == nil
+}
+
+func isPaused(jobDir string) bool {
+	_, err := os.Stat(path.Join(jobDir, pausedKey))
+	return err == nil
+}
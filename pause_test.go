@@ -0,0 +1,60 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type pausingObserver struct {
+	queueDir string
+	after    int
+}
+
+func (p pausingObserver) Observe(e Event) {
+	if e.Type == MessageSent && e.Recipient == p.after-1 {
+		Pause(p.queueDir, e.Job)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_pause_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithObserver(pausingObserver{dir, 1}))
+	if svc.nsent != 1 {
+		t.Fatal("expected 1 message before pausing, not", svc.nsent)
+	}
+	status, err := GetJobStatus(dir, j.Basename)
+	if err != nil || status.State != "paused" || status.Sent != 1 {
+		t.Fatal("unexpected status:", status, err)
+	}
+	if err := Resume(dir, j.Basename); err != nil {
+		t.Fatal("Resume", err)
+	}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 3 {
+		t.Fatal("expected 3 messages after resuming, not", svc.nsent)
+	}
+	ensureExist(t, path.Join(dir, "done", j.Basename))
+	if err := Resume(dir, j.Basename); err == nil {
+		t.Fatal("expected error when resuming a job that is not paused")
+	}
+}
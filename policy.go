@@ -0,0 +1,37 @@
+package mailrail
+
+import (
+	"fmt"
+	"time"
+)
+
+// skip returns an error saying why recipient i must not be sent a
+// message, or nil if the message should be sent.
+func (mailing *mailing) skip(i int) error {
+	recipient := *mailing.recipient(i)
+	if recipient.SuppressUntil != nil && time.Now().Before(*recipient.SuppressUntil) {
+		return fmt.Errorf("Recipient is suppressed until %s", recipient.SuppressUntil.Format(time.RFC3339))
+	}
+	stream, err := computeStream(*mailing, i)
+	if err != nil {
+		return err
+	}
+	if suppressions := mailing.opts.suppressions; suppressions != nil {
+		// Unsubscribing opts out of bulk mail, not of mail the
+		// recipient asked for.
+		if entry, ok := suppressions.Lookup(recipient.Addr); ok && (entry.Reason != "unsubscribe" || stream == MarketingStream) {
+			return fmt.Errorf("Address is suppressed: %s", entry.Reason)
+		}
+	}
+	if as := mailing.opts.accountSuppressions; as != nil {
+		if reason := as.Lookup(recipient.Addr); reason != "" {
+			return fmt.Errorf("Address is suppressed by SES: %s", reason)
+		}
+	}
+	if fc := mailing.opts.frequencyCap; fc != nil && stream == MarketingStream {
+		if fc.history.Count(recipient.Addr, time.Now().Add(-fc.period)) >= fc.max {
+			return fmt.Errorf("Frequency cap of %d messages per %s reached", fc.max, fc.period)
+		}
+	}
+	return nil
+}
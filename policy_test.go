@@ -0,0 +1,46 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSuppressUntil(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_policy_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	earlier := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com", "suppress_until": "`+later+`"},
+  {"addr": "b@example.com", "suppress_until": "`+earlier+`"}, {"addr": "c@example.com"}]}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 2 {
+		t.Fatal("expected 2 messages to be sent, not", svc.nsent)
+	}
+	report, err := JobReport(dir, j.Basename)
+	if err != nil {
+		t.Fatal("JobReport", err)
+	}
+	if report[0].Status != StatusSkipped || report[0].Error != "Recipient is suppressed until "+later {
+		t.Fatal("unexpected result:", report[0])
+	}
+	if report[1].Status != StatusSent || report[2].Status != StatusSent {
+		t.Fatal("unexpected results:", report[1:])
+	}
+}
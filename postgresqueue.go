@@ -0,0 +1,279 @@
+package mailrail
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A PostgresQueue is a job queue in PostgreSQL for workers on several
+// hosts. Jobs are rows of mailrail_jobs, which workers take with row
+// locking, highest priority first; their specs, checkpoints, and the
+// other artifacts that the worker records are rows of
+// mailrail_artifacts; and each result is a row of mailrail_results, so
+// that jobs can be reported on with SQL and backed up with the
+// database. A worker leases the jobs it takes, in locked_by and
+// locked_until, and renews the leases while it processes them; workers
+// put the jobs whose leases have expired back in the queue, so the
+// jobs of a worker that died are taken up again. The program must
+// import a Postgres driver for database/sql. Pausing, resuming, and the
+// commands that read queue directories work only with queue
+// directories.
+type PostgresQueue struct {
+	// How long a taken job stays leased to the worker unless it
+	// renews the lease, which it does every third of this.
+	Lease time.Duration
+	db    *sql.DB
+}
+
+// PostgresSchema creates the tables of a PostgresQueue.
+const PostgresSchema = `
+CREATE TABLE IF NOT EXISTS mailrail_jobs (
+    name text PRIMARY KEY,
+    state text NOT NULL DEFAULT 'queued',
+    priority integer NOT NULL DEFAULT 0,
+    wake_at timestamptz,
+    submitted_at timestamptz NOT NULL DEFAULT now(),
+    locked_by text,
+    locked_until timestamptz
+);
+ALTER TABLE mailrail_jobs ADD COLUMN IF NOT EXISTS locked_by text;
+ALTER TABLE mailrail_jobs ADD COLUMN IF NOT EXISTS locked_until timestamptz;
+CREATE INDEX IF NOT EXISTS mailrail_jobs_state ON mailrail_jobs (state, priority DESC, name);
+CREATE TABLE IF NOT EXISTS mailrail_artifacts (
+    job text NOT NULL REFERENCES mailrail_jobs,
+    key text NOT NULL,
+    value bytea NOT NULL,
+    PRIMARY KEY (job, key)
+);
+CREATE TABLE IF NOT EXISTS mailrail_results (
+    id bigserial PRIMARY KEY,
+    job text NOT NULL REFERENCES mailrail_jobs,
+    recipient integer NOT NULL,
+    addr text NOT NULL,
+    status text NOT NULL,
+    message_id text,
+    content_hash text,
+    time timestamptz NOT NULL,
+    error_code text,
+    request_id text,
+    error text,
+    zone text
+);
+CREATE INDEX IF NOT EXISTS mailrail_results_job ON mailrail_results (job, recipient);
+`
+
+const (
+	pgInsertJob      = `INSERT INTO mailrail_jobs (name, state, priority) VALUES ($1, 'submitting', $2)`
+	pgWakeJobs       = `UPDATE mailrail_jobs SET state = 'queued', wake_at = NULL WHERE state = 'scheduled' AND wake_at <= now()`
+	pgReclaimJobs    = `UPDATE mailrail_jobs SET state = 'queued', locked_by = NULL, locked_until = NULL WHERE state = 'cur' AND locked_until < now()`
+	pgTakeJob        = `UPDATE mailrail_jobs SET state = 'cur', locked_by = $1, locked_until = now() + $2 * interval '1 millisecond' WHERE name = (SELECT name FROM mailrail_jobs WHERE state = 'queued' ORDER BY priority DESC, name LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING name`
+	pgRenewLease     = `UPDATE mailrail_jobs SET locked_until = now() + $3 * interval '1 millisecond' WHERE name = $1 AND state = 'cur' AND locked_by = $2 AND locked_until >= now()`
+	pgSetState       = `UPDATE mailrail_jobs SET state = $2, wake_at = $3, locked_by = NULL, locked_until = NULL WHERE name = $1 AND locked_by IS NOT DISTINCT FROM $4`
+	pgGetArtifact    = `SELECT value FROM mailrail_artifacts WHERE job = $1 AND key = $2`
+	pgSetArtifact    = `INSERT INTO mailrail_artifacts (job, key, value) VALUES ($1, $2, $3) ON CONFLICT (job, key) DO UPDATE SET value = EXCLUDED.value`
+	pgInsertResult   = `INSERT INTO mailrail_results (job, recipient, addr, status, message_id, content_hash, time, error_code, request_id, error, zone) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	pgGetResultChunk = `SELECT recipient, addr, status, message_id, content_hash, time, error_code, request_id, error, zone FROM mailrail_results WHERE job = $1 AND recipient >= $2 AND recipient < $3 ORDER BY id`
+)
+
+// Returns a job queue in a PostgreSQL database whose tables have been
+// created with `PostgresSchema`.
+func NewPostgresQueue(db *sql.DB) *PostgresQueue {
+	return &PostgresQueue{Lease: 5 * time.Minute, db: db}
+}
+
+// Submit stores a spec and queues it, and returns the name of the new
+// job. The job is queued only once its spec is stored, so that no
+// worker takes it before.
+func (q *PostgresQueue) Submit(specBytes []byte) (string, error) {
+	spec, err := parseSpec(specBytes)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	name := fmt.Sprintf("%d-%d-standalone", time.Now().UnixNano(), os.Getpid())
+	if _, err := q.db.Exec(pgInsertJob, name, spec.Priority); err != nil {
+		return "", err
+	}
+	job := &postgresJob{queue: q, name: name}
+	if err := job.Set("spec", specBytes); err != nil {
+		return "", err
+	}
+	if err := job.Set(submittedKey, []byte(time.Now().Format(time.RFC3339Nano))); err != nil {
+		return "", err
+	}
+	if err := job.setState("queued", nil); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Take puts the scheduled jobs that are due and the jobs whose leases
+// have expired back in the queue, then takes and leases the oldest of
+// the queued jobs with the highest priority.
+func (q *PostgresQueue) Take() (Job, error) {
+	if _, err := q.db.Exec(pgWakeJobs); err != nil {
+		return nil, err
+	}
+	if err := q.Rescue(); err != nil {
+		return nil, err
+	}
+	token := leaseToken()
+	now := time.Now()
+	var name string
+	if err := q.db.QueryRow(pgTakeJob, token, q.Lease.Milliseconds()).Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &postgresJob{queue: q, name: name, token: token, renewed: now}, nil
+}
+
+// Rescue puts the jobs whose leases have expired, as the workers that
+// took them died or lost touch, back in the queue.
+func (q *PostgresQueue) Rescue() error {
+	_, err := q.db.Exec(pgReclaimJobs)
+	return err
+}
+
+type postgresJob struct {
+	queue *PostgresQueue
+	name  string
+	token string
+	// When the lease was last taken or renewed.
+	renewed time.Time
+	lost    int32
+}
+
+func (job *postgresJob) leaseDuration() time.Duration {
+	return job.queue.Lease
+}
+
+func (job *postgresJob) renewLease() (time.Duration, error) {
+	now := time.Now()
+	result, err := job.queue.db.Exec(pgRenewLease, job.name, job.token, job.queue.Lease.Milliseconds())
+	var n int64
+	if err == nil {
+		if n, err = result.RowsAffected(); err == nil && n == 1 {
+			job.renewed = now
+			return job.queue.Lease, nil
+		}
+	}
+	remaining := job.queue.Lease - time.Since(job.renewed)
+	if err == nil || remaining <= 0 {
+		atomic.StoreInt32(&job.lost, 1)
+		if err == nil {
+			err = fmt.Errorf("Job %s is no longer leased to this worker", job.name)
+		}
+		return 0, err
+	}
+	// Try again before the lease expires.
+	log.Printf("Job %s failed to renew its lease: %s", job.name, err)
+	return remaining, nil
+}
+
+func (job *postgresJob) leaseLost() bool {
+	return atomic.LoadInt32(&job.lost) != 0
+}
+
+func (job *postgresJob) Name() string {
+	return job.name
+}
+
+// Get returns an artifact. The chunks of results are read from
+// mailrail_results.
+func (job *postgresJob) Get(key string) ([]byte, error) {
+	if strings.HasPrefix(key, "results.") {
+		if chunk, err := strconv.Atoi(strings.TrimPrefix(key, "results.")); err == nil {
+			return job.getResultsChunk(chunk)
+		}
+	}
+	var value []byte
+	if err := job.queue.db.QueryRow(pgGetArtifact, job.name, key).Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+func (job *postgresJob) Set(key string, value []byte) error {
+	_, err := job.queue.db.Exec(pgSetArtifact, job.name, key, value)
+	return err
+}
+
+// RecordResult adds a result to mailrail_results.
+func (job *postgresJob) RecordResult(r Result) error {
+	_, err := job.queue.db.Exec(pgInsertResult, job.name, r.Recipient, r.Addr, r.Status,
+		nullString(r.MessageId), nullString(r.ContentHash), r.Time, nullString(r.ErrorCode),
+		nullString(r.RequestId), nullString(r.Error), nullString(r.Zone))
+	return err
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (job *postgresJob) getResultsChunk(chunk int) ([]byte, error) {
+	rows, err := job.queue.db.Query(pgGetResultChunk, job.name, chunk*resultsPerChunk, (chunk+1)*resultsPerChunk)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rs []Result
+	for rows.Next() {
+		var r Result
+		var messageId, contentHash, errorCode, requestId, errorMessage, zone sql.NullString
+		if err := rows.Scan(&r.Recipient, &r.Addr, &r.Status, &messageId, &contentHash, &r.Time,
+			&errorCode, &requestId, &errorMessage, &zone); err != nil {
+			return nil, err
+		}
+		r.MessageId, r.ContentHash, r.ErrorCode = messageId.String, contentHash.String, errorCode.String
+		r.RequestId, r.Error, r.Zone = requestId.String, errorMessage.String, zone.String
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if rs == nil {
+		return nil, os.ErrNotExist
+	}
+	return json.Marshal(rs)
+}
+
+// setState moves the job to a state and gives up its lease, unless
+// another worker has leased it since.
+func (job *postgresJob) setState(state string, wakeAt *time.Time) error {
+	result, err := job.queue.db.Exec(pgSetState, job.name, state, wakeAt, nullString(job.token))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return fmt.Errorf("Job %s is no longer leased to this worker", job.name)
+	}
+	return nil
+}
+
+func (job *postgresJob) Submit() error {
+	return job.setState("queued", nil)
+}
+
+func (job *postgresJob) Fail() error {
+	return job.setState("failed", nil)
+}
+
+func (job *postgresJob) Finish() error {
+	return job.setState("done", nil)
+}
+
+// Schedule marks the job as scheduled until wakeAt.
+func (job *postgresJob) Schedule(wakeAt time.Time) error {
+	return job.setState("scheduled", &wakeAt)
+}
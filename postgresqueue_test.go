@@ -0,0 +1,277 @@
+package mailrail
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A database/sql driver that carries out the statements of the
+// Postgres job queue on tables in memory.
+type fakePostgres struct {
+	mu        sync.Mutex
+	jobs      map[string]*fakePostgresJob
+	artifacts map[string][]byte
+	results   [][]driver.Value
+	// If set, storing artifacts fails.
+	failArtifacts bool
+}
+
+type fakePostgresJob struct {
+	state    string
+	priority int64
+	wakeAt   time.Time
+	// The lease, if the job is taken.
+	lockedBy    string
+	lockedUntil time.Time
+}
+
+type fakePostgresConn struct{ db *fakePostgres }
+type fakePostgresStmt struct {
+	db    *fakePostgres
+	query string
+}
+type fakePostgresRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakePostgresDriver opens the fakePostgres named by the data source
+// name. It is registered once, as registering a driver twice panics
+// when tests run more than once.
+type fakePostgresDriver struct{}
+
+var fakePostgresDBs = struct {
+	sync.Mutex
+	m map[string]*fakePostgres
+}{m: make(map[string]*fakePostgres)}
+
+func init() {
+	sql.Register("mailrailpostgresfake", fakePostgresDriver{})
+}
+
+func (fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	fakePostgresDBs.Lock()
+	defer fakePostgresDBs.Unlock()
+	db, ok := fakePostgresDBs.m[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return fakePostgresConn{db}, nil
+}
+
+// openFakePostgres returns a database on fake for a test.
+func openFakePostgres(t *testing.T, fake *fakePostgres) *sql.DB {
+	fakePostgresDBs.Lock()
+	fakePostgresDBs.m[t.Name()] = fake
+	fakePostgresDBs.Unlock()
+	db, err := sql.Open("mailrailpostgresfake", t.Name())
+	if err != nil {
+		t.Fatal("sql.Open", err)
+	}
+	return db
+}
+
+func (c fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return fakePostgresStmt{c.db, query}, nil
+}
+func (c fakePostgresConn) Close() error              { return nil }
+func (c fakePostgresConn) Begin() (driver.Tx, error) { return nil, io.EOF }
+func (s fakePostgresStmt) Close() error              { return nil }
+func (s fakePostgresStmt) NumInput() int             { return -1 }
+
+func (s fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, n, err := s.run(args)
+	return driver.RowsAffected(n), err
+}
+
+func (s fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, _, err := s.run(args)
+	return rows, err
+}
+
+// run carries out the statement and returns its rows and the number of
+// rows it changed.
+func (s fakePostgresStmt) run(args []driver.Value) (driver.Rows, int64, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch s.query {
+	case pgInsertJob:
+		db.jobs[args[0].(string)] = &fakePostgresJob{state: "submitting", priority: args[1].(int64)}
+	case pgWakeJobs:
+		for _, job := range db.jobs {
+			if job.state == "scheduled" && !job.wakeAt.After(time.Now()) {
+				job.state = "queued"
+			}
+		}
+	case pgReclaimJobs:
+		for _, job := range db.jobs {
+			if job.state == "cur" && job.lockedUntil.Before(time.Now()) {
+				job.state, job.lockedBy, job.lockedUntil = "queued", "", time.Time{}
+			}
+		}
+	case pgTakeJob:
+		var names []string
+		for name, job := range db.jobs {
+			if job.state == "queued" {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if db.jobs[names[i]].priority != db.jobs[names[j]].priority {
+				return db.jobs[names[i]].priority > db.jobs[names[j]].priority
+			}
+			return names[i] < names[j]
+		})
+		if len(names) == 0 {
+			return &fakePostgresRows{columns: []string{"name"}}, 0, nil
+		}
+		job := db.jobs[names[0]]
+		job.state, job.lockedBy = "cur", args[0].(string)
+		job.lockedUntil = time.Now().Add(time.Duration(args[1].(int64)) * time.Millisecond)
+		return &fakePostgresRows{[]string{"name"}, [][]driver.Value{{names[0]}}}, 1, nil
+	case pgRenewLease:
+		job := db.jobs[args[0].(string)]
+		if job.state != "cur" || job.lockedBy != args[1] || job.lockedUntil.Before(time.Now()) {
+			return &fakePostgresRows{}, 0, nil
+		}
+		job.lockedUntil = time.Now().Add(time.Duration(args[2].(int64)) * time.Millisecond)
+	case pgSetState:
+		job := db.jobs[args[0].(string)]
+		lockedBy, _ := args[3].(string)
+		if job.lockedBy != lockedBy {
+			return &fakePostgresRows{}, 0, nil
+		}
+		job.state, job.lockedBy, job.lockedUntil = args[1].(string), "", time.Time{}
+		if wakeAt, ok := args[2].(time.Time); ok {
+			job.wakeAt = wakeAt
+		}
+	case pgGetArtifact:
+		rows := &fakePostgresRows{columns: []string{"value"}}
+		if value, ok := db.artifacts[args[0].(string)+"/"+args[1].(string)]; ok {
+			rows.rows = [][]driver.Value{{value}}
+		}
+		return rows, 0, nil
+	case pgSetArtifact:
+		if db.failArtifacts {
+			return nil, 0, fmt.Errorf("connection reset")
+		}
+		db.artifacts[args[0].(string)+"/"+args[1].(string)] = args[2].([]byte)
+	case pgInsertResult:
+		db.results = append(db.results, args)
+	case pgGetResultChunk:
+		rows := &fakePostgresRows{columns: []string{"recipient", "addr", "status", "message_id",
+			"content_hash", "time", "error_code", "request_id", "error", "zone"}}
+		for _, r := range db.results {
+			if r[0] == args[0] && r[1].(int64) >= args[1].(int64) && r[1].(int64) < args[2].(int64) {
+				rows.rows = append(rows.rows, r[1:])
+			}
+		}
+		return rows, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("unexpected query %q", s.query)
+	}
+	return &fakePostgresRows{}, 1, nil
+}
+
+func (r *fakePostgresRows) Columns() []string { return r.columns }
+func (r *fakePostgresRows) Close() error      { return nil }
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestPostgresQueue(t *testing.T) {
+	fake := &fakePostgres{jobs: map[string]*fakePostgresJob{}, artifacts: map[string][]byte{}}
+	q := NewPostgresQueue(openFakePostgres(t, fake))
+	low, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	high, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"priority": 5, "recipients": [{"addr": "b@example.com"}, {"addr": "fail@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	svc := FlakySES{failAddr: "fail@example.com"}
+	ProcessJobStore(q, UseMockSesService(&svc), WithErrorPolicy(SkipRecipient))
+	if len(fake.results) != 3 || fake.results[0][2] != "b@example.com" {
+		t.Fatal("expected the job with the higher priority to be sent first:", fake.results)
+	}
+	for _, name := range []string{low, high} {
+		if fake.jobs[name].state != "done" {
+			t.Fatal("expected the job to be done:", name, fake.jobs[name])
+		}
+	}
+	job := &postgresJob{queue: q, name: high}
+	rs, err := getResultsChunk(job.Get, 0)
+	if err != nil || len(rs) != 2 || rs[1].Status != StatusFailed || rs[1].Error == "" || rs[0].MessageId == "" {
+		t.Fatal("expected the results to be read back from the table:", rs, err)
+	}
+	if _, err := job.Get("results.1"); !os.IsNotExist(err) {
+		t.Fatal("expected a chunk without results not to exist:", err)
+	}
+	if i, err := getCheckpoint(job); err != nil || i != 2 {
+		t.Fatal("expected the checkpoint in the artifacts:", i, err)
+	}
+}
+
+func TestPostgresQueueSubmitQueuesLast(t *testing.T) {
+	fake := &fakePostgres{jobs: map[string]*fakePostgresJob{}, artifacts: map[string][]byte{}, failArtifacts: true}
+	q := NewPostgresQueue(openFakePostgres(t, fake))
+	if _, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`)); err == nil {
+		t.Fatal("expected Submit to fail when the spec cannot be stored")
+	}
+	if job, err := q.Take(); err != nil || job != nil {
+		t.Fatal("expected a job without its spec not to be taken:", job, err)
+	}
+}
+
+func TestPostgresQueueLease(t *testing.T) {
+	fake := &fakePostgres{jobs: map[string]*fakePostgresJob{}, artifacts: map[string][]byte{}}
+	q := NewPostgresQueue(openFakePostgres(t, fake))
+	name, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	taken, err := q.Take()
+	if err != nil || taken == nil {
+		t.Fatal("expected to take the job:", taken, err)
+	}
+	job := taken.(*postgresJob)
+	if d, err := job.renewLease(); err != nil || d != q.Lease {
+		t.Fatal("expected the lease to be renewed:", d, err)
+	}
+	if err := q.Rescue(); err != nil || fake.jobs[name].state != "cur" {
+		t.Fatal("expected a leased job not to be rescued:", fake.jobs[name], err)
+	}
+	// The worker dies and its lease expires.
+	fake.jobs[name].lockedUntil = time.Now().Add(-time.Second)
+	again, err := q.Take()
+	if err != nil || again == nil || again.Name() != name {
+		t.Fatal("expected the job with the expired lease to be taken again:", again, err)
+	}
+	if _, err := job.renewLease(); err == nil || !job.leaseLost() {
+		t.Fatal("expected the first worker to lose the lease:", err)
+	}
+	if err := job.Finish(); err == nil {
+		t.Fatal("expected the first worker not to be able to finish the job")
+	}
+	if err := again.Finish(); err != nil || fake.jobs[name].state != "done" {
+		t.Fatal("expected the second worker to finish the job:", fake.jobs[name], err)
+	}
+}
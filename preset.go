@@ -0,0 +1,100 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"io/ioutil"
+	"sort"
+)
+
+// A Preset holds policy that the worker applies to every spec that
+// names it with `preset`, so that specs stay small and the policy can
+// be changed in one place. A spec's own tracking URLs, UTM parameters,
+// and send window take precedence over the preset's. The footers are
+// appended to the spec's text and HTML templates, and the
+// configuration set, if given, is used instead of the one for the
+// stream.
+type Preset struct {
+	ConfigurationSet string            `json:"configuration_set"`
+	Tags             map[string]string `json:"tags"`
+	OpenTrackingURL  string            `json:"open_tracking_url"`
+	ClickTrackingURL string            `json:"click_tracking_url"`
+	UTM              *UTM              `json:"utm"`
+	TextFooter       string            `json:"text_footer"`
+	HtmlFooter       string            `json:"html_footer"`
+	SendWindow       *SendWindow       `json:"send_window"`
+}
+
+// LoadPresets reads a JSON file that maps preset names to presets.
+func LoadPresets(filename string) (map[string]Preset, error) {
+	presetBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var presets map[string]Preset
+	if err := json.Unmarshal(presetBytes, &presets); err != nil {
+		return nil, fmt.Errorf("Cannot parse presets in %s: %s", filename, err)
+	}
+	return presets, nil
+}
+
+// Let specs refer to presets by name.
+func WithPresets(presets map[string]Preset) Option {
+	return func(o *options) {
+		o.presets = presets
+	}
+}
+
+// applyPreset fills in the spec from the preset it names.
+func (mailing *mailing) applyPreset() error {
+	spec := &mailing.spec
+	if spec.Preset == "" {
+		return nil
+	}
+	preset, ok := mailing.opts.presets[spec.Preset]
+	if !ok {
+		return fmt.Errorf("Unknown preset %q", spec.Preset)
+	}
+	mailing.preset = &preset
+	if spec.OpenTrackingURL == "" {
+		spec.OpenTrackingURL = preset.OpenTrackingURL
+	}
+	if spec.ClickTrackingURL == "" {
+		spec.ClickTrackingURL = preset.ClickTrackingURL
+	}
+	if spec.UTM == nil {
+		spec.UTM = preset.UTM
+	}
+	if spec.SendWindow == nil {
+		spec.SendWindow = preset.SendWindow
+	}
+	if spec.Text != "" {
+		spec.Text += preset.TextFooter
+	}
+	if spec.Html != "" {
+		spec.Html += preset.HtmlFooter
+	}
+	return nil
+}
+
+// applyPresetToMessage sets the configuration set and adds the tags
+// of the spec's preset.
+func (mailing *mailing) applyPresetToMessage(params *ses.SendEmailInput) {
+	preset := mailing.preset
+	if preset == nil {
+		return
+	}
+	if preset.ConfigurationSet != "" {
+		params.ConfigurationSetName = aws.String(preset.ConfigurationSet)
+	}
+	var names []string
+	for name := range preset.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params.Tags = append(params.Tags, &ses.MessageTag{Name: aws.String(name), Value: aws.String(preset.Tags[name])})
+	}
+}
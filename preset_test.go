@@ -0,0 +1,64 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPreset(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_preset_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	presetsFilename := path.Join(dir, "presets.json")
+	ioutil.WriteFile(presetsFilename, []byte(`{"newsletter": {"configuration_set": "newsletters",
+"tags": {"team": "editorial"}, "text_footer": "\n-- \nYou get this because you are {{.name}}.",
+"utm": {"source": "newsletter"}}}`), 0644)
+	presets, err := LoadPresets(presetsFilename)
+	if err != nil {
+		t.Fatal("LoadPresets", err)
+	}
+	queueDir := path.Join(dir, "queue")
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "preset": "newsletter",
+"text": "Read https://example.com/", "recipients": [{"addr": "a@example.com", "context": {"name": "Alice"}}]}`))
+	j.Submit()
+	unknown, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	unknown.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "preset": "nosuchpreset",
+"text": "Hello", "recipients": [{"addr": "a@example.com"}]}`))
+	unknown.Submit()
+	svc := MockSES{}
+	Process(queueDir, UseMockSesService(&svc), WithPresets(presets))
+	if svc.nsent != 1 {
+		t.Fatal("expected only the job with a known preset to send:", svc.nsent)
+	}
+	text := *svc.sent.Message.Body.Text.Data
+	if !strings.Contains(text, "utm_source=newsletter") || !strings.HasSuffix(text, "you are Alice.") {
+		t.Fatal("expected the preset's UTM parameters and footer:", text)
+	}
+	if svc.sent.ConfigurationSetName == nil || *svc.sent.ConfigurationSetName != "newsletters" {
+		t.Fatal("expected the preset's configuration set:", svc.sent.ConfigurationSetName)
+	}
+	tags := svc.sent.Tags
+	if len(tags) != 2 || *tags[1].Name != "team" || *tags[1].Value != "editorial" {
+		t.Fatal("expected the preset's tags:", tags)
+	}
+	if status, _ := GetJobStatus(queueDir, unknown.Basename); status.State != "failed" {
+		t.Fatal("expected a job with an unknown preset to fail:", status)
+	}
+}
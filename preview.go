@@ -0,0 +1,238 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Instead of sending, write the messages of each job as .eml files
+// to a directory named after the job in dir, one file per recipient
+// named after the recipient's index. The worker renders the messages
+// from a copy of the job, whose results say that every recipient was
+// skipped, and which is neither recorded in the send history nor
+// reported to observers or webhooks. The job itself is left as it was
+// and paused, so that it is sent once it is resumed, for instance by
+// whoever approves the campaign, or fails if its messages cannot be
+// rendered.
+func WithPreview(dir string) Option {
+	return func(o *options) {
+		o.previewDir = dir
+	}
+}
+
+// A previewCopy is a copy of a job for previewing. It reads the job's
+// artifacts, but keeps what the worker records in memory, and its
+// state changes do nothing.
+type previewCopy struct {
+	Job
+	artifacts map[string][]byte
+}
+
+func (c *previewCopy) Get(key string) ([]byte, error) {
+	if value, ok := c.artifacts[key]; ok {
+		return value, nil
+	}
+	return c.Job.Get(key)
+}
+
+func (c *previewCopy) Set(key string, value []byte) error {
+	c.artifacts[key] = value
+	return nil
+}
+
+func (c *previewCopy) Submit() error { return nil }
+func (c *previewCopy) Fail() error   { return nil }
+func (c *previewCopy) Finish() error { return nil }
+
+// previewJob writes the messages of a job to the preview directory by
+// processing a copy of it, and then pauses the job, or fails it if the
+// copy failed.
+func previewJob(svc sesService, job Job, mangler Mangler, o *options) {
+	c := &previewCopy{job, make(map[string][]byte)}
+	processJob(svc, c, mangler, o.with(func(o *options) {
+		// Nothing outside the copy is changed.
+		o.queueDir = ""
+		o.observers = nil
+		o.operatorSummary = nil
+		o.residency = nil
+		o.rateLimiter = nil
+	}))
+	dir := path.Join(o.previewDir, job.Name())
+	if reportBytes, ok := c.artifacts[failureReportKey]; ok {
+		var report FailureReport
+		if err := json.Unmarshal(reportBytes, &report); err == nil && report.Failed {
+			log.Printf("Job %s failed to preview to %s: %s", job.Name(), dir, report.Reason)
+			if err := job.Set(failureReportKey, reportBytes); err != nil {
+				log.Printf("Job %s failed to write failure report: %s", job.Name(), err)
+			}
+			job.Fail()
+			return
+		}
+	}
+	log.Printf("Job %s previewed to %s; paused until resumed", job.Name(), dir)
+	if err := job.Set(pausedKey, []byte(time.Now().Format(time.RFC3339))); err != nil {
+		log.Printf("Job %s failed to record that it is paused: %s", job.Name(), err)
+	}
+	job.Fail()
+}
+
+// A Preview renders the messages of a spec outside of any queue, so
+// that reviewers can read the exact messages of a campaign in a mail
+// client before approving it.
+type Preview struct {
+	mailing *mailing
+}
+
+// NewPreview parses a spec for previewing. The spec must have its
+// recipients in it, not in a list, segment, or elsewhere. Unsubscribe
+// links and tracking are rendered with example URLs unless options
+// say otherwise.
+func NewPreview(specBytes []byte, opts ...Option) (*Preview, error) {
+	spec, err := parseSpec(specBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	if source := spec.recipientSource(); source != "" {
+		return nil, fmt.Errorf("Cannot preview recipients in %s", source)
+	}
+	opts = append([]Option{
+		WithUnsubscribeLinks("https://example.com/unsubscribe", []byte("example")),
+		WithTracking([]byte("example"))}, opts...)
+	mailing := &mailing{spec: spec, opts: newOptions(opts), basename: "preview"}
+	if err := mailing.loadTemplates(); err != nil {
+		return nil, err
+	}
+	if err := mailing.applyPreset(); err != nil {
+		return nil, err
+	}
+	if err := mailing.prepare(); err != nil {
+		return nil, err
+	}
+	return &Preview{mailing}, nil
+}
+
+// Len returns the number of recipients.
+func (p *Preview) Len() int {
+	return p.mailing.recipientCount()
+}
+
+// A RenderedMessage is the message to a recipient as it would be
+// sent, but for any AMP version and headers.
+type RenderedMessage struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Render renders the message to recipient i.
+func (p *Preview) Render(i int) (*RenderedMessage, error) {
+	params, err := p.mailing.computeSendEmailInput(i, DoNotMangle)
+	if err != nil {
+		return nil, err
+	}
+	return &RenderedMessage{
+		From:    aws.StringValue(params.Source),
+		To:      aws.StringValue(params.Destination.ToAddresses[0]),
+		Subject: aws.StringValue(params.Message.Subject.Data),
+		Text:    aws.StringValue(params.Message.Body.Text.Data),
+		HTML:    aws.StringValue(params.Message.Body.Html.Data)}, nil
+}
+
+// Message renders the message to recipient i as it would be sent.
+func (p *Preview) Message(i int) ([]byte, error) {
+	return p.mailing.eml(i, DoNotMangle)
+}
+
+// WriteEML writes the messages to all the recipients to .eml files in
+// a directory.
+func (p *Preview) WriteEML(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := 0; i < p.Len(); i++ {
+		msg, err := p.Message(i)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(emlFilename(dir, i), msg, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func emlFilename(dir string, i int) string {
+	return path.Join(dir, fmt.Sprintf("%06d.eml", i))
+}
+
+// eml renders the message to recipient i as a MIME message. Messages
+// that SES would compose are rendered as raw messages with the same
+// content.
+func (mailing *mailing) eml(i int, mangler Mangler) ([]byte, error) {
+	params, err := mailing.computeSendRawEmailInput(i, mangler)
+	if err != nil {
+		return nil, err
+	}
+	return params.RawMessage.Data, nil
+}
+
+// composePreview renders the message to recipient i and returns a
+// function that writes it to the job's preview directory.
+func (mailing *mailing) composePreview(i int, mangler Mangler) (func() (string, error), string, error) {
+	msg, err := mailing.eml(i, mangler)
+	if err != nil {
+		return nil, "", err
+	}
+	dir := path.Join(mailing.opts.previewDir, mailing.basename)
+	return func() (string, error) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		filename := emlFilename(dir, i)
+		if err := ioutil.WriteFile(filename, msg, 0644); err != nil {
+			return "", err
+		}
+		return "preview:" + filename, nil
+	}, rawHash(msg), nil
+}
+
+// Send sends the message to recipient i through a mangler and returns
+// the message ID. With `SendToMe`, this sends a recipient's message to
+// a review address without submitting the spec to a queue.
+func (p *Preview) Send(i int, mangler Mangler) (string, error) {
+	if i < 0 || i >= p.Len() {
+		return "", fmt.Errorf("No recipient %d; the spec has %d", i, p.Len())
+	}
+	svc := mangler.SesService
+	if svc == nil {
+		svc = ses.New(session.New(), getSesConfig())
+	}
+	send, _, err := p.mailing.compose(svc, i, mangler)
+	if err != nil {
+		return "", err
+	}
+	return send()
+}
+
+// Sample returns the indices of n recipients chosen at random, in
+// order, or of all the recipients if there are no more than n.
+func (p *Preview) Sample(n int, rnd *rand.Rand) []int {
+	indices := rnd.Perm(p.Len())
+	if n < len(indices) {
+		indices = indices[:n]
+	}
+	sort.Ints(indices)
+	return indices
+}
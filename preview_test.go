@@ -0,0 +1,112 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreview(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_preview_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"html": "<p>Hello, {{.name}}</p>",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}}, {"addr": "b@example.com", "context": {"name": "B"}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	if err := preview.WriteEML(path.Join(dir, "eml")); err != nil {
+		t.Fatal("WriteEML", err)
+	}
+	msg, err := ioutil.ReadFile(path.Join(dir, "eml", "000001.eml"))
+	if err != nil || !strings.Contains(string(msg), "To: b@example.com") || !strings.Contains(string(msg), "<p>Hello, B</p>") {
+		t.Fatal("unexpected message:", string(msg), err)
+	}
+
+	queueDir := path.Join(dir, "queue")
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", spec)
+	j.Submit()
+	history, err := OpenSendHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal("OpenSendHistory", err)
+	}
+	svc := MockSES{}
+	Process(queueDir, UseMockSesService(&svc), WithPreview(path.Join(dir, "preview")),
+		WithFrequencyCap(history, 1, time.Hour))
+	if svc.nsent != 0 {
+		t.Fatal("expected nothing to be sent:", svc.nsent)
+	}
+	msg, err = ioutil.ReadFile(path.Join(dir, "preview", j.Basename, "000000.eml"))
+	if err != nil || !strings.Contains(string(msg), "Hello, A") {
+		t.Fatal("expected the job's messages to be previewed:", string(msg), err)
+	}
+	if n := history.Count("a@example.com", time.Now().Add(-time.Hour)); n != 0 {
+		t.Fatal("expected a preview not to be recorded in the send history:", n)
+	}
+	jobDir := path.Join(queueDir, "failed", j.Basename)
+	if !isPaused(jobDir) {
+		t.Fatal("expected the previewed job to be paused")
+	}
+	results, err := JobReport(queueDir, j.Basename)
+	if err != nil || len(results) != 2 || results[0].Status != StatusPending || results[1].Status != StatusPending {
+		t.Fatal("expected the previewed job to have no results:", results, err)
+	}
+	if i, err := getCheckpointFrom(func(key string) ([]byte, error) { return readJobFile(jobDir, key) }); err != nil || i != 0 {
+		t.Fatal("expected the previewed job not to have advanced:", i, err)
+	}
+
+	// Once resumed, a worker that does not preview sends it.
+	if err := Resume(queueDir, j.Basename); err != nil {
+		t.Fatal("Resume", err)
+	}
+	Process(queueDir, UseMockSesService(&svc))
+	if svc.nsent != 2 {
+		t.Fatal("expected the resumed job to be sent:", svc.nsent)
+	}
+}
+
+func TestPreviewSend(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}}, {"addr": "b@example.com", "context": {"name": "B"}},
+{"addr": "c@example.com", "context": {"name": "C"}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	svc := MockSES{}
+	mangler := Mangler{ShouldSend: true, Mangle: alwaysAddr("reviewer@example.com"), SesService: &svc}
+	if _, err := preview.Send(1, mangler); err != nil {
+		t.Fatal("Send", err)
+	}
+	if svc.nsent != 1 || *svc.sentRaw.Destinations[0] != "reviewer@example.com" ||
+		!strings.Contains(string(svc.sentRaw.RawMessage.Data), "Hello, B") {
+		t.Fatal("expected recipient 1's message to be sent to the reviewer:", svc.sentRaw)
+	}
+	if _, err := preview.Send(3, mangler); err == nil {
+		t.Fatal("expected an error for a recipient out of range")
+	}
+	sample := preview.Sample(2, rand.New(rand.NewSource(1)))
+	if len(sample) != 2 || sample[0] >= sample[1] || sample[1] > 2 {
+		t.Fatal("expected two sorted recipient indices:", sample)
+	}
+	if sample := preview.Sample(5, rand.New(rand.NewSource(1))); len(sample) != 3 {
+		t.Fatal("expected all three recipients:", sample)
+	}
+}
@@ -0,0 +1,188 @@
+package mailrail
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PreviewHandler serves the messages of a spec file rendered for
+// each recipient, for iterating on templates without sending
+// anything. The index lists the recipients; /N shows the message to
+// recipient N, and /N/html, /N/text, and /N/eml its HTML, text, and
+// the whole message. The spec is read again whenever the file
+// changes, and the pages reload themselves when it does. Specs that
+// do not have their recipients in them are previewed with Samples
+// recipients from `FakeRecipients`.
+type PreviewHandler struct {
+	Filename string
+	Samples  int
+	opts     []Option
+
+	mu      sync.Mutex
+	modTime time.Time
+	preview *Preview
+	err     error
+}
+
+// Returns a preview handler for a spec file.
+func NewPreviewHandler(filename string, samples int, opts ...Option) *PreviewHandler {
+	return &PreviewHandler{Filename: filename, Samples: samples, opts: opts}
+}
+
+// load reads the spec again if the file changed, and returns the
+// version of the spec and its preview, or why there is none.
+func (h *PreviewHandler) load() (string, *Preview, error) {
+	info, err := os.Stat(h.Filename)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.ModTime().Equal(h.modTime) || (h.preview == nil && h.err == nil) {
+		h.modTime = info.ModTime()
+		h.preview, h.err = h.read()
+	}
+	return strconv.FormatInt(h.modTime.UnixNano(), 10), h.preview, h.err
+}
+
+func (h *PreviewHandler) read() (*Preview, error) {
+	specBytes, err := ioutil.ReadFile(h.Filename)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseSpec(specBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	if spec.recipientSource() != "" || len(spec.Recipients) == 0 {
+		vars, err := TemplateVariables(spec)
+		if err != nil {
+			return nil, err
+		}
+		// Values in the spec's context are shown as they are.
+		var fake []string
+		for _, v := range vars {
+			if _, ok := spec.Context[v]; !ok {
+				fake = append(fake, v)
+			}
+		}
+		// The same samples every time, so that changes stand out.
+		samples := FakeRecipients(fake, h.Samples, rand.New(rand.NewSource(1)))
+		if specBytes, err = SpecWithRecipients(specBytes, samples); err != nil {
+			return nil, err
+		}
+	}
+	return NewPreview(specBytes, h.opts...)
+}
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html><head><title>{{if .Message}}{{.Message.Subject}}{{else}}Preview{{end}}</title>
+<script>
+setInterval(function() {
+  fetch("/version").then(function(r) { return r.text(); }).then(function(v) {
+    if (v !== "{{.Version}}") { location.reload(); }
+  });
+}, 1000);
+</script></head>
+<body>
+{{if .Err}}<pre>{{.Err}}</pre>
+{{else if .Message}}<p><a href="/">All recipients</a>{{if .Prev}} | <a href="/{{.Prev}}">Previous</a>{{end}}{{if .Next}} | <a href="/{{.Next}}">Next</a>{{end}}
+ | <a href="/{{.Index}}/text">Text</a> | <a href="/{{.Index}}/eml">.eml</a></p>
+<p>From: {{.Message.From}}<br>To: {{.Message.To}}<br>Subject: {{.Message.Subject}}</p>
+{{if .Message.HTML}}<iframe src="/{{.Index}}/html" style="width: 100%; height: 80vh; border: 1px solid #ccc"></iframe>
+{{else}}<pre>{{.Message.Text}}</pre>{{end}}
+{{else}}<ol start="0">{{range .Recipients}}<li><a href="/{{.Index}}">{{.To}}</a>: {{.Subject}}</li>
+{{end}}</ol>{{end}}
+</body></html>
+`))
+
+type previewRecipient struct {
+	Index       int
+	To, Subject string
+}
+
+func (h *PreviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Messages are rendered one at a time.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	version, preview, err := h.load()
+	if r.URL.Path == "/version" {
+		fmt.Fprint(w, version)
+		return
+	}
+	data := struct {
+		Version    string
+		Err        error
+		Index      int
+		Prev, Next string
+		Message    *RenderedMessage
+		Recipients []previewRecipient
+	}{Version: version, Err: err}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err != nil {
+		previewPage.Execute(w, data)
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		for i := 0; i < preview.Len(); i++ {
+			msg, err := preview.Render(i)
+			if err != nil {
+				data.Err = err
+				break
+			}
+			data.Recipients = append(data.Recipients, previewRecipient{i, msg.To, msg.Subject})
+		}
+		previewPage.Execute(w, data)
+		return
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil || i < 0 || i >= preview.Len() {
+		http.NotFound(w, r)
+		return
+	}
+	data.Index = i
+	if data.Message, data.Err = preview.Render(i); data.Err != nil {
+		previewPage.Execute(w, data)
+		return
+	}
+	if len(parts) == 1 {
+		if i > 0 {
+			data.Prev = strconv.Itoa(i - 1)
+		}
+		if i+1 < preview.Len() {
+			data.Next = strconv.Itoa(i + 1)
+		}
+		previewPage.Execute(w, data)
+		return
+	}
+	switch parts[1] {
+	case "html":
+		fmt.Fprint(w, data.Message.HTML)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, data.Message.Text)
+	case "eml":
+		msg, err := preview.Message(i)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%06d.eml", i))
+		w.Write(msg)
+	default:
+		http.NotFound(w, r)
+	}
+}
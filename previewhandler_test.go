@@ -0,0 +1,53 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreviewHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_previewhandler_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "spec.json")
+	ioutil.WriteFile(filename, []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.first_name}}",
+"html": "<p>Hello, {{.first_name}}</p>", "list": "newsletter"}`), 0644)
+	h := NewPreviewHandler(filename, 3)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+	if rec := get("/"); rec.Code != http.StatusOK || strings.Count(rec.Body.String(), "<li>") != 3 {
+		t.Fatal("expected an index of 3 sample recipients:", rec.Code, rec.Body.String())
+	}
+	if rec := get("/2/html"); !strings.HasPrefix(rec.Body.String(), "<p>Hello, ") || strings.Contains(rec.Body.String(), "no value") {
+		t.Fatal("expected the HTML of a sample recipient:", rec.Body.String())
+	}
+	if rec := get("/3"); rec.Code != http.StatusNotFound {
+		t.Fatal("expected a recipient that does not exist not to be found:", rec.Code)
+	}
+	version := get("/version").Body.String()
+	ioutil.WriteFile(filename, []byte(`{"from_addr": "johndoe@example.com", "subject": "Hi", "text": "Hi, {{.name}}",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}}]}`), 0644)
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Second))
+	if rec := get("/0/text"); rec.Body.String() != "Hi, A" {
+		t.Fatal("expected the changed spec to be read again:", rec.Body.String())
+	}
+	if get("/version").Body.String() == version {
+		t.Fatal("expected the version to change")
+	}
+	ioutil.WriteFile(filename, []byte(`{"text": "{{.name"}`), 0644)
+	os.Chtimes(filename, time.Now(), time.Now().Add(2*time.Second))
+	if rec := get("/0"); !strings.Contains(rec.Body.String(), "<pre>") {
+		t.Fatal("expected the template error to be shown:", rec.Body.String())
+	}
+}
@@ -0,0 +1,89 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"os"
+	"path"
+	"time"
+)
+
+// Jobs with a higher `priority` are taken before jobs with a lower
+// one, so that a small urgent job does not wait for a large newsletter
+// that was submitted before it. Jobs without a priority have priority
+// 0, and jobs with the same priority are taken in the order they were
+// submitted.
+//
+// The queue only takes jobs in order, so the worker takes a job by
+// scheduling the queued jobs with a lower priority than the highest
+// for now, taking a job, and then putting them back in the queue. If
+// the worker dies in between, it wakes them the next time around.
+
+// takeJob takes the oldest of the queued jobs with the highest
+// priority. The priorities of the queued jobs are cached, as specs do
+// not change once they are queued.
+func takeJob(q *pqueue.Queue, queueDir string, priorities map[string]int) (*pqueue.Job, error) {
+	basenames, err := listJobs(queueDir, "queue")
+	if err != nil {
+		return nil, err
+	}
+	queued := make(map[string]bool)
+	highest := 0
+	for i, basename := range basenames {
+		queued[basename] = true
+		priority, ok := priorities[basename]
+		if !ok {
+			priority = readPriority(path.Join(queueDir, "queue", basename))
+			priorities[basename] = priority
+		}
+		if i == 0 || priority > highest {
+			highest = priority
+		}
+	}
+	for basename := range priorities {
+		if !queued[basename] {
+			delete(priorities, basename)
+		}
+	}
+	var held []string
+	defer func() {
+		for _, basename := range held {
+			wakeJob(queueDir, basename)
+		}
+	}()
+	for _, basename := range basenames {
+		if priorities[basename] < highest && holdJob(queueDir, basename) {
+			held = append(held, basename)
+		}
+	}
+	return q.Take()
+}
+
+func readPriority(jobDir string) int {
+	specBytes, err := readJobFile(jobDir, "spec")
+	if err == nil {
+		specBytes, err = decodeArtifact(specBytes)
+	}
+	if err != nil {
+		return 0
+	}
+	var spec struct {
+		Priority int `json:"priority"`
+	}
+	json.Unmarshal(specBytes, &spec)
+	return spec.Priority
+}
+
+// holdJob schedules a queued job for now, and returns false if it was
+// taken by another worker first.
+func holdJob(queueDir, basename string) bool {
+	dir := path.Join(queueDir, "failed", basename)
+	if err := os.Rename(path.Join(queueDir, "queue", basename), dir); err != nil {
+		return false
+	}
+	if err := writeJobFile(dir, wakeAtKey, []byte(time.Now().Format(time.RFC3339Nano))); err != nil {
+		os.Rename(dir, path.Join(queueDir, "queue", basename))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_priority_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	for _, job := range []struct{ addr, priority string }{
+		{"newsletter@example.com", `"priority": -1, `},
+		{"normal@example.com", ""},
+		{"urgent@example.com", `"priority": 10, `}} {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", `+
+			job.priority+`"recipients": [{"addr": "`+job.addr+`"}]}`))
+		j.Submit()
+	}
+	svc := MockSES{}
+	for _, expected := range []string{"urgent@example.com", "normal@example.com", "newsletter@example.com"} {
+		ProcessOne(dir, UseMockSesService(&svc))
+		if *svc.sent.Destination.ToAddresses[0] != expected {
+			t.Fatal("expected to send to", expected, "not", *svc.sent.Destination.ToAddresses[0])
+		}
+	}
+	statuses, err := QueueStatus(dir)
+	if err != nil {
+		t.Fatal("QueueStatus", err)
+	}
+	for _, status := range statuses {
+		if status.State != "done" {
+			t.Fatal("expected every job to be done:", status)
+		}
+	}
+}
+
+func TestProcessQueuesByWeight(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_priority_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	var queues []WeightedQueue
+	for _, queue := range []WeightedQueue{{dir + "/high", 2}, {dir + "/low", 1}} {
+		q, err := pqueue.OpenQueue(queue.Dir)
+		if err != nil {
+			t.Fatal("failed to open queue", err)
+		}
+		for i := 0; i < 3; i++ {
+			j, err := q.CreateJob("foo")
+			if err != nil {
+				t.Fatal("failed to create job:", err)
+			}
+			j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "`+path.Base(queue.Dir)+`@example.com"}]}`))
+			j.Submit()
+		}
+		queues = append(queues, queue)
+	}
+	var order []string
+	svc := CountingSES{}
+	observer := &recordingObserver{}
+	ProcessQueues(queues, UseMockSesService(&svc), WithObserver(observer))
+	for _, e := range observer.events {
+		if e.Type == JobStarted {
+			order = append(order, e.Job)
+		}
+	}
+	if len(order) != 6 {
+		t.Fatal("expected every job to be processed:", order)
+	}
+	statuses, _ := QueueStatus(dir + "/low")
+	low := map[string]bool{}
+	for _, status := range statuses {
+		low[status.Job] = true
+	}
+	var pattern string
+	for _, job := range order {
+		if low[job] {
+			pattern += "L"
+		} else {
+			pattern += "H"
+		}
+	}
+	if pattern != "HLHHLL" {
+		t.Fatal("expected jobs to be taken in proportion to the weights:", pattern)
+	}
+}
@@ -0,0 +1,40 @@
+package mailrail
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	htemplate "html/template"
+)
+
+const (
+	defaultQRCodeSize = 256
+	maxQRCodeSize     = 1024
+)
+
+// qrCodeDataURI returns a data URI with a PNG image of a QR code
+// encoding content, so templates can embed per-recipient codes with
+// `<img src="{{qrcode .ticket_url}}">`. The optional argument is the
+// width of the image in pixels, at most maxQRCodeSize, so that a
+// template cannot make the worker render huge images.
+func qrCodeDataURI(content string, size ...int) (string, error) {
+	width := defaultQRCodeSize
+	if len(size) > 0 {
+		width = size[0]
+	}
+	if width < 1 || width > maxQRCodeSize {
+		return "", fmt.Errorf("Cannot make QR code %d pixels wide: must be from 1 to %d", width, maxQRCodeSize)
+	}
+	png, err := qrcode.Encode(content, qrcode.Medium, width)
+	if err != nil {
+		return "", fmt.Errorf("Cannot make QR code: %s", err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// html/template only lets data URIs through if they are marked as
+// safe URLs.
+func qrCodeURL(content string, size ...int) (htemplate.URL, error) {
+	uri, err := qrCodeDataURI(content, size...)
+	return htemplate.URL(uri), err
+}
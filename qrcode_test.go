@@ -0,0 +1,49 @@
+package mailrail
+
+import (
+	"bytes"
+	"encoding/base64"
+	htmlpkg "html"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestQRCode(t *testing.T) {
+	sent := makeSendEmailInput(t, `{
+            "from_addr": "johndoe@example.com",
+            "subject": "Your ticket",
+            "html": "<img src=\"{{qrcode .ticket_url 128}}\">",
+            "recipients": [{
+              "addr": "janedoe@example.com",
+              "context": {"ticket_url": "https://example.com/tickets/42"}
+            }]
+          }`, DoNotMangle)
+	html := htmlpkg.UnescapeString(*sent.Message.Body.Html.Data)
+	prefix := `<img src="data:image/png;base64,`
+	if !strings.HasPrefix(html, prefix) {
+		t.Fatal("unexpected HTML:", html)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(html, prefix), `">`))
+	if err != nil {
+		t.Fatal("data URI is not base64:", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("data URI is not a PNG:", err)
+	}
+	if img.Bounds().Dx() != 128 {
+		t.Fatal("unexpected width:", img.Bounds().Dx())
+	}
+}
+
+func TestQRCodeSize(t *testing.T) {
+	if _, err := qrCodeDataURI("https://example.com/tickets/42", maxQRCodeSize); err != nil {
+		t.Fatal("qrCodeDataURI", err)
+	}
+	for _, size := range []int{maxQRCodeSize + 1, 0, -10} {
+		if _, err := qrCodeDataURI("https://example.com/tickets/42", size); err == nil {
+			t.Fatal("expected an error for size", size)
+		}
+	}
+}
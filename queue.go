@@ -0,0 +1,187 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// A Job is a job that a worker has taken from a queue. Its spec and
+// the artifacts that the worker records as it goes, such as the
+// checkpoint and results, are kept under keys. Submit puts the job
+// back in the queue, Fail moves it to the failed state, and Finish to
+// the done state.
+type Job interface {
+	Name() string
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Submit() error
+	Fail() error
+	Finish() error
+}
+
+// A JobStore keeps jobs and hands them out to workers. Take returns
+// nil if there is no job to take. Rescue puts the jobs that were taken
+// by workers that died back in the queue, if the store can tell which
+// they are; the worker calls it when it starts. Besides queue
+// directories, jobs can be kept in an `SQSQueue`, a `RedisQueue`, a
+// `PostgresQueue`, or, for tests, a `MemoryStore`.
+type JobStore interface {
+	Take() (Job, error)
+	Rescue() error
+}
+
+// A dirJob is a job in a queue directory. dir is the queue directory,
+// if the job was taken from it.
+type dirJob struct {
+	*pqueue.Job
+	dir string
+}
+
+func (job dirJob) Name() string {
+	return job.Basename
+}
+
+// Append appends to an artifact of the job while it is being
+// processed, or rewrites it if the job was not taken from its queue
+// directory.
+func (job dirJob) Append(key string, value []byte) error {
+	if job.dir == "" {
+		data, err := job.Get(key)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return job.Set(key, append(data, value...))
+	}
+	f, err := os.OpenFile(path.Join(job.dir, "cur", job.Basename, key), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// A dirQueue is a queue directory. Taking a job from it puts the
+// scheduled jobs that are due, and the jobs whose leases have expired,
+// back in the queue first, and takes the jobs with the highest
+// priority first. If lease is not zero, the worker takes a lease on
+// the job.
+type dirQueue struct {
+	q          *pqueue.Queue
+	dir        string
+	priorities map[string]int
+	worker     string
+	lease      time.Duration
+}
+
+func openDirQueue(queueDir string) (*dirQueue, error) {
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		return nil, err
+	}
+	return &dirQueue{q: q, dir: queueDir, priorities: make(map[string]int)}, nil
+}
+
+// Rescue puts the jobs being processed back in the queue, taking them
+// all to belong to dead workers, unless the workers take leases. Then
+// only the jobs whose leases have expired are put back, as the others
+// may belong to live workers on the same queue.
+func (d *dirQueue) Rescue() error {
+	if d.lease > 0 {
+		return reclaimExpiredLeases(d.dir, time.Now())
+	}
+	d.q.RescueDeadJobs()
+	return nil
+}
+
+func (d *dirQueue) Take() (Job, error) {
+	if err := wakeScheduledJobs(d.dir, time.Now()); err != nil {
+		log.Printf("Failed to wake scheduled jobs in %s: %s", d.dir, err)
+	}
+	if d.lease > 0 {
+		if err := reclaimExpiredLeases(d.dir, time.Now()); err != nil {
+			log.Printf("Failed to reclaim jobs with expired leases in %s: %s", d.dir, err)
+		}
+	}
+	job, err := takeJob(d.q, d.dir, d.priorities)
+	if job == nil {
+		return nil, err
+	}
+	if d.lease == 0 {
+		// A lease left behind when the job last left cur/ would let
+		// another worker reclaim it.
+		if err := os.Remove(path.Join(d.dir, "cur", job.Basename, leaseKey)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove stale lease of job %s: %s", job.Basename, err)
+		}
+		return dirJob{job, d.dir}, nil
+	}
+	leased := &leasedDirJob{dirJob: dirJob{job, d.dir}, worker: d.worker, d: d.lease}
+	if err := leased.takeLease(); err != nil {
+		return nil, fmt.Errorf("Failed to lease job %s: %s", job.Basename, err)
+	}
+	return leased, nil
+}
+
+// A job store that can tell an idle worker when a job may have been
+// submitted, so that the worker need not poll it as often. notify
+// returns false if it cannot.
+type notifyingStore interface {
+	notify(wake chan<- struct{}) bool
+}
+
+// notify watches the queue subdirectory, where jobs appear when they
+// are submitted.
+func (d *dirQueue) notify(wake chan<- struct{}) bool {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to watch queue %s, polling instead: %s", d.dir, err)
+		return false
+	}
+	if err := watcher.Add(path.Join(d.dir, "queue")); err != nil {
+		log.Printf("Failed to watch queue %s, polling instead: %s", d.dir, err)
+		watcher.Close()
+		return false
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create == 0 {
+					continue
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// Events may have been lost.
+				log.Printf("Failed to watch queue %s: %s", d.dir, err)
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return true
+}
+
+// Poll idle queues every min at first, backing off to every max as
+// they stay empty. By default, workers poll every second.
+func WithIdlePolling(min, max time.Duration) Option {
+	return func(o *options) {
+		if max < min {
+			max = min
+		}
+		o.idlePollMin, o.idlePollMax = min, max
+	}
+}
@@ -0,0 +1,46 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDirQueueNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_queue_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := openDirQueue(dir)
+	if err != nil {
+		t.Fatal("openDirQueue", err)
+	}
+	wake := make(chan struct{}, 1)
+	if !d.notify(wake) {
+		t.Fatal("expected the queue directory to be watched")
+	}
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	select {
+	case <-wake:
+		t.Fatal("expected no wake-up before the job is submitted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	j.Submit()
+	select {
+	case <-wake:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a wake-up when the job was submitted")
+	}
+}
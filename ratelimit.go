@@ -0,0 +1,195 @@
+package mailrail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each worker paces itself to the maximum send rate of the SES
+// account, so several workers that send for the same account together
+// send too fast. A SharedRateLimiter paces them all: before each send,
+// a worker waits for its turn from the shared limiter as well as from
+// its own token bucket, which still backs off when SES throttles.
+type SharedRateLimiter interface {
+	// Wait blocks until the worker may send one message, so that all
+	// workers together send at most rate messages per second.
+	Wait(rate float64) error
+}
+
+// Pace sends with a rate limiter shared with other workers.
+func WithSharedRateLimiter(limiter SharedRateLimiter) Option {
+	return func(o *options) {
+		o.rateLimiter = limiter
+	}
+}
+
+// How many times a worker asks the shared rate limiter for a turn,
+// and how long it waits before asking again the first time. The wait
+// doubles each time.
+var (
+	rateLimiterAttempts = 5
+	rateLimiterBackoff  = 100 * time.Millisecond
+)
+
+// A rateLimiterError is returned when a worker cannot get a turn from
+// the shared rate limiter, so that the job fails rather than sends
+// without one.
+type rateLimiterError struct {
+	err error
+}
+
+func (e *rateLimiterError) Error() string {
+	return fmt.Sprintf("Cannot get a turn from the shared rate limiter: %s", e.err)
+}
+
+// waitForTurn waits for a turn from limiter, asking again with backoff
+// if it fails.
+func waitForTurn(limiter SharedRateLimiter, rate float64) error {
+	backoff := rateLimiterBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = limiter.Wait(rate); err == nil {
+			return nil
+		}
+		if attempt >= rateLimiterAttempts {
+			return &rateLimiterError{err}
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// OpenSharedRateLimiter returns the shared rate limiter at a location:
+// a Redis URL of the form redis://HOST:PORT/KEY, for workers on
+// several hosts, or else the name of a ledger file, for workers on one
+// host. A ledger file must be one that can be locked, which rules out
+// Windows.
+func OpenSharedRateLimiter(location string) (SharedRateLimiter, error) {
+	if strings.HasPrefix(location, "redis://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "redis://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid Redis rate limiter location %q", location)
+		}
+		key := "mailrail:rate"
+		if len(parts) == 2 && parts[1] != "" {
+			key = parts[1]
+		}
+		return NewRedisRateLimiter(parts[0], key), nil
+	}
+	l := &FileRateLimiter{Filename: location}
+	if err := l.check(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// A FileRateLimiter keeps the time of the next free turn to send in a
+// ledger file that workers lock while they take a turn. A worker takes
+// the next free turn and then sleeps until it comes, so the workers
+// send in the order they asked.
+type FileRateLimiter struct {
+	Filename string
+}
+
+// check makes sure that the ledger can be opened and locked, so that a
+// worker that cannot take turns fails when it starts instead of
+// sending without them.
+func (l *FileRateLimiter) check() error {
+	f, err := os.OpenFile(l.Filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("Cannot lock %s: %s", l.Filename, err)
+	}
+	return unlockFile(f)
+}
+
+func (l *FileRateLimiter) Wait(rate float64) error {
+	f, err := os.OpenFile(l.Filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("Cannot lock %s: %s", l.Filename, err)
+	}
+	turn, err := l.take(f, rate)
+	unlockFile(f)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Until(turn))
+	return nil
+}
+
+func (l *FileRateLimiter) take(f *os.File, rate float64) (time.Time, error) {
+	ledger, err := ioutil.ReadAll(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	turn := time.Now()
+	if s := strings.TrimSpace(string(ledger)); s != "" {
+		next, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Cannot parse contents of %s: %s", l.Filename, err)
+		}
+		if t := time.Unix(0, next); t.After(turn) {
+			turn = t
+		}
+	}
+	next := turn.Add(time.Duration(float64(time.Second) / rate))
+	if _, err := f.Seek(0, 0); err != nil {
+		return time.Time{}, err
+	}
+	if err := f.Truncate(0); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := f.WriteString(strconv.FormatInt(next.UnixNano(), 10)); err != nil {
+		return time.Time{}, err
+	}
+	return turn, nil
+}
+
+// A RedisRateLimiter keeps the time of the next free turn to send
+// under a key in Redis, like a FileRateLimiter keeps it in a ledger
+// file. A script takes the next free turn atomically, and the worker
+// sleeps until it comes. The key expires once no one is sending. The
+// workers' clocks should be synchronized.
+type RedisRateLimiter struct {
+	Key  string
+	conn redisDoer
+}
+
+func NewRedisRateLimiter(addr, key string) *RedisRateLimiter {
+	return &RedisRateLimiter{Key: key, conn: &redisClient{addr: addr}}
+}
+
+// KEYS: next free turn; ARGV: now (µs), time between turns (µs).
+// Returns the turn taken (µs).
+const redisRateScript = `local now = tonumber(ARGV[1])
+local turn = tonumber(redis.call('GET', KEYS[1]) or now)
+if turn < now then turn = now end
+local next = turn + tonumber(ARGV[2])
+redis.call('SET', KEYS[1], string.format('%.0f', next), 'PX', math.ceil((next - now) / 1000) + 1000)
+return turn`
+
+func (l *RedisRateLimiter) Wait(rate float64) error {
+	interval := time.Duration(float64(time.Second) / rate)
+	reply, err := l.conn.do("EVAL", redisRateScript, "1", l.Key,
+		strconv.FormatInt(time.Now().UnixNano()/1000, 10), strconv.FormatInt(int64(interval/time.Microsecond), 10))
+	if err != nil {
+		return err
+	}
+	turn, ok := reply.(int64)
+	if !ok {
+		return fmt.Errorf("Unexpected reply from Redis: %v", reply)
+	}
+	time.Sleep(time.Until(time.Unix(0, turn*1000)))
+	return nil
+}
@@ -0,0 +1,144 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileRateLimiter(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_ratelimit_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "ledger")
+	// Two workers share the ledger.
+	workers := []SharedRateLimiter{&FileRateLimiter{filename}, &FileRateLimiter{filename}}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(l SharedRateLimiter) {
+			defer wg.Done()
+			if err := l.Wait(50); err != nil {
+				t.Error("Wait", err)
+			}
+		}(workers[i%2])
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 170*time.Millisecond {
+		t.Fatal("expected 10 sends at 50 per second to take 180 ms:", elapsed)
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	// Two workers share the key.
+	var workers []SharedRateLimiter
+	for i := 0; i < 2; i++ {
+		l, err := OpenSharedRateLimiter("redis://" + addr + "/test:rate")
+		if err != nil {
+			t.Fatal("OpenSharedRateLimiter", err)
+		}
+		workers = append(workers, l)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(l SharedRateLimiter) {
+			defer wg.Done()
+			// A fractional rate is not rounded up.
+			if err := l.Wait(12.5); err != nil {
+				t.Error("Wait", err)
+			}
+		}(workers[i%2])
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 230*time.Millisecond {
+		t.Fatal("expected 4 sends at 12.5 per second to take 240 ms:", elapsed)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.strings["test:rate"] == "" {
+		t.Fatal("expected the next free turn in Redis:", f.strings)
+	}
+}
+
+func TestOpenSharedRateLimiter(t *testing.T) {
+	if _, err := OpenSharedRateLimiter("redis:///key"); err == nil {
+		t.Fatal("expected a Redis location without a host to be refused")
+	}
+	if l, err := OpenSharedRateLimiter("redis://localhost:6379"); err != nil || l.(*RedisRateLimiter).Key != "mailrail:rate" {
+		t.Fatal("expected the default key:", l, err)
+	}
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_ratelimit_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "ledger")
+	if l, err := OpenSharedRateLimiter(filename); err != nil || l.(*FileRateLimiter).Filename != filename {
+		t.Fatal("expected a ledger file:", l, err)
+	}
+	if _, err := OpenSharedRateLimiter(path.Join(dir, "nosuchdir", "ledger")); err == nil {
+		t.Fatal("expected a ledger that cannot be opened to be refused")
+	}
+}
+
+// A failingRateLimiter fails its first failures waits.
+type failingRateLimiter struct {
+	failures int
+	waits    int
+}
+
+func (l *failingRateLimiter) Wait(rate float64) error {
+	l.waits++
+	if l.waits <= l.failures {
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func TestSharedRateLimiterFailure(t *testing.T) {
+	defer func(backoff time.Duration) { rateLimiterBackoff = backoff }(rateLimiterBackoff)
+	rateLimiterBackoff = time.Millisecond
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_ratelimit_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	submit := func() string {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"error_policy": "skip-recipient", "recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+		j.Submit()
+		return j.Basename
+	}
+	// A limiter that fails now and then is asked again.
+	submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithSharedRateLimiter(&failingRateLimiter{failures: 2}))
+	if svc.nsent != 2 {
+		t.Fatal("expected the job to be sent once the limiter gave turns, not", svc.nsent)
+	}
+	// A limiter that keeps failing fails the job instead of
+	// letting it send or skip recipients.
+	basename := submit()
+	svc = MockSES{}
+	Process(dir, UseMockSesService(&svc), WithSharedRateLimiter(&failingRateLimiter{failures: 1000}))
+	if svc.nsent != 0 {
+		t.Fatal("expected nothing to be sent without a turn, not", svc.nsent)
+	}
+	ensureExist(t, path.Join(dir, "failed", basename))
+}
@@ -0,0 +1,14 @@
+package mailrail
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(f *os.File) error {
+	return errors.New("File locking is not supported on Windows")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
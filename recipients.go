@@ -0,0 +1,287 @@
+package mailrail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Instead of embedding recipients, a spec can take them from a named
+// list or a SQL segment. The worker snapshots the recipients into the
+// job when it first takes it, so that the job sends to the same
+// recipients even if it is interrupted and the source changes.
+const recipientsSnapshotKey = "recipients_snapshot"
+
+// recipientSource describes where the recipients of a spec come from,
+// or returns "" if they are embedded.
+func (spec Spec) recipientSource() string {
+	switch {
+	case spec.List != "":
+		return "list " + spec.List
+	case spec.Segment != nil:
+		return "segment from " + spec.Segment.Source
+	case spec.recipientsRef() != "":
+		return spec.recipientsRef()
+	default:
+		return ""
+	}
+}
+
+// snapshotRecipients fills in the recipients of a spec from the job's
+// snapshot, taking the snapshot first if there is none. Recipients
+// that the spec refers to are left where they are.
+func snapshotRecipients(spec *Spec, job Job, o *options) error {
+	source := spec.recipientSource()
+	if source == "" {
+		return nil
+	}
+	sources := 0
+	for _, ok := range []bool{spec.List != "", spec.Segment != nil, spec.RecipientsNDJSON, spec.RecipientsRef != ""} {
+		if ok {
+			sources++
+		}
+	}
+	if len(spec.Recipients) > 0 || sources > 1 {
+		return fmt.Errorf("Spec has more than one source of recipients")
+	}
+	if spec.recipientsRef() != "" {
+		return nil
+	}
+	snapshotBytes, err := job.Get(recipientsSnapshotKey)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.IsNotExist(err) {
+		recipients, err := fetchRecipients(*spec, o)
+		if err != nil {
+			return err
+		}
+		snapshotBytes, err = json.Marshal(recipients)
+		if err != nil {
+			return err
+		}
+		stored := snapshotBytes
+		if spec.kmsKeyID != "" {
+			if stored, err = Encrypt(spec.kmsKeyID, snapshotBytes); err != nil {
+				return err
+			}
+		}
+		if err := job.Set(recipientsSnapshotKey, stored); err != nil {
+			return fmt.Errorf("Cannot snapshot %s: %s", source, err)
+		}
+	} else if snapshotBytes, err = decodeArtifact(snapshotBytes); err != nil {
+		return err
+	}
+	if err := unmarshalJSON(snapshotBytes, &spec.Recipients); err != nil {
+		return fmt.Errorf("Cannot parse snapshot of %s: %s", source, err)
+	}
+	return nil
+}
+
+func fetchRecipients(spec Spec, o *options) ([]Recipient, error) {
+	if spec.List != "" {
+		if o.lists == nil {
+			return nil, fmt.Errorf("Spec names list %s but there is no list store", spec.List)
+		}
+		return o.lists.Members(spec.List)
+	}
+	db, ok := o.dataSources[spec.Segment.Source]
+	if !ok {
+		return nil, fmt.Errorf("No data source %s", spec.Segment.Source)
+	}
+	return materializeSegment(db, spec.Segment.Query)
+}
+
+// A spec can also refer to its recipients with `recipients_ref`: the
+// key of a job artifact, such as "recipients", a file in the worker's
+// recipients directory, file:NAME, or an S3 object, s3://BUCKET/KEY,
+// so that the recipients can be generated and updated apart from the
+// spec until the job starts.
+// The recipients are a JSON array or NDJSON, one JSON recipient per
+// line. A file is copied into the job's "recipients_ref_snapshot"
+// artifact when the worker first takes the job, so that the job sends
+// to the same recipients if it is interrupted and the file changes. An
+// S3 object, which may be too large to copy into the queue directory,
+// is fetched whenever the job is taken; its ETag is recorded under
+// "recipients_ref_etag" instead, and the job fails if the object
+// changes.
+const (
+	recipientsRefSnapshotKey = "recipients_ref_snapshot"
+	recipientsRefETagKey     = "recipients_ref_etag"
+)
+
+// Let specs refer to recipients in files in a directory with
+// `recipients_ref` file:NAME. Without a recipients directory, specs
+// cannot refer to files, so that whoever can submit a spec cannot make
+// the worker read any file it can.
+func WithRecipientsDir(dir string) Option {
+	return func(o *options) {
+		o.recipientsDir = dir
+	}
+}
+
+// isFileRef tells whether a `recipients_ref` refers to a file.
+func isFileRef(ref string) bool {
+	return strings.HasPrefix(ref, "file:")
+}
+
+// recipientsFilename returns the name of the file that a
+// `recipients_ref` file:NAME refers to in a recipients directory.
+func recipientsFilename(dir, ref string) (string, error) {
+	name := strings.TrimPrefix(ref, "file:")
+	if dir == "" {
+		return "", fmt.Errorf("Cannot use recipients_ref %q without a recipients directory", ref)
+	}
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid recipients_ref %q", ref)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// recipientsRef returns where the recipients of a spec are, if they
+// are referred to.
+func (spec Spec) recipientsRef() string {
+	if spec.RecipientsRef != "" {
+		return spec.RecipientsRef
+	}
+	if spec.RecipientsNDJSON {
+		return recipientsNDJSONKey
+	}
+	return ""
+}
+
+// readRecipientsRef returns the contents of the recipients a spec
+// refers to, snapshotting a file in the recipients directory dir if
+// set is not nil. S3 objects are fetched with svc, or with a new
+// client if it is nil.
+func readRecipientsRef(spec Spec, dir string, get func(string) ([]byte, error), set func(string, []byte) error, svc s3Service) ([]byte, error) {
+	ref := spec.recipientsRef()
+	if strings.HasPrefix(ref, "s3://") {
+		return readS3RecipientsRef(ref, get, set, svc)
+	}
+	if !isFileRef(ref) {
+		if strings.Contains(ref, "/") || ref == "spec" {
+			return nil, fmt.Errorf("Invalid recipients_ref %q", ref)
+		}
+		data, err := get(ref)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Spec refers to recipients in %s, but the job has no %s", ref, ref)
+		}
+		return data, err
+	}
+	data, err := get(recipientsRefSnapshotKey)
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	filename, err := recipientsFilename(dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return nil, err
+	}
+	if set != nil {
+		stored := data
+		if spec.kmsKeyID != "" {
+			if stored, err = Encrypt(spec.kmsKeyID, data); err != nil {
+				return nil, err
+			}
+		}
+		if err := set(recipientsRefSnapshotKey, stored); err != nil {
+			return nil, fmt.Errorf("Cannot snapshot %s: %s", ref, err)
+		}
+	}
+	return data, nil
+}
+
+// readS3RecipientsRef fetches the recipients in an S3 object, as long
+// as it has the ETag recorded for the job, and records its ETag if set
+// is not nil and none is recorded.
+func readS3RecipientsRef(ref string, get func(string) ([]byte, error), set func(string, []byte) error, svc s3Service) ([]byte, error) {
+	parts := strings.SplitN(strings.TrimPrefix(ref, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid recipients_ref %q", ref)
+	}
+	etag, err := get(recipientsRefETagKey)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{Bucket: aws.String(parts[0]), Key: aws.String(parts[1])}
+	if len(etag) > 0 {
+		input.IfMatch = aws.String(string(etag))
+	}
+	if svc == nil {
+		svc = s3.New(session.New(), getSesConfig())
+	}
+	out, err := svc.GetObject(input)
+	if err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == http.StatusPreconditionFailed {
+			return nil, fmt.Errorf("Recipients in %s changed after the job started", ref)
+		}
+		return nil, fmt.Errorf("Cannot get %s: %s", ref, err)
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get %s: %s", ref, err)
+	}
+	if len(etag) == 0 && set != nil && out.ETag != nil {
+		if err := set(recipientsRefETagKey, []byte(*out.ETag)); err != nil {
+			return nil, fmt.Errorf("Cannot record ETag of %s: %s", ref, err)
+		}
+	}
+	return data, nil
+}
+
+// parseRecipientsRef fills in the recipients of a spec from a JSON
+// array, or returns them indexed if they are NDJSON. Either may be
+// gzipped or encrypted.
+func parseRecipientsRef(spec *Spec, data []byte) (*ndjsonRecipients, error) {
+	data, err := decodeArtifact(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read recipients in %s: %s", spec.recipientsRef(), err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := unmarshalJSON(trimmed, &spec.Recipients); err != nil {
+			return nil, fmt.Errorf("Cannot parse recipients in %s: %s", spec.recipientsRef(), err)
+		}
+		return nil, nil
+	}
+	return newNDJSONRecipients(data)
+}
+
+// SpecWithRecipients returns a spec with its recipients replaced,
+// including any list, segment, or recipients it refers to.
+func SpecWithRecipients(specBytes []byte, recipients []Recipient) ([]byte, error) {
+	specBytes, err := decodeArtifact(specBytes)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(specBytes, &fields); err != nil {
+		return nil, fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	for field := range fields {
+		switch strings.ToLower(field) {
+		case "recipients", "list", "segment", "recipients_ndjson", "recipients_ref":
+			delete(fields, field)
+		}
+	}
+	recipientsBytes, err := json.Marshal(recipients)
+	if err != nil {
+		return nil, err
+	}
+	fields["recipients"] = recipientsBytes
+	return json.Marshal(fields)
+}
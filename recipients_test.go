@@ -0,0 +1,121 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecipientsRef(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_recipients_ref_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"recipients_ref": "recipients"}`))
+	j.Set("recipients", []byte(`[{"addr": "a@example.com", "context": {"name": "A"}},
+{"addr": "b@example.com", "context": {"name": "B"}}]`))
+	j.Submit()
+	filename := path.Join(dir, "recipients.ndjson")
+	ioutil.WriteFile(filename, []byte(`{"addr": "c@example.com", "context": {"name": "C"}}`), 0644)
+	k, err := q.CreateJob("bar")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	k.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"recipients_ref": "file:recipients.ndjson"}`))
+	k.Submit()
+	if spec, err := readJobSpec(path.Join(dir, "queue", k.Basename)); err != nil || len(spec.Recipients) != 0 {
+		t.Fatal("expected the file not to be read before the job is taken:", spec.Recipients, err)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithRecipientsDir(dir))
+	if svc.nsent != 3 || *svc.sent.Message.Body.Text.Data != "Hello, C" {
+		t.Fatal("expected the recipients referred to to be sent to:", svc.nsent)
+	}
+	// The job keeps the file's recipients as they were.
+	os.Remove(filename)
+	report, err := JobReport(dir, k.Basename)
+	if err != nil || len(report) != 1 || report[0].Addr != "c@example.com" {
+		t.Fatal("expected the file to be snapshotted:", report, err)
+	}
+	spec, err := readJobSpec(path.Join(dir, "done", j.Basename))
+	if err != nil || len(spec.Recipients) != 2 {
+		t.Fatal("expected the recipients of the artifact:", spec.Recipients, err)
+	}
+	resendJob, err := ResendTo(dir, j.Basename, []string{"1"})
+	if err != nil {
+		t.Fatal("ResendTo", err)
+	}
+	if _, err := QueueStatus(dir); err != nil {
+		t.Fatal("expected the resend to have a single source of recipients:", err)
+	}
+	svc = MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 1 || *svc.sent.Destination.ToAddresses[0] != "b@example.com" {
+		t.Fatal("expected the resend to be sent to the recipient selected:", resendJob, svc.nsent)
+	}
+}
+
+func TestInvalidRecipientsRef(t *testing.T) {
+	get := func(string) ([]byte, error) { return nil, os.ErrNotExist }
+	for _, ref := range []string{"../recipients", "/etc/passwd", "file:/etc/passwd", "file:../secrets", "file:a/../../secrets", "file:"} {
+		spec := Spec{RecipientsRef: ref}
+		if _, err := readRecipientsRef(spec, "/tmp", get, nil, nil); err == nil {
+			t.Fatal("expected a path outside the recipients directory to be refused:", ref)
+		}
+	}
+	spec := Spec{RecipientsRef: "file:recipients.ndjson"}
+	if _, err := readRecipientsRef(spec, "", get, nil, nil); err == nil {
+		t.Fatal("expected a file to be refused without a recipients directory")
+	}
+	spec.RecipientsRef = "recipients"
+	if _, err := readRecipientsRef(spec, "/tmp", get, nil, nil); err == nil {
+		t.Fatal("expected a missing artifact to be an error")
+	}
+}
+
+func TestS3RecipientsRef(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_s3_recipients_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	s3svc := &MockS3{objects: map[string][]byte{
+		"bucket/lists/customers.ndjson": []byte(`{"addr": "a@example.com", "context": {"name": "A"}}
+{"addr": "b@example.com", "context": {"name": "B"}}`)}}
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"recipients_ref": "s3://bucket/lists/customers.ndjson"}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), func(o *options) { o.s3 = s3svc })
+	if svc.nsent != 2 || *svc.sent.Message.Body.Text.Data != "Hello, B" {
+		t.Fatal("expected the recipients in S3 to be sent to:", svc.nsent)
+	}
+	jobDir := path.Join(dir, "done", j.Basename)
+	if _, err := readJobFile(jobDir, recipientsRefSnapshotKey); !os.IsNotExist(err) {
+		t.Fatal("expected the S3 object not to be copied into the job:", err)
+	}
+	get := func(key string) ([]byte, error) { return readJobFile(jobDir, key) }
+	spec := Spec{RecipientsRef: "s3://bucket/lists/customers.ndjson"}
+	if _, err := readRecipientsRef(spec, "", get, nil, s3svc); err != nil {
+		t.Fatal("expected the recipients to be read again:", err)
+	}
+	s3svc.objects["bucket/lists/customers.ndjson"] = []byte(`{"addr": "c@example.com"}`)
+	if _, err := readRecipientsRef(spec, "", get, nil, s3svc); err == nil {
+		t.Fatal("expected the job to refuse recipients that changed")
+	}
+}
@@ -0,0 +1,249 @@
+package mailrail
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A RedisQueue is a job queue in Redis for workers on several hosts.
+// Under a key prefix, it keeps each job's spec and the artifacts that
+// the worker records in a hash PREFIX:job:JOB, the names of queued
+// jobs in the list PREFIX:queue, the jobs being processed in the
+// sorted set PREFIX:processing, by when their leases expire, and
+// scheduled jobs in the sorted set PREFIX:scheduled, by when they are
+// due. A job's "state" artifact says whether it is done or failed, and
+// its "lease" artifact which worker holds it. Workers renew the leases
+// on the jobs they process and put the jobs whose leases have expired
+// back in the queue, so the jobs of a worker that died are taken up
+// again; the workers' clocks should be synchronized. Pausing, resuming,
+// and the commands that read queue directories work only with queue
+// directories.
+type RedisQueue struct {
+	Prefix string
+	// How long a taken job stays leased to the worker unless it
+	// renews the lease, which it does every third of this.
+	Lease time.Duration
+	conn  redisDoer
+}
+
+// Returns a job queue in the Redis server at addr (HOST:PORT), with
+// keys under prefix.
+func NewRedisQueue(addr, prefix string) *RedisQueue {
+	return &RedisQueue{Prefix: prefix, Lease: 5 * time.Minute, conn: &redisClient{addr: addr}}
+}
+
+// Scripts that move jobs between the queue and the jobs being
+// processed, so that a job is always in one of them and its lease
+// changes hands atomically.
+const (
+	// KEYS: queue, processing; ARGV: lease expiry (ms), lease token,
+	// prefix of job hashes.
+	redisTakeScript = `local name = redis.call('RPOP', KEYS[1])
+if not name then return false end
+redis.call('ZADD', KEYS[2], ARGV[1], name)
+redis.call('HSET', ARGV[3] .. name, 'lease', ARGV[2])
+return name`
+	// KEYS: processing, job hash; ARGV: job, lease token, new expiry
+	// (ms), now (ms).
+	redisRenewScript = `if redis.call('HGET', KEYS[2], 'lease') ~= ARGV[2] then return 0 end
+local expires = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not expires or tonumber(expires) < tonumber(ARGV[4]) then return 0 end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1`
+	// KEYS: processing, job hash, queue or scheduled jobs; ARGV: job,
+	// lease token, "queue", "schedule" with when it is due (s), or
+	// "done".
+	redisReleaseScript = `if redis.call('HGET', KEYS[2], 'lease') ~= ARGV[2] then return 0 end
+redis.call('HDEL', KEYS[2], 'lease')
+redis.call('ZREM', KEYS[1], ARGV[1])
+if ARGV[3] == 'queue' then
+  redis.call('LPUSH', KEYS[3], ARGV[1])
+elseif ARGV[3] == 'schedule' then
+  redis.call('ZADD', KEYS[3], ARGV[4], ARGV[1])
+end
+return 1`
+	// KEYS: processing, queue; ARGV: now (ms), prefix of job hashes.
+	redisReclaimScript = `local names = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+for _, name in ipairs(names) do
+  redis.call('ZREM', KEYS[1], name)
+  redis.call('HDEL', ARGV[2] .. name, 'lease')
+  redis.call('RPUSH', KEYS[2], name)
+end
+return names`
+)
+
+func unixMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func (q *RedisQueue) key(parts ...string) string {
+	key := q.Prefix
+	for _, part := range parts {
+		key += ":" + part
+	}
+	return key
+}
+
+// Submit stores a spec and queues it, and returns the name of the new
+// job.
+func (q *RedisQueue) Submit(specBytes []byte) (string, error) {
+	if _, err := parseSpec(specBytes); err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	name := fmt.Sprintf("%d-%d-standalone", time.Now().UnixNano(), os.Getpid())
+	if _, err := q.conn.do("HSET", q.key("job", name), "spec", string(specBytes),
+		submittedKey, time.Now().Format(time.RFC3339Nano)); err != nil {
+		return "", err
+	}
+	if _, err := q.conn.do("LPUSH", q.key("queue"), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Take puts the scheduled jobs that are due and the jobs whose leases
+// have expired back in the queue, then moves the oldest queued job to
+// the jobs being processed and leases it.
+func (q *RedisQueue) Take() (Job, error) {
+	due, err := q.conn.do("ZRANGEBYSCORE", q.key("scheduled"), "-inf", strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		return nil, err
+	}
+	names, _ := due.([]interface{})
+	for _, name := range names {
+		name, _ := name.(string)
+		// Only the worker that removes it puts it back.
+		if removed, err := q.conn.do("ZREM", q.key("scheduled"), name); err != nil || removed != int64(1) {
+			continue
+		}
+		if _, err := q.conn.do("LPUSH", q.key("queue"), name); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.Rescue(); err != nil {
+		return nil, err
+	}
+	token := leaseToken()
+	now := time.Now()
+	reply, err := q.conn.do("EVAL", redisTakeScript, "2", q.key("queue"), q.key("processing"),
+		unixMillis(now.Add(q.Lease)), token, q.key("job", ""))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	return &redisJob{queue: q, name: reply.(string), token: token, renewed: now}, nil
+}
+
+// Rescue puts the jobs whose leases have expired, as the workers that
+// took them died or lost touch, back in the queue.
+func (q *RedisQueue) Rescue() error {
+	reply, err := q.conn.do("EVAL", redisReclaimScript, "2", q.key("processing"), q.key("queue"),
+		unixMillis(time.Now()), q.key("job", ""))
+	if err != nil {
+		return err
+	}
+	names, _ := reply.([]interface{})
+	for _, name := range names {
+		log.Printf("Job %s put back in the queue: lease expired", name)
+	}
+	return nil
+}
+
+type redisJob struct {
+	queue *RedisQueue
+	name  string
+	token string
+	// When the lease was last taken or renewed.
+	renewed time.Time
+	lost    int32
+}
+
+func (job *redisJob) Name() string {
+	return job.name
+}
+
+func (job *redisJob) Get(key string) ([]byte, error) {
+	reply, err := job.queue.conn.do("HGET", job.queue.key("job", job.name), key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, os.ErrNotExist
+	}
+	return []byte(reply.(string)), nil
+}
+
+func (job *redisJob) Set(key string, value []byte) error {
+	_, err := job.queue.conn.do("HSET", job.queue.key("job", job.name), key, string(value))
+	return err
+}
+
+func (job *redisJob) leaseDuration() time.Duration {
+	return job.queue.Lease
+}
+
+func (job *redisJob) renewLease() (time.Duration, error) {
+	now := time.Now()
+	reply, err := job.queue.conn.do("EVAL", redisRenewScript, "2", job.queue.key("processing"), job.queue.key("job", job.name),
+		job.name, job.token, unixMillis(now.Add(job.queue.Lease)), unixMillis(now))
+	if err == nil && reply == int64(1) {
+		job.renewed = now
+		return job.queue.Lease, nil
+	}
+	remaining := job.queue.Lease - time.Since(job.renewed)
+	if err == nil || remaining <= 0 {
+		atomic.StoreInt32(&job.lost, 1)
+		if err == nil {
+			err = fmt.Errorf("Job %s is no longer leased to this worker", job.name)
+		}
+		return 0, err
+	}
+	// Try again before the lease expires.
+	log.Printf("Job %s failed to renew its lease: %s", job.name, err)
+	return remaining, nil
+}
+
+func (job *redisJob) leaseLost() bool {
+	return atomic.LoadInt32(&job.lost) != 0
+}
+
+// release gives up the lease on the job, and puts it in the queue,
+// schedules it, or leaves it be done, unless another worker has leased
+// it since.
+func (job *redisJob) release(dest, how string, args ...string) error {
+	reply, err := job.queue.conn.do(append([]string{"EVAL", redisReleaseScript, "3", job.queue.key("processing"),
+		job.queue.key("job", job.name), job.queue.key(dest), job.name, job.token, how}, args...)...)
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return fmt.Errorf("Job %s is no longer leased to this worker", job.name)
+	}
+	return nil
+}
+
+func (job *redisJob) Submit() error {
+	return job.release("queue", "queue")
+}
+
+func (job *redisJob) Fail() error {
+	if err := job.Set("state", []byte("failed")); err != nil {
+		return err
+	}
+	return job.release("queue", "done")
+}
+
+func (job *redisJob) Finish() error {
+	if err := job.Set("state", []byte("done")); err != nil {
+		return err
+	}
+	return job.release("queue", "done")
+}
+
+// Schedule puts the job in the scheduled set to be queued at wakeAt.
+func (job *redisJob) Schedule(wakeAt time.Time) error {
+	return job.release("scheduled", "schedule", strconv.FormatInt(wakeAt.Unix(), 10))
+}
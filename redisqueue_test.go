@@ -0,0 +1,365 @@
+package mailrail
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands that the Redis job queue and rate
+// limiter use.
+type fakeRedis struct {
+	mu      sync.Mutex
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+	zsets   map[string]map[string]float64
+	strings map[string]string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	f := &fakeRedis{hashes: map[string]map[string]string{}, lists: map[string][]string{},
+		zsets: map[string]map[string]float64{}, strings: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		request, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range request.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		f.mu.Lock()
+		reply := f.command(args)
+		f.mu.Unlock()
+		switch reply := reply.(type) {
+		case nil:
+			fmt.Fprint(conn, "$-1\r\n")
+		case int:
+			fmt.Fprintf(conn, ":%d\r\n", reply)
+		case string:
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(reply), reply)
+		case []string:
+			fmt.Fprintf(conn, "*%d\r\n", len(reply))
+			for _, s := range reply {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+			}
+		}
+	}
+}
+
+func (f *fakeRedis) command(args []string) interface{} {
+	key := args[1]
+	switch args[0] {
+	case "HSET":
+		if f.hashes[key] == nil {
+			f.hashes[key] = map[string]string{}
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			f.hashes[key][args[i]] = args[i+1]
+		}
+		return len(args)/2 - 1
+	case "HGET":
+		if value, ok := f.hashes[key][args[2]]; ok {
+			return value
+		}
+		return nil
+	case "LPUSH":
+		f.lists[key] = append([]string{args[2]}, f.lists[key]...)
+		return len(f.lists[key])
+	case "RPOPLPUSH":
+		list := f.lists[key]
+		if len(list) == 0 {
+			return nil
+		}
+		value := list[len(list)-1]
+		f.lists[key] = list[:len(list)-1]
+		f.lists[args[2]] = append([]string{value}, f.lists[args[2]]...)
+		return value
+	case "LREM":
+		for i, value := range f.lists[key] {
+			if value == args[3] {
+				f.lists[key] = append(f.lists[key][:i], f.lists[key][i+1:]...)
+				return 1
+			}
+		}
+		return 0
+	case "ZADD":
+		if f.zsets[key] == nil {
+			f.zsets[key] = map[string]float64{}
+		}
+		score, _ := strconv.ParseFloat(args[2], 64)
+		f.zsets[key][args[3]] = score
+		return 1
+	case "ZRANGEBYSCORE":
+		max, _ := strconv.ParseFloat(args[3], 64)
+		var members []string
+		for member, score := range f.zsets[key] {
+			if score <= max {
+				members = append(members, member)
+			}
+		}
+		return members
+	case "ZREM":
+		if _, ok := f.zsets[key][args[2]]; !ok {
+			return 0
+		}
+		delete(f.zsets[key], args[2])
+		return 1
+	case "EVAL":
+		n, _ := strconv.Atoi(args[2])
+		return f.eval(args[1], args[3:3+n], args[3+n:])
+	}
+	return nil
+}
+
+// eval carries out the scripts of the Redis job queue and rate
+// limiter.
+func (f *fakeRedis) eval(script string, keys, argv []string) interface{} {
+	zadd := func(key, member string, score float64) {
+		if f.zsets[key] == nil {
+			f.zsets[key] = map[string]float64{}
+		}
+		f.zsets[key][member] = score
+	}
+	hset := func(key, field, value string) {
+		if f.hashes[key] == nil {
+			f.hashes[key] = map[string]string{}
+		}
+		f.hashes[key][field] = value
+	}
+	switch script {
+	case redisTakeScript:
+		list := f.lists[keys[0]]
+		if len(list) == 0 {
+			return nil
+		}
+		name := list[len(list)-1]
+		f.lists[keys[0]] = list[:len(list)-1]
+		expires, _ := strconv.ParseFloat(argv[0], 64)
+		zadd(keys[1], name, expires)
+		hset(argv[2]+name, "lease", argv[1])
+		return name
+	case redisRenewScript:
+		expires, ok := f.zsets[keys[0]][argv[0]]
+		now, _ := strconv.ParseFloat(argv[3], 64)
+		if f.hashes[keys[1]]["lease"] != argv[1] || !ok || expires < now {
+			return 0
+		}
+		expires, _ = strconv.ParseFloat(argv[2], 64)
+		zadd(keys[0], argv[0], expires)
+		return 1
+	case redisReleaseScript:
+		if f.hashes[keys[1]]["lease"] != argv[1] {
+			return 0
+		}
+		delete(f.hashes[keys[1]], "lease")
+		delete(f.zsets[keys[0]], argv[0])
+		switch argv[2] {
+		case "queue":
+			f.lists[keys[2]] = append([]string{argv[0]}, f.lists[keys[2]]...)
+		case "schedule":
+			score, _ := strconv.ParseFloat(argv[3], 64)
+			zadd(keys[2], argv[0], score)
+		}
+		return 1
+	case redisReclaimScript:
+		now, _ := strconv.ParseFloat(argv[0], 64)
+		var names []string
+		for name, expires := range f.zsets[keys[0]] {
+			if expires < now {
+				names = append(names, name)
+			}
+		}
+		for _, name := range names {
+			delete(f.zsets[keys[0]], name)
+			delete(f.hashes[argv[1]+name], "lease")
+			f.lists[keys[1]] = append(f.lists[keys[1]], name)
+		}
+		return names
+	case redisRateScript:
+		now, _ := strconv.Atoi(argv[0])
+		interval, _ := strconv.Atoi(argv[1])
+		turn, err := strconv.Atoi(f.strings[keys[0]])
+		if err != nil || turn < now {
+			turn = now
+		}
+		f.strings[keys[0]] = strconv.Itoa(turn + interval)
+		return turn
+	}
+	return nil
+}
+
+func TestRedisQueue(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	q := NewRedisQueue(addr, "test")
+	name, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com", "send_at": "` +
+		time.Now().Add(time.Hour).Format(time.RFC3339) + `"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	svc := MockSES{}
+	ProcessJobStore(q, UseMockSesService(&svc))
+	if svc.nsent != 1 {
+		t.Fatal("expected the recipient that is due to be sent to:", svc.nsent)
+	}
+	job := &redisJob{queue: q, name: name}
+	if i, err := getCheckpoint(job); err != nil || i != 2 {
+		t.Fatal("expected the checkpoint in Redis:", i, err)
+	}
+	if _, err := job.Get("nosuchartifact"); !os.IsNotExist(err) {
+		t.Fatal("expected a missing artifact not to exist:", err)
+	}
+	if len(f.zsets["test:processing"]) != 0 || len(f.lists["test:queue"]) != 0 {
+		t.Fatal("expected the job to have left the queue:", f.lists)
+	}
+	if _, ok := f.zsets["test:scheduled"][name]; !ok {
+		t.Fatal("expected the job to be scheduled:", f.zsets)
+	}
+
+	// Once due, the job is queued again and finishes.
+	f.mu.Lock()
+	f.zsets["test:scheduled"][name] = 0
+	f.hashes["test:job:"+name]["spec"] = `{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`
+	f.mu.Unlock()
+	ProcessJobStore(q, UseMockSesService(&svc))
+	if svc.nsent != 2 {
+		t.Fatal("expected the deferred recipient to be sent to:", svc.nsent)
+	}
+	if state, _ := job.Get("state"); string(state) != "done" {
+		t.Fatal("expected the job to be done:", string(state))
+	}
+}
+
+func TestRedisQueueLeases(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	a := NewRedisQueue(addr, "test")
+	b := NewRedisQueue(addr, "test")
+	name, err := a.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	taken, err := a.Take()
+	if err != nil || taken == nil {
+		t.Fatal("expected to take the job:", err)
+	}
+	leased := taken.(leasedJob)
+	if d, err := leased.renewLease(); err != nil || d != a.Lease {
+		t.Fatal("expected to renew the lease:", d, err)
+	}
+	if err := b.Rescue(); err != nil {
+		t.Fatal("Rescue", err)
+	}
+	if job, _ := b.Take(); job != nil {
+		t.Fatal("expected a leased job not to be taken:", job.Name())
+	}
+	// The worker that took the job stops renewing its lease.
+	f.mu.Lock()
+	f.zsets["test:processing"][name] = 0
+	f.mu.Unlock()
+	reclaimed, err := b.Take()
+	if err != nil || reclaimed == nil || reclaimed.Name() != name {
+		t.Fatal("expected the job with the expired lease to be taken again:", reclaimed, err)
+	}
+	if _, err := leased.renewLease(); err == nil || !leased.leaseLost() {
+		t.Fatal("expected the first worker to find that it lost the lease")
+	}
+	if err := taken.Finish(); err == nil {
+		t.Fatal("expected the first worker not to be able to finish the job")
+	}
+	if err := reclaimed.Finish(); err != nil {
+		t.Fatal("Finish", err)
+	}
+	if len(f.zsets["test:processing"]) != 0 || len(f.lists["test:queue"]) != 0 {
+		t.Fatal("expected the job to have left the queue:", f.zsets, f.lists)
+	}
+}
+
+func TestRedisErrorReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readRedisReply(r); err != nil {
+				return
+			}
+			fmt.Fprint(conn, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+		}
+	}()
+	c := &redisClient{addr: l.Addr().String()}
+	if _, err := c.do("HGET", "key", "field"); err == nil {
+		t.Fatal("expected an error reply to be an error")
+	}
+	if c.conn == nil {
+		t.Fatal("expected the connection to be kept after an error reply")
+	}
+}
+
+func TestRedisTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { redisTimeout = timeout }(redisTimeout)
+	redisTimeout = 50 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	defer l.Close()
+	// The server reads requests but never answers.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readRedisReply(r); err != nil {
+				return
+			}
+		}
+	}()
+	c := &redisClient{addr: l.Addr().String()}
+	start := time.Now()
+	if _, err := c.do("GET", "key"); err == nil {
+		t.Fatal("expected a server that does not answer to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("expected the round trip to give up after the timeout:", elapsed)
+	}
+	if c.conn != nil {
+		t.Fatal("expected the connection to be dropped after a timeout")
+	}
+}
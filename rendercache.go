@@ -0,0 +1,243 @@
+package mailrail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"text/template/parse"
+)
+
+// Campaigns with little personalization render the same content for
+// many recipients. The render cache keeps rendered templates keyed by
+// the hash of the recipient context they were rendered with, so each
+// distinct context is rendered once. Where a template only refers to
+// fields of the context by name, only those fields are part of the
+// key, so a body that does not depend on what varies between
+// recipients, such as their subjects, is rendered once for all of
+// them. The cache is not used for templates that call functions bound
+// to the recipient, such as unsubscribe_url, whose output depends on
+// more than the context.
+type renderCache struct {
+	entries map[string]string
+	max     int
+	hits    int
+	// The fields each template depends on, by template name; a
+	// template that is not here depends on the whole context.
+	fields map[string][]string
+}
+
+// The most rendered templates a job keeps. Once the cache is full,
+// contexts not already in it are rendered every time.
+const renderCacheSize = 10000
+
+// The template functions whose output depends on the recipient and
+// not only on the template's data; see `mailing.bindRecipient`.
+var recipientFuncs = map[string]bool{"unsubscribe_url": true}
+
+func newRenderCache() *renderCache {
+	return &renderCache{entries: make(map[string]string), max: renderCacheSize, fields: make(map[string][]string)}
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// render renders a template of the mailing for recipient i, using the
+// cache if it can.
+func (mailing *mailing) render(name string, t executor, i int) (string, error) {
+	context := mailing.context(i)
+	cache := mailing.renderCache
+	var key string
+	if cache != nil {
+		k, ok := contextKey(context, cache.fields[name])
+		if !ok {
+			// The context cannot be told apart from others.
+			cache = nil
+		} else {
+			key = name + "\x00" + k
+			if rendered, ok := cache.entries[key]; ok {
+				cache.hits++
+				return rendered, nil
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, context); err != nil {
+		return "", err
+	}
+	if cache != nil && len(cache.entries) < cache.max {
+		cache.entries[key] = buf.String()
+	}
+	return buf.String(), nil
+}
+
+// contextKey returns the SHA-256 of some sorted fields of a context,
+// or of all of them if fields is nil. Fields that are missing differ
+// from fields that are empty. It returns false if a field is not plain
+// JSON, such as a struct from an enricher, as such values may encode
+// the same although they differ.
+func contextKey(context map[string]interface{}, fields []string) (string, bool) {
+	if fields == nil {
+		fields = make([]string, 0, len(context))
+		for k := range context {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+	}
+	h := sha256.New()
+	for _, k := range fields {
+		h.Write([]byte(k))
+		if v, ok := context[k]; ok {
+			if !isPlainJSON(v) {
+				return "", false
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", false
+			}
+			h.Write([]byte{0})
+			h.Write(b)
+		}
+		h.Write([]byte{0, 0})
+	}
+	return string(h.Sum(nil)), true
+}
+
+// isPlainJSON tells whether a value is made of what decoding JSON
+// into an interface{} makes, or of Go numbers, so that it encodes to
+// JSON without losing anything.
+func isPlainJSON(v interface{}) bool {
+	switch v := v.(type) {
+	case nil, bool, string, json.Number, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	case float64:
+		return !math.IsNaN(v) && !math.IsInf(v, 0)
+	case float32:
+		return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+	case []interface{}:
+		for _, e := range v {
+			if !isPlainJSON(e) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		for _, e := range v {
+			if !isPlainJSON(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// templateFields returns the sorted names of the context fields that a
+// template depends on, or nil if it may depend on the whole context:
+// if it uses the context itself as `.` or `$`, for instance to pass it
+// to another template.
+func templateFields(tree *parse.Tree) []string {
+	if usesWholeContext(tree.Root) {
+		return nil
+	}
+	seen := make(map[string]bool)
+	collectVariables(tree.Root, seen)
+	fields := make([]string, 0, len(seen))
+	for f := range seen {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func usesWholeContext(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesWholeContext(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesWholeContext(n.Pipe)
+	case *parse.IfNode:
+		return usesWholeContext(n.Pipe) || usesWholeContext(n.List) || usesWholeContext(n.ElseList)
+	case *parse.RangeNode, *parse.WithNode, *parse.TemplateNode:
+		// Fields inside them may not be fields of the context.
+		return true
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesWholeContext(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesWholeContext(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return usesWholeContext(n.Node)
+	case *parse.DotNode:
+		return true
+	case *parse.VariableNode:
+		return len(n.Ident) == 1 && n.Ident[0] == "$"
+	}
+	return false
+}
+
+// callsRecipientFuncs tells whether a template calls any function
+// whose output depends on the recipient.
+func callsRecipientFuncs(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if callsRecipientFuncs(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return callsRecipientFuncs(n.Pipe)
+	case *parse.IfNode:
+		return callsRecipientFuncs(n.Pipe) || callsRecipientFuncs(n.List) || callsRecipientFuncs(n.ElseList)
+	case *parse.RangeNode:
+		return callsRecipientFuncs(n.Pipe) || callsRecipientFuncs(n.List) || callsRecipientFuncs(n.ElseList)
+	case *parse.WithNode:
+		return callsRecipientFuncs(n.Pipe) || callsRecipientFuncs(n.List) || callsRecipientFuncs(n.ElseList)
+	case *parse.TemplateNode:
+		return callsRecipientFuncs(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if callsRecipientFuncs(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if callsRecipientFuncs(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return callsRecipientFuncs(n.Node)
+	case *parse.IdentifierNode:
+		return recipientFuncs[n.Ident]
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	ttemplate "text/template"
+)
+
+func TestRenderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_rendercache_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "Hello {{.name}}", "html": "<p>Hello {{.name}}</p>",
+"recipients": [
+  {"addr": "a@example.com", "context": {"name": "A", "lang": "en"}},
+  {"addr": "b@example.com", "context": {"lang": "en", "name": "A"}},
+  {"addr": "c@example.com", "context": {"name": "C", "lang": "en"}}]}`))
+	j.Submit()
+	job, _ := q.Take()
+	ml, err := getMailing(dirJob{Job: job}, newOptions(nil))
+	if err != nil {
+		t.Fatal("getMailing", err)
+	}
+	for i := range ml.spec.Recipients {
+		params, err := ml.computeSendEmailInput(i, DoNotMangle)
+		if err != nil {
+			t.Fatal("computeSendEmailInput", err)
+		}
+		name := ml.spec.Recipients[i].Context["name"].(string)
+		if *params.Message.Body.Text.Data != "Hello "+name || *params.Message.Body.Html.Data != "<p>Hello "+name+"</p>" {
+			t.Fatal("unexpected content:", params.Message.Body)
+		}
+	}
+	if ml.renderCache.hits != 2 || len(ml.renderCache.entries) != 4 {
+		t.Fatal("expected the second recipient to be rendered from the cache:", ml.renderCache.hits, len(ml.renderCache.entries))
+	}
+
+	unsubscribing := ml.spec
+	unsubscribing.Text = `{{define "footer"}}{{unsubscribe_url .}}{{end}}Hello {{template "footer" .}}`
+	m := &mailing{spec: unsubscribing, opts: newOptions(nil)}
+	if err := m.prepare(); err != nil {
+		t.Fatal("prepare", err)
+	}
+	if m.renderCache != nil {
+		t.Fatal("expected no render cache for a template with unsubscribe links")
+	}
+}
+
+func TestRenderCacheSubjectOnly(t *testing.T) {
+	spec, err := parseSpec([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "Your order has shipped", "html": "<p>Your order {{.order}} has shipped</p>",
+"recipients": [
+  {"addr": "a@example.com", "subject": "Order 1", "context": {"order": "1", "name": "A"}},
+  {"addr": "b@example.com", "subject": "Order 1 again", "context": {"order": "1", "name": "B"}},
+  {"addr": "c@example.com", "subject": "Order 2", "context": {"order": "2", "name": "C"}}]}`))
+	if err != nil {
+		t.Fatal("parseSpec", err)
+	}
+	ml := &mailing{spec: spec, opts: newOptions(nil)}
+	if err := ml.prepare(); err != nil {
+		t.Fatal("prepare", err)
+	}
+	for i := range ml.spec.Recipients {
+		params, err := ml.computeSendEmailInput(i, DoNotMangle)
+		if err != nil {
+			t.Fatal("computeSendEmailInput", err)
+		}
+		if *params.Message.Subject.Data != ml.spec.Recipients[i].Subject {
+			t.Fatal("unexpected subject:", *params.Message.Subject.Data)
+		}
+	}
+	if ml.renderCache.hits != 3 || len(ml.renderCache.entries) != 3 {
+		t.Fatal("expected bodies to be rendered once per distinct order:", ml.renderCache.hits, len(ml.renderCache.entries))
+	}
+
+	for text, whole := range map[string]bool{
+		"{{.a}} {{$.b}} {{if .c}}{{.d}}{{end}}": false,
+		"{{range .a}}{{.}}{{end}}":              true,
+		"{{printf \"%v\" .}}":                   true,
+		"{{with $}}{{.a}}{{end}}":               true,
+	} {
+		tmpl, err := ttemplate.New("text").Funcs(textFuncs(nil)).Parse(text)
+		if err != nil {
+			t.Fatal("Parse", err)
+		}
+		if fields := templateFields(tmpl.Tree); (fields == nil) != whole {
+			t.Fatal("unexpected fields for", text, fields)
+		}
+	}
+}
+
+type account struct {
+	Balance string `json:"-"`
+}
+
+func TestRenderCacheSkipsValuesThatAreNotJSON(t *testing.T) {
+	preview, err := NewPreview([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "Balance: {{.account.Balance}}",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	// As an enricher might set them.
+	preview.mailing.spec.Recipients[0].Context = map[string]interface{}{"account": account{"$1"}}
+	preview.mailing.spec.Recipients[1].Context = map[string]interface{}{"account": account{"$2"}}
+	for i, expected := range []string{"Balance: $1", "Balance: $2"} {
+		msg, err := preview.Render(i)
+		if err != nil || msg.Text != expected {
+			t.Fatal("expected each recipient's own balance:", msg, err)
+		}
+	}
+	if preview.mailing.renderCache.hits != 0 {
+		t.Fatal("expected no cache hits:", preview.mailing.renderCache.hits)
+	}
+	if _, ok := contextKey(map[string]interface{}{"x": math.NaN()}, nil); ok {
+		t.Fatal("expected no key for NaN")
+	}
+	if _, ok := contextKey(map[string]interface{}{"x": []interface{}{1.5, "a", map[string]interface{}{"b": nil}}}, nil); !ok {
+		t.Fatal("expected a key for plain JSON")
+	}
+}
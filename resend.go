@@ -0,0 +1,244 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Resend records that some of a job's recipients were sent the
+// job's content again by a separate job.
+type Resend struct {
+	Job        string    `json:"job"`
+	Recipients []int     `json:"recipients"`
+	Created    time.Time `json:"created"`
+}
+
+// ResendTo submits a new job that sends the spec of an existing job
+// to some of its recipients again. Each selector is either the index
+// of a recipient or an email address, which selects every recipient
+// with that address. The new job is recorded in the "resends" report
+// of the original job, and its basename is returned.
+func ResendTo(queueDir, basename string, selectors []string) (string, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return "", err
+	}
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return "", err
+	}
+	indices, err := selectRecipients(spec, selectors)
+	if err != nil {
+		return "", err
+	}
+	return resend(queueDir, basename, dir, spec, indices)
+}
+
+// ResendFailed submits a new job that sends the spec of an existing
+// job to the recipients whose latest result is failed or skipped,
+// and returns its basename. Like `ResendTo`, it records the new job
+// in the "resends" report of the original job.
+func ResendFailed(queueDir, basename string) (string, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return "", err
+	}
+	if pathHasState(dir, "queue") || pathHasState(dir, "cur") {
+		return "", fmt.Errorf("Job %s has not finished", basename)
+	}
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return "", err
+	}
+	report, err := JobReport(queueDir, basename)
+	if err != nil {
+		return "", err
+	}
+	var indices []int
+	for _, r := range report {
+		if r.Status == StatusFailed || r.Status == StatusSkipped {
+			indices = append(indices, r.Recipient)
+		}
+	}
+	if len(indices) == 0 {
+		return "", fmt.Errorf("Job %s has no failed or skipped recipients", basename)
+	}
+	return resend(queueDir, basename, dir, spec, indices)
+}
+
+// ResendToNonOpeners submits a follow-up job that sends the spec of
+// an existing job with a different subject to the recipients who were
+// sent it at least `after` ago and have neither opened nor clicked it,
+// and returns its basename. Recipients whose message bounced or drew
+// a complaint are left out, as are those in suppressions, if given,
+// which includes those who have unsubscribed since. Opens and clicks
+// are only known if the feedback ingester receives open and click
+// events from SES. Like `ResendTo`, it records the new job in the
+// "resends" report of the original job.
+func ResendToNonOpeners(queueDir, basename string, after time.Duration, subject string, suppressions *SuppressionList) (string, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return "", err
+	}
+	if pathHasState(dir, "queue") || pathHasState(dir, "cur") {
+		return "", fmt.Errorf("Job %s has not finished", basename)
+	}
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return "", err
+	}
+	report, err := JobReport(queueDir, basename)
+	if err != nil {
+		return "", err
+	}
+	feedback, err := getFeedback(dir)
+	if err != nil {
+		return "", err
+	}
+	excluded := make(map[int]bool)
+	for _, f := range feedback {
+		excluded[f.Recipient] = true
+	}
+	now := time.Now()
+	var indices []int
+	for _, r := range report {
+		if r.Status != StatusSent || excluded[r.Recipient] {
+			continue
+		}
+		if now.Sub(r.Time) < after {
+			return "", fmt.Errorf("Job %s sent to recipient %d less than %s ago", basename, r.Recipient, after)
+		}
+		if suppressions != nil {
+			if _, ok := suppressions.Lookup(r.Addr); ok {
+				continue
+			}
+		}
+		indices = append(indices, r.Recipient)
+	}
+	if len(indices) == 0 {
+		return "", fmt.Errorf("Job %s has no recipients who have not opened it", basename)
+	}
+	spec.Subject = subject
+	for _, i := range indices {
+		spec.Recipients[i].Subject = ""
+	}
+	return resend(queueDir, basename, dir, spec, indices)
+}
+
+func resend(queueDir, basename, dir string, spec Spec, indices []int) (string, error) {
+	resendJob, err := submitSubset(queueDir, basename, spec, indices)
+	if err != nil {
+		return "", err
+	}
+	resends, err := getResends(dir)
+	if err != nil {
+		return "", err
+	}
+	resends = append(resends, Resend{resendJob, indices, time.Now()})
+	resendsBytes, err := json.Marshal(resends)
+	if err != nil {
+		return "", err
+	}
+	if err := writeJobFile(dir, "resends", resendsBytes); err != nil {
+		return "", fmt.Errorf("Submitted %s but failed to record it in %s: %s", resendJob, basename, err)
+	}
+	return resendJob, nil
+}
+
+// submitSubset submits a job with the given recipients of spec. The
+// new job's "resend_of" artifact maps its recipients back to the
+// original job.
+func submitSubset(queueDir, basename string, spec Spec, indices []int) (string, error) {
+	recipients := make([]Recipient, len(indices))
+	for j, i := range indices {
+		recipients[j] = spec.Recipients[i]
+	}
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	if specBytes, err = SpecWithRecipients(specBytes, recipients); err != nil {
+		return "", err
+	}
+	if spec.kmsKeyID != "" {
+		if specBytes, err = Encrypt(spec.kmsKeyID, specBytes); err != nil {
+			return "", err
+		}
+	}
+	resendOfBytes, err := json.Marshal(Resend{basename, indices, time.Now()})
+	if err != nil {
+		return "", err
+	}
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open queue %s: %s", queueDir, err)
+	}
+	job, err := q.CreateJob("resend")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create job: %s", err)
+	}
+	if err := job.Set("spec", specBytes); err != nil {
+		return "", err
+	}
+	if err := job.Set("resend_of", resendOfBytes); err != nil {
+		return "", err
+	}
+	if err := job.Submit(); err != nil {
+		return "", err
+	}
+	return job.Basename, nil
+}
+
+func selectRecipients(spec Spec, selectors []string) ([]int, error) {
+	var indices []int
+	seen := make(map[int]bool)
+	add := func(i int) {
+		if !seen[i] {
+			seen[i] = true
+			indices = append(indices, i)
+		}
+	}
+	for _, selector := range selectors {
+		if i, err := strconv.Atoi(selector); err == nil {
+			if i < 0 || i >= len(spec.Recipients) {
+				return nil, fmt.Errorf("No recipient %d; the job has %d recipients", i, len(spec.Recipients))
+			}
+			add(i)
+			continue
+		}
+		found := false
+		for i, recipient := range spec.Recipients {
+			if strings.EqualFold(recipient.Addr, selector) {
+				add(i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No recipient with address %s", selector)
+		}
+	}
+	if len(indices) == 0 {
+		return nil, fmt.Errorf("No recipients selected")
+	}
+	return indices, nil
+}
+
+func getResends(jobDir string) ([]Resend, error) {
+	var resends []Resend
+	resendsBytes, err := readJobFile(jobDir, "resends")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(resendsBytes, &resends); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of resends: %s", err)
+	}
+	return resends, nil
+}
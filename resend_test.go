@@ -0,0 +1,153 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestResendTo(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_resend_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.pet_name}}",
+"recipients": [
+  {"addr": "janedoe@example.com", "context": {"pet_name": "Janie"}},
+  {"addr": "jimdoe@example.com", "context": {"pet_name": "Jimmy"}},
+  {"addr": "joedoe@example.com", "context": {"pet_name": "Joey"}}
+]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(&MockSES{}))
+	resendJob, err := ResendTo(dir, j.Basename, []string{"2", "JaneDoe@example.com"})
+	if err != nil {
+		t.Fatal("ResendTo", err)
+	}
+	ensureExist(t, path.Join(dir, "queue", resendJob))
+	resends, err := getResends(path.Join(dir, "done", j.Basename))
+	if err != nil {
+		t.Fatal("getResends", err)
+	}
+	if len(resends) != 1 || resends[0].Job != resendJob {
+		t.Fatal("unexpected resends:", resends)
+	}
+	if len(resends[0].Recipients) != 2 || resends[0].Recipients[0] != 2 || resends[0].Recipients[1] != 0 {
+		t.Fatal("unexpected recipients:", resends[0].Recipients)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 2 {
+		t.Fatal("expected 2 messages to be resent, not", svc.nsent)
+	}
+	if _, err := ResendTo(dir, j.Basename, []string{"nobody@example.com"}); err == nil {
+		t.Fatal("expected error for unknown address")
+	}
+	if _, err := ResendTo(dir, j.Basename, []string{"3"}); err == nil {
+		t.Fatal("expected error for out-of-range index")
+	}
+}
+
+func TestResendFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_resend_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(&FlakySES{failAddr: "b@example.com"}))
+	ensureExist(t, path.Join(dir, "failed", j.Basename))
+	resendJob, err := ResendFailed(dir, j.Basename)
+	if err != nil {
+		t.Fatal("ResendFailed", err)
+	}
+	resends, err := getResends(path.Join(dir, "failed", j.Basename))
+	if err != nil {
+		t.Fatal("getResends", err)
+	}
+	if len(resends) != 1 || resends[0].Job != resendJob || len(resends[0].Recipients) != 1 || resends[0].Recipients[0] != 1 {
+		t.Fatal("unexpected resends:", resends)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 1 {
+		t.Fatal("expected 1 message to be resent, not", svc.nsent)
+	}
+	if _, err := ResendFailed(dir, resendJob); err == nil {
+		t.Fatal("expected error for job without failed recipients")
+	}
+}
+
+func TestResendToNonOpeners(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_resend_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com", "subject": "Hi, B"},
+  {"addr": "c@example.com"}, {"addr": "d@example.com"}, {"addr": "e@example.com"}]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(&MockSES{}))
+	if _, err := ResendToNonOpeners(dir, j.Basename, time.Hour, "Did you see this?", nil); err == nil {
+		t.Fatal("expected error for a job sent too recently")
+	}
+	recordFeedback(dir, j.Basename, Feedback{Type: FeedbackOpen, Recipient: 0, Addr: "a@example.com"})
+	recordFeedback(dir, j.Basename, Feedback{Type: FeedbackBounce, Recipient: 2, Addr: "c@example.com", Kind: "Transient"})
+	suppressions, err := OpenSuppressionList(path.Join(dir, "suppressions"))
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	suppressions.Add("d@example.com", "unsubscribe", time.Now())
+	resendJob, err := ResendToNonOpeners(dir, j.Basename, 0, "Did you see this?", suppressions)
+	if err != nil {
+		t.Fatal("ResendToNonOpeners", err)
+	}
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 2 {
+		t.Fatal("expected 2 messages to be resent, not", svc.nsent)
+	}
+	resends, err := getResends(path.Join(dir, "done", j.Basename))
+	if err != nil || len(resends) != 1 || resends[0].Job != resendJob {
+		t.Fatal("unexpected resends:", resends, err)
+	}
+	if r := resends[0].Recipients; len(r) != 2 || r[0] != 1 || r[1] != 4 {
+		t.Fatal("unexpected recipients:", r)
+	}
+	if *svc.sent.Message.Subject.Data != "Did you see this?" {
+		t.Fatal("unexpected subject:", *svc.sent.Message.Subject.Data)
+	}
+}
@@ -0,0 +1,110 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"os"
+	"path"
+)
+
+// A Zone is where the mail of recipients subject to data-residency
+// requirements is handled, such as the EU. Their messages are sent
+// through an SES identity in the zone's region, and if ArtifactDir is
+// set, their results are stored there instead of in the job, which
+// keeps only their status. The spec itself stays in the queue, so the
+// queue directory must be in a place every zone accepts.
+type Zone struct {
+	Region      string
+	ArtifactDir string
+	svc         sesService
+}
+
+// Returns a zone that sends through SES in a region and stores
+// results under artifactDir, if it is not empty.
+func NewZone(region, artifactDir string) *Zone {
+	return &Zone{
+		Region:      region,
+		ArtifactDir: artifactDir,
+		svc:         ses.New(session.New(), &aws.Config{Region: aws.String(region)})}
+}
+
+type residency struct {
+	field string
+	zones map[string]*Zone
+}
+
+// Route recipients to zones by a field of their context. For
+// instance, with the field "region", recipients whose context has
+// `"region": "eu"` are handled in zones["eu"]. Recipients without
+// the field, or with a value that names no zone, are handled as
+// usual.
+func WithResidency(field string, zones map[string]*Zone) Option {
+	return func(o *options) {
+		o.residency = &residency{field, zones}
+	}
+}
+
+// zone returns the zone of a recipient, or "" and nil if the
+// recipient has none.
+func (mailing *mailing) zone(i int) (string, *Zone) {
+	r := mailing.opts.residency
+	if r == nil {
+		return "", nil
+	}
+	name := contextString(mailing.context(i), r.field)
+	if zone := r.zones[name]; zone != nil {
+		return name, zone
+	}
+	return "", nil
+}
+
+// service returns the SES service that sends to a recipient.
+func (mailing *mailing) service(svc sesService, i int) sesService {
+	if _, zone := mailing.zone(i); zone != nil {
+		return zone.svc
+	}
+	return svc
+}
+
+// zoneResult stores the result of a zoned recipient in the zone's
+// artifact directory, in an append-only file of JSON lines per job,
+// and returns what the job may keep of it.
+func (mailing *mailing) zoneResult(basename string, r Result) (Result, error) {
+	name, zone := mailing.zone(r.Recipient)
+	if zone == nil || zone.ArtifactDir == "" {
+		return r, nil
+	}
+	if err := appendZoneResult(zone.ArtifactDir, basename, r); err != nil {
+		return r, fmt.Errorf("Job %s failed to store result for recipient %d in zone %s: %s", basename, r.Recipient, name, err)
+	}
+	return Result{
+		Recipient: r.Recipient,
+		Status:    r.Status,
+		MessageId: r.MessageId,
+		Time:      r.Time,
+		ErrorCode: r.ErrorCode,
+		Zone:      name}, nil
+}
+
+func appendZoneResult(artifactDir, basename string, r Result) error {
+	resultBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(artifactDir, basename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(dir, "results"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(resultBytes, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,58 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResidency(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_residency_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir := path.Join(dir, "queue")
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [
+  {"addr": "a@example.com", "context": {"region": "eu"}},
+  {"addr": "b@example.com", "context": {"region": "us"}},
+  {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	var defaultSES, euSES MockSES
+	eu := &Zone{Region: "eu-west-1", ArtifactDir: path.Join(dir, "eu"), svc: &euSES}
+	Process(queueDir, UseMockSesService(&defaultSES), WithResidency("region", map[string]*Zone{"eu": eu}))
+	if euSES.nsent != 1 || *euSES.sent.Destination.ToAddresses[0] != "a@example.com" || defaultSES.nsent != 2 {
+		t.Fatal("unexpected routing:", euSES.nsent, defaultSES.nsent)
+	}
+	results, err := GetResults(queueDir, j.Basename)
+	if err != nil || len(results) != 3 {
+		t.Fatal("GetResults", results, err)
+	}
+	if results[0].Addr != "" || results[0].Zone != "eu" || results[0].Status != StatusSent || results[1].Addr != "b@example.com" {
+		t.Fatal("unexpected results in job:", results)
+	}
+	zoneBytes, err := ioutil.ReadFile(path.Join(dir, "eu", j.Basename, "results"))
+	if err != nil {
+		t.Fatal("failed to read zone results", err)
+	}
+	var zoneResult Result
+	if err := json.Unmarshal(zoneBytes, &zoneResult); err != nil || zoneResult.Addr != "a@example.com" {
+		t.Fatal("unexpected zone result:", string(zoneBytes), err)
+	}
+}
@@ -0,0 +1,275 @@
+package mailrail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Statuses of recipients in a job's results.
+const (
+	StatusSent    = "sent"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+	// Used in reports for recipients the job has not gotten to.
+	StatusPending = "pending"
+)
+
+// A Result records what happened when a job got to a recipient.
+// ErrorCode is the AWS error code, if any, and RequestId the ID of
+// the failed SES request. ContentHash is the SHA-256 of the message
+// that was sent: of the raw message, if it was sent raw, or else of
+// its sender, recipient, subject, and bodies, separated by NUL bytes. Zone is the data-residency zone whose
+// artifact directory holds the full result, if any; see `Zone`.
+type Result struct {
+	Recipient   int       `json:"recipient"`
+	Addr        string    `json:"addr"`
+	Status      string    `json:"status"`
+	MessageId   string    `json:"message_id,omitempty"`
+	ContentHash string    `json:"content_hash,omitempty"`
+	Time        time.Time `json:"time"`
+	ErrorCode   string    `json:"error_code,omitempty"`
+	RequestId   string    `json:"request_id,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Zone        string    `json:"zone,omitempty"`
+}
+
+// Results are stored in the job in chunks of resultsPerChunk
+// recipients, so that recording a result does not rewrite the
+// results of the entire job. Chunk k is stored under "results.k".
+const resultsPerChunk = 1000
+
+func resultsKey(chunk int) string {
+	return fmt.Sprintf("results.%d", chunk)
+}
+
+// A job that can append to an artifact without rewriting it, such as
+// a job in a queue directory or in a MemoryStore.
+type appender interface {
+	Append(key string, value []byte) error
+}
+
+// A resultsWriter writes each chunk whole when it first records a
+// result in it, and then, if the job can append, appends the results
+// after it, one per line, until the chunk is closed, when it writes it
+// whole again. A chunk is closed when the writer moves on to another
+// chunk and when the job stops. The results of a job with an encrypted
+// spec are encrypted under the same KMS key, given by keyID.
+type resultsWriter struct {
+	job    Job
+	keyID  string
+	sealer *sealer
+	chunk  int
+	rs     []Result
+	// appended is the number of results appended to the chunk since
+	// it was written whole, or -1 if it has not been.
+	appended int
+}
+
+func newResultsWriter(job Job, keyID string) *resultsWriter {
+	return &resultsWriter{job: job, keyID: keyID, chunk: -1}
+}
+
+// A job that its queue records results for one by one, such as a job
+// in Postgres. It gets the chunks of results from the same place.
+type resultRecorder interface {
+	RecordResult(r Result) error
+}
+
+func (w *resultsWriter) record(r Result) error {
+	if recorder, ok := w.job.(resultRecorder); ok {
+		if err := recorder.RecordResult(r); err != nil {
+			return fmt.Errorf("Job %s failed to record result for recipient %d: %s", w.job.Name(), r.Recipient, err)
+		}
+		return nil
+	}
+	chunk := r.Recipient / resultsPerChunk
+	if chunk != w.chunk {
+		if err := w.close(); err != nil {
+			// The results appended to it can still be read.
+			log.Println(err)
+		}
+		rs, err := getResultsChunk(w.job.Get, chunk)
+		if err != nil {
+			return err
+		}
+		w.chunk = chunk
+		w.rs = rs
+		w.appended = -1
+	}
+	w.rs = append(w.rs, r)
+	var err error
+	if a, ok := w.job.(appender); ok && w.appended >= 0 {
+		var line []byte
+		if line, err = w.encode(r); err == nil {
+			err = a.Append(resultsKey(chunk), append(line, '\n'))
+		}
+		w.appended++
+	} else if err = w.write(); err == nil && ok {
+		w.appended = 0
+	}
+	if err != nil {
+		return fmt.Errorf("Job %s failed to record result for recipient %d: %s", w.job.Name(), r.Recipient, err)
+	}
+	return nil
+}
+
+// close writes the current chunk whole if results have been appended
+// to it.
+func (w *resultsWriter) close() error {
+	if w.appended <= 0 {
+		return nil
+	}
+	if err := w.write(); err != nil {
+		return fmt.Errorf("Job %s failed to compact %s: %s", w.job.Name(), resultsKey(w.chunk), err)
+	}
+	w.appended = 0
+	return nil
+}
+
+func (w *resultsWriter) write() error {
+	chunkBytes, err := w.encode(w.rs)
+	if err != nil {
+		return err
+	}
+	return w.job.Set(resultsKey(w.chunk), append(chunkBytes, '\n'))
+}
+
+// encode marshals results, or a result, as JSON, sealed and marshaled
+// again as a base64 string if the job is encrypted, so that the chunk
+// has one line per result appended.
+func (w *resultsWriter) encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || w.keyID == "" {
+		return data, err
+	}
+	if w.sealer == nil {
+		if w.sealer, err = newSealer(w.keyID); err != nil {
+			return nil, err
+		}
+	}
+	if data, err = w.sealer.seal(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+func getResultsChunk(get func(string) ([]byte, error), chunk int) ([]Result, error) {
+	chunkBytes, err := get(resultsKey(chunk))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rs, err := decodeResults(chunkBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of %s: %s", resultsKey(chunk), err)
+	}
+	return rs, nil
+}
+
+// decodeResults decodes a chunk of results: JSON values that are each
+// an array of results, a result, or a base64 string of either, sealed.
+// The chunk as a whole may be sealed too. A result at the end that was
+// cut short, as when the worker died while appending it, is ignored.
+func decodeResults(data []byte) ([]Result, error) {
+	data, err := decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	var rs []Result
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var value json.RawMessage
+		if err := dec.Decode(&value); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return rs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch value[0] {
+		case '"':
+			var sealed []byte
+			if err := json.Unmarshal(value, &sealed); err != nil {
+				return nil, err
+			}
+			more, err := decodeResults(sealed)
+			if err != nil {
+				return nil, err
+			}
+			rs = append(rs, more...)
+		case '[':
+			var more []Result
+			if err := json.Unmarshal(value, &more); err != nil {
+				return nil, err
+			}
+			rs = append(rs, more...)
+		default:
+			var r Result
+			if err := json.Unmarshal(value, &r); err != nil {
+				return nil, err
+			}
+			rs = append(rs, r)
+		}
+	}
+}
+
+// getResults returns all results of a job in the order they were
+// recorded. A recipient can have more than one result if the job was
+// retried.
+func getResults(get func(string) ([]byte, error), recipients int) ([]Result, error) {
+	var all []Result
+	for chunk := 0; chunk*resultsPerChunk < recipients; chunk++ {
+		rs, err := getResultsChunk(get, chunk)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rs...)
+	}
+	return all, nil
+}
+
+// GetResults returns the results recorded so far for the job with
+// the given basename in queueDir.
+func GetResults(queueDir, basename string) ([]Result, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return nil, err
+	}
+	return getResults(func(key string) ([]byte, error) { return readJobFile(dir, key) }, len(spec.Recipients))
+}
+
+// JobReport returns the latest result of each recipient of a job, in
+// recipient order. Recipients without results are pending.
+func JobReport(queueDir, basename string) ([]Result, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return nil, err
+	}
+	results, err := getResults(func(key string) ([]byte, error) { return readJobFile(dir, key) }, len(spec.Recipients))
+	if err != nil {
+		return nil, err
+	}
+	report := make([]Result, len(spec.Recipients))
+	for i, recipient := range spec.Recipients {
+		report[i] = Result{Recipient: i, Addr: recipient.Addr, Status: StatusPending}
+	}
+	for _, r := range results {
+		if r.Recipient >= 0 && r.Recipient < len(report) {
+			report[r.Recipient] = r
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,160 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestResults(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_results_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "janedoe@example.com"}, {"addr": "jimdoe@example.com"}]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(&MockSES{}))
+	results, err := GetResults(dir, j.Basename)
+	if err != nil {
+		t.Fatal("GetResults", err)
+	}
+	if len(results) != 2 {
+		t.Fatal("expected 2 results, not", len(results))
+	}
+	for i, r := range results {
+		if r.Recipient != i || r.Status != StatusSent || r.MessageId != "foo" || r.Time.IsZero() {
+			t.Fatal("unexpected result:", r)
+		}
+	}
+	if results[1].Addr != "jimdoe@example.com" {
+		t.Fatal("unexpected address:", results[1].Addr)
+	}
+}
+
+func TestResultsChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_results_chunks_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	n := resultsPerChunk + 10
+	w := newResultsWriter(dirJob{Job: j}, "")
+	for i := 0; i < n; i++ {
+		if err := w.record(Result{Recipient: i, Status: StatusSent}); err != nil {
+			t.Fatal("record", err)
+		}
+	}
+	// A new writer, as after a restart, appends to the existing chunk.
+	w = newResultsWriter(dirJob{Job: j}, "")
+	if err := w.record(Result{Recipient: n - 1, Status: StatusFailed}); err != nil {
+		t.Fatal("record", err)
+	}
+	results, err := getResults(j.Get, n)
+	if err != nil {
+		t.Fatal("getResults", err)
+	}
+	if len(results) != n+1 || results[n].Status != StatusFailed || results[resultsPerChunk].Recipient != resultsPerChunk {
+		t.Fatal("unexpected results")
+	}
+}
+
+func TestResultsAppended(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_results_appended_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := openDirQueue(dir)
+	if err != nil {
+		t.Fatal("openDirQueue", err)
+	}
+	j, err := d.q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Submit()
+	job, err := d.Take()
+	if err != nil || job == nil {
+		t.Fatal("Take", err)
+	}
+	w := newResultsWriter(job, "")
+	for i := 0; i < 3; i++ {
+		if err := w.record(Result{Recipient: i, Status: StatusSent}); err != nil {
+			t.Fatal("record", err)
+		}
+	}
+	chunkFile := path.Join(dir, "cur", j.Basename, resultsKey(0))
+	chunkBytes, _ := ioutil.ReadFile(chunkFile)
+	if lines := strings.Split(strings.TrimSpace(string(chunkBytes)), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "[") {
+		t.Fatal("expected the results after the first to be appended:", string(chunkBytes))
+	}
+	// A result cut short by a crash is ignored.
+	job.(appender).Append(resultsKey(0), []byte(`{"recipient": 3, "sta`))
+	if rs, err := getResultsChunk(job.Get, 0); err != nil || len(rs) != 3 {
+		t.Fatal("unexpected results:", rs, err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal("close", err)
+	}
+	chunkBytes, _ = ioutil.ReadFile(chunkFile)
+	var rs []Result
+	if err := json.Unmarshal(chunkBytes, &rs); err != nil || len(rs) != 3 || rs[2].Recipient != 2 {
+		t.Fatal("expected the chunk to be compacted:", string(chunkBytes), err)
+	}
+}
+
+func TestJobReport(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_report_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "janedoe@example.com"}, {"addr": "jimdoe@example.com"}]
+}`))
+	w := newResultsWriter(dirJob{Job: j}, "")
+	w.record(Result{Recipient: 0, Addr: "janedoe@example.com", Status: StatusFailed, ErrorCode: "MessageRejected"})
+	w.record(Result{Recipient: 0, Addr: "janedoe@example.com", Status: StatusSent, MessageId: "foo"})
+	j.Submit()
+	report, err := JobReport(dir, j.Basename)
+	if err != nil {
+		t.Fatal("JobReport", err)
+	}
+	if len(report) != 2 {
+		t.Fatal("expected 2 lines, not", len(report))
+	}
+	if report[0].Status != StatusSent || report[0].MessageId != "foo" {
+		t.Fatal("unexpected first line:", report[0])
+	}
+	if report[1].Status != StatusPending || report[1].Addr != "jimdoe@example.com" {
+		t.Fatal("unexpected second line:", report[1])
+	}
+}
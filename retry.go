@@ -0,0 +1,67 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+)
+
+const retriesKey = "retries"
+
+// Retry moves a failed job back to the queue and counts the retry in
+// the job's "retries" artifact. Unless resetCheckpoint is set, the
+// job continues from where it failed. The job's failure report is
+// removed. Paused, cancelled, and scheduled jobs are not retried;
+// resume paused jobs with `Resume`.
+func Retry(queueDir, basename string, resetCheckpoint bool) error {
+	dir := path.Join(queueDir, "failed", basename)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("No failed job %s in queue %s", basename, queueDir)
+	}
+	if isPaused(dir) {
+		return fmt.Errorf("Job %s is paused, not failed", basename)
+	}
+	if isCancelled(dir) {
+		return fmt.Errorf("Job %s was cancelled", basename)
+	}
+	if isScheduled(dir) {
+		return fmt.Errorf("Job %s is scheduled, not failed", basename)
+	}
+	retries, err := getRetries(dir)
+	if err != nil {
+		return err
+	}
+	if err := writeJobFile(dir, retriesKey, []byte(strconv.Itoa(retries+1))); err != nil {
+		return err
+	}
+	if err := os.Remove(path.Join(dir, failureReportKey)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if resetCheckpoint {
+		checkpointBytes, err := json.Marshal(checkpoint{0})
+		if err != nil {
+			return err
+		}
+		if err := writeJobFile(dir, name, checkpointBytes); err != nil {
+			return err
+		}
+	}
+	return os.Rename(dir, path.Join(queueDir, "queue", basename))
+}
+
+func getRetries(jobDir string) (int, error) {
+	retriesBytes, err := readJobFile(jobDir, retriesKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	retries, err := strconv.Atoi(string(retriesBytes))
+	if err != nil {
+		return 0, fmt.Errorf("Cannot parse contents of %s: %s", retriesKey, err)
+	}
+	return retries, nil
+}
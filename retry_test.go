@@ -0,0 +1,66 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// A mock SES service that rejects messages to one address until it is
+// fixed.
+type FlakySES struct {
+	MockSES
+	failAddr string
+	fixed    bool
+	attempts int
+}
+
+func (svc *FlakySES) SendEmail(input *ses.SendEmailInput) (*ses.SendEmailOutput, error) {
+	if !svc.fixed && *input.Destination.ToAddresses[0] == svc.failAddr {
+		svc.attempts++
+		return nil, awserr.New("MessageRejected", "rejected", nil)
+	}
+	return svc.MockSES.SendEmail(input)
+}
+
+func TestRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_retry_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]
+}`))
+	j.Submit()
+	svc := FlakySES{failAddr: "b@example.com"}
+	Process(dir, UseMockSesService(&svc))
+	ensureExist(t, path.Join(dir, "failed", j.Basename))
+	if err := Retry(dir, j.Basename, false); err != nil {
+		t.Fatal("Retry", err)
+	}
+	svc.fixed = true
+	Process(dir, UseMockSesService(&svc))
+	ensureExist(t, path.Join(dir, "done", j.Basename))
+	if svc.nsent != 3 {
+		t.Fatal("expected 3 messages in total, not", svc.nsent)
+	}
+	if retries, err := getRetries(path.Join(dir, "done", j.Basename)); err != nil || retries != 1 {
+		t.Fatal("unexpected retry count:", retries, err)
+	}
+	if err := Retry(dir, j.Basename, false); err == nil {
+		t.Fatal("expected error when retrying a job that is done")
+	}
+}
@@ -0,0 +1,143 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// An IndexEntry is the result of one recipient of an archived job.
+// Campaign is the spec's `campaign`, or else the job's basename.
+type IndexEntry struct {
+	Job       string    `json:"job"`
+	Campaign  string    `json:"campaign"`
+	Subject   string    `json:"subject"`
+	Recipient int       `json:"recipient"`
+	Addr      string    `json:"addr"`
+	Status    string    `json:"status"`
+	MessageId string    `json:"message_id,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// A SearchQuery selects index entries. Empty fields match anything.
+// Addresses match case-insensitively, and times are inclusive.
+type SearchQuery struct {
+	Addr      string
+	Campaign  string
+	MessageId string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (q SearchQuery) matches(e IndexEntry) bool {
+	return (q.Addr == "" || normalizeAddr(q.Addr) == normalizeAddr(e.Addr)) &&
+		(q.Campaign == "" || q.Campaign == e.Campaign) &&
+		(q.MessageId == "" || q.MessageId == e.MessageId) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || !e.Time.After(q.Until))
+}
+
+// UpdateIndex adds the jobs in a queue that are archived (done or
+// cancelled) and not yet in the index file to the index, and returns
+// the number of jobs added. Failed jobs are left out because they may
+// still be retried.
+func UpdateIndex(queueDir, indexFilename string) (int, error) {
+	indexed := make(map[string]bool)
+	err := readLines(indexFilename, func(line []byte) error {
+		var e IndexEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		indexed[e.Job] = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(indexFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	encoder := json.NewEncoder(f)
+	added := 0
+	for _, state := range []string{"done", "failed"} {
+		basenames, err := listJobs(queueDir, state)
+		if err != nil {
+			f.Close()
+			return added, err
+		}
+		for _, basename := range basenames {
+			if indexed[basename] {
+				continue
+			}
+			dir, err := findJob(queueDir, basename)
+			if err != nil || (state == "failed" && stateOfJobDir(dir) != "cancelled") {
+				continue
+			}
+			entries, err := indexJob(queueDir, dir, basename)
+			if err != nil {
+				f.Close()
+				return added, err
+			}
+			for _, e := range entries {
+				if err := encoder.Encode(e); err != nil {
+					f.Close()
+					return added, err
+				}
+			}
+			if len(entries) > 0 {
+				added++
+			}
+		}
+	}
+	return added, f.Close()
+}
+
+func indexJob(queueDir, dir, basename string) ([]IndexEntry, error) {
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return nil, err
+	}
+	report, err := JobReport(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	campaign := spec.Campaign
+	if campaign == "" {
+		campaign = basename
+	}
+	var entries []IndexEntry
+	for _, r := range report {
+		if r.Status == StatusPending {
+			continue
+		}
+		subject := spec.Recipients[r.Recipient].Subject
+		if subject == "" {
+			subject = spec.Subject
+		}
+		entries = append(entries, IndexEntry{basename, campaign, subject, r.Recipient, r.Addr, r.Status, r.MessageId, r.Time})
+	}
+	return entries, nil
+}
+
+// SearchIndex returns the entries of an index file that match a
+// query, in the order they were indexed.
+func SearchIndex(indexFilename string, q SearchQuery) ([]IndexEntry, error) {
+	var found []IndexEntry
+	err := readLines(indexFilename, func(line []byte) error {
+		// Skip decoding lines that cannot match.
+		if q.Addr != "" && !strings.Contains(strings.ToLower(string(line)), normalizeAddr(q.Addr)) {
+			return nil
+		}
+		var e IndexEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if q.matches(e) {
+			found = append(found, e)
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,54 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSearchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_search_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Spring sale",
+"campaign": "spring",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com", "subject": "Spring sale for you"}]
+}`))
+	j.Submit()
+	Process(dir, UseMockSesService(&MockSES{}))
+	indexFilename := path.Join(dir, "search-index")
+	if added, err := UpdateIndex(dir, indexFilename); err != nil || added != 1 {
+		t.Fatal("UpdateIndex", added, err)
+	}
+	if added, err := UpdateIndex(dir, indexFilename); err != nil || added != 0 {
+		t.Fatal("expected the job to be indexed only once:", added, err)
+	}
+	entries, err := SearchIndex(indexFilename, SearchQuery{Addr: "B@example.com"})
+	if err != nil {
+		t.Fatal("SearchIndex", err)
+	}
+	if len(entries) != 1 || entries[0].Campaign != "spring" || entries[0].Subject != "Spring sale for you" || entries[0].Status != StatusSent {
+		t.Fatal("unexpected entries:", entries)
+	}
+	entries, err = SearchIndex(indexFilename, SearchQuery{Campaign: "spring", Since: time.Now().Add(-time.Hour)})
+	if err != nil || len(entries) != 2 {
+		t.Fatal("expected 2 entries in the campaign:", entries, err)
+	}
+	entries, err = SearchIndex(indexFilename, SearchQuery{Until: time.Now().Add(-time.Hour)})
+	if err != nil || len(entries) != 0 {
+		t.Fatal("expected no entries before the job ran:", entries, err)
+	}
+}
@@ -0,0 +1,163 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// SecretProviders look up secrets, such as webhook signing keys, by
+// name.
+type SecretProvider interface {
+	Secret(name string) ([]byte, error)
+}
+
+// EnvSecrets looks up secrets in environment variables. The name is
+// the name of the variable.
+type EnvSecrets struct{}
+
+func (EnvSecrets) Secret(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s is not set", name)
+	}
+	return []byte(value), nil
+}
+
+// FileSecrets reads secrets from files. The name is the path of the
+// file, relative to Dir if it is not absolute. A trailing newline is
+// removed.
+type FileSecrets struct {
+	Dir string
+}
+
+func (fs FileSecrets) Secret(name string) ([]byte, error) {
+	filename := name
+	if fs.Dir != "" && !strings.HasPrefix(name, "/") {
+		filename = fs.Dir + "/" + name
+	}
+	value, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(string(value), "\r\n")), nil
+}
+
+type secretsManagerService interface {
+	GetSecretValue(*secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// SecretsManagerSecrets looks up secrets in AWS Secrets Manager. The
+// name is the secret ID or ARN.
+type SecretsManagerSecrets struct {
+	svc secretsManagerService
+}
+
+// Returns a provider for AWS Secrets Manager in the region given by
+// AWS_DEFAULT_REGION.
+func NewSecretsManagerSecrets() *SecretsManagerSecrets {
+	return &SecretsManagerSecrets{secretsmanager.New(session.New(), getSesConfig())}
+}
+
+func (sm *SecretsManagerSecrets) Secret(name string) ([]byte, error) {
+	resp, err := sm.svc.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.SecretString != nil {
+		return []byte(*resp.SecretString), nil
+	}
+	return resp.SecretBinary, nil
+}
+
+// VaultSecrets reads secrets from a HashiCorp Vault KV version 2
+// secrets engine. The name is PATH#KEY, where PATH includes the mount
+// point, e.g., `secret/mailrail#webhook`.
+type VaultSecrets struct {
+	Addr   string
+	Token  string
+	Client *http.Client
+}
+
+// Returns a provider for the Vault server given by the VAULT_ADDR and
+// VAULT_TOKEN environment variables.
+func NewVaultSecrets() *VaultSecrets {
+	return &VaultSecrets{Addr: os.Getenv("VAULT_ADDR"), Token: os.Getenv("VAULT_TOKEN")}
+}
+
+func (v *VaultSecrets) Secret(name string) ([]byte, error) {
+	parts := strings.SplitN(name, "#", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Vault secret name %q is not of the form PATH#KEY", name)
+	}
+	mountAndPath := strings.SplitN(strings.Trim(parts[0], "/"), "/", 2)
+	if len(mountAndPath) != 2 {
+		return nil, fmt.Errorf("Vault secret path %q does not include a mount point", parts[0])
+	}
+	url := strings.TrimRight(v.Addr, "/") + "/v1/" + mountAndPath[0] + "/data/" + mountAndPath[1]
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault returned %s for %s", resp.Status, parts[0])
+	}
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Cannot parse Vault response: %s", err)
+	}
+	value, ok := body.Data.Data[parts[1]].(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault secret %s has no string key %s", parts[0], parts[1])
+	}
+	return []byte(value), nil
+}
+
+// LookupSecret resolves a secret reference of the form
+// PROVIDER:NAME, where PROVIDER is `env`, `file`, `secretsmanager`,
+// or `vault`. This is how the commands accept secrets on the command
+// line without exposing them in the process list.
+func LookupSecret(ref string) ([]byte, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Secret reference %q is not of the form PROVIDER:NAME", ref)
+	}
+	var provider SecretProvider
+	switch parts[0] {
+	case "env":
+		provider = EnvSecrets{}
+	case "file":
+		provider = FileSecrets{}
+	case "secretsmanager":
+		provider = NewSecretsManagerSecrets()
+	case "vault":
+		provider = NewVaultSecrets()
+	default:
+		return nil, fmt.Errorf("Unknown secret provider %q", parts[0])
+	}
+	value, err := provider.Secret(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get secret %s: %s", ref, err)
+	}
+	return value, nil
+}
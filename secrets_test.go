@@ -0,0 +1,67 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLookupSecret(t *testing.T) {
+	os.Setenv("MAILRAIL_TEST_SECRET", "from-env")
+	defer os.Unsetenv("MAILRAIL_TEST_SECRET")
+	secret, err := LookupSecret("env:MAILRAIL_TEST_SECRET")
+	if err != nil || string(secret) != "from-env" {
+		t.Fatal("unexpected env secret:", string(secret), err)
+	}
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_secrets_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "webhook"), []byte("from-file\n"), 0600)
+	secret, err = LookupSecret("file:" + path.Join(dir, "webhook"))
+	if err != nil || string(secret) != "from-file" {
+		t.Fatal("unexpected file secret:", string(secret), err)
+	}
+	if _, err := LookupSecret("keychain:foo"); err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+}
+
+type MockSecretsManager struct{}
+
+func (MockSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String("value-of-" + *input.SecretId)}, nil
+}
+
+func TestSecretsManagerSecrets(t *testing.T) {
+	sm := SecretsManagerSecrets{MockSecretsManager{}}
+	secret, err := sm.Secret("mailrail/webhook")
+	if err != nil || string(secret) != "value-of-mailrail/webhook" {
+		t.Fatal("unexpected secret:", string(secret), err)
+	}
+}
+
+func TestVaultSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/mailrail" || r.Header.Get("X-Vault-Token") != "t0ken" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"webhook": "from-vault"}}}`))
+	}))
+	defer server.Close()
+	v := VaultSecrets{Addr: server.URL, Token: "t0ken"}
+	secret, err := v.Secret("secret/mailrail#webhook")
+	if err != nil || string(secret) != "from-vault" {
+		t.Fatal("unexpected secret:", string(secret), err)
+	}
+	if _, err := v.Secret("secret/mailrail#missing"); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+}
@@ -0,0 +1,103 @@
+package mailrail
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Segment selects recipients with a SQL query against a data
+// source configured in the worker with `WithDataSource`, or with the
+// -data-source flag of `mailrail-worker`. Columns
+// named addr, name, from_name, from_addr, subject, and stream set the
+// corresponding recipient fields; all other columns go in the
+// recipient's context. NULLs are left out.
+type Segment struct {
+	Source string `json:"source"`
+	Query  string `json:"query"`
+}
+
+// Make a database available to specs as a data source for segments.
+// Any database/sql driver can be used (e.g., for Postgres, MySQL, or
+// Redshift); the program must import it.
+func WithDataSource(name string, db *sql.DB) Option {
+	return func(o *options) {
+		if o.dataSources == nil {
+			o.dataSources = make(map[string]*sql.DB)
+		}
+		o.dataSources[name] = db
+	}
+}
+
+// How long a segment query may run. Queries run in read-only
+// transactions, as they come from specs, which anyone who can submit
+// jobs writes; the data source should also connect as a user that can
+// only read what segments need.
+var segmentQueryTimeout = 10 * time.Minute
+
+func materializeSegment(db *sql.DB, query string) ([]Recipient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), segmentQueryTimeout)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot begin read-only transaction for segment query: %s", err)
+	}
+	// Nothing to commit.
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("Segment query failed: %s", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	hasAddr := false
+	for _, column := range columns {
+		if strings.ToLower(column) == "addr" {
+			hasAddr = true
+		}
+	}
+	if !hasAddr {
+		return nil, fmt.Errorf("Segment query has no addr column")
+	}
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	recipients := []Recipient{}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		r := Recipient{Context: make(map[string]interface{})}
+		for i, column := range columns {
+			if !values[i].Valid {
+				continue
+			}
+			v := values[i].String
+			switch strings.ToLower(column) {
+			case "addr":
+				r.Addr = v
+			case "name":
+				r.Name = v
+			case "from_name":
+				r.FromName = v
+			case "from_addr":
+				r.FromAddr = v
+			case "subject":
+				r.Subject = v
+			case "stream":
+				r.Stream = v
+			default:
+				r.Context[column] = v
+			}
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
@@ -0,0 +1,115 @@
+package mailrail
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// A database/sql driver whose queries all return the same rows. It
+// records whether the last query ran in a read-only transaction and
+// had a deadline.
+type fakeDriver struct {
+	columns  []string
+	rows     [][]driver.Value
+	readOnly bool
+	deadline bool
+}
+
+type fakeConn struct{ d *fakeDriver }
+type fakeStmt struct{ d *fakeDriver }
+type fakeTx struct{}
+type fakeRows struct {
+	d *fakeDriver
+	i int
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error)  { return fakeConn{d}, nil }
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.d}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, io.EOF }
+func (c fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.d.readOnly = opts.ReadOnly
+	return fakeTx{}, nil
+}
+func (tx fakeTx) Commit() error   { return nil }
+func (tx fakeTx) Rollback() error { return nil }
+func (s fakeStmt) Close() error   { return nil }
+func (s fakeStmt) NumInput() int  { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, io.EOF
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{d: s.d}, nil
+}
+func (s fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	_, s.d.deadline = ctx.Deadline()
+	return &fakeRows{d: s.d}, nil
+}
+func (r *fakeRows) Columns() []string { return r.d.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.d.rows) {
+		return io.EOF
+	}
+	copy(dest, r.d.rows[r.i])
+	r.i++
+	return nil
+}
+
+var segmentDriver = &fakeDriver{
+	columns: []string{"addr", "name", "pet_name", "plan"},
+	rows: [][]driver.Value{
+		{"janedoe@example.com", "Jane Doe", "Janie", "gold"},
+		{"jimdoe@example.com", nil, "Jimmy", nil}}}
+
+func init() {
+	sql.Register("mailrailfake", segmentDriver)
+}
+
+func TestSegment(t *testing.T) {
+	db, err := sql.Open("mailrailfake", "")
+	if err != nil {
+		t.Fatal("sql.Open", err)
+	}
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_segment_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.pet_name}}",
+"segment": {"source": "crm", "query": "SELECT addr, name, pet_name, plan FROM customers"}
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions([]Option{WithDataSource("crm", db)}))
+	if svc.nsent != 2 || *svc.sent.Message.Body.Text.Data != "Hello, Jimmy" {
+		t.Fatal("unexpected messages:", svc.nsent)
+	}
+	spec, err := readJobSpec(dir + "/done/" + j.Basename)
+	if err != nil {
+		t.Fatal("readJobSpec", err)
+	}
+	r := spec.Recipients[0]
+	if r.Addr != "janedoe@example.com" || r.Name != "Jane Doe" || r.Context["plan"] != "gold" {
+		t.Fatal("unexpected recipient:", r)
+	}
+	if _, ok := spec.Recipients[1].Context["plan"]; ok {
+		t.Fatal("NULL was not left out")
+	}
+	if !segmentDriver.readOnly || !segmentDriver.deadline {
+		t.Fatal("expected the query to run read-only with a deadline:", segmentDriver.readOnly, segmentDriver.deadline)
+	}
+}
@@ -0,0 +1,171 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// Recipients with a `send_at` in the future, or outside the send
+// window of the spec, are passed over and listed in the job's
+// "deferred" artifact, and the checkpoint moves on. Once the job has
+// been through its recipients, it sends to the deferred recipients
+// whose time has come. If some are left, it records when the next one
+// is due under "wake_at" and moves to the failed state, where
+// `mailrail-status` shows it as scheduled, so that the worker can get
+// on with other jobs; the worker puts it back in the queue when it is
+// due.
+const (
+	deferredKey = "deferred"
+	wakeAtKey   = "wake_at"
+)
+
+func getDeferred(job Job) ([]int, error) {
+	return getDeferredFrom(job.Get)
+}
+
+func getDeferredFrom(get func(string) ([]byte, error)) ([]int, error) {
+	deferredBytes, err := get(deferredKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var deferred []int
+	if err := json.Unmarshal(deferredBytes, &deferred); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of %s: %s", deferredKey, err)
+	}
+	return deferred, nil
+}
+
+func setDeferred(job Job, deferred []int) error {
+	deferredBytes, err := json.Marshal(deferred)
+	if err != nil {
+		return err
+	}
+	if err := job.Set(deferredKey, deferredBytes); err != nil {
+		return fmt.Errorf("Job %s failed to record deferred recipients: %s", job.Name(), err)
+	}
+	return nil
+}
+
+// addDeferred adds recipient i to the deferred recipients, unless it
+// was deferred before the worker last stopped.
+func addDeferred(job Job, deferred []int, i int) ([]int, error) {
+	for _, d := range deferred {
+		if d == i {
+			return deferred, nil
+		}
+	}
+	deferred = append(deferred, i)
+	return deferred, setDeferred(job, deferred)
+}
+
+// removeDeferred removes recipient i from the deferred recipients
+// once it has been sent to or skipped.
+func removeDeferred(job Job, deferred []int, i int) ([]int, error) {
+	var remaining []int
+	for _, d := range deferred {
+		if d != i {
+			remaining = append(remaining, d)
+		}
+	}
+	return remaining, setDeferred(job, remaining)
+}
+
+// nextSendAt returns the earliest time one of the deferred recipients
+// is due.
+func (mailing *mailing) nextSendAt(deferred []int) time.Time {
+	var next time.Time
+	now := time.Now()
+	for _, d := range deferred {
+		if due := mailing.dueAt(d, now); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// A job that its queue can schedule itself, such as a job in SQS.
+type schedulableJob interface {
+	Schedule(wakeAt time.Time) error
+}
+
+// schedule moves the job to the failed state until the worker puts it
+// back in the queue at wakeAt.
+func schedule(job Job, wakeAt time.Time) error {
+	if s, ok := job.(schedulableJob); ok {
+		return s.Schedule(wakeAt)
+	}
+	if err := job.Set(wakeAtKey, []byte(wakeAt.Format(time.RFC3339Nano))); err != nil {
+		return err
+	}
+	job.Fail()
+	return nil
+}
+
+// getNotBefore returns the `not_before` of the job's spec, the time
+// before which the job does not start, without resolving its
+// recipients. Such jobs are scheduled like jobs with deferred
+// recipients.
+func getNotBefore(job Job) (time.Time, error) {
+	specBytes, err := job.Get("spec")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if specBytes, err = decodeArtifact(specBytes); err != nil {
+		return time.Time{}, err
+	}
+	var spec struct {
+		NotBefore *time.Time `json:"not_before"`
+	}
+	if err := json.Unmarshal(specBytes, &spec); err != nil || spec.NotBefore == nil {
+		return time.Time{}, err
+	}
+	return *spec.NotBefore, nil
+}
+
+func isScheduled(jobDir string) bool {
+	_, err := os.Stat(path.Join(jobDir, wakeAtKey))
+	return err == nil
+}
+
+// wakeScheduledJobs puts the scheduled jobs whose deferred recipients
+// are due back in the queue.
+func wakeScheduledJobs(queueDir string, now time.Time) error {
+	basenames, err := listJobs(queueDir, "failed")
+	if err != nil {
+		return err
+	}
+	for _, basename := range basenames {
+		dir := path.Join(queueDir, "failed", basename)
+		wakeAtBytes, err := readJobFile(dir, wakeAtKey)
+		if err != nil {
+			continue
+		}
+		wakeAt, err := time.Parse(time.RFC3339Nano, string(wakeAtBytes))
+		if err != nil {
+			return fmt.Errorf("Cannot parse contents of %s of job %s: %s", wakeAtKey, basename, err)
+		}
+		if now.Before(wakeAt) {
+			continue
+		}
+		if err := wakeJob(queueDir, basename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wakeJob puts a scheduled job back in the queue.
+func wakeJob(queueDir, basename string) error {
+	dir := path.Join(queueDir, "failed", basename)
+	if err := os.Remove(path.Join(dir, wakeAtKey)); err != nil {
+		// Another worker woke it.
+		return nil
+	}
+	return os.Rename(dir, path.Join(queueDir, "queue", basename))
+}
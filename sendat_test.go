@@ -0,0 +1,97 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSendAt(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sendat_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	soon := time.Now().Add(200 * time.Millisecond)
+	later := time.Now().Add(time.Hour)
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com", "send_at": "`+later.Format(time.RFC3339Nano)+`"},
+  {"addr": "b@example.com", "send_at": "`+soon.Format(time.RFC3339Nano)+`"}, {"addr": "c@example.com"}]}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 1 || *svc.sent.Destination.ToAddresses[0] != "c@example.com" {
+		t.Fatal("expected only the recipient without send_at to be sent to:", svc.nsent)
+	}
+	status, err := GetJobStatus(dir, j.Basename)
+	if err != nil || status.State != "scheduled" || status.Sent != 1 {
+		t.Fatal("expected the job to be scheduled:", status, err)
+	}
+
+	time.Sleep(time.Until(soon))
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 2 || *svc.sent.Destination.ToAddresses[0] != "b@example.com" {
+		t.Fatal("expected the recipient that is due to be sent to:", svc.nsent)
+	}
+	if status, _ := GetJobStatus(dir, j.Basename); status.State != "scheduled" || status.Sent != 2 {
+		t.Fatal("expected the job to be scheduled again:", status)
+	}
+
+	if err := wakeScheduledJobs(dir, later); err != nil {
+		t.Fatal("wakeScheduledJobs", err)
+	}
+	if status, _ := GetJobStatus(dir, j.Basename); status.State != "queued" {
+		t.Fatal("expected the job to be queued once due:", status)
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sendat_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	later, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	notBefore := time.Now().Add(time.Hour)
+	later.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"not_before": "`+notBefore.Format(time.RFC3339Nano)+`", "recipients": [{"addr": "a@example.com"}]}`))
+	later.Submit()
+	now, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	now.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "b@example.com"}]}`))
+	now.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 1 || *svc.sent.Destination.ToAddresses[0] != "b@example.com" {
+		t.Fatal("expected only the job that is due to send:", svc.nsent)
+	}
+	if status, err := GetJobStatus(dir, later.Basename); err != nil || status.State != "scheduled" || status.Sent != 0 {
+		t.Fatal("expected the job to be scheduled:", status, err)
+	}
+	if err := wakeScheduledJobs(dir, notBefore); err != nil {
+		t.Fatal("wakeScheduledJobs", err)
+	}
+	if status, _ := GetJobStatus(dir, later.Basename); status.State != "queued" {
+		t.Fatal("expected the job to be queued once due:", status)
+	}
+}
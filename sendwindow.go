@@ -0,0 +1,105 @@
+package mailrail
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SendWindow restricts sending to the hours between Start and End
+// ("09:00", "17:00") in the time zone that each recipient gives in the
+// `tz` field of its context, or in Timezone for recipients that do not
+// have one. A window that ends before it starts goes past midnight.
+// Recipients outside their window are deferred like recipients with a
+// `send_at` until the window next opens.
+type SendWindow struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+type sendWindow struct {
+	start, end time.Duration
+	location   *time.Location
+	mu         sync.Mutex
+	locations  map[string]*time.Location
+}
+
+func parseClock(name, clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s of send window %q", name, clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseSendWindow(w *SendWindow) (*sendWindow, error) {
+	start, err := parseClock("start", w.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock("end", w.End)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("Send window starts and ends at %s", w.Start)
+	}
+	location, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time zone of send window %q", w.Timezone)
+	}
+	return &sendWindow{start: start, end: end, location: location, locations: make(map[string]*time.Location)}, nil
+}
+
+// recipientLocation returns the time zone named by tz, falling back on
+// the window's own time zone if it is missing or unknown.
+func (w *sendWindow) recipientLocation(tz string) *time.Location {
+	if tz == "" {
+		return w.location
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	location, ok := w.locations[tz]
+	if !ok {
+		var err error
+		if location, err = time.LoadLocation(tz); err != nil {
+			location = w.location
+		}
+		w.locations[tz] = location
+	}
+	return location
+}
+
+// next returns t if it is inside the window in the given time zone,
+// and otherwise the time the window next opens.
+func (w *sendWindow) next(t time.Time, location *time.Location) time.Time {
+	local := t.In(location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	clock := local.Sub(midnight)
+	if w.start < w.end {
+		if clock >= w.start && clock < w.end {
+			return t
+		}
+		if clock >= w.end {
+			midnight = time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, location)
+		}
+	} else if clock >= w.start || clock < w.end {
+		return t
+	}
+	return midnight.Add(w.start)
+}
+
+// dueAt returns the time recipient i is due: the later of now and its
+// `send_at`, moved forward to when its send window opens.
+func (mailing *mailing) dueAt(i int, now time.Time) time.Time {
+	due := now
+	r := *mailing.recipient(i)
+	if r.SendAt != nil && r.SendAt.After(due) {
+		due = *r.SendAt
+	}
+	if w := mailing.sendWindow; w != nil {
+		due = w.next(due, w.recipientLocation(contextString(mailing.context(i), "tz")))
+	}
+	return due
+}
@@ -0,0 +1,91 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSendWindowNext(t *testing.T) {
+	w, err := parseSendWindow(&SendWindow{Start: "09:00", End: "17:00", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal("parseSendWindow", err)
+	}
+	oslo, _ := time.LoadLocation("Europe/Oslo")
+	noon := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	if next := w.next(noon, time.UTC); !next.Equal(noon) {
+		t.Fatal("expected noon to be inside the window:", next)
+	}
+	if next := w.next(time.Date(2026, 3, 2, 3, 0, 0, 0, time.UTC), time.UTC); !next.Equal(time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)) {
+		t.Fatal("expected the window to open later the same day:", next)
+	}
+	if next := w.next(time.Date(2026, 3, 2, 17, 0, 0, 0, time.UTC), time.UTC); !next.Equal(time.Date(2026, 3, 3, 9, 0, 0, 0, time.UTC)) {
+		t.Fatal("expected the window to open the next day:", next)
+	}
+	// 08:30 UTC is 09:30 in Oslo in the winter.
+	early := time.Date(2026, 3, 2, 8, 30, 0, 0, time.UTC)
+	if next := w.next(early, oslo); !next.Equal(early) {
+		t.Fatal("expected the window to follow the recipient's time zone:", next)
+	}
+	night, err := parseSendWindow(&SendWindow{Start: "22:00", End: "02:00"})
+	if err != nil {
+		t.Fatal("parseSendWindow", err)
+	}
+	if next := night.next(time.Date(2026, 3, 2, 1, 0, 0, 0, time.UTC), time.UTC); next.Hour() != 1 {
+		t.Fatal("expected a window past midnight to be open at 01:00:", next)
+	}
+	if next := night.next(noon, time.UTC); !next.Equal(time.Date(2026, 3, 2, 22, 0, 0, 0, time.UTC)) {
+		t.Fatal("expected a window past midnight to open in the evening:", next)
+	}
+	for _, bad := range []SendWindow{{Start: "9am", End: "17:00"}, {Start: "09:00", End: "09:00"},
+		{Start: "09:00", End: "17:00", Timezone: "Nowhere/Special"}} {
+		if _, err := parseSendWindow(&bad); err == nil {
+			t.Fatal("expected an invalid send window to be rejected:", bad)
+		}
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sendwindow_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	// A window that is open for the next hour in UTC, which is closed
+	// half a day away.
+	now := time.Now().UTC()
+	start := now.Add(-time.Minute).Format("15:04")
+	end := now.Add(time.Hour).Format("15:04")
+	away := time.FixedZone("away", 12*60*60)
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"send_window": {"start": "`+start+`", "end": "`+end+`", "timezone": "UTC"},
+"recipients": [{"addr": "a@example.com", "context": {"tz": "Etc/GMT-12"}},
+  {"addr": "b@example.com", "context": {"tz": "Not/AZone"}}, {"addr": "c@example.com"}]}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc))
+	if svc.nsent != 2 {
+		t.Fatal("expected the recipients inside the window to be sent to:", svc.nsent)
+	}
+	status, err := GetJobStatus(dir, j.Basename)
+	if err != nil || status.State != "scheduled" || status.Sent != 2 {
+		t.Fatal("expected the job to be scheduled:", status, err)
+	}
+	w, _ := parseSendWindow(&SendWindow{Start: start, End: end})
+	if err := wakeScheduledJobs(dir, w.next(now.Add(time.Minute), away).Add(-time.Second)); err != nil {
+		t.Fatal("wakeScheduledJobs", err)
+	}
+	if status, _ := GetJobStatus(dir, j.Basename); status.State != "scheduled" {
+		t.Fatal("expected the job to stay scheduled until the window opens:", status)
+	}
+}
@@ -0,0 +1,89 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sesv2"
+	"log"
+	"sync"
+)
+
+type sesv2Service interface {
+	GetSuppressedDestination(*sesv2.GetSuppressedDestinationInput) (*sesv2.GetSuppressedDestinationOutput, error)
+	ListSuppressedDestinations(*sesv2.ListSuppressedDestinationsInput) (*sesv2.ListSuppressedDestinationsOutput, error)
+}
+
+// AccountSuppressions is the SES account-level suppression list, which
+// SES adds addresses to when they bounce or complain. Sending to them
+// uses up quota and hurts reputation without delivering anything.
+// Addresses are either looked up as they are needed, and remembered
+// for the life of the worker, or all preloaded.
+type AccountSuppressions struct {
+	svc     sesv2Service
+	mu      sync.Mutex
+	reasons map[string]string
+	preload bool
+}
+
+// Returns the SES account suppression list. If preload is true, the
+// whole list is fetched now; otherwise addresses are looked up one at
+// a time.
+func NewAccountSuppressions(preload bool) (*AccountSuppressions, error) {
+	return newAccountSuppressions(sesv2.New(session.New(), getSesConfig()), preload)
+}
+
+func newAccountSuppressions(svc sesv2Service, preload bool) (*AccountSuppressions, error) {
+	as := &AccountSuppressions{svc: svc, reasons: make(map[string]string), preload: preload}
+	if !preload {
+		return as, nil
+	}
+	input := &sesv2.ListSuppressedDestinationsInput{PageSize: aws.Int64(1000)}
+	for {
+		resp, err := svc.ListSuppressedDestinations(input)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot list SES account suppression list: %s", err)
+		}
+		for _, d := range resp.SuppressedDestinationSummaries {
+			as.reasons[normalizeAddr(aws.StringValue(d.EmailAddress))] = aws.StringValue(d.Reason)
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		input.NextToken = resp.NextToken
+	}
+	log.Printf("Preloaded %d addresses from the SES account suppression list", len(as.reasons))
+	return as, nil
+}
+
+// Lookup returns the reason ("BOUNCE" or "COMPLAINT") that an address
+// is on the account suppression list, or "" if it is not. If SES
+// cannot be asked, the address is taken not to be suppressed.
+func (as *AccountSuppressions) Lookup(addr string) string {
+	addr = normalizeAddr(addr)
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if reason, ok := as.reasons[addr]; ok || as.preload {
+		return reason
+	}
+	resp, err := as.svc.GetSuppressedDestination(&sesv2.GetSuppressedDestinationInput{EmailAddress: aws.String(addr)})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == sesv2.ErrCodeNotFoundException {
+			as.reasons[addr] = ""
+		} else {
+			log.Printf("Failed to look up %s in the SES account suppression list: %s", addr, err)
+		}
+		return ""
+	}
+	reason := aws.StringValue(resp.SuppressedDestination.Reason)
+	as.reasons[addr] = reason
+	return reason
+}
+
+// Skip recipients on the SES account suppression list.
+func WithAccountSuppressions(as *AccountSuppressions) Option {
+	return func(o *options) {
+		o.accountSuppressions = as
+	}
+}
@@ -0,0 +1,77 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sesv2"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type MockSESV2 struct {
+	suppressed map[string]string
+	gets       int
+}
+
+func (svc *MockSESV2) GetSuppressedDestination(input *sesv2.GetSuppressedDestinationInput) (*sesv2.GetSuppressedDestinationOutput, error) {
+	svc.gets++
+	reason, ok := svc.suppressed[*input.EmailAddress]
+	if !ok {
+		return nil, awserr.New(sesv2.ErrCodeNotFoundException, "not found", nil)
+	}
+	return &sesv2.GetSuppressedDestinationOutput{SuppressedDestination: &sesv2.SuppressedDestination{
+		EmailAddress: input.EmailAddress,
+		Reason:       aws.String(reason)}}, nil
+}
+
+func (svc *MockSESV2) ListSuppressedDestinations(input *sesv2.ListSuppressedDestinationsInput) (*sesv2.ListSuppressedDestinationsOutput, error) {
+	var summaries []*sesv2.SuppressedDestinationSummary
+	for addr, reason := range svc.suppressed {
+		summaries = append(summaries, &sesv2.SuppressedDestinationSummary{EmailAddress: aws.String(addr), Reason: aws.String(reason)})
+	}
+	return &sesv2.ListSuppressedDestinationsOutput{SuppressedDestinationSummaries: summaries}, nil
+}
+
+func TestAccountSuppressions(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sesv2_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	for _, preload := range []bool{false, true} {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "bounced@example.com"}, {"addr": "ok@example.com"}, {"addr": "OK@example.com"}]}`))
+		j.Submit()
+		sesv2svc := &MockSESV2{suppressed: map[string]string{"bounced@example.com": "BOUNCE"}}
+		as, err := newAccountSuppressions(sesv2svc, preload)
+		if err != nil {
+			t.Fatal("newAccountSuppressions", err)
+		}
+		var svc MockSES
+		Process(dir, UseMockSesService(&svc), WithAccountSuppressions(as))
+		results, err := GetResults(dir, j.Basename)
+		if err != nil || len(results) != 3 {
+			t.Fatal("GetResults", results, err)
+		}
+		if results[0].Status != StatusSkipped || results[0].Error != "Address is suppressed by SES: BOUNCE" || svc.nsent != 2 {
+			t.Fatal("unexpected results:", results)
+		}
+		expectedGets := 2
+		if preload {
+			expectedGets = 0
+		}
+		if sesv2svc.gets != expectedGets {
+			t.Fatal("expected", expectedGets, "lookups, not", sesv2svc.gets)
+		}
+	}
+}
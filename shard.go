@@ -0,0 +1,320 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// A worker with a shard size splits jobs in queue directories with
+// more recipients than that into shards: child jobs in the same queue,
+// each with a range of the recipients, that any worker can take. The
+// parent job records its shards under "shards" and waits for them as a
+// scheduled job, checking on them every shardPollInterval and when one
+// finishes. Once all shards are done, failed, or cancelled, the report
+// records when, and the parent finishes, or fails if a shard did not
+// finish. Jobs are sharded only before they start, and shards, whose
+// specs name their parent in `shard_of`, are not sharded again.
+const (
+	shardsKey         = "shards"
+	shardPollInterval = time.Minute
+)
+
+// A Shard is a child job with Recipients recipients of its parent,
+// starting with recipient First. State and Sent are as of when the
+// parent last checked.
+type Shard struct {
+	Job        string `json:"job"`
+	First      int    `json:"first"`
+	Recipients int    `json:"recipients"`
+	State      string `json:"state,omitempty"`
+	Sent       int    `json:"sent"`
+}
+
+// A ShardReport is the record of a sharded job's shards. Completed is
+// when the last of them completed, or zero if some have not.
+type ShardReport struct {
+	Shards    []Shard   `json:"shards"`
+	Completed time.Time `json:"completed,omitempty"`
+}
+
+// Split jobs with more than size recipients into shards of size
+// recipients.
+func WithSharding(size int) Option {
+	return func(o *options) {
+		o.shardSize = size
+	}
+}
+
+func getShardReport(get func(string) ([]byte, error)) (*ShardReport, error) {
+	reportBytes, err := get(shardsKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var report ShardReport
+	if err := json.Unmarshal(reportBytes, &report); err != nil {
+		return nil, fmt.Errorf("Cannot parse contents of %s: %s", shardsKey, err)
+	}
+	return &report, nil
+}
+
+func setShardReport(job Job, report *ShardReport) error {
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := job.Set(shardsKey, reportBytes); err != nil {
+		return fmt.Errorf("Job %s failed to record its shards: %s", job.Name(), err)
+	}
+	return nil
+}
+
+// GetShardReport returns the shard report of a job, or nil if it was
+// not sharded.
+func GetShardReport(queueDir, basename string) (*ShardReport, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return nil, err
+	}
+	return getShardReport(func(key string) ([]byte, error) { return readJobFile(dir, key) })
+}
+
+// shard splits the job into shards, or checks on the shards it was
+// split into. It tells whether the job was sharded, in which case the
+// worker is done with it for now. The shards are planned before they
+// are submitted, so that a worker that takes the job after another
+// died while sharding it submits the rest.
+func (mailing *mailing) shard(job Job, o *options) (bool, error) {
+	report, err := getShardReport(job.Get)
+	if err != nil {
+		return false, err
+	}
+	if report == nil {
+		n := mailing.recipientCount()
+		if o.shardSize <= 0 || n <= o.shardSize || mailing.spec.ShardOf != "" || o.queueDir == "" {
+			return false, nil
+		}
+		if i, err := getCheckpoint(job); err != nil || i > 0 {
+			return false, err
+		}
+		report = &ShardReport{}
+		for first := 0; first < n; first += o.shardSize {
+			count := o.shardSize
+			if first+count > n {
+				count = n - first
+			}
+			report.Shards = append(report.Shards, Shard{First: first, Recipients: count})
+		}
+		if err := setShardReport(job, report); err != nil {
+			return true, err
+		}
+		log.Printf("Job %s split into %d shards of up to %d recipients", job.Name(), len(report.Shards), o.shardSize)
+	}
+	for k, shard := range report.Shards {
+		if shard.Job != "" {
+			continue
+		}
+		recipients := make([]Recipient, shard.Recipients)
+		for j := range recipients {
+			recipients[j] = *mailing.recipient(shard.First + j)
+		}
+		child, err := submitShard(job, recipients, o.queueDir)
+		if err != nil {
+			return true, err
+		}
+		report.Shards[k].Job = child
+		if err := setShardReport(job, report); err != nil {
+			return true, err
+		}
+	}
+	return true, checkShards(job, report, o)
+}
+
+// submitShard submits a child job with some of the recipients of a
+// job, and returns its basename.
+func submitShard(job Job, recipients []Recipient, queueDir string) (string, error) {
+	original, err := job.Get("spec")
+	if err != nil {
+		return "", err
+	}
+	specBytes, err := SpecWithRecipients(original, recipients)
+	if err != nil {
+		return "", err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(specBytes, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "not_before")
+	if fields["shard_of"], err = json.Marshal(job.Name()); err != nil {
+		return "", err
+	}
+	if specBytes, err = json.Marshal(fields); err != nil {
+		return "", err
+	}
+	if specBytes, err = encryptLike(original, specBytes); err != nil {
+		return "", err
+	}
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		return "", err
+	}
+	child, err := q.CreateJob("shard")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create shard: %s", err)
+	}
+	if err := child.Set("spec", specBytes); err != nil {
+		return "", err
+	}
+	if submitted, err := job.Get(submittedKey); err == nil {
+		if err := child.Set(submittedKey, submitted); err != nil {
+			return "", err
+		}
+	}
+	if err := child.Submit(); err != nil {
+		return "", err
+	}
+	return child.Basename, nil
+}
+
+// checkShards updates the shard report of a sharded job and finishes
+// the job once all shards are complete, or else schedules it to check
+// again.
+func checkShards(job Job, report *ShardReport, o *options) error {
+	complete := true
+	var failed []string
+	n := 0
+	for k, shard := range report.Shards {
+		n += shard.Recipients
+		dir, err := findJob(o.queueDir, shard.Job)
+		if err != nil {
+			return err
+		}
+		state := stateOfJobDir(dir)
+		status, err := getJobStatus(dir, shard.Job, state)
+		if err != nil {
+			return err
+		}
+		report.Shards[k].State, report.Shards[k].Sent = state, status.Sent
+		switch state {
+		case stateNames["done"]:
+		case stateNames["failed"], "cancelled":
+			failed = append(failed, shard.Job)
+		default:
+			complete = false
+		}
+	}
+	if !complete && cancelRequested(job) {
+		if err := setShardReport(job, report); err != nil {
+			return err
+		}
+		if err := controlShards(o.queueDir, report, hasEnded, Cancel); err != nil {
+			return err
+		}
+		log.Printf("Job %s cancelled with its shards", job.Name())
+		if err := recordCancellation(job, sentByShards(report)); err != nil {
+			log.Printf("Job %s failed to record cancellation: %s", job.Name(), err)
+		}
+		o.notify(Event{Type: JobCancelled, Job: job.Name(), Recipient: sentByShards(report), Recipients: n})
+		job.Fail()
+		o.archiveJob(job.Name())
+		return nil
+	}
+	if !complete && pauseRequested(job) {
+		if err := setShardReport(job, report); err != nil {
+			return err
+		}
+		if err := controlShards(o.queueDir, report, hasEnded, Pause); err != nil {
+			return err
+		}
+		log.Printf("Job %s paused with its shards", job.Name())
+		if err := job.Set(pausedKey, []byte(time.Now().Format(time.RFC3339))); err != nil {
+			log.Printf("Job %s failed to record that it is paused: %s", job.Name(), err)
+		}
+		o.notify(Event{Type: JobPaused, Job: job.Name(), Recipient: sentByShards(report), Recipients: n})
+		job.Fail()
+		return nil
+	}
+	if !complete {
+		if err := setShardReport(job, report); err != nil {
+			return err
+		}
+		return schedule(job, time.Now().Add(shardPollInterval))
+	}
+	report.Completed = time.Now()
+	if err := setShardReport(job, report); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Shards %s did not finish", strings.Join(failed, ", "))
+	}
+	log.Printf("Job %s finished with its %d shards", job.Name(), len(report.Shards))
+	o.notify(Event{Type: JobFinished, Job: job.Name(), Recipients: n})
+	job.Finish()
+	o.archiveJob(job.Name())
+	return nil
+}
+
+// wakeParent wakes the job a shard belongs to, so that it can check
+// on its shards.
+func (mailing *mailing) wakeParent(o *options) {
+	if mailing.spec.ShardOf == "" || o.queueDir == "" {
+		return
+	}
+	if err := wakeJob(o.queueDir, mailing.spec.ShardOf); err != nil {
+		log.Printf("Failed to wake job %s: %s", mailing.spec.ShardOf, err)
+	}
+}
+
+func sentByShards(report *ShardReport) int {
+	sent := 0
+	for _, shard := range report.Shards {
+		sent += shard.Sent
+	}
+	return sent
+}
+
+// controlShards cancels, pauses, or resumes the submitted shards of a
+// sharded job with control, except for those whose directories skip
+// is true for.
+func controlShards(queueDir string, report *ShardReport, skip func(dir string) bool, control func(queueDir, basename string) error) error {
+	for _, shard := range report.Shards {
+		if shard.Job == "" {
+			continue
+		}
+		dir, err := findJob(queueDir, shard.Job)
+		if err != nil {
+			return err
+		}
+		if skip(dir) {
+			continue
+		}
+		if err := control(queueDir, shard.Job); err != nil {
+			return fmt.Errorf("Cannot control shard %s: %s", shard.Job, err)
+		}
+	}
+	return nil
+}
+
+// controlShardsOf is controlShards for a job given by its directory,
+// which need not have been sharded.
+func controlShardsOf(queueDir, jobDir string, skip func(dir string) bool, control func(queueDir, basename string) error) error {
+	report, err := getShardReport(func(key string) ([]byte, error) { return readJobFile(jobDir, key) })
+	if err != nil || report == nil {
+		return err
+	}
+	return controlShards(queueDir, report, skip, control)
+}
+
+// hasEnded tells whether a job is done, or failed, cancelled, or
+// paused rather than scheduled.
+func hasEnded(dir string) bool {
+	return pathHasState(dir, "done") || (pathHasState(dir, "failed") && !isScheduled(dir))
+}
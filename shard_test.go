@@ -0,0 +1,110 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSharding(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_shard_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.name}}",
+"recipients": [
+  {"addr": "a@example.com", "context": {"name": "A"}},
+  {"addr": "b@example.com", "context": {"name": "B"}},
+  {"addr": "c@example.com", "context": {"name": "C"}},
+  {"addr": "d@example.com", "context": {"name": "D"}},
+  {"addr": "e@example.com", "context": {"name": "E"}}]
+}`))
+	j.Submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithSharding(2))
+	if svc.nsent != 5 || *svc.sent.Message.Body.Text.Data != "Hello, E" {
+		t.Fatal("expected the shards to send to all recipients:", svc.nsent)
+	}
+	if _, err := os.Stat(path.Join(dir, "done", j.Basename)); err != nil {
+		t.Fatal("expected the parent to finish once its shards did:", err)
+	}
+	report, err := GetShardReport(dir, j.Basename)
+	if err != nil || report == nil || len(report.Shards) != 3 || report.Completed.IsZero() {
+		t.Fatal("expected a completed report of 3 shards:", report, err)
+	}
+	for k, shard := range report.Shards {
+		if shard.First != 2*k || shard.State != "done" || shard.Sent != shard.Recipients {
+			t.Fatal("unexpected shard:", shard)
+		}
+		spec, err := readJobSpec(path.Join(dir, "done", shard.Job))
+		if err != nil || spec.ShardOf != j.Basename || spec.Recipients[0].Context["name"] != string(rune('A'+2*k)) {
+			t.Fatal("unexpected spec of shard:", spec, err)
+		}
+	}
+}
+
+func TestPauseAndCancelShardedJob(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_shard_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}]}`))
+	j.Submit()
+	svc := MockSES{}
+	// The parent is split into shards, and waits for them.
+	ProcessOne(dir, UseMockSesService(&svc), WithSharding(2))
+	report, err := GetShardReport(dir, j.Basename)
+	if err != nil || report == nil || len(report.Shards) != 2 {
+		t.Fatal("expected the job to be sharded:", report, err)
+	}
+	if err := Pause(dir, j.Basename); err != nil {
+		t.Fatal("Pause", err)
+	}
+	Process(dir, UseMockSesService(&svc), WithSharding(2))
+	if svc.nsent != 0 {
+		t.Fatal("expected the shards to be paused along with the parent:", svc.nsent)
+	}
+	for _, basename := range []string{j.Basename, report.Shards[0].Job, report.Shards[1].Job} {
+		if state := stateOfJobDir(path.Join(dir, "failed", basename)); state != "paused" {
+			t.Fatal("expected the job to be paused:", basename, state)
+		}
+	}
+	if err := Resume(dir, j.Basename); err != nil {
+		t.Fatal("Resume", err)
+	}
+	for _, shard := range report.Shards {
+		ensureExist(t, path.Join(dir, "queue", shard.Job))
+	}
+	// A parent that is cancelled while it is in the queue cancels its
+	// shards when the worker takes it.
+	if err := Cancel(dir, j.Basename); err != nil {
+		t.Fatal("Cancel", err)
+	}
+	Process(dir, UseMockSesService(&svc), WithSharding(2))
+	if svc.nsent != 0 {
+		t.Fatal("expected the shards to be cancelled along with the parent:", svc.nsent)
+	}
+	for _, basename := range []string{j.Basename, report.Shards[0].Job, report.Shards[1].Job} {
+		if state := stateOfJobDir(path.Join(dir, "failed", basename)); state != "cancelled" {
+			t.Fatal("expected the job to be cancelled:", basename, state)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A SignupHandler adds addresses to lists with double opt-in. A POST
+// to `/signup` with the form fields `list`, `addr`, and optionally
+// `name` emails the address a link to `/confirm`; following the link
+// shows a page with a button, and the button adds the address to the
+// list, so that mail scanners that fetch links do not sign anyone up.
+// Other form fields become the member's context. The link carries a
+// signed token, so nothing is stored until the address is confirmed.
+//
+// So that the endpoint cannot be used to flood an address with
+// confirmation emails, signups are limited per client IP address and
+// per address, and suppressed addresses are not emailed.
+type SignupHandler struct {
+	Lists   *ListStore
+	Secret  []byte
+	BaseURL string
+	// Only these lists accept signups.
+	AllowedLists  []string
+	FromAddr      string
+	Subject       string
+	TokenLifetime time.Duration
+	// If set, signups of suppressed addresses are answered as usual
+	// but not emailed.
+	Suppressions *SuppressionList
+	// At most MaxPerIP signups from one client IP address, and at
+	// most MaxPerAddr signups of one address, are accepted per
+	// ThrottleWindow. Zero means no limit.
+	MaxPerIP       int
+	MaxPerAddr     int
+	ThrottleWindow time.Duration
+	throttle       signupThrottle
+	svc            sesService
+}
+
+type signupClaims struct {
+	List    string                 `json:"list"`
+	Addr    string                 `json:"addr"`
+	Name    string                 `json:"name,omitempty"`
+	Context map[string]interface{} `json:"context,omitempty"`
+	Expires int64                  `json:"exp"`
+}
+
+// Returns a signup handler that sends confirmation emails via SES.
+// BaseURL is the URL the handler is served under, as seen by
+// subscribers.
+func NewSignupHandler(lists *ListStore, secret []byte, baseURL, fromAddr string, allowedLists []string) *SignupHandler {
+	return &SignupHandler{
+		Lists:          lists,
+		Secret:         secret,
+		BaseURL:        strings.TrimRight(baseURL, "/"),
+		AllowedLists:   allowedLists,
+		FromAddr:       fromAddr,
+		Subject:        "Please confirm your subscription",
+		TokenLifetime:  7 * 24 * time.Hour,
+		MaxPerIP:       10,
+		MaxPerAddr:     3,
+		ThrottleWindow: time.Hour,
+		svc:            ses.New(session.New(), getSesConfig())}
+}
+
+// Counts recent signups by key, such as "ip:192.0.2.1" or
+// "addr:janedoe@example.com".
+type signupThrottle struct {
+	mu   sync.Mutex
+	hits map[string][]time.Time
+	// When keys without recent signups were last dropped.
+	swept time.Time
+}
+
+// allow records a signup under a key and tells whether there have been
+// no more than max signups under the key within the window.
+func (t *signupThrottle) allow(key string, max int, window time.Duration, now time.Time) bool {
+	if max <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hits == nil {
+		t.hits = make(map[string][]time.Time)
+	}
+	since := now.Add(-window)
+	if now.Sub(t.swept) > window {
+		for k, times := range t.hits {
+			if !times[len(times)-1].After(since) {
+				delete(t.hits, k)
+			}
+		}
+		t.swept = now
+	}
+	times := t.hits[key]
+	for len(times) > 0 && !times[0].After(since) {
+		times = times[1:]
+	}
+	if len(times) >= max {
+		t.hits[key] = times
+		return false
+	}
+	t.hits[key] = append(times, now)
+	return true
+}
+
+// clientIP returns the IP address of the client that made a request.
+// Behind a proxy, this is the proxy's address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html><head><title>Confirm subscription</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<p>Add {{.Addr}} to the list {{.List}}?</p>
+<p><button type="submit">Confirm</button></p>
+</form>
+</body></html>
+`))
+
+func (h *SignupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/signup") && r.Method == "POST":
+		h.signup(w, r)
+	case strings.HasSuffix(r.URL.Path, "/confirm") && (r.Method == "GET" || r.Method == "POST"):
+		h.confirm(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *SignupHandler) allowed(list string) bool {
+	for _, l := range h.AllowedLists {
+		if l == list {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *SignupHandler) signup(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	if !h.throttle.allow("ip:"+clientIP(r), h.MaxPerIP, h.ThrottleWindow, now) {
+		http.Error(w, "Too many signups; try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad form", http.StatusBadRequest)
+		return
+	}
+	claims := signupClaims{
+		List:    r.PostForm.Get("list"),
+		Addr:    strings.TrimSpace(r.PostForm.Get("addr")),
+		Name:    r.PostForm.Get("name"),
+		Context: make(map[string]interface{}),
+		Expires: now.Add(h.TokenLifetime).Unix()}
+	if !h.allowed(claims.List) {
+		http.Error(w, "No such list", http.StatusNotFound)
+		return
+	}
+	if !strings.Contains(claims.Addr, "@") {
+		http.Error(w, "Invalid address", http.StatusBadRequest)
+		return
+	}
+	if !h.throttle.allow("addr:"+normalizeAddr(claims.Addr), h.MaxPerAddr, h.ThrottleWindow, now) {
+		http.Error(w, "Too many signups; try again later", http.StatusTooManyRequests)
+		return
+	}
+	if h.Suppressions != nil {
+		if _, ok := h.Suppressions.Lookup(claims.Addr); ok {
+			// Answer as if the email was sent, so as not to tell
+			// who is suppressed.
+			log.Printf("Not sending signup confirmation for list %s to a suppressed address", claims.List)
+			fmt.Fprintf(w, "Check your email to confirm your subscription.\n")
+			return
+		}
+	}
+	for k, v := range r.PostForm {
+		if k != "list" && k != "addr" && k != "name" && len(v) > 0 {
+			claims.Context[k] = v[0]
+		}
+	}
+	token, err := signToken(h.Secret, claims)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	link := h.BaseURL + "/confirm?token=" + url.QueryEscape(token)
+	text := fmt.Sprintf("Please confirm that you want to join the list %s by visiting\n\n%s\n\nIf you did not ask to join, you can ignore this message.\n", claims.List, link)
+	params := &ses.SendEmailInput{
+		Source:      aws.String(h.FromAddr),
+		Destination: &ses.Destination{ToAddresses: []*string{aws.String(claims.Addr)}},
+		Message: &ses.Message{
+			Subject: &ses.Content{Data: aws.String(h.Subject), Charset: aws.String("UTF-8")},
+			Body:    &ses.Body{Text: &ses.Content{Data: aws.String(text), Charset: aws.String("UTF-8")}}}}
+	if _, err := h.svc.SendEmail(params); err != nil {
+		log.Printf("Failed to send signup confirmation for list %s: %s", claims.List, err)
+		http.Error(w, "Failed to send confirmation email", http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "Check your email to confirm your subscription.\n")
+}
+
+// confirm shows a page with a button on GET, and adds the address to
+// the list on POST.
+func (h *SignupHandler) confirm(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	var claims signupClaims
+	if err := verifyToken(h.Secret, token, &claims); err != nil {
+		http.Error(w, "Invalid confirmation link", http.StatusBadRequest)
+		return
+	}
+	if time.Now().Unix() > claims.Expires {
+		http.Error(w, "Confirmation link has expired", http.StatusGone)
+		return
+	}
+	if !h.allowed(claims.List) {
+		http.Error(w, "No such list", http.StatusNotFound)
+		return
+	}
+	if r.Method == "GET" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		confirmPage.Execute(w, struct{ Token, Addr, List string }{token, claims.Addr, claims.List})
+		return
+	}
+	member := Recipient{Name: claims.Name, Addr: claims.Addr, Context: claims.Context}
+	if err := h.Lists.AddMember(claims.List, member); err != nil {
+		log.Printf("Failed to add confirmed subscriber to list %s: %s", claims.List, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Your subscription is confirmed.\n")
+}
@@ -0,0 +1,157 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignup(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_signup_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	lists, err := OpenListStore(dir)
+	if err != nil {
+		t.Fatal("OpenListStore", err)
+	}
+	lists.CreateList("news")
+	svc := MockSES{}
+	h := &SignupHandler{
+		Lists:         lists,
+		Secret:        []byte("s3cret"),
+		BaseURL:       "https://example.com/lists",
+		AllowedLists:  []string{"news"},
+		FromAddr:      "news@example.com",
+		Subject:       "Confirm",
+		TokenLifetime: time.Hour,
+		svc:           &svc}
+
+	form := url.Values{"list": {"news"}, "addr": {"janedoe@example.com"}, "pet_name": {"Janie"}}
+	req := httptest.NewRequest("POST", "/lists/signup", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || svc.nsent != 1 {
+		t.Fatal("signup failed:", rec.Code, rec.Body.String())
+	}
+	members, _ := lists.Members("news")
+	if len(members) != 0 {
+		t.Fatal("address was added before confirmation")
+	}
+	link := regexp.MustCompile(`https://example.com/lists(/confirm\?token=\S+)`).FindStringSubmatch(*svc.sent.Message.Body.Text.Data)
+	if link == nil {
+		t.Fatal("no confirmation link in:", *svc.sent.Message.Body.Text.Data)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/lists"+link[1]+"x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("expected tampered token to be rejected, got", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/lists"+link[1], nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="post">`) {
+		t.Fatal("expected a confirmation page:", rec.Code, rec.Body.String())
+	}
+	if members, _ = lists.Members("news"); len(members) != 0 {
+		t.Fatal("address was added when the link was fetched")
+	}
+	u, _ := url.Parse(link[1])
+	req = httptest.NewRequest("POST", "/lists/confirm", strings.NewReader(url.Values{"token": {u.Query().Get("token")}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal("confirmation failed:", rec.Code, rec.Body.String())
+	}
+	members, _ = lists.Members("news")
+	if len(members) != 1 || members[0].Addr != "janedoe@example.com" || members[0].Context["pet_name"] != "Janie" {
+		t.Fatal("unexpected members:", members)
+	}
+
+	form.Set("list", "secret-list")
+	req = httptest.NewRequest("POST", "/lists/signup", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("expected signup to unlisted list to be rejected, got", rec.Code)
+	}
+}
+
+func TestSignupThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_signup_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	lists, err := OpenListStore(dir + "/lists")
+	if err != nil {
+		t.Fatal("OpenListStore", err)
+	}
+	lists.CreateList("news")
+	suppressions, err := OpenSuppressionList(dir + "/suppressions")
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	suppressions.Add("bounced@example.com", "bounce", time.Now())
+	svc := MockSES{}
+	h := &SignupHandler{
+		Lists:          lists,
+		Secret:         []byte("s3cret"),
+		BaseURL:        "https://example.com/lists",
+		AllowedLists:   []string{"news"},
+		FromAddr:       "news@example.com",
+		TokenLifetime:  time.Hour,
+		Suppressions:   suppressions,
+		MaxPerIP:       3,
+		MaxPerAddr:     2,
+		ThrottleWindow: time.Hour,
+		svc:            &svc}
+	signup := func(addr, ip string) int {
+		form := url.Values{"list": {"news"}, "addr": {addr}}
+		req := httptest.NewRequest("POST", "/lists/signup", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := signup("bounced@example.com", "192.0.2.1"); code != http.StatusOK || svc.nsent != 0 {
+		t.Fatal("expected a suppressed address not to be emailed:", code, svc.nsent)
+	}
+	for i, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		if code := signup("JaneDoe@example.com", ip); code != http.StatusOK || svc.nsent != i+1 {
+			t.Fatal("signup failed:", code)
+		}
+	}
+	if code := signup("janedoe@example.com", "192.0.2.4"); code != http.StatusTooManyRequests || svc.nsent != 2 {
+		t.Fatal("expected too many signups of an address to be refused:", code)
+	}
+	for _, addr := range []string{"a@example.com", "b@example.com"} {
+		if code := signup(addr, "192.0.2.3"); code != http.StatusOK {
+			t.Fatal("signup failed:", code)
+		}
+	}
+	if code := signup("c@example.com", "192.0.2.3"); code != http.StatusTooManyRequests {
+		t.Fatal("expected too many signups from an IP address to be refused:", code)
+	}
+
+	var throttle signupThrottle
+	now := time.Now()
+	if !throttle.allow("k", 1, time.Minute, now) || throttle.allow("k", 1, time.Minute, now.Add(time.Second)) {
+		t.Fatal("expected the second signup within the window to be refused")
+	}
+	if !throttle.allow("k", 1, time.Minute, now.Add(2*time.Minute)) {
+		t.Fatal("expected a signup after the window to be allowed")
+	}
+}
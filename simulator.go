@@ -0,0 +1,75 @@
+package mailrail
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// The SES mailbox simulator's addresses, by outcome.
+var simulatorAddrs = map[string]string{
+	"success":    "success@simulator.amazonses.com",
+	"bounce":     "bounce@simulator.amazonses.com",
+	"ooto":       "ooto@simulator.amazonses.com",
+	"complaint":  "complaint@simulator.amazonses.com",
+	"suppressed": "suppressionlist@simulator.amazonses.com"}
+
+// The order in which outcomes are assigned to recipients.
+var simulatorOutcomes = []string{"success", "bounce", "ooto", "complaint", "suppressed"}
+
+// A SimulatorMix is the share of messages to send to each SES
+// mailbox simulator address. The shares are relative weights, such as
+// percentages; they need not add up to any particular total.
+type SimulatorMix map[string]float64
+
+// ParseSimulatorMix parses a mix such as
+// "success=90,bounce=5,complaint=3,ooto=2". The outcomes are success,
+// bounce, ooto, complaint, and suppressed.
+func ParseSimulatorMix(s string) (SimulatorMix, error) {
+	mix := SimulatorMix{}
+	total := 0.0
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Expected OUTCOME=SHARE, not %q", pair)
+		}
+		if _, ok := simulatorAddrs[kv[0]]; !ok {
+			return nil, fmt.Errorf("Unknown simulator outcome %q", kv[0])
+		}
+		share, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || share < 0 {
+			return nil, fmt.Errorf("Invalid share %q for %s", kv[1], kv[0])
+		}
+		mix[kv[0]] = share
+		total += share
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("Simulator mix %q has no shares", s)
+	}
+	return mix, nil
+}
+
+// Returns a mangler that sends each message to a simulator address
+// chosen according to the mix, so that rehearsals produce bounces and
+// complaints as well as deliveries. The choice depends only on the
+// recipient's address, so a recipient gets the same outcome every
+// time.
+func SendToSimulatorMix(mix SimulatorMix) Mangler {
+	total := 0.0
+	for _, outcome := range simulatorOutcomes {
+		total += mix[outcome]
+	}
+	return Mangler{ShouldSend: true, Mangle: func(addr string) string {
+		h := fnv.New64a()
+		h.Write([]byte(normalizeAddr(addr)))
+		x := float64(h.Sum64()%1000000) / 1000000 * total
+		for _, outcome := range simulatorOutcomes {
+			if x < mix[outcome] {
+				return simulatorAddrs[outcome]
+			}
+			x -= mix[outcome]
+		}
+		return simulatorAddrs["success"]
+	}}
+}
@@ -0,0 +1,38 @@
+package mailrail
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSendToSimulatorMix(t *testing.T) {
+	mix, err := ParseSimulatorMix("success=80, bounce=15,complaint=5")
+	if err != nil {
+		t.Fatal("ParseSimulatorMix", err)
+	}
+	mangler := SendToSimulatorMix(mix)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[mangler.Mangle(fmt.Sprintf("user%d@example.com", i))]++
+	}
+	expected := map[string]int{
+		"success@simulator.amazonses.com":   8000,
+		"bounce@simulator.amazonses.com":    1500,
+		"complaint@simulator.amazonses.com": 500}
+	for addr, n := range expected {
+		if counts[addr] < n*8/10 || counts[addr] > n*12/10 {
+			t.Fatal("unexpected count for", addr, counts[addr])
+		}
+	}
+	if len(counts) != 3 {
+		t.Fatal("unexpected addresses:", counts)
+	}
+	if mangler.Mangle("user1@example.com") != mangler.Mangle("User1@example.com") {
+		t.Fatal("expected the same outcome for the same recipient")
+	}
+	for _, s := range []string{"success", "hard-bounce=5", "success=0", "bounce=-1"} {
+		if _, err := ParseSimulatorMix(s); err == nil {
+			t.Fatal("expected error for", s)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mailrail
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Specs can set an `sla`, a duration such as "4h" within which the
+// job must be sent after it was submitted. The time of submission is
+// recorded in the job's "submitted" artifact by `Submitter`; jobs
+// submitted by other means count as submitted when a worker first
+// takes them.
+const submittedKey = "submitted"
+
+// How often a job in progress checks whether it will make its SLA.
+const slaCheckInterval = 10 * time.Second
+
+type slaTracker struct {
+	deadline   time.Time
+	start      time.Time
+	startIndex int
+	lastCheck  time.Time
+	warned     bool
+}
+
+// trackSLA returns a tracker for the job's SLA, or nil if the spec has
+// none. The job is resuming at recipient i.
+func (mailing *mailing) trackSLA(job Job, i int) (*slaTracker, error) {
+	if mailing.sla == 0 {
+		return nil, nil
+	}
+	submitted, err := getSubmitted(job.Get)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if submitted.IsZero() {
+		submitted = now
+		if err := job.Set(submittedKey, []byte(now.Format(time.RFC3339Nano))); err != nil {
+			return nil, err
+		}
+	}
+	return &slaTracker{deadline: submitted.Add(mailing.sla), start: now, startIndex: i, lastCheck: now}, nil
+}
+
+func getSubmitted(get func(string) ([]byte, error)) (time.Time, error) {
+	submittedBytes, err := get(submittedKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, string(submittedBytes))
+}
+
+// predict estimates when a job that has gotten to recipient i of n
+// will finish, from its rate since it started or resumed.
+func (t *slaTracker) predict(now time.Time, i, n int) (time.Time, bool) {
+	elapsed := now.Sub(t.start)
+	if i <= t.startIndex || elapsed <= 0 {
+		return time.Time{}, false
+	}
+	rate := float64(i-t.startIndex) / elapsed.Seconds()
+	return now.Add(time.Duration(float64(n-i) / rate * float64(time.Second))), true
+}
+
+// check notifies SLAAtRisk, once per run, when the job is predicted to
+// finish after its deadline.
+func (t *slaTracker) check(job string, i, n int, o *options) {
+	now := time.Now()
+	if t.warned || now.Sub(t.lastCheck) < slaCheckInterval {
+		return
+	}
+	t.lastCheck = now
+	eta, ok := t.predict(now, i, n)
+	if !ok || !eta.After(t.deadline) {
+		return
+	}
+	t.warned = true
+	late := eta.Sub(t.deadline)
+	log.Printf("Job %s is predicted to miss its SLA by %s", job, late.Round(time.Second))
+	o.notify(Event{Type: SLAAtRisk, Job: job, Recipient: i, Recipients: n, Duration: late})
+}
+
+// finish notifies SLAMissed if the job finished after its deadline.
+func (t *slaTracker) finish(job string, n int, o *options) {
+	if late := time.Since(t.deadline); late > 0 {
+		log.Printf("Job %s missed its SLA by %s", job, late.Round(time.Second))
+		o.notify(Event{Type: SLAMissed, Job: job, Recipients: n, Duration: late})
+	}
+}
@@ -0,0 +1,78 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	events []Event
+}
+
+func (r *recordingObserver) Observe(e Event) {
+	r.events = append(r.events, e)
+}
+
+func TestSLAPredict(t *testing.T) {
+	start := time.Now()
+	tracker := slaTracker{deadline: start.Add(time.Minute), start: start, startIndex: 10}
+	if _, ok := tracker.predict(start.Add(time.Second), 10, 100); ok {
+		t.Fatal("expected no prediction without progress")
+	}
+	// 10 recipients in 10 seconds leaves 80 seconds for the rest.
+	eta, ok := tracker.predict(start.Add(10*time.Second), 20, 100)
+	if !ok || eta.Sub(start) != 90*time.Second {
+		t.Fatal("unexpected ETA:", eta.Sub(start))
+	}
+}
+
+func TestSLAMissed(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sla_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewSubmitter(dir)
+	basename, err := s.Submit([]byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"sla": "1ns",
+"recipients": [{"addr": "a@example.com"}]
+}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	status, err := GetJobStatus(dir, basename)
+	if err != nil || status.Deadline.IsZero() {
+		t.Fatal("expected the job to have a deadline:", status, err)
+	}
+	observer := recordingObserver{}
+	Process(dir, UseMockSesService(&MockSES{}), WithObserver(&observer))
+	last := observer.events[len(observer.events)-1]
+	if last.Type != SLAMissed || last.Job != basename || last.Duration <= 0 {
+		t.Fatal("expected the SLA to be missed, not", last)
+	}
+}
+
+func TestInvalidSLA(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sla_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "text": "Hello", "sla": "soon", "recipients": [{"addr": "a@example.com"}]}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions(nil))
+	if svc.nsent != 0 {
+		t.Fatal("expected the job to fail")
+	}
+}
@@ -0,0 +1,77 @@
+package mailrail
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SlackObserver posts a message to a Slack incoming webhook when each
+// job starts, finishes, fails, or is cancelled, with the number of
+// messages sent, failed, and skipped and how long the job took.
+// Messages are posted in order from a separate goroutine.
+type SlackObserver struct {
+	queue *webhookQueue
+	mu    sync.Mutex
+	jobs  map[string]*JobSummary
+}
+
+// The payload of a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// Returns an observer that posts to the Slack incoming webhook with
+// the given URL.
+func NewSlackObserver(webhookURL string) *SlackObserver {
+	return &SlackObserver{
+		queue: newWebhookQueue(NewWebhook(webhookURL, nil, "")),
+		jobs:  make(map[string]*JobSummary)}
+}
+
+func (s *SlackObserver) Observe(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary, ok := s.jobs[e.Job]
+	if !ok {
+		summary = &JobSummary{Job: e.Job}
+		s.jobs[e.Job] = summary
+	}
+	var text string
+	switch e.Type {
+	case JobStarted:
+		summary.Recipients = e.Recipients
+		text = fmt.Sprintf(":rocket: Job `%s` started sending to %d recipients", e.Job, e.Recipients)
+		if e.Recipient > 0 {
+			text += fmt.Sprintf(", resuming at recipient %d", e.Recipient)
+		}
+	case MessageSent:
+		summary.Sent++
+	case SendFailed:
+		summary.Failed++
+	case Skipped:
+		summary.Skipped++
+	case JobFinished:
+		text = ":white_check_mark: Job `%s` finished in %s: %s"
+	case JobFailed:
+		text = ":x: Job `%s` failed after %s: %s"
+	case JobCancelled:
+		text = ":no_entry_sign: Job `%s` was cancelled after %s: %s"
+	case JobPaused:
+		text = ":double_vertical_bar: Job `%s` was paused after %s: %s"
+	}
+	switch e.Type {
+	case JobFinished, JobFailed, JobCancelled, JobPaused:
+		delete(s.jobs, e.Job)
+		counts := fmt.Sprintf("%d sent, %d failed, %d skipped", summary.Sent, summary.Failed, summary.Skipped)
+		text = fmt.Sprintf(text, e.Job, e.Duration.Round(time.Second), counts)
+	}
+	if text != "" {
+		s.queue.add(slackMessage{text}, false)
+	}
+}
+
+// Close waits for pending messages to be posted.
+func (s *SlackObserver) Close() {
+	s.queue.close()
+}
@@ -0,0 +1,38 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlackObserver(t *testing.T) {
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var msg slackMessage
+		json.Unmarshal(body, &msg)
+		texts = append(texts, msg.Text)
+	}))
+	defer server.Close()
+	s := NewSlackObserver(server.URL)
+	s.Observe(Event{Type: JobStarted, Job: "foo", Recipients: 3})
+	s.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 0})
+	s.Observe(Event{Type: Skipped, Job: "foo", Recipient: 1})
+	s.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 2})
+	s.Observe(Event{Type: JobFinished, Job: "foo", Recipients: 3, Duration: 90 * time.Second})
+	s.Close()
+	if len(texts) != 2 {
+		t.Fatal("expected 2 messages, not", texts)
+	}
+	if !strings.Contains(texts[0], "`foo` started sending to 3 recipients") {
+		t.Fatal("unexpected start message:", texts[0])
+	}
+	if !strings.Contains(texts[1], "finished in 1m30s: 2 sent, 0 failed, 1 skipped") {
+		t.Fatal("unexpected finish message:", texts[1])
+	}
+}
@@ -0,0 +1,101 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"log"
+	"sync"
+)
+
+type snsService interface {
+	Publish(*sns.PublishInput) (*sns.PublishOutput, error)
+}
+
+// The message an SNSObserver publishes. Event is "job.finished",
+// "job.failed", or "job.cancelled".
+type JobSummary struct {
+	Event           string  `json:"event"`
+	Job             string  `json:"job"`
+	Recipients      int     `json:"recipients"`
+	Sent            int     `json:"sent"`
+	Failed          int     `json:"failed"`
+	Skipped         int     `json:"skipped"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// SNSObserver publishes a `JobSummary` to an SNS topic when each job
+// finishes, fails, or is cancelled. The message has an `event`
+// attribute, so subscriptions can filter on it.
+type SNSObserver struct {
+	topicArn string
+	svc      snsService
+	mu       sync.Mutex
+	jobs     map[string]*JobSummary
+}
+
+// Returns an observer that publishes to the topic with the given ARN.
+func NewSNSObserver(topicArn string) *SNSObserver {
+	return newSNSObserver(topicArn, sns.New(session.New(), getSesConfig()))
+}
+
+func newSNSObserver(topicArn string, svc snsService) *SNSObserver {
+	return &SNSObserver{
+		topicArn: topicArn,
+		svc:      svc,
+		jobs:     make(map[string]*JobSummary)}
+}
+
+func (o *SNSObserver) Observe(e Event) {
+	o.mu.Lock()
+	summary, ok := o.jobs[e.Job]
+	if !ok {
+		summary = &JobSummary{Job: e.Job}
+		o.jobs[e.Job] = summary
+	}
+	switch e.Type {
+	case JobStarted:
+		summary.Recipients = e.Recipients
+	case MessageSent:
+		summary.Sent++
+	case SendFailed:
+		summary.Failed++
+	case Skipped:
+		summary.Skipped++
+	case JobFinished:
+		summary.Event = "job.finished"
+	case JobFailed:
+		summary.Event = "job.failed"
+	case JobCancelled:
+		summary.Event = "job.cancelled"
+	case JobPaused:
+		// The job starts over when it is resumed.
+		delete(o.jobs, e.Job)
+	}
+	done := summary.Event != ""
+	if done {
+		summary.DurationSeconds = e.Duration.Seconds()
+		delete(o.jobs, e.Job)
+	}
+	o.mu.Unlock()
+	if done {
+		o.publish(summary)
+	}
+}
+
+func (o *SNSObserver) publish(summary *JobSummary) {
+	message, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Job %s failed to encode SNS message: %s", summary.Job, err)
+		return
+	}
+	params := &sns.PublishInput{
+		TopicArn: aws.String(o.topicArn),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"event": {DataType: aws.String("String"), StringValue: aws.String(summary.Event)}}}
+	if _, err := o.svc.Publish(params); err != nil {
+		log.Printf("Job %s failed to publish to SNS: %s", summary.Job, err)
+	}
+}
@@ -0,0 +1,44 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"testing"
+	"time"
+)
+
+type MockSNS struct {
+	inputs []*sns.PublishInput
+}
+
+func (svc *MockSNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	svc.inputs = append(svc.inputs, input)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestSNSObserver(t *testing.T) {
+	svc := MockSNS{}
+	o := newSNSObserver("arn:aws:sns:us-east-1:123456789012:mailrail", &svc)
+	o.Observe(Event{Type: JobStarted, Job: "foo", Recipients: 3})
+	o.Observe(Event{Type: MessageSent, Job: "foo", Recipient: 0})
+	o.Observe(Event{Type: Skipped, Job: "foo", Recipient: 1})
+	o.Observe(Event{Type: SendFailed, Job: "foo", Recipient: 2, Code: "MessageRejected"})
+	if len(svc.inputs) != 0 {
+		t.Fatal("published before the job ended")
+	}
+	o.Observe(Event{Type: JobFailed, Job: "foo", Duration: 2 * time.Second})
+	if len(svc.inputs) != 1 || *svc.inputs[0].MessageAttributes["event"].StringValue != "job.failed" {
+		t.Fatal("unexpected messages:", svc.inputs)
+	}
+	var summary JobSummary
+	if err := json.Unmarshal([]byte(*svc.inputs[0].Message), &summary); err != nil {
+		t.Fatal("cannot parse message", err)
+	}
+	expected := JobSummary{"job.failed", "foo", 3, 1, 1, 1, 2}
+	if summary != expected {
+		t.Fatal("unexpected summary:", summary)
+	}
+	if len(o.jobs) != 0 {
+		t.Fatal("summary of failed job was not forgotten")
+	}
+}
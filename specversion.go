@@ -0,0 +1,213 @@
+package mailrail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Specs say which version of the spec format they follow in
+// `version`. Specs of a version are parsed strictly: fields that the
+// version does not have, such as a misspelled "form_addr", are errors,
+// and so are a missing from_addr, subject, or text and html, unless
+// every recipient has its own from_addr or subject. Specs without a
+// version, from before there were versions, are parsed as they always
+// were: their fields are matched regardless of case, and unknown
+// fields are ignored. `UpgradeSpec` tells which, and rewrites them in
+// the current version.
+const CurrentSpecVersion = 1
+
+// UpgradeSpec returns a spec in the current version, with the names of
+// the fields of an unversioned spec that were ignored because the
+// current version does not have them. Specs that have a version are
+// returned as they are if they are valid.
+func UpgradeSpec(specBytes []byte) ([]byte, []string, error) {
+	specBytes, err := decodeArtifact(specBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := specVersion(specBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version > 0 {
+		if _, err := decodeSpec(specBytes, version); err != nil {
+			return nil, nil, err
+		}
+		return specBytes, nil, nil
+	}
+	upgraded, ignored, err := canonicalizeFields(specBytes, reflect.TypeOf(Spec{}), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(upgraded, &fields); err != nil {
+		return nil, nil, err
+	}
+	fields["version"] = json.RawMessage(fmt.Sprint(CurrentSpecVersion))
+	upgraded, err = json.Marshal(fields)
+	return upgraded, ignored, err
+}
+
+// specVersion returns the version of a decoded spec, or 0 if it has
+// none.
+func specVersion(specBytes []byte) (int, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(specBytes, &header); err != nil {
+		return 0, err
+	}
+	switch {
+	case header.Version > CurrentSpecVersion:
+		return 0, fmt.Errorf("Spec version %d is newer than this version of mailrail supports (%d)", header.Version, CurrentSpecVersion)
+	case header.Version < 0:
+		return 0, fmt.Errorf("Invalid spec version %d", header.Version)
+	}
+	return header.Version, nil
+}
+
+// decodeSpec decodes a spec of a version, strictly if it has one.
+// Unversioned specs need not be upgraded first, since JSON fields are
+// matched regardless of case and unknown ones ignored anyway, which
+// saves rewriting every recipient each time a job's spec is parsed.
+func decodeSpec(specBytes []byte, version int) (Spec, error) {
+	var spec Spec
+	decoder := json.NewDecoder(bytes.NewReader(specBytes))
+	decoder.UseNumber()
+	if version > 0 {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&spec); err != nil {
+		return Spec{}, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return Spec{}, fmt.Errorf("invalid character after top-level value")
+	}
+	convertNumbers(reflect.ValueOf(&spec))
+	if version > 0 {
+		if err := checkRequiredFields(spec); err != nil {
+			return Spec{}, err
+		}
+	}
+	// Copies of unversioned specs, such as resends, stay unversioned.
+	spec.Version = version
+	return spec, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// canonicalizeFields renames the fields of the JSON objects in data
+// that match fields of type t regardless of case to their names in t,
+// and leaves out the fields that t does not have, returning their
+// paths.
+func canonicalizeFields(data []byte, t reflect.Type, prefix string) ([]byte, []string, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return data, nil, nil
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return data, nil, nil
+		}
+		var ignored []string
+		for i := range elems {
+			elem, elemIgnored, err := canonicalizeFields(elems[i], t.Elem(), fmt.Sprintf("%s[%d]", prefix, i))
+			if err != nil {
+				return nil, nil, err
+			}
+			elems[i], ignored = elem, append(ignored, elemIgnored...)
+		}
+		canonical, err := json.Marshal(elems)
+		return canonical, ignored, err
+	case reflect.Struct:
+	default:
+		return data, nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		// Left for the spec's parser to report.
+		return data, nil, nil
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	canonical := make(map[string]json.RawMessage)
+	var ignored []string
+	for name, value := range fields {
+		field, ok := jsonField(t, name)
+		if !ok {
+			ignored = append(ignored, prefix+name)
+			continue
+		}
+		value, fieldIgnored, err := canonicalizeFields(value, field.Type, prefix+jsonName(field))
+		if err != nil {
+			return nil, nil, err
+		}
+		canonical[jsonName(field)] = value
+		ignored = append(ignored, fieldIgnored...)
+	}
+	sort.Strings(ignored)
+	data, err := json.Marshal(canonical)
+	return data, ignored, err
+}
+
+// jsonField returns the exported field of a struct that a JSON object
+// field decodes into.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+		if strings.EqualFold(jsonName(field), name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// checkRequiredFields checks that a versioned spec has what every
+// message needs.
+func checkRequiredFields(spec Spec) error {
+	var missing []string
+	everyRecipient := func(has func(Recipient) bool) bool {
+		if spec.recipientSource() != "" || len(spec.Recipients) == 0 {
+			return false
+		}
+		for _, recipient := range spec.Recipients {
+			if !has(recipient) {
+				return false
+			}
+		}
+		return true
+	}
+	if spec.FromAddr == "" && !everyRecipient(func(r Recipient) bool { return r.FromAddr != "" }) {
+		missing = append(missing, "from_addr")
+	}
+	if spec.Subject == "" && !everyRecipient(func(r Recipient) bool { return r.Subject != "" }) {
+		missing = append(missing, "subject")
+	}
+	if spec.Text == "" && spec.Html == "" && spec.TextTemplate == "" && spec.HtmlTemplate == "" {
+		missing = append(missing, "text or html")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Spec version %d has no %s", spec.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
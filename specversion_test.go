@@ -0,0 +1,54 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeSpec(t *testing.T) {
+	upgraded, ignored, err := UpgradeSpec([]byte(`{"From_Addr": "johndoe@example.com", "form_name": "John",
+"subject": "Hello", "text": "Hello", "not_before": "2026-01-01T00:00:00Z",
+"recipients": [{"ADDR": "a@example.com", "contxt": {"name": "A"}, "context": {"Name": "A"}}]}`))
+	if err != nil {
+		t.Fatal("UpgradeSpec", err)
+	}
+	if strings.Join(ignored, ",") != "Recipients[0].contxt,form_name" {
+		t.Fatal("unexpected ignored fields:", ignored)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(upgraded, &fields)
+	if string(fields["version"]) != "1" || string(fields["from_addr"]) != `"johndoe@example.com"` {
+		t.Fatal("unexpected upgraded spec:", string(upgraded))
+	}
+	spec, err := parseSpec(upgraded)
+	if err != nil {
+		t.Fatal("expected the upgraded spec to parse strictly:", err)
+	}
+	if spec.Version != 1 || spec.Recipients[0].Addr != "a@example.com" || spec.Recipients[0].Context["Name"] != "A" || spec.NotBefore == nil {
+		t.Fatal("unexpected spec:", spec)
+	}
+}
+
+func TestStrictSpec(t *testing.T) {
+	spec, err := parseSpec([]byte(`{"form_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", "list": "x"}`))
+	if err != nil || spec.Version != 0 || spec.FromAddr != "" {
+		t.Fatal("expected an unversioned spec to be parsed leniently:", spec, err)
+	}
+	if _, err := parseSpec([]byte(`{"version": 1, "form_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello", "list": "x"}`)); err == nil || !strings.Contains(err.Error(), "form_addr") {
+		t.Fatal("expected an unknown field to be refused:", err)
+	}
+	if _, err := parseSpec([]byte(`{"version": 1, "subject": "Hello", "text": "Hello", "list": "x"}`)); err == nil || !strings.Contains(err.Error(), "from_addr") {
+		t.Fatal("expected a missing from_addr to be refused:", err)
+	}
+	if _, err := parseSpec([]byte(`{"version": 1, "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com", "from_addr": "johndoe@example.com"}]}`)); err != nil {
+		t.Fatal("expected recipients to be able to have their own from_addr:", err)
+	}
+	if _, err := parseSpec([]byte(`{"version": 2}`)); err == nil {
+		t.Fatal("expected a newer version to be refused")
+	}
+	if _, err := NewSubmitter("/nonexistent").Submit([]byte(`{"version": 1, "form_addr": "johndoe@example.com"}`)); err == nil || !strings.Contains(err.Error(), "form_addr") {
+		t.Fatal("expected the submitter to refuse an invalid spec:", err)
+	}
+}
@@ -0,0 +1,208 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// An SQSQueue is a job queue for workers that do not share a
+// filesystem. A job's spec and the artifacts that the worker records
+// are kept in a store, such as an `S3Archive`, under JOB/KEY, and the
+// SQS message only names the job. A worker keeps the message invisible
+// to other workers while it processes the job, and deletes it when the job is
+// done or failed; the "state" artifact then says which. Scheduled jobs
+// are sent to the queue again with a delay. Pausing, resuming, and
+// the commands that read queue directories work only with queue
+// directories.
+type SQSQueue struct {
+	QueueURL string
+	Store    ArchiveStore
+	// How long a taken job stays invisible to other workers unless
+	// the worker renews it, which it does every third of this.
+	VisibilityTimeout time.Duration
+	svc               sqsQueueService
+}
+
+type sqsQueueService interface {
+	ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(*sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+	SendMessage(*sqs.SendMessageInput) (*sqs.SendMessageOutput, error)
+	ChangeMessageVisibility(*sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// SQS delays messages by at most 15 minutes, so jobs scheduled further
+// ahead are taken and scheduled again until they are due.
+const sqsMaxDelay = 15 * time.Minute
+
+type sqsPointer struct {
+	Job string `json:"job"`
+}
+
+// Returns a job queue in SQS with jobs kept in a store.
+func NewSQSQueue(queueURL string, store ArchiveStore) *SQSQueue {
+	return &SQSQueue{
+		QueueURL:          queueURL,
+		Store:             store,
+		VisibilityTimeout: 5 * time.Minute,
+		svc:               sqs.New(session.New(), getSesConfig())}
+}
+
+// Submit stores a spec and queues it, and returns the name of the new
+// job.
+func (q *SQSQueue) Submit(specBytes []byte) (string, error) {
+	if _, err := parseSpec(specBytes); err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	name := fmt.Sprintf("%d-%d-standalone", time.Now().UnixNano(), os.Getpid())
+	if err := q.Store.Put(name+"/spec", specBytes); err != nil {
+		return "", err
+	}
+	if err := q.Store.Put(name+"/"+submittedKey, []byte(time.Now().Format(time.RFC3339Nano))); err != nil {
+		return "", err
+	}
+	if err := q.send(name, 0); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (q *SQSQueue) send(name string, delay time.Duration) error {
+	body, err := json.Marshal(sqsPointer{name})
+	if err != nil {
+		return err
+	}
+	_, err = q.svc.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:     aws.String(q.QueueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: aws.Int64(int64(delay / time.Second))})
+	return err
+}
+
+// Rescue does nothing, as SQS makes the jobs of dead workers visible
+// again by itself.
+func (q *SQSQueue) Rescue() error {
+	return nil
+}
+
+func (q *SQSQueue) Take() (Job, error) {
+	resp, err := q.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.QueueURL),
+		MaxNumberOfMessages: aws.Int64(1),
+		VisibilityTimeout:   aws.Int64(int64(q.VisibilityTimeout / time.Second))})
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range resp.Messages {
+		var pointer sqsPointer
+		if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &pointer); err != nil || pointer.Job == "" {
+			// Leave it to be received again, or dead-lettered.
+			log.Printf("Failed to parse job message %s: %v", aws.StringValue(message.MessageId), err)
+			continue
+		}
+		return &sqsJob{queue: q, name: pointer.Job, receiptHandle: message.ReceiptHandle, extended: time.Now()}, nil
+	}
+	return nil, nil
+}
+
+type sqsJob struct {
+	queue         *SQSQueue
+	name          string
+	receiptHandle *string
+	// When the message was last made invisible for VisibilityTimeout.
+	extended time.Time
+	lost     int32
+}
+
+func (job *sqsJob) Name() string {
+	return job.name
+}
+
+func (job *sqsJob) Get(key string) ([]byte, error) {
+	return job.queue.Store.Get(job.name + "/" + key)
+}
+
+func (job *sqsJob) Set(key string, value []byte) error {
+	return job.queue.Store.Put(job.name+"/"+key, value)
+}
+
+// The message of the job is its lease: the worker keeps it invisible
+// to other workers while it processes the job, whether or not it is
+// sending, and stops if it became visible, as another worker may have
+// received it since.
+func (job *sqsJob) leaseDuration() time.Duration {
+	return job.queue.VisibilityTimeout
+}
+
+func (job *sqsJob) renewLease() (time.Duration, error) {
+	_, err := job.queue.svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(job.queue.QueueURL),
+		ReceiptHandle:     job.receiptHandle,
+		VisibilityTimeout: aws.Int64(int64(job.queue.VisibilityTimeout / time.Second))})
+	if err == nil {
+		job.extended = time.Now()
+		return job.queue.VisibilityTimeout, nil
+	}
+	remaining := job.queue.VisibilityTimeout - time.Since(job.extended)
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == sqs.ErrCodeMessageNotInflight || aerr.Code() == sqs.ErrCodeReceiptHandleIsInvalid) || remaining <= 0 {
+		atomic.StoreInt32(&job.lost, 1)
+		return 0, fmt.Errorf("Job %s is visible again in %s: %s", job.name, job.queue.QueueURL, err)
+	}
+	// Try again before the message becomes visible.
+	log.Printf("Job %s failed to stay invisible in %s: %s", job.name, job.queue.QueueURL, err)
+	return remaining, nil
+}
+
+func (job *sqsJob) leaseLost() bool {
+	return atomic.LoadInt32(&job.lost) != 0
+}
+
+func (job *sqsJob) delete() error {
+	_, err := job.queue.svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(job.queue.QueueURL),
+		ReceiptHandle: job.receiptHandle})
+	return err
+}
+
+func (job *sqsJob) Submit() error {
+	if err := job.queue.send(job.name, 0); err != nil {
+		return err
+	}
+	return job.delete()
+}
+
+func (job *sqsJob) Fail() error {
+	if err := job.queue.Store.Put(job.name+"/state", []byte("failed")); err != nil {
+		return err
+	}
+	return job.delete()
+}
+
+func (job *sqsJob) Finish() error {
+	if err := job.queue.Store.Put(job.name+"/state", []byte("done")); err != nil {
+		return err
+	}
+	return job.delete()
+}
+
+// Schedule sends the job to the queue again to be taken at wakeAt.
+func (job *sqsJob) Schedule(wakeAt time.Time) error {
+	delay := time.Until(wakeAt)
+	if delay > sqsMaxDelay {
+		delay = sqsMaxDelay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if err := job.queue.send(job.name, delay); err != nil {
+		return err
+	}
+	return job.delete()
+}
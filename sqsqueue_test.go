@@ -0,0 +1,138 @@
+package mailrail
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// MockSQSQueue is an SQS queue whose messages become visible as soon
+// as they are received, unless they were delayed.
+type MockSQSQueue struct {
+	messages map[string]string
+	delayed  map[string]int64
+	next     int
+	// Returned by ChangeMessageVisibility, if set.
+	visibilityErr error
+	nextended     int
+}
+
+func (svc *MockSQSQueue) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	svc.next++
+	handle := fmt.Sprint(svc.next)
+	svc.messages[handle] = *input.MessageBody
+	if *input.DelaySeconds > 0 {
+		svc.delayed[handle] = *input.DelaySeconds
+	}
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (svc *MockSQSQueue) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	for handle, body := range svc.messages {
+		if svc.delayed[handle] > 0 {
+			continue
+		}
+		return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{
+			Body: aws.String(body), ReceiptHandle: aws.String(handle)}}}, nil
+	}
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func (svc *MockSQSQueue) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	delete(svc.messages, *input.ReceiptHandle)
+	delete(svc.delayed, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (svc *MockSQSQueue) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if svc.visibilityErr != nil {
+		return nil, svc.visibilityErr
+	}
+	svc.nextended++
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func TestSQSQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_sqsqueue_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	svc := &MockSQSQueue{messages: make(map[string]string), delayed: make(map[string]int64)}
+	q := &SQSQueue{QueueURL: "queue-url", Store: FileArchive(dir), VisibilityTimeout: time.Minute, svc: svc}
+	if _, err := q.Submit([]byte("not json")); err == nil {
+		t.Fatal("expected an unparseable spec to be refused")
+	}
+	name, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	later, err := q.Submit([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"not_before": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `", "recipients": [{"addr": "c@example.com"}]}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	ses := MockSES{}
+	ProcessJobStore(q, UseMockSesService(&ses))
+	if ses.nsent != 2 {
+		t.Fatal("expected the job that is due to be sent:", ses.nsent)
+	}
+	if state, err := q.Store.Get(name + "/state"); err != nil || string(state) != "done" {
+		t.Fatal("expected the job to be done:", string(state), err)
+	}
+	if i, err := getCheckpoint(&sqsJob{queue: q, name: name}); err != nil || i != 2 {
+		t.Fatal("expected the checkpoint in the store:", i, err)
+	}
+	if len(svc.messages) != 1 {
+		t.Fatal("expected only the scheduled job to be left in the queue:", svc.messages)
+	}
+	for handle, body := range svc.messages {
+		if svc.delayed[handle] != int64(sqsMaxDelay/time.Second) || body != `{"job":"`+later+`"}` {
+			t.Fatal("expected the scheduled job to be delayed:", body, svc.delayed[handle])
+		}
+	}
+}
+
+func TestSQSJobLease(t *testing.T) {
+	svc := &MockSQSQueue{messages: make(map[string]string), delayed: make(map[string]int64)}
+	q := &SQSQueue{QueueURL: "queue-url", VisibilityTimeout: time.Minute, svc: svc}
+	job := &sqsJob{queue: q, name: "foo", receiptHandle: aws.String("1"), extended: time.Now()}
+	if d, err := job.renewLease(); err != nil || d != time.Minute || svc.nextended != 1 {
+		t.Fatal("expected the message to stay invisible:", d, err)
+	}
+	svc.visibilityErr = awserr.New("ServiceUnavailable", "try again", nil)
+	if d, err := job.renewLease(); err != nil || d <= 0 || d > time.Minute || job.leaseLost() {
+		t.Fatal("expected a transient error to be retried before the message is visible:", d, err)
+	}
+	job.extended = time.Now().Add(-2 * time.Minute)
+	if _, err := job.renewLease(); err == nil || !job.leaseLost() {
+		t.Fatal("expected the lease to be lost once the message may be visible")
+	}
+	job = &sqsJob{queue: q, name: "foo", receiptHandle: aws.String("1"), extended: time.Now()}
+	svc.visibilityErr = awserr.New(sqs.ErrCodeMessageNotInflight, "not in flight", nil)
+	if _, err := job.renewLease(); err == nil || !job.leaseLost() {
+		t.Fatal("expected the lease to be lost when the message is not in flight")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take() (Job, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func (failingStore) Rescue() error {
+	return nil
+}
+
+func TestTakeWeightedError(t *testing.T) {
+	if job, state := takeWeighted([]*queueState{{queue: failingStore{}, weight: 1}}); job != nil || state != nil {
+		t.Fatal("expected a store that fails to be taken to be empty")
+	}
+}
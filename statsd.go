@@ -0,0 +1,70 @@
+package mailrail
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// StatsDObserver sends metrics to a StatsD server over UDP:
+// PREFIX.sent, PREFIX.errors, PREFIX.backoffs, PREFIX.jobs.finished,
+// PREFIX.jobs.failed, the timer PREFIX.jobs.duration, and, for jobs
+// with an SLA, PREFIX.sla.at_risk, PREFIX.sla.missed, and the timer
+// PREFIX.sla.lateness. With
+// DogStatsD, metrics are tagged with the job name and, for errors and
+// backoffs, the SES error code.
+type StatsDObserver struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+}
+
+// Returns an observer that sends metrics to the StatsD server at
+// addr (HOST:PORT).
+func NewStatsDObserver(addr, prefix string, dogStatsD bool) (*StatsDObserver, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDObserver{conn: conn, prefix: prefix, dogStatsD: dogStatsD}, nil
+}
+
+func (s *StatsDObserver) Observe(e Event) {
+	tags := []string{"job:" + e.Job}
+	switch e.Type {
+	case MessageSent:
+		s.send("sent", "1|c", tags)
+	case Throttled:
+		s.send("backoffs", "1|c", append(tags, "code:"+e.Code))
+	case SendFailed:
+		code := e.Code
+		if code == "" {
+			code = "none"
+		}
+		s.send("errors", "1|c", append(tags, "code:"+code))
+	case JobFinished:
+		s.send("jobs.finished", "1|c", tags)
+		s.send("jobs.duration", fmt.Sprintf("%d|ms", e.Duration.Nanoseconds()/1e6), tags)
+	case JobFailed:
+		s.send("jobs.failed", "1|c", tags)
+		s.send("jobs.duration", fmt.Sprintf("%d|ms", e.Duration.Nanoseconds()/1e6), tags)
+	case SLAAtRisk:
+		s.send("sla.at_risk", "1|c", tags)
+	case SLAMissed:
+		s.send("sla.missed", "1|c", tags)
+		s.send("sla.lateness", fmt.Sprintf("%d|ms", e.Duration.Nanoseconds()/1e6), tags)
+	case CheckpointFailing:
+		s.send("checkpoint.failing", "1|c", tags)
+	}
+}
+
+func (s *StatsDObserver) send(name, value string, tags []string) {
+	line := s.prefix + "." + name + ":" + value
+	if s.dogStatsD {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		log.Printf("Failed to send metric %s to StatsD: %s", name, err)
+	}
+}
@@ -0,0 +1,27 @@
+package mailrail
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStatsDObserver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("ListenPacket", err)
+	}
+	defer conn.Close()
+	s, err := NewStatsDObserver(conn.LocalAddr().String(), "mailrail", true)
+	if err != nil {
+		t.Fatal("NewStatsDObserver", err)
+	}
+	s.Observe(Event{Type: SendFailed, Job: "foo", Recipient: 3, Code: "MessageRejected"})
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("ReadFrom", err)
+	}
+	if string(buf[:n]) != "mailrail.errors:1|c|#job:foo,code:MessageRejected" {
+		t.Fatal("unexpected metric:", string(buf[:n]))
+	}
+}
@@ -0,0 +1,133 @@
+package mailrail
+
+import "time"
+
+// Names of the states of jobs, as shown by `mailrail-status`.
+var stateNames = map[string]string{
+	"queue":  "queued",
+	"cur":    "in-progress",
+	"done":   "done",
+	"failed": "failed"}
+
+// The status of a job. Rate (messages per second) is estimated from
+// the most recent results, and ETA from the rate; both are zero
+// unless the job is in progress and has sent at least two messages.
+// Deadline is zero unless the spec has an SLA and the job has been
+// submitted or taken.
+type JobStatus struct {
+	Job        string
+	State      string
+	Recipients int
+	Sent       int
+	Rate       float64
+	ETA        time.Time
+	Deadline   time.Time
+}
+
+// AtRisk tells whether the job is predicted to miss its SLA.
+func (s JobStatus) AtRisk() bool {
+	return !s.Deadline.IsZero() && !s.ETA.IsZero() && s.ETA.After(s.Deadline)
+}
+
+// The number of recent results used to estimate the rate of a job.
+const rateWindow = 100
+
+// GetJobStatus returns the status of the job with the given basename.
+func GetJobStatus(queueDir, basename string) (JobStatus, error) {
+	dir, err := findJob(queueDir, basename)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	return getJobStatus(dir, basename, stateOfJobDir(dir))
+}
+
+// QueueStatus returns the status of every job in a queue, grouped by
+// state.
+func QueueStatus(queueDir string) ([]JobStatus, error) {
+	var statuses []JobStatus
+	for _, state := range jobStates {
+		basenames, err := listJobs(queueDir, state)
+		if err != nil {
+			return nil, err
+		}
+		for _, basename := range basenames {
+			dir, err := findJob(queueDir, basename)
+			if err != nil {
+				continue
+			}
+			status, err := getJobStatus(dir, basename, stateOfJobDir(dir))
+			if err != nil {
+				return nil, err
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+func stateOfJobDir(dir string) string {
+	if pathHasState(dir, "failed") && isCancelled(dir) {
+		return "cancelled"
+	}
+	if pathHasState(dir, "failed") && isPaused(dir) {
+		return "paused"
+	}
+	if pathHasState(dir, "failed") && isScheduled(dir) {
+		return "scheduled"
+	}
+	for _, state := range jobStates {
+		if pathHasState(dir, state) {
+			return stateNames[state]
+		}
+	}
+	return ""
+}
+
+func getJobStatus(dir, basename, state string) (JobStatus, error) {
+	spec, err := readJobSpec(dir)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	get := func(key string) ([]byte, error) { return readJobFile(dir, key) }
+	sent, err := getCheckpointFrom(get)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	deferred, err := getDeferredFrom(get)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	status := JobStatus{Job: basename, State: state, Recipients: len(spec.Recipients), Sent: sent - len(deferred)}
+	if sla, err := time.ParseDuration(spec.SLA); err == nil {
+		if submitted, err := getSubmitted(get); err == nil && !submitted.IsZero() {
+			status.Deadline = submitted.Add(sla)
+		}
+	}
+	if state != stateNames["cur"] || sent == 0 {
+		return status, nil
+	}
+	chunk := (sent - 1) / resultsPerChunk
+	recent, err := getResultsChunk(get, chunk)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	if len(recent) < rateWindow && chunk > 0 {
+		previous, err := getResultsChunk(get, chunk-1)
+		if err != nil {
+			return JobStatus{}, err
+		}
+		recent = append(previous, recent...)
+	}
+	if len(recent) > rateWindow {
+		recent = recent[len(recent)-rateWindow:]
+	}
+	if len(recent) >= 2 {
+		elapsed := recent[len(recent)-1].Time.Sub(recent[0].Time)
+		if elapsed > 0 {
+			status.Rate = float64(len(recent)-1) / elapsed.Seconds()
+			remaining := status.Recipients - sent
+			status.ETA = time.Now().Add(time.Duration(float64(remaining) / status.Rate * float64(time.Second)))
+		}
+	}
+	return status, nil
+}
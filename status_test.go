@@ -0,0 +1,55 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJobStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_status_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}, {"addr": "c@example.com"}, {"addr": "d@example.com"}]
+}`))
+	j.Submit()
+	statuses, err := QueueStatus(dir)
+	if err != nil {
+		t.Fatal("QueueStatus", err)
+	}
+	if len(statuses) != 1 || statuses[0].State != "queued" || statuses[0].Recipients != 4 {
+		t.Fatal("unexpected statuses:", statuses)
+	}
+	j, err = q.Take()
+	if err != nil || j == nil {
+		t.Fatal("failed to take job:", err)
+	}
+	w := newResultsWriter(dirJob{Job: j}, "")
+	start := time.Now().Add(-time.Minute)
+	w.record(Result{Recipient: 0, Status: StatusSent, Time: start})
+	w.record(Result{Recipient: 1, Status: StatusSent, Time: start.Add(2 * time.Second)})
+	setCheckpoint(dirJob{Job: j}, 2)
+	status, err := GetJobStatus(dir, j.Basename)
+	if err != nil {
+		t.Fatal("GetJobStatus", err)
+	}
+	if status.State != "in-progress" || status.Sent != 2 || status.Rate != 0.5 {
+		t.Fatal("unexpected status:", status)
+	}
+	if eta := status.ETA.Sub(time.Now()); eta < 3*time.Second || eta > 4*time.Second {
+		t.Fatal("unexpected ETA:", eta)
+	}
+}
@@ -0,0 +1,38 @@
+package mailrail
+
+import "fmt"
+
+// Messages belong to a stream, which tells whether they are bulk
+// mail that recipients can opt out of or transactional mail that
+// they asked for. The stream of a recipient's message is the
+// recipient's `stream` field, or else the spec's. Specs that set
+// neither are marketing mail.
+const (
+	MarketingStream     = "marketing"
+	TransactionalStream = "transactional"
+)
+
+func computeStream(mailing mailing, i int) (string, error) {
+	recipient := *mailing.recipient(i)
+	stream := recipient.Stream
+	if stream == "" {
+		stream = mailing.spec.Stream
+	}
+	switch stream {
+	case "":
+		return MarketingStream, nil
+	case MarketingStream, TransactionalStream:
+		return stream, nil
+	default:
+		return "", fmt.Errorf("Unknown stream %q for recipient %d", stream, i)
+	}
+}
+
+// Send messages in each stream with an SES configuration set, for
+// instance to use separate IP pools or event destinations for
+// marketing and transactional mail. The map is keyed by stream.
+func WithConfigurationSets(configurationSets map[string]string) Option {
+	return func(o *options) {
+		o.configurationSets = configurationSets
+	}
+}
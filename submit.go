@@ -0,0 +1,215 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/ljosa/go-pqueue/pqueue"
+	"time"
+)
+
+// A Submitter submits specs to a queue. It can refuse specs when the
+// queue's backlog is long or the SES sending quota is nearly used
+// up, so that producers do not submit more than the worker can send.
+type Submitter struct {
+	QueueDir string
+	// The maximum number of recipients in queued and in-progress
+	// jobs, including the new spec's. Zero means no limit.
+	MaxBacklog int
+	// If set, the 24-hour SES sending quota must have room for the
+	// backlog, the new spec, and MinQuotaHeadroom more messages.
+	CheckQuota       bool
+	MinQuotaHeadroom int
+	// How long Submit waits for room before giving up. If zero,
+	// Submit returns a *RetryAfterError right away.
+	Wait time.Duration
+	// How often Submit checks for room while waiting.
+	PollInterval time.Duration
+	svc          sesService
+}
+
+// A RetryAfterError is returned when a Submitter refuses a spec. It
+// says when the producer should try again.
+type RetryAfterError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s; retry after %s", e.Reason, e.RetryAfter)
+}
+
+// The backlog is assumed to drain at this rate unless a job in
+// progress says otherwise.
+const defaultDrainRate = 1.0
+
+// SES counts its quota over the last 24 hours, so there is no telling
+// exactly when room frees up.
+const quotaRetryAfter = time.Hour
+
+// Returns a submitter with no limits.
+func NewSubmitter(queueDir string) *Submitter {
+	return &Submitter{QueueDir: queueDir, PollInterval: 10 * time.Second}
+}
+
+// Submit submits a spec and returns the basename of the new job.
+// Specs whose recipients come from a list or a segment count as
+// having no recipients, as they are not known until the worker takes
+// the job.
+func (s *Submitter) Submit(specBytes []byte) (string, error) {
+	spec, err := parseSpec(specBytes)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	return s.submit(specBytes, len(spec.Recipients), nil)
+}
+
+// SubmitNDJSON submits a spec with recipients in NDJSON, one JSON
+// recipient per line, and returns the basename of the new job. The
+// recipients are stored in the job's "recipients.ndjson" artifact
+// rather than in the spec. The spec and the recipients stay gzipped or
+// encrypted if they are.
+func (s *Submitter) SubmitNDJSON(specBytes, recipients []byte) (string, error) {
+	original := specBytes
+	specBytes, err := decrypt(specBytes)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	gzipped := isGzipped(specBytes)
+	if specBytes, err = gunzip(specBytes); err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(specBytes, &fields); err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	fields["recipients_ndjson"] = json.RawMessage("true")
+	if specBytes, err = json.Marshal(fields); err != nil {
+		return "", err
+	}
+	if _, err := parseSpec(specBytes); err != nil {
+		return "", fmt.Errorf("Cannot parse spec: %s", err)
+	}
+	if gzipped {
+		if specBytes, err = Gzip(specBytes); err != nil {
+			return "", err
+		}
+	}
+	if specBytes, err = encryptLike(original, specBytes); err != nil {
+		return "", err
+	}
+	data, err := decodeArtifact(recipients)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read recipients: %s", err)
+	}
+	r, err := newNDJSONRecipients(data)
+	if err != nil {
+		return "", err
+	}
+	return s.submit(specBytes, r.len(), map[string][]byte{recipientsNDJSONKey: recipients})
+}
+
+// submit waits for room for n recipients and then submits a spec with
+// more artifacts.
+func (s *Submitter) submit(specBytes []byte, n int, artifacts map[string][]byte) (string, error) {
+	q, err := pqueue.OpenQueue(s.QueueDir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open queue %s: %s", s.QueueDir, err)
+	}
+	deadline := time.Now().Add(s.Wait)
+	for {
+		err := s.checkRoom(n)
+		if err == nil {
+			break
+		}
+		retryErr, ok := err.(*RetryAfterError)
+		if !ok || !time.Now().Before(deadline) {
+			return "", err
+		}
+		sleep := s.PollInterval
+		if retryErr.RetryAfter < sleep {
+			sleep = retryErr.RetryAfter
+		}
+		if remaining := deadline.Sub(time.Now()); remaining < sleep {
+			sleep = remaining
+		}
+		time.Sleep(sleep)
+	}
+	job, err := q.CreateJob("standalone")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create job: %s", err)
+	}
+	for key, value := range artifacts {
+		if err := job.Set(key, value); err != nil {
+			return "", err
+		}
+	}
+	if err := job.Set("spec", specBytes); err != nil {
+		return "", err
+	}
+	if err := job.Set(submittedKey, []byte(time.Now().Format(time.RFC3339Nano))); err != nil {
+		return "", err
+	}
+	if err := job.Submit(); err != nil {
+		return "", err
+	}
+	return job.Basename, nil
+}
+
+func (s *Submitter) checkRoom(n int) error {
+	if s.MaxBacklog == 0 && !s.CheckQuota {
+		return nil
+	}
+	backlog, rate, err := s.backlog()
+	if err != nil {
+		return err
+	}
+	if s.MaxBacklog > 0 && backlog+n > s.MaxBacklog {
+		excess := backlog + n - s.MaxBacklog
+		return &RetryAfterError{
+			Reason:     fmt.Sprintf("Backlog of %d recipients plus %d new exceeds %d", backlog, n, s.MaxBacklog),
+			RetryAfter: time.Duration(float64(excess) / rate * float64(time.Second))}
+	}
+	if s.CheckQuota {
+		if s.svc == nil {
+			s.svc = ses.New(session.New(), getSesConfig())
+		}
+		quota, err := s.svc.GetSendQuota(&ses.GetSendQuotaInput{})
+		if err != nil {
+			return fmt.Errorf("Failed to get send quota from SES: %s", err)
+		}
+		// SES reports a negative maximum for unlimited quotas.
+		if quota.Max24HourSend != nil && *quota.Max24HourSend >= 0 {
+			headroom := *quota.Max24HourSend - *quota.SentLast24Hours - float64(backlog+n)
+			if headroom < float64(s.MinQuotaHeadroom) {
+				return &RetryAfterError{
+					Reason:     fmt.Sprintf("SES quota has room for %.0f more messages after the backlog and %d new", headroom+float64(n), n),
+					RetryAfter: quotaRetryAfter}
+			}
+		}
+	}
+	return nil
+}
+
+// backlog returns the number of recipients in queued and in-progress
+// jobs that have not been sent yet, and the rate at which they are
+// being sent.
+func (s *Submitter) backlog() (int, float64, error) {
+	statuses, err := QueueStatus(s.QueueDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	backlog := 0
+	rate := 0.0
+	for _, status := range statuses {
+		if status.State == stateNames["queue"] || status.State == stateNames["cur"] {
+			backlog += status.Recipients - status.Sent
+			rate += status.Rate
+		}
+	}
+	if rate == 0 {
+		rate = defaultDrainRate
+	}
+	return backlog, rate, nil
+}
@@ -0,0 +1,73 @@
+package mailrail
+
+import (
+	"github.com/aws/aws-sdk-go/service/ses"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// A mock SES service with a 24-hour quota.
+type QuotaSES struct {
+	MockSES
+	max, sent float64
+}
+
+func (svc *QuotaSES) GetSendQuota(input *ses.GetSendQuotaInput) (*ses.GetSendQuotaOutput, error) {
+	maxSendRate := 3.0
+	return &ses.GetSendQuotaOutput{MaxSendRate: &maxSendRate, Max24HourSend: &svc.max, SentLast24Hours: &svc.sent}, nil
+}
+
+const submitTestSpec = `{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]
+}`
+
+func TestSubmitBacklog(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_submit_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewSubmitter(dir)
+	s.MaxBacklog = 3
+	if _, err := s.Submit([]byte(submitTestSpec)); err != nil {
+		t.Fatal("Submit", err)
+	}
+	_, err = s.Submit([]byte(submitTestSpec))
+	retryErr, ok := err.(*RetryAfterError)
+	if !ok {
+		t.Fatal("expected RetryAfterError, not", err)
+	}
+	if retryErr.RetryAfter != time.Second {
+		t.Fatal("unexpected retry after:", retryErr.RetryAfter)
+	}
+	Process(dir, UseMockSesService(&MockSES{}))
+	if _, err := s.Submit([]byte(submitTestSpec)); err != nil {
+		t.Fatal("expected room after processing the backlog, not", err)
+	}
+}
+
+func TestSubmitQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_submit_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewSubmitter(dir)
+	s.CheckQuota = true
+	s.svc = &QuotaSES{max: 100, sent: 97}
+	if _, err := s.Submit([]byte(submitTestSpec)); err != nil {
+		t.Fatal("Submit", err)
+	}
+	if _, err := s.Submit([]byte(submitTestSpec)); err == nil {
+		t.Fatal("expected the quota to be exhausted")
+	}
+	s.svc = &QuotaSES{max: -1}
+	if _, err := s.Submit([]byte(submitTestSpec)); err != nil {
+		t.Fatal("expected unlimited quota to have room, not", err)
+	}
+}
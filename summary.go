@@ -0,0 +1,81 @@
+package mailrail
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"log"
+	"time"
+)
+
+type operatorSummary struct {
+	to   string
+	from string
+}
+
+// Email a summary of each job to an operator when the job finishes,
+// fails, or is cancelled: how many messages were sent, failed, and
+// skipped, how long it took, and the rate achieved. The summary is
+// sent with the same SES service as the job's messages, but not when
+// the worker is told not to send.
+func WithOperatorSummary(to, from string) Option {
+	return func(o *options) {
+		o.operatorSummary = &operatorSummary{to, from}
+	}
+}
+
+// A summaryObserver counts the outcomes of one job and sends the
+// summary when the job ends.
+type summaryObserver struct {
+	svc     sesService
+	summary *operatorSummary
+	counts  JobSummary
+}
+
+func (s *summaryObserver) Observe(e Event) {
+	switch e.Type {
+	case JobStarted:
+		s.counts.Job = e.Job
+		s.counts.Recipients = e.Recipients
+	case MessageSent:
+		s.counts.Sent++
+	case SendFailed:
+		s.counts.Failed++
+	case Skipped:
+		s.counts.Skipped++
+	case JobFinished:
+		s.send(e, "finished")
+	case JobFailed:
+		s.send(e, "failed")
+	case JobCancelled:
+		s.send(e, "was cancelled")
+	}
+}
+
+func (s *summaryObserver) send(e Event, outcome string) {
+	c := s.counts
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Job %s %s.\n\n", e.Job, outcome)
+	fmt.Fprintf(&body, "Recipients: %d\n", c.Recipients)
+	fmt.Fprintf(&body, "Sent:       %d\n", c.Sent)
+	fmt.Fprintf(&body, "Failed:     %d\n", c.Failed)
+	fmt.Fprintf(&body, "Skipped:    %d\n", c.Skipped)
+	fmt.Fprintf(&body, "Duration:   %s\n", e.Duration.Round(time.Second))
+	if seconds := e.Duration.Seconds(); seconds > 0 {
+		fmt.Fprintf(&body, "Rate:       %.1f messages/second\n", float64(c.Sent)/seconds)
+	}
+	params := &ses.SendEmailInput{
+		Source:      aws.String(s.summary.from),
+		Destination: &ses.Destination{ToAddresses: []*string{aws.String(s.summary.to)}},
+		Message: &ses.Message{
+			Subject: &ses.Content{
+				Data:    aws.String(fmt.Sprintf("[mailrail] Job %s %s: %d sent, %d failed", e.Job, outcome, c.Sent, c.Failed)),
+				Charset: aws.String("UTF-8")},
+			Body: &ses.Body{Text: &ses.Content{
+				Data:    aws.String(body.String()),
+				Charset: aws.String("UTF-8")}}}}
+	if _, err := s.svc.SendEmail(params); err != nil {
+		log.Printf("Job %s failed to send summary to %s: %s", e.Job, s.summary.to, err)
+	}
+}
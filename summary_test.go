@@ -0,0 +1,43 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOperatorSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_summary_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]
+}`))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions([]Option{WithOperatorSummary("ops@example.com", "mailrail@example.com")}))
+	if svc.nsent != 3 {
+		t.Fatal("expected 2 messages and a summary, not", svc.nsent)
+	}
+	if *svc.sent.Destination.ToAddresses[0] != "ops@example.com" {
+		t.Fatal("expected the summary to be sent last, to the operator")
+	}
+	subject := *svc.sent.Message.Subject.Data
+	if !strings.Contains(subject, "finished: 2 sent, 0 failed") {
+		t.Fatal("unexpected subject:", subject)
+	}
+	if !strings.Contains(*svc.sent.Message.Body.Text.Data, "Recipients: 2") {
+		t.Fatal("unexpected body:", *svc.sent.Message.Body.Text.Data)
+	}
+}
@@ -0,0 +1,224 @@
+package mailrail
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Suppression says that an address must not be emailed, and why.
+// Suppressions are permanent unless they have an expiry, like those
+// for soft bounces; Count is the number of soft bounces in a row.
+type Suppression struct {
+	Addr    string    `json:"addr"`
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"time"`
+	Expires time.Time `json:"expires,omitempty"`
+	Count   int       `json:"count,omitempty"`
+}
+
+// Expired tells whether a suppression no longer applies at a time.
+func (entry Suppression) Expired(t time.Time) bool {
+	return !entry.Expires.IsZero() && !t.Before(entry.Expires)
+}
+
+// A SuppressionList is a file of addresses that must not be emailed,
+// one JSON-encoded `Suppression` per line. New suppressions are
+// appended to the file; the whole list is kept in memory, and
+// reloaded by Lookup if another process has changed the file.
+type SuppressionList struct {
+	filename string
+	mu       sync.Mutex
+	entries  map[string]Suppression
+	loaded   os.FileInfo
+	checked  time.Time
+}
+
+// How often Lookup checks whether the file has changed.
+const suppressionReloadInterval = 10 * time.Second
+
+func normalizeAddr(addr string) string {
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// Opens a suppression list, creating it if it does not exist.
+func OpenSuppressionList(filename string) (*SuppressionList, error) {
+	s := &SuppressionList{filename: filename}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SuppressionList) load() error {
+	fi, _ := os.Stat(s.filename)
+	entries := make(map[string]Suppression)
+	err := readLines(s.filename, func(line []byte) error {
+		var entry Suppression
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		entries[normalizeAddr(entry.Addr)] = entry
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot read suppression list %s: %s", s.filename, err)
+	}
+	s.entries = entries
+	s.loaded = fi
+	s.checked = time.Now()
+	return nil
+}
+
+// reload reloads the file if it has changed since it was loaded and
+// was last checked long enough ago.
+func (s *SuppressionList) reload() {
+	if time.Since(s.checked) < suppressionReloadInterval {
+		return
+	}
+	s.checked = time.Now()
+	fi, err := os.Stat(s.filename)
+	if err != nil || (s.loaded != nil && fi.Size() == s.loaded.Size() && fi.ModTime().Equal(s.loaded.ModTime())) {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Println(err)
+	}
+}
+
+// Add suppresses an address permanently.
+func (s *SuppressionList) Add(addr, reason string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(Suppression{Addr: normalizeAddr(addr), Reason: reason, Time: t})
+}
+
+// AddSoft suppresses an address for a while, such as after a soft
+// bounce because a mailbox is full. The first soft suppression of an
+// address lasts for base; each one that follows before the previous
+// one has expired lasts twice as long as the previous one. A permanent
+// suppression is left as it is.
+func (s *SuppressionList) AddSoft(addr, reason string, t time.Time, base time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := Suppression{Addr: normalizeAddr(addr), Reason: reason, Time: t, Count: 1}
+	if previous, ok := s.entries[entry.Addr]; ok {
+		if previous.Expires.IsZero() {
+			return nil
+		}
+		if !previous.Expired(t) {
+			entry.Count = previous.Count + 1
+		}
+	}
+	expiry := base
+	for n := 1; n < entry.Count && expiry < 100*365*24*time.Hour; n++ {
+		expiry *= 2
+	}
+	entry.Expires = t.Add(expiry)
+	return s.add(entry)
+}
+
+func (s *SuppressionList) add(entry Suppression) error {
+	if err := appendLine(s.filename, entry); err != nil {
+		return err
+	}
+	s.entries[entry.Addr] = entry
+	return nil
+}
+
+// Lookup tells whether an address is suppressed.
+func (s *SuppressionList) Lookup(addr string) (Suppression, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	entry, ok := s.entries[normalizeAddr(addr)]
+	if ok && entry.Expired(time.Now()) {
+		return Suppression{}, false
+	}
+	return entry, ok
+}
+
+// Compact rewrites the file of a suppression list with only the
+// entries that apply at a time, dropping expired suppressions and
+// superseded lines. It is meant to be run periodically, for instance
+// by `mailrail-suppression compact` from cron, while nothing else
+// writes to the list. Returns the number of entries dropped.
+func (s *SuppressionList) Compact(t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := 0
+	var lines []byte
+	for addr, entry := range s.entries {
+		if entry.Expired(t) {
+			delete(s.entries, addr)
+			dropped++
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return 0, err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, lines, 0644); err != nil {
+		return 0, err
+	}
+	return dropped, os.Rename(tmp, s.filename)
+}
+
+// readLines calls f with each line of a file. A missing file has no
+// lines.
+func readLines(filename string, f func([]byte) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := f(scanner.Bytes()); err != nil {
+			return fmt.Errorf("line %d: %s", lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// appendLine appends the JSON encoding of v to a file as a line.
+func appendLine(filename string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Skip recipients whose addresses are in a suppression list. Addresses
+// suppressed because they unsubscribed are still sent transactional
+// mail.
+func WithSuppressionList(suppressions *SuppressionList) Option {
+	return func(o *options) {
+		o.suppressions = suppressions
+	}
+}
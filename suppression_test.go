@@ -0,0 +1,96 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSuppressionDecay(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_suppression_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "suppressions")
+	s, err := OpenSuppressionList(filename)
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	day := 24 * time.Hour
+	now := time.Now()
+	s.AddSoft("full@example.com", "soft bounce", now.Add(-70*day), 30*day)
+	if _, ok := s.Lookup("full@example.com"); ok {
+		t.Fatal("expected the soft suppression to have expired")
+	}
+	s.AddSoft("full@example.com", "soft bounce", now.Add(-20*day), 30*day)
+	s.AddSoft("full@example.com", "soft bounce", now.Add(-10*day), 30*day)
+	entry, ok := s.Lookup("full@example.com")
+	if !ok || entry.Count != 2 || !entry.Expires.Equal(now.Add(-10*day).Add(60*day)) {
+		t.Fatal("expected a doubled expiry:", entry, ok)
+	}
+	s.Add("hard@example.com", "bounce", now)
+	s.AddSoft("hard@example.com", "soft bounce", now, 30*day)
+	if entry, ok := s.Lookup("hard@example.com"); !ok || !entry.Expires.IsZero() {
+		t.Fatal("soft bounce downgraded a permanent suppression:", entry)
+	}
+
+	dropped, err := s.Compact(now.Add(100 * day))
+	if err != nil || dropped != 1 {
+		t.Fatal("Compact", dropped, err)
+	}
+	s, err = OpenSuppressionList(filename)
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	if _, ok := s.Lookup("hard@example.com"); !ok {
+		t.Fatal("permanent suppression lost in compaction")
+	}
+	if len(s.entries) != 1 {
+		t.Fatal("expected one entry after compaction:", s.entries)
+	}
+}
+
+func TestSuppressionListSkips(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_suppression_skip_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	suppressions, err := OpenSuppressionList(path.Join(dir, "suppressions"))
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	suppressions.Add("Bounced@Example.com", "bounce", time.Now())
+	suppressions.Add("gone@example.com", "unsubscribe", time.Now())
+	queueDir := path.Join(dir, "queue")
+	q, err := pqueue.OpenQueue(queueDir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "bounced@example.com"}, {"addr": "gone@example.com"},
+  {"addr": "gone@example.com", "stream": "transactional"}, {"addr": "ok@example.com"}]}`))
+	j.Submit()
+	var svc MockSES
+	Process(queueDir, UseMockSesService(&svc), WithSuppressionList(suppressions))
+	results, err := GetResults(queueDir, j.Basename)
+	if err != nil || len(results) != 4 {
+		t.Fatal("GetResults", results, err)
+	}
+	for i, status := range []string{StatusSkipped, StatusSkipped, StatusSent, StatusSent} {
+		if results[i].Status != status {
+			t.Fatal("unexpected results:", results)
+		}
+	}
+	if results[0].Error != "Address is suppressed: bounce" || svc.nsent != 2 {
+		t.Fatal("unexpected skip:", results[0], svc.nsent)
+	}
+}
@@ -0,0 +1,117 @@
+package mailrail
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A RateSample counts what a worker did in one minute. Attempts are
+// calls to SES, whether they sent a message, were throttled, or
+// failed.
+type RateSample struct {
+	Minute    time.Time `json:"minute"`
+	Attempts  int       `json:"attempts"`
+	Sent      int       `json:"sent"`
+	Throttled int       `json:"throttled"`
+}
+
+// TelemetryObserver records the attempted and achieved send rate and
+// throttling of a worker, one `RateSample` per line in a file, for
+// `ExportThrottleTelemetry`. A sample is written when its minute is
+// over and an event arrives, and whenever a job ends. Several workers
+// can share a file; samples for the same minute are added up.
+type TelemetryObserver struct {
+	filename string
+	mu       sync.Mutex
+	sample   RateSample
+}
+
+// Returns an observer that appends rate samples to a file.
+func NewTelemetryObserver(filename string) *TelemetryObserver {
+	return &TelemetryObserver{filename: filename}
+}
+
+func (to *TelemetryObserver) Observe(e Event) {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	minute := time.Now().UTC().Truncate(time.Minute)
+	if !minute.Equal(to.sample.Minute) {
+		to.flush()
+		to.sample = RateSample{Minute: minute}
+	}
+	switch e.Type {
+	case MessageSent:
+		to.sample.Attempts++
+		to.sample.Sent++
+	case Throttled:
+		to.sample.Attempts++
+		to.sample.Throttled++
+	case SendFailed:
+		to.sample.Attempts++
+	case JobFinished, JobFailed, JobCancelled, JobPaused:
+		to.flush()
+	}
+}
+
+func (to *TelemetryObserver) flush() {
+	if to.sample.Attempts == 0 {
+		return
+	}
+	if err := appendLine(to.filename, to.sample); err != nil {
+		log.Printf("Failed to record rate sample in %s: %s", to.filename, err)
+	}
+	to.sample = RateSample{Minute: to.sample.Minute}
+}
+
+// ExportThrottleTelemetry writes the rate samples recorded since a
+// time as CSV, one row per minute with sending activity: timestamp,
+// attempted_per_second, achieved_per_second, throttle_events. This is
+// the time series AWS support asks for with requests to raise an SES
+// sending rate.
+func ExportThrottleTelemetry(filename string, since time.Time, w io.Writer) error {
+	samples := make(map[time.Time]*RateSample)
+	err := readLines(filename, func(line []byte) error {
+		var s RateSample
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		if s.Minute.Before(since) {
+			return nil
+		}
+		if total, ok := samples[s.Minute]; ok {
+			total.Attempts += s.Attempts
+			total.Sent += s.Sent
+			total.Throttled += s.Throttled
+		} else {
+			samples[s.Minute] = &s
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot read telemetry %s: %s", filename, err)
+	}
+	minutes := make([]time.Time, 0, len(samples))
+	for minute := range samples {
+		minutes = append(minutes, minute)
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i].Before(minutes[j]) })
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "attempted_per_second", "achieved_per_second", "throttle_events"})
+	for _, minute := range minutes {
+		s := samples[minute]
+		cw.Write([]string{
+			minute.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(float64(s.Attempts)/60, 'f', 3, 64),
+			strconv.FormatFloat(float64(s.Sent)/60, 'f', 3, 64),
+			strconv.Itoa(s.Throttled)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,54 @@
+package mailrail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelemetry(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_telemetry_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "telemetry")
+	minute := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	for _, s := range []RateSample{
+		{minute.Add(-48 * time.Hour), 60, 60, 0},
+		{minute, 90, 60, 30},
+		{minute, 30, 30, 0},
+		{minute.Add(time.Minute), 6, 6, 0}} {
+		if err := appendLine(filename, s); err != nil {
+			t.Fatal("appendLine", err)
+		}
+	}
+	var out bytes.Buffer
+	if err := ExportThrottleTelemetry(filename, minute.Add(-time.Hour), &out); err != nil {
+		t.Fatal("ExportThrottleTelemetry", err)
+	}
+	expected := `timestamp,attempted_per_second,achieved_per_second,throttle_events
+2026-01-02T03:04:00Z,2.000,1.500,30
+2026-01-02T03:05:00Z,0.100,0.100,0
+`
+	if out.String() != expected {
+		t.Fatal("unexpected export:", out.String())
+	}
+
+	observer := NewTelemetryObserver(path.Join(dir, "observed"))
+	observer.Observe(Event{Type: Throttled, Job: "foo"})
+	observer.Observe(Event{Type: MessageSent, Job: "foo"})
+	observer.Observe(Event{Type: JobFinished, Job: "foo"})
+	out.Reset()
+	if err := ExportThrottleTelemetry(path.Join(dir, "observed"), time.Now().Add(-time.Hour), &out); err != nil {
+		t.Fatal("ExportThrottleTelemetry", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], ",0.033,0.017,1") {
+		t.Fatal("unexpected export of observed events:", out.String())
+	}
+}
@@ -0,0 +1,201 @@
+package mailrail
+
+import (
+	"encoding/json"
+	"fmt"
+	htemplate "html/template"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	ttemplate "text/template"
+	"time"
+	"unicode"
+)
+
+// Make functions available in both text and HTML templates, such as
+// `{{productURL .sku}}`, in addition to the built-in ones, which they
+// override if they have the same names. They are used as is in HTML
+// templates, so functions that return markup must return
+// `html/template` types such as `template.HTML` to avoid escaping.
+func WithTemplateFuncs(funcs map[string]interface{}) Option {
+	return func(o *options) {
+		if o.templateFuncs == nil {
+			o.templateFuncs = make(map[string]interface{})
+		}
+		for name, f := range funcs {
+			o.templateFuncs[name] = f
+		}
+	}
+}
+
+// Functions available in text templates, with custom functions added.
+func textFuncs(custom map[string]interface{}) ttemplate.FuncMap {
+	funcs := ttemplate.FuncMap{
+		"qrcode":          qrCodeDataURI,
+		"unsubscribe_url": unboundRecipientFunc}
+	for _, m := range []map[string]interface{}{formatFuncs, custom} {
+		for name, f := range m {
+			funcs[name] = f
+		}
+	}
+	return funcs
+}
+
+// Functions available in HTML templates, with custom functions added.
+func htmlFuncs(custom map[string]interface{}) htemplate.FuncMap {
+	funcs := htemplate.FuncMap{
+		"qrcode":          qrCodeURL,
+		"unsubscribe_url": unboundRecipientFunc}
+	for _, m := range []map[string]interface{}{formatFuncs, custom} {
+		for name, f := range m {
+			funcs[name] = f
+		}
+	}
+	return funcs
+}
+
+// Functions for formatting context values, available in both text
+// and HTML templates. The value comes last so that they can be used
+// in pipelines:
+//
+//	{{.name | title}}                 "jane doe" => "Jane Doe"
+//	{{.due | date "January 2, 2006"}} a Go time layout
+//	{{.total | currency "USD"}}       "1234.5" => "$1,234.50"
+//	{{.name | default "friend"}}      when the value is empty or missing
+//	{{.code | urlescape}}             for query parameters in URLs
+//
+// Dates can be RFC 3339 timestamps, dates like 2006-01-02, or Unix
+// times in seconds.
+var formatFuncs = map[string]interface{}{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      title,
+	"date":       formatDate,
+	"currency":   formatCurrency,
+	"default":    defaultValue,
+	"urlescape":  url.QueryEscape,
+	"pathescape": url.PathEscape}
+
+// title upper-cases the first letter of every word.
+func title(s string) string {
+	prev := ' '
+	return strings.Map(func(r rune) rune {
+		defer func() { prev = r }()
+		if unicode.IsSpace(prev) || prev == '-' {
+			return unicode.ToTitle(r)
+		}
+		return r
+	}, s)
+}
+
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+func formatDate(layout string, v interface{}) (string, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(layout), nil
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(seconds, 0).UTC(), nil
+		}
+		return time.Time{}, fmt.Errorf("Cannot parse %q as a date", v)
+	}
+	seconds, err := toFloat(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Cannot use %v as a date", v)
+	}
+	return time.Unix(int64(seconds), 0).UTC(), nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("Cannot use %v as a number", v)
+}
+
+// Symbols and number of decimals of common currencies. Others are
+// written with their code and two decimals.
+var currencies = map[string]struct {
+	symbol   string
+	decimals int
+}{
+	"USD": {"$", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+	"JPY": {"¥", 0},
+	"CNY": {"¥", 2},
+	"INR": {"₹", 2},
+	"KRW": {"₩", 0},
+}
+
+func formatCurrency(code string, v interface{}) (string, error) {
+	amount, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	if math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return "", fmt.Errorf("Cannot format %v as an amount", v)
+	}
+	code = strings.ToUpper(code)
+	c, ok := currencies[code]
+	if !ok {
+		c.decimals = 2
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	s := strconv.FormatFloat(amount, 'f', c.decimals, 64)
+	whole, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, fraction = s[:i], s[i:]
+	}
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	if !ok {
+		return code + " " + sign + b.String() + fraction, nil
+	}
+	return sign + c.symbol + b.String() + fraction, nil
+}
+
+// defaultValue returns the fallback if the value is missing or empty.
+func defaultValue(fallback, v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return fallback
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return fallback
+		}
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package mailrail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatFuncs(t *testing.T) {
+	sent := makeSendEmailInput(t, `{
+            "from_addr": "johndoe@example.com",
+            "subject": "Your order",
+            "text": "{{.name | title}}|{{.name | upper}}|{{.due | date \"January 2, 2006\"}}|{{.total | currency \"USD\"}}|{{.nickname | default \"friend\"}}|{{.code | urlescape}}",
+            "html": "<a href=\"https://example.com/?c={{.code}}\">{{.total | currency \"NOK\"}}</a>",
+            "recipients": [{
+              "addr": "janedoe@example.com",
+              "context": {"name": "jane doe-smith", "due": "2024-03-05", "total": "-1234567.5", "code": "a b&c"}
+            }]
+          }`, DoNotMangle)
+	if text := *sent.Message.Body.Text.Data; text != "Jane Doe-Smith|JANE DOE-SMITH|March 5, 2024|-$1,234,567.50|friend|a+b%26c" {
+		t.Fatal("unexpected text:", text)
+	}
+	if html := *sent.Message.Body.Html.Data; html != `<a href="https://example.com/?c=a%20b%26c">NOK -1,234,567.50</a>` {
+		t.Fatal("unexpected HTML:", html)
+	}
+}
+
+func TestFormatFuncErrors(t *testing.T) {
+	if _, err := formatDate("2006", "yesterday"); err == nil {
+		t.Fatal("expected an error for an invalid date")
+	}
+	if _, err := formatCurrency("USD", "lots"); err == nil {
+		t.Fatal("expected an error for an invalid amount")
+	}
+	if s, err := formatCurrency("jpy", 1234.5); err != nil || s != "¥1,234" {
+		t.Fatal("unexpected yen:", s, err)
+	}
+	if s, err := formatDate(time.RFC3339, "1700000000"); err != nil || s != "2023-11-14T22:13:20Z" {
+		t.Fatal("unexpected Unix time:", s, err)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello",
+"text": "{{productURL .sku}} {{.sku | upper}}", "html": "<a href=\"{{productURL .sku}}\">{{.sku | upper}}</a>",
+"recipients": [{"addr": "a@example.com", "context": {"sku": "ab12"}}]}`)
+	if _, err := NewPreview(spec); err == nil {
+		t.Fatal("expected an error without the custom function")
+	}
+	preview, err := NewPreview(spec, WithTemplateFuncs(map[string]interface{}{
+		"productURL": func(sku string) string { return "https://example.com/p/" + sku },
+		"upper":      func(s string) string { return "<" + s + ">" }}))
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	msg, err := preview.Render(0)
+	if err != nil {
+		t.Fatal("Render", err)
+	}
+	if msg.Text != "https://example.com/p/ab12 <ab12>" || msg.HTML != `<a href="https://example.com/p/ab12">&lt;ab12&gt;</a>` {
+		t.Fatal("unexpected message:", msg.Text, msg.HTML)
+	}
+	vars, err := TemplateVariables(preview.mailing.spec)
+	if err != nil || len(vars) != 1 || vars[0] != "sku" {
+		t.Fatal("expected custom functions to be skipped:", vars, err)
+	}
+}
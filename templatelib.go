@@ -0,0 +1,71 @@
+package mailrail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A template library is a directory of templates that specs can name
+// with `text_template`, `html_template`, and `amp_template` instead of
+// embedding them. The template "newsletter/basic" is read from
+// newsletter/basic.txt, newsletter/basic.html, and
+// newsletter/basic.amp.html in the directory. Templates are read when
+// a worker takes a job, so changes to them apply to jobs that are
+// already queued, and to the rest of a job that is resumed.
+func WithTemplateDir(dir string) Option {
+	return func(o *options) {
+		o.templateDir = dir
+	}
+}
+
+// The file extensions of text, HTML, and AMP templates in a library.
+const (
+	textTemplateExt = ".txt"
+	htmlTemplateExt = ".html"
+	ampTemplateExt  = ".amp.html"
+)
+
+// loadTemplates reads the templates that the spec names from the
+// template library.
+func (mailing *mailing) loadTemplates() error {
+	spec := &mailing.spec
+	for _, t := range []struct {
+		field, name, ext string
+		template         *string
+	}{
+		{"text", spec.TextTemplate, textTemplateExt, &spec.Text},
+		{"html", spec.HtmlTemplate, htmlTemplateExt, &spec.Html},
+		{"amp", spec.AmpTemplate, ampTemplateExt, &spec.Amp},
+	} {
+		if t.name == "" {
+			continue
+		}
+		if *t.template != "" {
+			return fmt.Errorf("Spec has both %s and %s_template", t.field, t.field)
+		}
+		text, err := readLibraryTemplate(mailing.opts.templateDir, t.name, t.ext)
+		if err != nil {
+			return err
+		}
+		*t.template = text
+	}
+	return nil
+}
+
+func readLibraryTemplate(dir, name, ext string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("Cannot use template %q without a template library", name)
+	}
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid template name %q", name)
+	}
+	text, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(clean)+ext))
+	if err != nil {
+		return "", fmt.Errorf("Cannot read template %q: %s", name, err)
+	}
+	return string(text), nil
+}
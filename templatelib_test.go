@@ -0,0 +1,45 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTemplateLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_templatelib_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "newsletter"), 0755)
+	ioutil.WriteFile(path.Join(dir, "newsletter", "basic.txt"), []byte("Hello, {{.name}}"), 0644)
+	ioutil.WriteFile(path.Join(dir, "newsletter", "basic.html"), []byte("<p>Hello, {{.name}}</p>"), 0644)
+	spec := []byte(`{"version": 1, "from_addr": "johndoe@example.com", "subject": "Hello",
+"text_template": "newsletter/basic", "html_template": "newsletter/basic",
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}}]}`)
+	preview, err := NewPreview(spec, WithTemplateDir(dir))
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	msg, err := preview.Render(0)
+	if err != nil {
+		t.Fatal("Render", err)
+	}
+	if msg.Text != "Hello, A" || msg.HTML != "<p>Hello, A</p>" {
+		t.Fatal("unexpected message:", msg.Text, msg.HTML)
+	}
+	if _, err := NewPreview(spec); err == nil {
+		t.Fatal("expected an error without a template library")
+	}
+	for _, bad := range []string{
+		`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hi", "text_template": "newsletter/basic", "recipients": [{"addr": "a@example.com"}]}`,
+		`{"from_addr": "johndoe@example.com", "subject": "Hello", "text_template": "../basic", "recipients": [{"addr": "a@example.com"}]}`,
+		`{"from_addr": "johndoe@example.com", "subject": "Hello", "html_template": "newsletter/missing", "recipients": [{"addr": "a@example.com"}]}`,
+	} {
+		if _, err := NewPreview([]byte(bad), WithTemplateDir(dir)); err == nil {
+			t.Fatal("expected an error:", bad)
+		}
+	}
+}
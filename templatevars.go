@@ -0,0 +1,87 @@
+package mailrail
+
+import (
+	"sort"
+	"text/template/parse"
+)
+
+// TemplateVariables returns the sorted names of the recipient context
+// variables that the subject, text and HTML templates of a spec, its
+// partials, and its variants refer to.
+// Fields referred to inside `range` and `with` blocks are not
+// included, as they are not fields of the context.
+func TemplateVariables(spec Spec) ([]string, error) {
+	seen := make(map[string]bool)
+	texts := []string{spec.Subject, spec.Text, spec.Html}
+	for _, partial := range spec.Partials {
+		texts = append(texts, partial)
+	}
+	for _, variant := range spec.Variants {
+		texts = append(texts, variant.Subject, variant.Text, variant.Html)
+	}
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		// Both templates are parsed as text without checking
+		// that the functions they call exist, as they may be
+		// custom functions that only the worker has.
+		tree := parse.New("vars")
+		tree.Mode = parse.SkipFuncCheck
+		if _, err := tree.Parse(text, "", "", map[string]*parse.Tree{}); err != nil {
+			return nil, err
+		}
+		collectVariables(tree.Root, seen)
+	}
+	vars := make([]string, 0, len(seen))
+	for v := range seen {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	return vars, nil
+}
+
+func collectVariables(node parse.Node, seen map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectVariables(child, seen)
+		}
+	case *parse.ActionNode:
+		collectVariables(n.Pipe, seen)
+	case *parse.IfNode:
+		collectVariables(n.Pipe, seen)
+		collectVariables(n.List, seen)
+		collectVariables(n.ElseList, seen)
+	case *parse.RangeNode:
+		collectVariables(n.Pipe, seen)
+		collectVariables(n.ElseList, seen)
+	case *parse.WithNode:
+		collectVariables(n.Pipe, seen)
+		collectVariables(n.ElseList, seen)
+	case *parse.TemplateNode:
+		collectVariables(n.Pipe, seen)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			collectVariables(cmd, seen)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectVariables(arg, seen)
+		}
+	case *parse.ChainNode:
+		collectVariables(n.Node, seen)
+	case *parse.FieldNode:
+		seen[n.Ident[0]] = true
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			seen[n.Ident[1]] = true
+		}
+	}
+}
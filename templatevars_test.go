@@ -0,0 +1,48 @@
+package mailrail
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestTemplateVariables(t *testing.T) {
+	spec := Spec{
+		Text: `Hi {{.first_name}}, {{if .coupon}}use {{.coupon}}{{end}} {{range .items}}{{.ignored}}{{end}}`,
+		Html: `<img src="{{qrcode .ticket_url}}">{{$.city}}`}
+	vars, err := TemplateVariables(spec)
+	if err != nil {
+		t.Fatal("TemplateVariables", err)
+	}
+	if strings.Join(vars, ",") != "city,coupon,first_name,items,ticket_url" {
+		t.Fatal("unexpected variables:", vars)
+	}
+	if _, err := TemplateVariables(Spec{Text: "{{.foo"}); err == nil {
+		t.Fatal("expected error for malformed template")
+	}
+}
+
+func TestFakeRecipients(t *testing.T) {
+	vars := []string{"first_name", "email", "order_total"}
+	recipients := FakeRecipients(vars, 5, rand.New(rand.NewSource(1)))
+	if len(recipients) != 5 {
+		t.Fatal("expected 5 recipients, not", len(recipients))
+	}
+	seen := make(map[string]bool)
+	for _, r := range recipients {
+		if !strings.HasSuffix(r.Addr, "@example.com") || seen[r.Addr] {
+			t.Fatal("unexpected address:", r.Addr)
+		}
+		seen[r.Addr] = true
+		if !strings.HasPrefix(r.Name, r.Context["first_name"].(string)+" ") {
+			t.Fatal("first_name does not match name:", r.Context["first_name"], r.Name)
+		}
+		if r.Context["email"] != r.Addr || r.Context["order_total"] == "" {
+			t.Fatal("unexpected context:", r.Context)
+		}
+	}
+	again := FakeRecipients(vars, 5, rand.New(rand.NewSource(1)))
+	if again[3].Addr != recipients[3].Addr {
+		t.Fatal("expected the same seed to give the same recipients")
+	}
+}
@@ -0,0 +1,15 @@
+package mailrail
+
+import "go.opentelemetry.io/otel/trace"
+
+const tracerName = "github.com/ljosa/mailrail"
+
+// Trace jobs with the given OpenTelemetry tracer provider instead of
+// the global one. Each job gets a `mailrail.job` span with a
+// `mailrail.send` child span per recipient; SES errors are recorded as
+// span events with the AWS error code and request ID.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracer = tp.Tracer(tracerName)
+	}
+}
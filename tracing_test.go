@@ -0,0 +1,46 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_tracing_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "janedoe@example.com"}, {"addr": "jimdoe@example.com"}]
+}`))
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	svc := MockSES{}
+	processJob(&svc, dirJob{Job: j}, DoNotMangle, newOptions([]Option{WithTracerProvider(tp)}))
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatal("expected 3 spans, not", len(spans))
+	}
+	jobSpan := spans[2]
+	if jobSpan.Name() != "mailrail.job" {
+		t.Fatal("unexpected job span:", jobSpan.Name())
+	}
+	for _, span := range spans[:2] {
+		if span.Name() != "mailrail.send" || span.Parent().SpanID() != jobSpan.SpanContext().SpanID() {
+			t.Fatal("unexpected send span:", span.Name())
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package mailrail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	stdhtml "html"
+	htemplate "html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	ttemplate "text/template"
+	"time"
+)
+
+// TrackingClaims are what a tracking token says: which recipient of
+// which job a tracked message was sent to and, for a tracked link,
+// where the link goes.
+type TrackingClaims struct {
+	Job       string `json:"job"`
+	Recipient int    `json:"recipient"`
+	Addr      string `json:"addr"`
+	URL       string `json:"url,omitempty"`
+}
+
+type tracking struct {
+	secret []byte
+}
+
+// Sign the tokens of tracking URLs with secret. Without this option,
+// jobs whose specs ask for tracking fail.
+func WithTracking(secret []byte) Option {
+	return func(o *options) {
+		o.tracking = &tracking{secret}
+	}
+}
+
+// trackingURL renders a tracking URL template, where `{{.token}}` is
+// a signed token for recipient i and, for a tracked link, link.
+func (mailing *mailing) trackingURL(t *ttemplate.Template, i int, link string) (string, error) {
+	tracking := mailing.opts.tracking
+	if tracking == nil {
+		return "", fmt.Errorf("Tracking needs a worker configured with a tracking secret")
+	}
+	claims := TrackingClaims{mailing.basename, i, normalizeAddr(mailing.recipient(i).Addr), link}
+	token, err := signToken(tracking.secret, claims)
+	if err != nil {
+		return "", err
+	}
+	var u bytes.Buffer
+	if err := t.Execute(&u, map[string]string{"token": token}); err != nil {
+		return "", fmt.Errorf("Failed to render %s: %s", t.Name(), err)
+	}
+	return u.String(), nil
+}
+
+// trackOpens adds an open-tracking pixel to the HTML of recipient i
+// if the spec has an open tracking URL. The pixel goes at the end of
+// the body, so that it is only loaded once the rest is.
+func (mailing *mailing) trackOpens(html string, i int) (string, error) {
+	if mailing.openTracking == nil {
+		return html, nil
+	}
+	u, err := mailing.trackingURL(mailing.openTracking, i, "")
+	if err != nil {
+		return "", err
+	}
+	pixel := `<img src="` + htemplate.HTMLEscapeString(u) + `" width="1" height="1" alt="" style="display:none">`
+	if end := strings.LastIndex(strings.ToLower(html), "</body>"); end >= 0 {
+		return html[:end] + pixel + html[end:], nil
+	}
+	return html + pixel, nil
+}
+
+// The http and https links of anchors, with the attribute up to the
+// URL, the quote, and the URL as submatches.
+var anchorHref = regexp.MustCompile(`(?i)(<a\s[^>]*?\bhref\s*=\s*)(["'])(https?://[^"']*)`)
+
+// trackClicks points the links in the HTML of recipient i at the
+// spec's click tracking URL, with the original URL in the token.
+// Unsubscribe links are left alone; so is the text part, which
+// readers can see the links of.
+func (mailing *mailing) trackClicks(html string, i int) (string, error) {
+	if mailing.clickTracking == nil {
+		return html, nil
+	}
+	var err error
+	tracked := anchorHref.ReplaceAllStringFunc(html, func(match string) string {
+		m := anchorHref.FindStringSubmatch(match)
+		link := stdhtml.UnescapeString(m[3])
+		if u := mailing.opts.unsubscribe; err != nil || (u != nil && strings.HasPrefix(link, u.baseURL)) {
+			return match
+		}
+		var redirect string
+		redirect, err = mailing.trackingURL(mailing.clickTracking, i, link)
+		return m[1] + m[2] + htemplate.HTMLEscapeString(redirect)
+	})
+	if err != nil {
+		return "", err
+	}
+	return tracked, nil
+}
+
+// parseTrackingURL parses a tracking URL template of a spec.
+func parseTrackingURL(name, pattern string) (*ttemplate.Template, error) {
+	t, err := ttemplate.New(name).Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %s", name, err)
+	}
+	return t, nil
+}
+
+// A TrackingHandler serves the open-tracking pixels and tracked links
+// of specs whose `open_tracking_url` and `click_tracking_url` point
+// at its `/open` and `/click`. It records each open and click whose
+// token verifies in the "feedback" artifact of the job, like the
+// opens and clicks that SES reports, and redirects clicks to the
+// original URL. It must be given the secret that the worker signs
+// tracking tokens with.
+type TrackingHandler struct {
+	QueueDir string
+	Secret   []byte
+}
+
+// Returns a tracking handler for the jobs of a queue directory.
+func NewTrackingHandler(queueDir string, secret []byte) *TrackingHandler {
+	return &TrackingHandler{QueueDir: queueDir, Secret: secret}
+}
+
+// A transparent 1x1 GIF.
+var pixelGIF, _ = base64.StdEncoding.DecodeString("R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7")
+
+func (h *TrackingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/open"):
+		h.open(w, r)
+	case strings.HasSuffix(r.URL.Path, "/click"):
+		h.click(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *TrackingHandler) record(claims TrackingClaims, f Feedback) {
+	if err := recordFeedback(h.QueueDir, claims.Job, f); err != nil {
+		log.Printf("Failed to record %s by recipient %d of job %s: %s", f.Type, claims.Recipient, claims.Job, err)
+	}
+}
+
+func (h *TrackingHandler) open(w http.ResponseWriter, r *http.Request) {
+	var claims TrackingClaims
+	if err := verifyToken(h.Secret, r.URL.Query().Get("token"), &claims); err == nil {
+		h.record(claims, Feedback{Type: FeedbackOpen, Recipient: claims.Recipient, Addr: claims.Addr, Time: time.Now()})
+	}
+	// Broken images look bad, so the pixel is served even if the
+	// token is bad.
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(pixelGIF)
+}
+
+func (h *TrackingHandler) click(w http.ResponseWriter, r *http.Request) {
+	var claims TrackingClaims
+	// Without a valid signature, the URL could send readers anywhere.
+	if err := verifyToken(h.Secret, r.URL.Query().Get("token"), &claims); err != nil || claims.URL == "" {
+		http.Error(w, "Invalid link", http.StatusBadRequest)
+		return
+	}
+	h.record(claims, Feedback{Type: FeedbackClick, Recipient: claims.Recipient, Addr: claims.Addr, Kind: claims.URL, Time: time.Now()})
+	http.Redirect(w, r, claims.URL, http.StatusFound)
+}
@@ -0,0 +1,125 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestOpenTracking(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_tracking_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	spec := `{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"html": "<html><body><p>Hello</p></body></html>",
+"open_tracking_url": "https://t.example.com/open?token={{.token}}",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]}`
+	submit := func() string {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(spec))
+		j.Submit()
+		return j.Basename
+	}
+	unconfigured := submit()
+	Process(dir, UseMockSesService(&MockSES{}))
+	if s, _ := GetJobStatus(dir, unconfigured); s.State != "failed" {
+		t.Fatal("expected a job with open tracking to fail without a secret:", s.State)
+	}
+
+	secret := []byte("s3cret")
+	job := submit()
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithTracking(secret))
+	if svc.nsent != 2 {
+		t.Fatal("expected 2 messages to be sent, not", svc.nsent)
+	}
+	html := *svc.sent.Message.Body.Html.Data
+	pixel := regexp.MustCompile(`^<html><body><p>Hello</p><img src="https://t.example.com(/open\?token=[^"]+)" width="1" height="1" alt="" style="display:none"></body></html>$`).FindStringSubmatch(html)
+	if pixel == nil {
+		t.Fatal("no tracking pixel in:", html)
+	}
+	if *svc.sent.Message.Body.Text.Data != "Hello" {
+		t.Fatal("unexpected text:", *svc.sent.Message.Body.Text.Data)
+	}
+
+	h := NewTrackingHandler(dir, secret)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", pixel[1]+"x", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/gif" {
+		t.Fatal("expected a pixel even for a bad token:", rec.Code, rec.Header())
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", pixel[1], nil))
+	feedback, err := GetFeedback(dir, job)
+	if err != nil || len(feedback) != 1 {
+		t.Fatal("GetFeedback", feedback, err)
+	}
+	if feedback[0].Type != FeedbackOpen || feedback[0].Recipient != 1 || feedback[0].Addr != "b@example.com" {
+		t.Fatal("unexpected open:", feedback[0])
+	}
+}
+
+func TestClickTracking(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_tracking_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	j.Set("spec", []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "stream": "transactional",
+"text": "See https://example.com/a?b=1&c=2",
+"html": "<a class=\"x\" href=\"https://example.com/a?b=1&c=2\">See</a> <a href=\"mailto:x@example.com\">x</a> <a href=\"{{unsubscribe_url .}}\">Unsubscribe</a>",
+"click_tracking_url": "https://t.example.com/click?token={{.token}}",
+"recipients": [{"addr": "a@example.com"}]}`))
+	j.Submit()
+	secret := []byte("s3cret")
+	svc := MockSES{}
+	Process(dir, UseMockSesService(&svc), WithTracking(secret), WithUnsubscribeLinks("https://example.com/unsubscribe", secret))
+	if svc.nsent != 1 {
+		t.Fatal("expected 1 message to be sent, not", svc.nsent)
+	}
+	if *svc.sent.Message.Body.Text.Data != "See https://example.com/a?b=1&c=2" {
+		t.Fatal("unexpected text:", *svc.sent.Message.Body.Text.Data)
+	}
+	html := *svc.sent.Message.Body.Html.Data
+	link := regexp.MustCompile(`^<a class="x" href="https://t.example.com(/click\?token=[^"]+)">See</a> <a href="mailto:x@example.com">x</a> <a href="https://example.com/unsubscribe\?token=[^"]+">Unsubscribe</a>$`).FindStringSubmatch(html)
+	if link == nil {
+		t.Fatal("unexpected links in:", html)
+	}
+
+	h := NewTrackingHandler(dir, secret)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", link[1]+"x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("expected tampered token to be rejected, got", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", link[1], nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://example.com/a?b=1&c=2" {
+		t.Fatal("expected a redirect to the original link:", rec.Code, rec.Header())
+	}
+	feedback, err := GetFeedback(dir, j.Basename)
+	if err != nil || len(feedback) != 1 || feedback[0].Type != FeedbackClick || feedback[0].Kind != "https://example.com/a?b=1&c=2" {
+		t.Fatal("unexpected feedback:", feedback, err)
+	}
+}
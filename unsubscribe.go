@@ -0,0 +1,77 @@
+package mailrail
+
+import (
+	"fmt"
+	htemplate "html/template"
+	"net/url"
+	ttemplate "text/template"
+)
+
+// UnsubscribeClaims are what an unsubscribe token says: which address
+// asked to stop getting mail, and from which campaign, if any.
+type UnsubscribeClaims struct {
+	Addr     string `json:"addr"`
+	Campaign string `json:"campaign,omitempty"`
+}
+
+// UnsubscribeURL returns baseURL with a signed unsubscribe token for
+// an address in its `token` query parameter.
+func UnsubscribeURL(baseURL string, secret []byte, addr, campaign string) (string, error) {
+	token, err := signToken(secret, UnsubscribeClaims{normalizeAddr(addr), campaign})
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid unsubscribe URL %q: %s", baseURL, err)
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+type unsubscribe struct {
+	baseURL string
+	secret  []byte
+}
+
+// Let templates call `{{unsubscribe_url .}}` for a link that
+// unsubscribes the recipient, signed with secret. Without this
+// option, jobs whose templates call it fail.
+func WithUnsubscribeLinks(baseURL string, secret []byte) Option {
+	return func(o *options) {
+		o.unsubscribe = &unsubscribe{baseURL, secret}
+	}
+}
+
+// unsubscribeURL returns the unsubscribe URL of recipient i.
+func (mailing *mailing) unsubscribeURL(i int) (string, error) {
+	u := mailing.opts.unsubscribe
+	if u == nil {
+		return "", fmt.Errorf("unsubscribe_url needs a worker configured with unsubscribe links")
+	}
+	return UnsubscribeURL(u.baseURL, u.secret, mailing.recipient(i).Addr, mailing.spec.Campaign)
+}
+
+// bindRecipient points the template functions that depend on the
+// recipient, rather than on the template's data, at recipient i. The
+// argument of such functions, usually `.`, is only there to make
+// templates read naturally.
+func (mailing *mailing) bindRecipient(i int) {
+	unsubscribeURL := func(...interface{}) (string, error) { return mailing.unsubscribeURL(i) }
+	if mailing.textTemplate != nil {
+		mailing.textTemplate.Funcs(ttemplate.FuncMap{"unsubscribe_url": unsubscribeURL})
+	}
+	for _, t := range []*htemplate.Template{mailing.htmlTemplate, mailing.ampTemplate} {
+		if t != nil {
+			t.Funcs(htemplate.FuncMap{"unsubscribe_url": unsubscribeURL})
+		}
+	}
+}
+
+// Stands in for functions that bindRecipient replaces, so templates
+// that call them parse.
+func unboundRecipientFunc(...interface{}) (string, error) {
+	return "", fmt.Errorf("Template function called without a recipient")
+}
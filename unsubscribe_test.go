@@ -0,0 +1,65 @@
+package mailrail
+
+import (
+	"github.com/ljosa/go-pqueue/pqueue"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeURL(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_unsubscribe_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := pqueue.OpenQueue(dir)
+	if err != nil {
+		t.Fatal("failed to open queue", err)
+	}
+	spec := `{"from_addr": "johndoe@example.com", "subject": "Hello", "campaign": "spring", "stream": "transactional",
+"text": "Bye: {{unsubscribe_url .}}",
+"html": "<a href=\"{{unsubscribe_url .}}\">Unsubscribe</a>",
+"recipients": [{"addr": "A@example.com"}, {"addr": "b@example.com"}]}`
+	submit := func() string {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		j.Set("spec", []byte(spec))
+		j.Submit()
+		return j.Basename
+	}
+	unconfigured := submit()
+	Process(dir, UseMockSesService(&MockSES{}))
+	if s, _ := GetJobStatus(dir, unconfigured); s.State != "failed" {
+		t.Fatal("expected a job with unsubscribe links to fail without a secret:", s.State)
+	}
+
+	submit()
+	secret := []byte("secret")
+	var svc MockSES
+	Process(dir, UseMockSesService(&svc), WithUnsubscribeLinks("https://example.com/unsubscribe?lang=en", secret))
+	text := *svc.sent.Message.Body.Text.Data
+	link := strings.TrimPrefix(text, "Bye: ")
+	u, err := url.Parse(link)
+	if err != nil || u.Host != "example.com" || u.Query().Get("lang") != "en" {
+		t.Fatal("unexpected unsubscribe URL:", text, err)
+	}
+	var claims UnsubscribeClaims
+	if err := verifyToken(secret, u.Query().Get("token"), &claims); err != nil {
+		t.Fatal("verifyToken", err)
+	}
+	if claims.Addr != "b@example.com" || claims.Campaign != "spring" {
+		t.Fatal("unexpected claims:", claims)
+	}
+	html := *svc.sent.Message.Body.Html.Data
+	if !strings.Contains(html, strings.Replace(link, "&", "&amp;", -1)) {
+		t.Fatal("unexpected HTML:", html)
+	}
+	if err := CheckSpec(Spec{Text: "{{unsubscribe_url .}}", Recipients: []Recipient{{Addr: "a@example.com"}}}); err != nil {
+		t.Fatal("CheckSpec", err)
+	}
+}
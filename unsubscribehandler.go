@@ -0,0 +1,65 @@
+package mailrail
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// An UnsubscribeHandler serves the links made by `unsubscribe_url`.
+// Following a link shows a page with a button to confirm, so that
+// mail scanners that fetch links do not unsubscribe anyone; the
+// button, or an RFC 8058 one-click POST from a mail client, adds the
+// address in the link's token to a suppression list with the reason
+// "unsubscribe". It must be given the secret that the worker signs
+// unsubscribe links with.
+type UnsubscribeHandler struct {
+	Suppressions *SuppressionList
+	Secret       []byte
+}
+
+// Returns an unsubscribe handler that suppresses addresses in a list.
+func NewUnsubscribeHandler(suppressions *SuppressionList, secret []byte) *UnsubscribeHandler {
+	return &UnsubscribeHandler{Suppressions: suppressions, Secret: secret}
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><title>Unsubscribe</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<p>Stop sending email to {{.Addr}}?</p>
+<p><button type="submit">Unsubscribe</button></p>
+</form>
+</body></html>
+`))
+
+func (h *UnsubscribeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// A one-click POST has the token in the URL and
+	// List-Unsubscribe=One-Click in the body; the button has it in
+	// the body.
+	token := r.FormValue("token")
+	var claims UnsubscribeClaims
+	if err := verifyToken(h.Secret, token, &claims); err != nil || claims.Addr == "" {
+		http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	if r.Method == "GET" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribePage.Execute(w, struct{ Token, Addr string }{token, claims.Addr})
+		return
+	}
+	if err := h.Suppressions.Add(claims.Addr, "unsubscribe", time.Now()); err != nil {
+		log.Printf("Failed to suppress %s after unsubscribe from campaign %q: %s", claims.Addr, claims.Campaign, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "You have been unsubscribed.\n")
+}
@@ -0,0 +1,65 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_unsubscribehandler_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	suppressions, err := OpenSuppressionList(dir + "/suppressions")
+	if err != nil {
+		t.Fatal("OpenSuppressionList", err)
+	}
+	secret := []byte("s3cret")
+	h := NewUnsubscribeHandler(suppressions, secret)
+	link, err := UnsubscribeURL("https://example.com/unsubscribe", secret, "janedoe@example.com", "spring")
+	if err != nil {
+		t.Fatal("UnsubscribeURL", err)
+	}
+	u, _ := url.Parse(link)
+	token := u.Query().Get("token")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="`+token+`"`) {
+		t.Fatal("expected a confirmation page:", rec.Code, rec.Body.String())
+	}
+	if _, ok := suppressions.Lookup("janedoe@example.com"); ok {
+		t.Fatal("address was suppressed before confirmation")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", u.RequestURI()+"x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("expected tampered token to be rejected, got", rec.Code)
+	}
+
+	form := url.Values{"token": {token}}
+	req := httptest.NewRequest("POST", "/unsubscribe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if entry, ok := suppressions.Lookup("janedoe@example.com"); rec.Code != http.StatusOK || !ok || entry.Reason != "unsubscribe" {
+		t.Fatal("expected the address to be unsubscribed:", rec.Code, entry, ok)
+	}
+
+	link, _ = UnsubscribeURL("https://example.com/unsubscribe", secret, "johndoe@example.com", "")
+	u, _ = url.Parse(link)
+	req = httptest.NewRequest("POST", u.RequestURI(), strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if _, ok := suppressions.Lookup("johndoe@example.com"); rec.Code != http.StatusOK || !ok {
+		t.Fatal("expected a one-click POST to unsubscribe:", rec.Code)
+	}
+}
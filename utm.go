@@ -0,0 +1,76 @@
+package mailrail
+
+import (
+	stdhtml "html"
+	htemplate "html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// UTM gives the UTM parameters that are added to the http and https
+// links of a spec's messages when they are sent. Campaign defaults to
+// the campaign of the spec. Parameters that a link already has are
+// left alone, and so are unsubscribe links.
+type UTM struct {
+	Source   string `json:"source"`
+	Medium   string `json:"medium"`
+	Campaign string `json:"campaign"`
+}
+
+// The http and https URLs of plain text, which end at whitespace or
+// at punctuation that ends a sentence.
+var textURL = regexp.MustCompile(`https?://[^\s<>"']*[^\s<>"'.,;:!?)\]]`)
+
+// addUTM adds the spec's UTM parameters to a link.
+func (mailing *mailing) addUTM(link string) string {
+	utm := mailing.spec.UTM
+	if u := mailing.opts.unsubscribe; u != nil && strings.HasPrefix(link, u.baseURL) {
+		return link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	campaign := utm.Campaign
+	if campaign == "" {
+		campaign = mailing.spec.Campaign
+	}
+	q := u.Query()
+	params := url.Values{}
+	for _, p := range [][2]string{{"utm_source", utm.Source}, {"utm_medium", utm.Medium}, {"utm_campaign", campaign}} {
+		if p[1] != "" && q.Get(p[0]) == "" {
+			params.Set(p[0], p[1])
+		}
+	}
+	if len(params) == 0 {
+		return link
+	}
+	// Appending keeps the link's own parameters as they were.
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += params.Encode()
+	return u.String()
+}
+
+// tagText adds the spec's UTM parameters, if any, to the links in a
+// text part.
+func (mailing *mailing) tagText(text string) string {
+	if mailing.spec.UTM == nil {
+		return text
+	}
+	return textURL.ReplaceAllStringFunc(text, mailing.addUTM)
+}
+
+// tagHTML adds the spec's UTM parameters, if any, to the links of the
+// anchors in an HTML or AMP part.
+func (mailing *mailing) tagHTML(html string) string {
+	if mailing.spec.UTM == nil {
+		return html
+	}
+	return anchorHref.ReplaceAllStringFunc(html, func(match string) string {
+		m := anchorHref.FindStringSubmatch(match)
+		return m[1] + m[2] + htemplate.HTMLEscapeString(mailing.addUTM(stdhtml.UnescapeString(m[3])))
+	})
+}
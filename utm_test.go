@@ -0,0 +1,36 @@
+package mailrail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUTM(t *testing.T) {
+	spec, err := parseSpec([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "campaign": "spring",
+"stream": "transactional",
+"text": "See https://example.com/a?b=1. Or https://example.com/c?utm_source=x#top",
+"html": "<a href=\"https://example.com/a?b=1&c=2\">See</a> <a href=\"mailto:x@example.com\">x</a> <a href=\"{{unsubscribe_url .}}\">Bye</a>",
+"utm": {"source": "newsletter", "medium": "email"},
+"recipients": [{"addr": "a@example.com"}]}`))
+	if err != nil {
+		t.Fatal("parseSpec", err)
+	}
+	ml := &mailing{spec: spec, opts: newOptions([]Option{WithUnsubscribeLinks("https://example.com/unsubscribe", []byte("s3cret"))})}
+	if err := ml.prepare(); err != nil {
+		t.Fatal("prepare", err)
+	}
+	params, err := ml.computeSendEmailInput(0, DoNotMangle)
+	if err != nil {
+		t.Fatal("computeSendEmailInput", err)
+	}
+	text := "See https://example.com/a?b=1&utm_campaign=spring&utm_medium=email&utm_source=newsletter. " +
+		"Or https://example.com/c?utm_source=x&utm_campaign=spring&utm_medium=email#top"
+	if *params.Message.Body.Text.Data != text {
+		t.Fatal("unexpected text:", *params.Message.Body.Text.Data)
+	}
+	html := *params.Message.Body.Html.Data
+	prefix := `<a href="https://example.com/a?b=1&amp;c=2&amp;utm_campaign=spring&amp;utm_medium=email&amp;utm_source=newsletter">See</a> <a href="mailto:x@example.com">x</a> <a href="https://example.com/unsubscribe?token=`
+	if !strings.HasPrefix(html, prefix) {
+		t.Fatal("unexpected html:", html)
+	}
+}
@@ -0,0 +1,92 @@
+// Package mailrail is version 2 of mailrail's API, which reads
+// mail-merge jobs from a persistent queue and sends them via Amazon
+// SES.
+//
+// The API is split by concern: package spec holds what a job sends
+// and to whom, package queue the job stores and the functions that
+// submit, control, and report on jobs, package sender the worker and
+// its options, and package render previews and the options that
+// change what messages look like. This package gathers what most
+// programs need from them.
+//
+// The identifiers of these packages follow semantic versioning: they
+// are not removed or changed incompatibly within major version 2, and
+// new extension points are added alongside them as options, fields,
+// and functions. The JSON fields of specs and the layout of queue
+// directories are kept compatible as well. Their types are those of
+// package github.com/ljosa/mailrail, which keeps its own API for
+// existing programs, so that values can be passed between the two.
+package mailrail
+
+import (
+	"github.com/ljosa/mailrail/v2/queue"
+	"github.com/ljosa/mailrail/v2/render"
+	"github.com/ljosa/mailrail/v2/sender"
+	"github.com/ljosa/mailrail/v2/spec"
+)
+
+type (
+	Spec      = spec.Spec
+	Recipient = spec.Recipient
+	Job       = queue.Job
+	JobStore  = queue.Store
+	Submitter = queue.Submitter
+	Result    = queue.Result
+	Option    = sender.Option
+	Mangler   = sender.Mangler
+	Observer  = sender.Observer
+	Event     = sender.Event
+	Preview   = render.Preview
+)
+
+// DoNotMangle sends every message as the spec says.
+var DoNotMangle = sender.DoNotMangle
+
+// NewSubmitter returns a submitter of jobs to a queue directory.
+func NewSubmitter(queueDir string) *Submitter {
+	return queue.NewSubmitter(queueDir)
+}
+
+// Process processes the jobs in a queue directory until there are no
+// more jobs, then stops.
+func Process(queueDir string, mangler Mangler, opts ...Option) {
+	sender.Process(queueDir, mangler, opts...)
+}
+
+// ProcessForever waits forever for new jobs in a queue directory and
+// processes them.
+func ProcessForever(queueDir string, mangler Mangler, opts ...Option) {
+	sender.ProcessForever(queueDir, mangler, opts...)
+}
+
+// Cancel asks the worker to stop a queued or in-progress job for good.
+func Cancel(queueDir, basename string) error {
+	return queue.Cancel(queueDir, basename)
+}
+
+// Pause asks the worker to stop a queued or in-progress job so that
+// `Resume` can continue it from the same recipient.
+func Pause(queueDir, basename string) error {
+	return queue.Pause(queueDir, basename)
+}
+
+// Resume requeues a paused job.
+func Resume(queueDir, basename string) error {
+	return queue.Resume(queueDir, basename)
+}
+
+// Report returns the latest result of each recipient of a job, in
+// recipient order.
+func Report(queueDir, basename string) ([]Result, error) {
+	return queue.Report(queueDir, basename)
+}
+
+// NewPreview parses a spec for previewing.
+func NewPreview(specBytes []byte, opts ...Option) (*Preview, error) {
+	return render.NewPreview(specBytes, opts...)
+}
+
+// WithObserver notifies observer of events as jobs are processed.
+func WithObserver(observer Observer) Option {
+	return sender.WithObserver(observer)
+}
@@ -0,0 +1,36 @@
+package mailrail
+
+import (
+	"github.com/ljosa/mailrail/mailrailtest"
+	"github.com/ljosa/mailrail/v2/queue"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_v2_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	basename, err := NewSubmitter(dir).Submit([]byte(`{
+"version": 1,
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello, {{.name}}",
+"recipients": [{"addr": "janedoe@example.com", "context": {"name": "Jane"}}]
+}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	svc := &mailrailtest.MockSES{}
+	Process(dir, svc.Mangler())
+	if svc.Len() != 1 || *svc.Sent[0].Message.Body.Text.Data != "Hello, Jane" {
+		t.Fatal("expected the job to be sent:", svc.Len())
+	}
+	report, err := Report(dir, basename)
+	if err != nil || len(report) != 1 || report[0].Status != queue.StatusSent {
+		t.Fatal("unexpected report:", report, err)
+	}
+}
@@ -0,0 +1,175 @@
+// Package queue holds the job stores of mailrail v2 and the functions
+// that submit jobs to a queue directory, control them, and report on
+// them. Jobs are found in a queue directory by their basenames.
+package queue
+
+import (
+	"database/sql"
+	"github.com/ljosa/mailrail"
+	"time"
+)
+
+// Statuses of recipients in a job's results.
+const (
+	StatusSent    = mailrail.StatusSent
+	StatusSkipped = mailrail.StatusSkipped
+	StatusFailed  = mailrail.StatusFailed
+	StatusPending = mailrail.StatusPending
+)
+
+// PostgresSchema creates the tables of a `Postgres` queue.
+const PostgresSchema = mailrail.PostgresSchema
+
+type (
+	Job             = mailrail.Job
+	Store           = mailrail.JobStore
+	MemoryStore     = mailrail.MemoryStore
+	SQS             = mailrail.SQSQueue
+	Redis           = mailrail.RedisQueue
+	Postgres        = mailrail.PostgresQueue
+	Submitter       = mailrail.Submitter
+	RetryAfterError = mailrail.RetryAfterError
+	Result          = mailrail.Result
+	JobStatus       = mailrail.JobStatus
+	FailureReport   = mailrail.FailureReport
+	Cancellation    = mailrail.Cancellation
+	Resend          = mailrail.Resend
+	Shard           = mailrail.Shard
+	ShardReport     = mailrail.ShardReport
+	Lease           = mailrail.Lease
+	CalendarEntry   = mailrail.CalendarEntry
+	ArchiveStore    = mailrail.ArchiveStore
+	FileArchive     = mailrail.FileArchive
+	S3Archive       = mailrail.S3Archive
+)
+
+// NewMemoryStore returns an empty job store in memory, for tests.
+func NewMemoryStore() *MemoryStore {
+	return mailrail.NewMemoryStore()
+}
+
+// NewSQS returns a job queue in SQS whose artifacts are kept in store.
+func NewSQS(queueURL string, store ArchiveStore) *SQS {
+	return mailrail.NewSQSQueue(queueURL, store)
+}
+
+// NewRedis returns a job queue in Redis with keys that start with
+// prefix.
+func NewRedis(addr, prefix string) *Redis {
+	return mailrail.NewRedisQueue(addr, prefix)
+}
+
+// NewPostgres returns a job queue in a PostgreSQL database whose
+// tables have been created with `PostgresSchema`.
+func NewPostgres(db *sql.DB) *Postgres {
+	return mailrail.NewPostgresQueue(db)
+}
+
+// NewSubmitter returns a submitter of jobs to a queue directory.
+func NewSubmitter(queueDir string) *Submitter {
+	return mailrail.NewSubmitter(queueDir)
+}
+
+// Cancel asks the worker to stop a queued or in-progress job for good.
+func Cancel(queueDir, basename string) error {
+	return mailrail.Cancel(queueDir, basename)
+}
+
+// Pause asks the worker to stop a queued or in-progress job so that
+// `Resume` can continue it from the same recipient.
+func Pause(queueDir, basename string) error {
+	return mailrail.Pause(queueDir, basename)
+}
+
+// Resume requeues a paused job.
+func Resume(queueDir, basename string) error {
+	return mailrail.Resume(queueDir, basename)
+}
+
+// Retry moves a failed job back to the queue. Unless resetCheckpoint
+// is set, the job continues from where it failed.
+func Retry(queueDir, basename string, resetCheckpoint bool) error {
+	return mailrail.Retry(queueDir, basename, resetCheckpoint)
+}
+
+// ResendTo submits a job that sends a job's content again to the
+// recipients that selectors pick, returning its basename.
+func ResendTo(queueDir, basename string, selectors []string) (string, error) {
+	return mailrail.ResendTo(queueDir, basename, selectors)
+}
+
+// ResendFailed submits a job that sends a job's content again to the
+// recipients whose latest result is failed or skipped, returning its
+// basename.
+func ResendFailed(queueDir, basename string) (string, error) {
+	return mailrail.ResendFailed(queueDir, basename)
+}
+
+// ResendToNonOpeners submits a job that sends a job's content again,
+// with a new subject, to the recipients who did not open it within
+// after, leaving out those in suppressions, and returns its basename.
+func ResendToNonOpeners(queueDir, basename string, after time.Duration, subject string, suppressions *mailrail.SuppressionList) (string, error) {
+	return mailrail.ResendToNonOpeners(queueDir, basename, after, subject, suppressions)
+}
+
+// Results returns the results recorded so far for a job.
+func Results(queueDir, basename string) ([]Result, error) {
+	return mailrail.GetResults(queueDir, basename)
+}
+
+// Report returns the latest result of each recipient of a job, in
+// recipient order.
+func Report(queueDir, basename string) ([]Result, error) {
+	return mailrail.JobReport(queueDir, basename)
+}
+
+// GetJobStatus returns the status of a job.
+func GetJobStatus(queueDir, basename string) (JobStatus, error) {
+	return mailrail.GetJobStatus(queueDir, basename)
+}
+
+// Status returns the status of every job in a queue directory.
+func Status(queueDir string) ([]JobStatus, error) {
+	return mailrail.QueueStatus(queueDir)
+}
+
+// GetFailureReport returns the failure report of a job, or nil if it
+// has none.
+func GetFailureReport(queueDir, basename string) (*FailureReport, error) {
+	return mailrail.GetFailureReport(queueDir, basename)
+}
+
+// GetShardReport returns the shard report of a job, or nil if it was
+// not sharded.
+func GetShardReport(queueDir, basename string) (*ShardReport, error) {
+	return mailrail.GetShardReport(queueDir, basename)
+}
+
+// GetLease returns the lease on a job that is being processed, or nil
+// if it has none.
+func GetLease(queueDir, basename string) (*Lease, error) {
+	return mailrail.GetLease(queueDir, basename)
+}
+
+// Calendar projects when the jobs in a queue directory will send at
+// rate messages per second.
+func Calendar(queueDir string, rate float64, now time.Time) ([]CalendarEntry, error) {
+	return mailrail.Calendar(queueDir, rate, now)
+}
+
+// OpenArchive returns the archive at a location: an S3 URL of the form
+// s3://BUCKET/PREFIX, or else a directory.
+func OpenArchive(location string) (ArchiveStore, error) {
+	return mailrail.OpenArchive(location)
+}
+
+// NewS3Archive returns an archive in an S3 bucket under prefix.
+func NewS3Archive(bucket, prefix string) *S3Archive {
+	return mailrail.NewS3Archive(bucket, prefix)
+}
+
+// ArchiveJob copies the artifacts of a done or cancelled job to an
+// archive, and removes the job from the queue if remove is set.
+func ArchiveJob(queueDir, basename string, store ArchiveStore, remove bool) error {
+	return mailrail.ArchiveJob(queueDir, basename, store, remove)
+}
@@ -0,0 +1,88 @@
+// Package render holds what mailrail v2 offers for rendering the
+// messages of a spec: previews, the options that change what the
+// worker's messages look like, and the template variables of a spec.
+package render
+
+import (
+	"github.com/ljosa/mailrail"
+	"github.com/ljosa/mailrail/v2/sender"
+	"github.com/ljosa/mailrail/v2/spec"
+)
+
+type (
+	Preview         = mailrail.Preview
+	RenderedMessage = mailrail.RenderedMessage
+	PreviewHandler  = mailrail.PreviewHandler
+	Preset          = mailrail.Preset
+)
+
+// NewPreview parses a spec for previewing. The spec must have its
+// recipients in it, not in a list, segment, or elsewhere.
+func NewPreview(specBytes []byte, opts ...sender.Option) (*Preview, error) {
+	return mailrail.NewPreview(specBytes, opts...)
+}
+
+// NewPreviewHandler returns a preview handler for a spec file, which
+// previews specs without recipients in them with samples fake
+// recipients.
+func NewPreviewHandler(filename string, samples int, opts ...sender.Option) *PreviewHandler {
+	return mailrail.NewPreviewHandler(filename, samples, opts...)
+}
+
+// TemplateVariables returns the sorted names of the recipient context
+// variables that the templates of a spec refer to.
+func TemplateVariables(s spec.Spec) ([]string, error) {
+	return mailrail.TemplateVariables(s)
+}
+
+// UnsubscribeURL returns baseURL with a signed unsubscribe token for
+// an address in its `token` query parameter.
+func UnsubscribeURL(baseURL string, secret []byte, addr, campaign string) (string, error) {
+	return mailrail.UnsubscribeURL(baseURL, secret, addr, campaign)
+}
+
+// LoadPresets reads a JSON file that maps preset names to presets.
+func LoadPresets(filename string) (map[string]Preset, error) {
+	return mailrail.LoadPresets(filename)
+}
+
+// WithPresets lets specs refer to presets by name.
+func WithPresets(presets map[string]Preset) sender.Option {
+	return mailrail.WithPresets(presets)
+}
+
+// WithPreview writes the messages of each job as .eml files to a
+// directory named after the job in dir instead of sending them, and
+// pauses the job.
+func WithPreview(dir string) sender.Option {
+	return mailrail.WithPreview(dir)
+}
+
+// WithTemplateFuncs makes functions available in both text and HTML
+// templates, in addition to the built-in ones.
+func WithTemplateFuncs(funcs map[string]interface{}) sender.Option {
+	return mailrail.WithTemplateFuncs(funcs)
+}
+
+// WithTemplateDir lets specs refer to templates in dir by name.
+func WithTemplateDir(dir string) sender.Option {
+	return mailrail.WithTemplateDir(dir)
+}
+
+// WithContextCheck fails jobs whose recipients lack context keys that
+// the templates refer to, and if unused is set, logs the keys that no
+// template refers to.
+func WithContextCheck(unused bool) sender.Option {
+	return mailrail.WithContextCheck(unused)
+}
+
+// WithUnsubscribeLinks lets templates call `{{unsubscribe_url .}}` for
+// a link that unsubscribes the recipient, signed with secret.
+func WithUnsubscribeLinks(baseURL string, secret []byte) sender.Option {
+	return mailrail.WithUnsubscribeLinks(baseURL, secret)
+}
+
+// WithTracking signs the tokens of tracking URLs with secret.
+func WithTracking(secret []byte) sender.Option {
+	return mailrail.WithTracking(secret)
+}
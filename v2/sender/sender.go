@@ -0,0 +1,319 @@
+// Package sender holds the worker of mailrail v2, which takes jobs
+// from a queue and sends them via Amazon SES, and the options that
+// configure it. Options that change what messages look like are in
+// package render.
+package sender
+
+import (
+	"database/sql"
+	"github.com/ljosa/mailrail"
+	"github.com/ljosa/mailrail/v2/queue"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// Types of events; see `mailrail.EventType` for what each says.
+const (
+	JobStarted        = mailrail.JobStarted
+	MessageSent       = mailrail.MessageSent
+	Throttled         = mailrail.Throttled
+	SendFailed        = mailrail.SendFailed
+	JobFinished       = mailrail.JobFinished
+	JobFailed         = mailrail.JobFailed
+	Skipped           = mailrail.Skipped
+	JobCancelled      = mailrail.JobCancelled
+	JobPaused         = mailrail.JobPaused
+	SLAAtRisk         = mailrail.SLAAtRisk
+	SLAMissed         = mailrail.SLAMissed
+	CheckpointFailing = mailrail.CheckpointFailing
+)
+
+// What an enricher does with a recipient it fails to enrich.
+const (
+	EnrichSkip  = mailrail.EnrichSkip
+	EnrichStale = mailrail.EnrichStale
+)
+
+type (
+	Option              = mailrail.Option
+	Mangler             = mailrail.Mangler
+	SimulatorMix        = mailrail.SimulatorMix
+	WeightedQueue       = mailrail.WeightedQueue
+	Observer            = mailrail.Observer
+	Event               = mailrail.Event
+	EventType           = mailrail.EventType
+	ErrorPolicy         = mailrail.ErrorPolicy
+	SharedRateLimiter   = mailrail.SharedRateLimiter
+	SendHistory         = mailrail.SendHistory
+	SendRecord          = mailrail.SendRecord
+	SuppressionList     = mailrail.SuppressionList
+	AccountSuppressions = mailrail.AccountSuppressions
+	ListStore           = mailrail.ListStore
+	Enricher            = mailrail.Enricher
+	EnricherFunc        = mailrail.EnricherFunc
+	HTTPEnricher        = mailrail.HTTPEnricher
+	Zone                = mailrail.Zone
+)
+
+// Manglers.
+var (
+	// Sends every message as the spec says.
+	DoNotMangle = mailrail.DoNotMangle
+	// Sends nothing.
+	DoNotSend = mailrail.DoNotSend
+	// Sends every message to the SES mailbox simulator.
+	SendToSimulator = mailrail.SendToSimulator
+)
+
+// Error policies.
+var (
+	FailJob       = mailrail.FailJob
+	SkipRecipient = mailrail.SkipRecipient
+)
+
+// SendToMe returns a mangler that sends every message to addr.
+func SendToMe(addr string) Mangler {
+	return mailrail.SendToMe(addr)
+}
+
+// ParseSimulatorMix parses a mix such as
+// "success=90,bounce=5,complaint=3,ooto=2".
+func ParseSimulatorMix(s string) (SimulatorMix, error) {
+	return mailrail.ParseSimulatorMix(s)
+}
+
+// SendToSimulatorMix returns a mangler that sends each message to a
+// simulator address chosen according to the mix.
+func SendToSimulatorMix(mix SimulatorMix) Mangler {
+	return mailrail.SendToSimulatorMix(mix)
+}
+
+// ParseErrorPolicy parses "fail-job", "skip-recipient", or
+// "retry-N-then-skip".
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	return mailrail.ParseErrorPolicy(s)
+}
+
+// MaxSendRate returns the maximum number of messages per second that
+// SES allows the account to send.
+func MaxSendRate() (float64, error) {
+	return mailrail.MaxSendRate()
+}
+
+// Process processes the jobs in a queue directory until there are no
+// more jobs, then stops.
+func Process(queueDir string, mangler Mangler, opts ...Option) {
+	mailrail.Process(queueDir, mangler, opts...)
+}
+
+// ProcessOne processes a single job from a queue directory.
+func ProcessOne(queueDir string, mangler Mangler, opts ...Option) {
+	mailrail.ProcessOne(queueDir, mangler, opts...)
+}
+
+// ProcessForever waits forever for new jobs in a queue directory and
+// processes them.
+func ProcessForever(queueDir string, mangler Mangler, opts ...Option) {
+	mailrail.ProcessForever(queueDir, mangler, opts...)
+}
+
+// ProcessQueues processes jobs from several queue directories, which
+// share the SES sending rate in proportion to their weights, until
+// there are no more jobs, then stops.
+func ProcessQueues(queues []WeightedQueue, mangler Mangler, opts ...Option) {
+	mailrail.ProcessQueues(queues, mangler, opts...)
+}
+
+// ProcessQueuesForever waits forever for new jobs in several queue
+// directories and processes them.
+func ProcessQueuesForever(queues []WeightedQueue, mangler Mangler, opts ...Option) {
+	mailrail.ProcessQueuesForever(queues, mangler, opts...)
+}
+
+// ProcessStore processes jobs from a job store other than a queue
+// directory until there are no more jobs, then stops.
+func ProcessStore(store queue.Store, mangler Mangler, opts ...Option) {
+	mailrail.ProcessJobStore(store, mangler, opts...)
+}
+
+// ProcessStoreForever waits forever for new jobs in a job store other
+// than a queue directory and processes them.
+func ProcessStoreForever(store queue.Store, mangler Mangler, opts ...Option) {
+	mailrail.ProcessJobStoreForever(store, mangler, opts...)
+}
+
+// OpenSharedRateLimiter returns the shared rate limiter at a location:
+// a Redis URL of the form redis://HOST:PORT/KEY, or else the name of a
+// ledger file.
+func OpenSharedRateLimiter(location string) (SharedRateLimiter, error) {
+	return mailrail.OpenSharedRateLimiter(location)
+}
+
+// OpenSendHistory opens a send history, creating it if it does not
+// exist.
+func OpenSendHistory(filename string) (*SendHistory, error) {
+	return mailrail.OpenSendHistory(filename)
+}
+
+// OpenSendHistoryFor opens a send history that keeps only the records
+// of the last period.
+func OpenSendHistoryFor(filename string, period time.Duration) (*SendHistory, error) {
+	return mailrail.OpenSendHistoryFor(filename, period)
+}
+
+// OpenSuppressionList opens a suppression list, creating it if it
+// does not exist.
+func OpenSuppressionList(filename string) (*SuppressionList, error) {
+	return mailrail.OpenSuppressionList(filename)
+}
+
+// NewAccountSuppressions returns the SES account suppression list,
+// fetched whole now if preload is set.
+func NewAccountSuppressions(preload bool) (*AccountSuppressions, error) {
+	return mailrail.NewAccountSuppressions(preload)
+}
+
+// OpenListStore opens a list store, creating the directory if it does
+// not exist.
+func OpenListStore(dir string) (*ListStore, error) {
+	return mailrail.OpenListStore(dir)
+}
+
+// NewHTTPEnricher returns an enricher that calls the given URL.
+func NewHTTPEnricher(url string) *HTTPEnricher {
+	return mailrail.NewHTTPEnricher(url)
+}
+
+// NewZone returns a data-residency zone that sends through SES in a
+// region and stores results under artifactDir, if it is not empty.
+func NewZone(region, artifactDir string) *Zone {
+	return mailrail.NewZone(region, artifactDir)
+}
+
+// WithConcurrency sends to up to n recipients of a job at a time.
+func WithConcurrency(n int) Option {
+	return mailrail.WithConcurrency(n)
+}
+
+// WithErrorPolicy says what a job does when sending to a recipient
+// fails.
+func WithErrorPolicy(policy ErrorPolicy) Option {
+	return mailrail.WithErrorPolicy(policy)
+}
+
+// WithObserver notifies observer of events as jobs are processed.
+func WithObserver(observer Observer) Option {
+	return mailrail.WithObserver(observer)
+}
+
+// WithLeases takes leases on the jobs taken from queue directories
+// that last for d unless they are renewed.
+func WithLeases(d time.Duration) Option {
+	return mailrail.WithLeases(d)
+}
+
+// WithWorkerID identifies the worker in the leases it takes.
+func WithWorkerID(id string) Option {
+	return mailrail.WithWorkerID(id)
+}
+
+// WithIdlePolling polls idle queues every min at first, backing off to
+// every max as they stay empty.
+func WithIdlePolling(min, max time.Duration) Option {
+	return mailrail.WithIdlePolling(min, max)
+}
+
+// WithSharedRateLimiter paces sends with a rate limiter shared with
+// other workers.
+func WithSharedRateLimiter(limiter SharedRateLimiter) Option {
+	return mailrail.WithSharedRateLimiter(limiter)
+}
+
+// WithFrequencyCap skips marketing messages to recipients who have
+// already been sent max marketing messages within period.
+func WithFrequencyCap(history *SendHistory, max int, period time.Duration) Option {
+	return mailrail.WithFrequencyCap(history, max, period)
+}
+
+// WithSuppressionList skips recipients whose addresses are in a
+// suppression list.
+func WithSuppressionList(suppressions *SuppressionList) Option {
+	return mailrail.WithSuppressionList(suppressions)
+}
+
+// WithAccountSuppressions skips recipients whose addresses are in the
+// SES account suppression list.
+func WithAccountSuppressions(as *AccountSuppressions) Option {
+	return mailrail.WithAccountSuppressions(as)
+}
+
+// WithListStore resolves recipient lists named in specs with a list
+// store.
+func WithListStore(lists *ListStore) Option {
+	return mailrail.WithListStore(lists)
+}
+
+// WithDataSource makes a database available to specs as a data source
+// for segments.
+func WithDataSource(name string, db *sql.DB) Option {
+	return mailrail.WithDataSource(name, db)
+}
+
+// WithRecipientsDir lets specs refer to recipients in files in dir
+// with `recipients_ref` file:NAME.
+func WithRecipientsDir(dir string) Option {
+	return mailrail.WithRecipientsDir(dir)
+}
+
+// WithEnricher adds to the context of each recipient what enricher
+// returns, within timeout; onError is `EnrichSkip` or `EnrichStale`.
+func WithEnricher(enricher Enricher, timeout time.Duration, onError string) Option {
+	return mailrail.WithEnricher(enricher, timeout, onError)
+}
+
+// WithResidency routes recipients to zones by a field of their
+// context.
+func WithResidency(field string, zones map[string]*Zone) Option {
+	return mailrail.WithResidency(field, zones)
+}
+
+// WithSharding splits jobs with more than size recipients into shards
+// of size recipients.
+func WithSharding(size int) Option {
+	return mailrail.WithSharding(size)
+}
+
+// WithConfigurationSets sends messages in each stream with an SES
+// configuration set, keyed by stream.
+func WithConfigurationSets(configurationSets map[string]string) Option {
+	return mailrail.WithConfigurationSets(configurationSets)
+}
+
+// WithSpecModes honors the `mode` field of specs.
+func WithSpecModes() Option {
+	return mailrail.WithSpecModes()
+}
+
+// WithSpecWebhooks lets specs have webhooks on the given hosts, signed
+// with the given secret references.
+func WithSpecWebhooks(hosts, secrets []string) Option {
+	return mailrail.WithSpecWebhooks(hosts, secrets)
+}
+
+// WithArchive copies the artifacts of each job that is done or
+// cancelled to an archive.
+func WithArchive(store queue.ArchiveStore) Option {
+	return mailrail.WithArchive(store)
+}
+
+// WithOperatorSummary emails a summary of each job to an operator when
+// the job finishes, fails, or is cancelled.
+func WithOperatorSummary(to, from string) Option {
+	return mailrail.WithOperatorSummary(to, from)
+}
+
+// WithTracerProvider traces jobs with the given OpenTelemetry tracer
+// provider instead of the global one.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return mailrail.WithTracerProvider(tp)
+}
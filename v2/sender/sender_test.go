@@ -0,0 +1,39 @@
+package sender
+
+import (
+	"github.com/ljosa/mailrail/mailrailtest"
+	"github.com/ljosa/mailrail/v2/queue"
+	"testing"
+)
+
+type countingObserver struct {
+	sent int
+}
+
+func (o *countingObserver) Observe(e Event) {
+	if e.Type == MessageSent {
+		o.sent++
+	}
+}
+
+func TestProcessStore(t *testing.T) {
+	store := queue.NewMemoryStore()
+	name, err := store.Submit([]byte(`{
+"from_addr": "johndoe@example.com",
+"subject": "Hello",
+"text": "Hello",
+"recipients": [{"addr": "a@example.com"}, {"addr": "b@example.com"}]
+}`))
+	if err != nil {
+		t.Fatal("Submit", err)
+	}
+	svc := &mailrailtest.MockSES{}
+	observer := &countingObserver{}
+	ProcessStore(store, svc.Mangler(), WithConcurrency(2), WithObserver(observer))
+	if state := store.State(name); state != "done" {
+		t.Fatal("expected the job to be done, not", state)
+	}
+	if svc.Len() != 2 || observer.sent != 2 {
+		t.Fatal("expected 2 messages to be sent:", svc.Len(), observer.sent)
+	}
+}
@@ -0,0 +1,83 @@
+// Package spec holds the job specs of mailrail v2: what a job sends
+// and to whom, and the functions that build, check, and upgrade them.
+// See `Spec`.
+package spec
+
+import (
+	"github.com/ljosa/mailrail"
+	"io"
+	"math/rand"
+)
+
+// The version of the spec format that this release writes.
+const CurrentVersion = mailrail.CurrentSpecVersion
+
+// Streams of messages.
+const (
+	MarketingStream     = mailrail.MarketingStream
+	TransactionalStream = mailrail.TransactionalStream
+)
+
+// Modes of specs.
+const (
+	ModeSend      = mailrail.ModeSend
+	ModeDoNotSend = mailrail.ModeDoNotSend
+	ModeSimulator = mailrail.ModeSimulator
+	ModeSendTo    = mailrail.ModeSendTo
+)
+
+type (
+	Spec            = mailrail.Spec
+	Recipient       = mailrail.Recipient
+	Variant         = mailrail.Variant
+	SendWindow      = mailrail.SendWindow
+	UTM             = mailrail.UTM
+	ListUnsubscribe = mailrail.ListUnsubscribe
+	Segment         = mailrail.Segment
+	JobWebhook      = mailrail.JobWebhook
+)
+
+// Check returns the first problem that would make a worker fail a
+// spec.
+func Check(spec Spec) error {
+	return mailrail.CheckSpec(spec)
+}
+
+// Upgrade returns a spec in the current version, with the names of
+// the fields of an unversioned spec that were ignored.
+func Upgrade(specBytes []byte) ([]byte, []string, error) {
+	return mailrail.UpgradeSpec(specBytes)
+}
+
+// WithRecipients returns a spec with its recipients replaced,
+// including any list, segment, or recipients it refers to.
+func WithRecipients(specBytes []byte, recipients []Recipient) ([]byte, error) {
+	return mailrail.SpecWithRecipients(specBytes, recipients)
+}
+
+// ReadRecipientsCSV reads recipients from CSV with a header row,
+// renaming columns first; see `mailrail.ReadRecipientsCSV`.
+func ReadRecipientsCSV(r io.Reader, columns map[string]string) ([]Recipient, error) {
+	return mailrail.ReadRecipientsCSV(r, columns)
+}
+
+// ReadRecipientsNDJSON reads recipients, one JSON object per line.
+func ReadRecipientsNDJSON(data []byte) ([]Recipient, error) {
+	return mailrail.ReadRecipientsNDJSON(data)
+}
+
+// FakeRecipients returns n recipients with synthetic data for the
+// given context variables.
+func FakeRecipients(vars []string, n int, rnd *rand.Rand) []Recipient {
+	return mailrail.FakeRecipients(vars, n, rnd)
+}
+
+// Gzip compresses a spec or recipients for submission.
+func Gzip(data []byte) ([]byte, error) {
+	return mailrail.Gzip(data)
+}
+
+// Encrypt encrypts a spec, or recipients, under a KMS key.
+func Encrypt(keyID string, data []byte) ([]byte, error) {
+	return mailrail.Encrypt(keyID, data)
+}
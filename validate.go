@@ -0,0 +1,24 @@
+package mailrail
+
+// CheckSpec returns an error if a worker would fail a job with this
+// spec before sending anything: if its templates or error policy do
+// not parse, or if a message cannot be rendered for a recipient.
+// Specs that take their recipients from a list or segment are
+// checked with an example recipient, as the worker resolves the
+// recipients only when it takes the job. Unsubscribe links are
+// rendered with an example URL. Presets and template libraries are
+// defined by the worker, so the spec is checked without its preset and
+// without the templates it names.
+func CheckSpec(spec Spec) error {
+	if spec.recipientSource() != "" {
+		spec.Recipients = []Recipient{{Addr: "recipient@example.com"}}
+	}
+	opts := newOptions([]Option{
+		WithUnsubscribeLinks("https://example.com/unsubscribe", []byte("example")),
+		WithTracking([]byte("example"))})
+	mailing := mailing{spec: spec, opts: opts}
+	if err := mailing.prepare(); err != nil {
+		return err
+	}
+	return mailing.dryRun(DoNotSend)
+}
@@ -0,0 +1,76 @@
+package mailrail
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A Variant is an alternative subject and body for the recipients
+// that select it with their `variant` field, so that, for instance,
+// free and paying users can get different content from one job.
+// Whatever a variant leaves empty is taken from the spec, and the
+// spec's preset footers and partials apply to it as well.
+type Variant struct {
+	Subject string `json:"subject,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Html    string `json:"html,omitempty"`
+	Amp     string `json:"amp,omitempty"`
+}
+
+// prepareVariants prepares a mailing for each variant of the spec of
+// a mailing, sharing its recipients.
+func prepareVariants(parent *mailing) (map[string]*mailing, error) {
+	if len(parent.spec.Variants) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(parent.spec.Variants))
+	for name := range parent.spec.Variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	variants := make(map[string]*mailing, len(names))
+	for _, name := range names {
+		v := parent.spec.Variants[name]
+		variant := *parent
+		variant.variantName = name
+		variant.variants = nil
+		variant.spec.Variants = nil
+		if v.Subject != "" {
+			variant.spec.Subject = v.Subject
+		}
+		if v.Text != "" {
+			variant.spec.Text = v.Text
+			if parent.preset != nil {
+				variant.spec.Text += parent.preset.TextFooter
+			}
+		}
+		if v.Html != "" {
+			variant.spec.Html = v.Html
+			if parent.preset != nil {
+				variant.spec.Html += parent.preset.HtmlFooter
+			}
+		}
+		if v.Amp != "" {
+			variant.spec.Amp = v.Amp
+		}
+		if err := variant.prepare(); err != nil {
+			return nil, fmt.Errorf("Variant %q: %s", name, err)
+		}
+		variants[name] = &variant
+	}
+	return variants, nil
+}
+
+// variant returns the mailing that renders the messages of recipient
+// i: the one of the variant it selects, or this one.
+func (mailing *mailing) variant(i int) (*mailing, error) {
+	name := mailing.recipient(i).Variant
+	if name == "" || name == mailing.variantName {
+		return mailing, nil
+	}
+	variant, ok := mailing.variants[name]
+	if !ok {
+		return nil, fmt.Errorf("Recipient %d selects unknown variant %q", i, name)
+	}
+	return variant, nil
+}
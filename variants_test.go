@@ -0,0 +1,41 @@
+package mailrail
+
+import (
+	"testing"
+)
+
+func TestVariants(t *testing.T) {
+	spec := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello, {{.name}}",
+"variants": {"paid": {"subject": "Thanks, {{.name}}", "text": "Thanks for paying, {{.name}}"}},
+"recipients": [{"addr": "a@example.com", "context": {"name": "A"}},
+{"addr": "b@example.com", "variant": "paid", "context": {"name": "B"}},
+{"addr": "c@example.com", "context": {"name": "A"}}]}`)
+	preview, err := NewPreview(spec)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	for i, expected := range [][2]string{{"Hello", "Hello, A"}, {"Thanks, B", "Thanks for paying, B"}, {"Hello", "Hello, A"}} {
+		msg, err := preview.Render(i)
+		if err != nil || msg.Subject != expected[0] || msg.Text != expected[1] {
+			t.Fatal("unexpected message:", i, msg, err)
+		}
+	}
+	vars, err := TemplateVariables(preview.mailing.spec)
+	if err != nil || len(vars) != 1 || vars[0] != "name" {
+		t.Fatal("unexpected variables:", vars, err)
+	}
+
+	unknown := []byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"recipients": [{"addr": "a@example.com", "variant": "paid"}]}`)
+	preview, err = NewPreview(unknown)
+	if err != nil {
+		t.Fatal("NewPreview", err)
+	}
+	if _, err := preview.Render(0); err == nil {
+		t.Fatal("expected an error for an unknown variant")
+	}
+	if _, err := NewPreview([]byte(`{"from_addr": "johndoe@example.com", "subject": "Hello", "text": "Hello",
+"variants": {"paid": {"text": "{{.name"}}, "recipients": [{"addr": "a@example.com"}]}`)); err == nil {
+		t.Fatal("expected an error for a variant that does not parse")
+	}
+}
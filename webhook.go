@@ -0,0 +1,158 @@
+package mailrail
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks deliver JSON payloads to an HTTP endpoint. Failed
+// deliveries are retried with exponential backoff; payloads that
+// still cannot be delivered are appended to a dead-letter file.
+//
+// If a secret is set, each request carries an `X-Mailrail-Timestamp`
+// header and an `X-Mailrail-Signature` header of the form
+// `sha256=HEX`, where HEX is the HMAC-SHA256 of the timestamp, a
+// period, and the body. Receivers can check it with
+// `VerifyWebhookSignature`.
+type Webhook struct {
+	URL            string
+	Secret         []byte
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	DeadLetterFile string
+	Client         *http.Client
+
+	mu    sync.Mutex
+	stats WebhookStats
+}
+
+// Delivery metrics of a webhook.
+type WebhookStats struct {
+	Delivered    int
+	Retries      int
+	DeadLettered int
+}
+
+// Returns a webhook with default retry settings: 5 attempts,
+// starting with a one-second backoff.
+func NewWebhook(url string, secret []byte, deadLetterFile string) *Webhook {
+	return &Webhook{
+		URL:            url,
+		Secret:         secret,
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		DeadLetterFile: deadLetterFile,
+		Client:         &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Deliver posts the JSON encoding of payload, blocking until it is
+// delivered or has been dead-lettered.
+func (w *Webhook) Deliver(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	backoff := w.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			w.count(func(s *WebhookStats) { s.Delivered++ })
+			return nil
+		}
+		if attempt >= w.MaxAttempts {
+			break
+		}
+		w.count(func(s *WebhookStats) { s.Retries++ })
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	w.count(func(s *WebhookStats) { s.DeadLettered++ })
+	if dlErr := w.deadLetter(body, err); dlErr != nil {
+		return fmt.Errorf("Webhook delivery to %s failed (%s) and so did dead-lettering: %s", w.URL, err, dlErr)
+	}
+	return fmt.Errorf("Webhook delivery to %s failed after %d attempts: %s", w.URL, w.MaxAttempts, err)
+}
+
+// Stats returns the delivery metrics of the webhook so far.
+func (w *Webhook) Stats() WebhookStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+func (w *Webhook) count(f func(*WebhookStats)) {
+	w.mu.Lock()
+	f(&w.stats)
+	w.mu.Unlock()
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Mailrail-Timestamp", timestamp)
+		req.Header.Set("X-Mailrail-Signature", signWebhook(w.Secret, timestamp, body))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) deadLetter(body []byte, deliveryErr error) error {
+	if w.DeadLetterFile == "" {
+		return nil
+	}
+	line, err := json.Marshal(struct {
+		Time    time.Time       `json:"time"`
+		URL     string          `json:"url"`
+		Error   string          `json:"error"`
+		Payload json.RawMessage `json:"payload"`
+	}{time.Now(), w.URL, deliveryErr.Error(), body})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature tells whether the signature and timestamp
+// headers of a webhook request match its body.
+func VerifyWebhookSignature(secret []byte, timestamp, signature string, body []byte) bool {
+	return hmac.Equal([]byte(signature), []byte(signWebhook(secret, timestamp, body)))
+}
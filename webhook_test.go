@@ -0,0 +1,66 @@
+package mailrail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWebhookSigned(t *testing.T) {
+	secret := []byte("s3cret")
+	var verified bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		verified = VerifyWebhookSignature(secret, r.Header.Get("X-Mailrail-Timestamp"), r.Header.Get("X-Mailrail-Signature"), body)
+	}))
+	defer server.Close()
+	webhook := NewWebhook(server.URL, secret, "")
+	if err := webhook.Deliver(map[string]string{"job": "foo"}); err != nil {
+		t.Fatal("Deliver", err)
+	}
+	if !verified {
+		t.Fatal("signature did not verify")
+	}
+	if webhook.Stats().Delivered != 1 {
+		t.Fatal("unexpected stats:", webhook.Stats())
+	}
+}
+
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "mailrail_test_webhook_")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	deadLetterFile := path.Join(dir, "dead-letter")
+	webhook := NewWebhook(server.URL, nil, deadLetterFile)
+	webhook.MaxAttempts = 3
+	webhook.InitialBackoff = 0
+	if err := webhook.Deliver(map[string]string{"job": "foo"}); err == nil {
+		t.Fatal("expected delivery to fail")
+	}
+	if attempts != 3 {
+		t.Fatal("expected 3 attempts, not", attempts)
+	}
+	stats := webhook.Stats()
+	if stats.Retries != 2 || stats.DeadLettered != 1 || stats.Delivered != 0 {
+		t.Fatal("unexpected stats:", stats)
+	}
+	deadLetters, err := ioutil.ReadFile(deadLetterFile)
+	if err != nil {
+		t.Fatal("failed to read dead-letter file:", err)
+	}
+	if !strings.Contains(string(deadLetters), `"payload":{"job":"foo"}`) {
+		t.Fatal("unexpected dead letters:", string(deadLetters))
+	}
+}